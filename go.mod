@@ -2,4 +2,40 @@ module github.com/OpenListTeam/OpenList-Proxy
 
 go 1.24.4
 
-require github.com/OpenListTeam/OpenList/v4 v4.0.7
+require (
+	github.com/OpenListTeam/OpenList/v4 v4.0.7
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/time v0.8.0
+)
+
+require github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+
+require (
+	github.com/expr-lang/expr v1.17.8
+	github.com/getsentry/sentry-go v0.36.0
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/nats-io/nats.go v1.47.0
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/pkg/sftp v1.13.9
+	github.com/quic-go/quic-go v0.59.0
+	github.com/redis/go-redis/v9 v9.17.0
+	github.com/segmentio/kafka-go v0.4.51
+	github.com/tetratelabs/wazero v1.11.0
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.41.0
+	golang.org/x/net v0.43.0
+	golang.org/x/sys v0.38.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/nats-io/nkeys v0.4.11 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
+	github.com/pierrec/lz4/v4 v4.1.22 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+)
@@ -0,0 +1,11 @@
+package main
+
+import "github.com/OpenListTeam/OpenList-Proxy/pkg/proxy"
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+func main() {
+	proxy.Version = version
+	proxy.Main()
+}
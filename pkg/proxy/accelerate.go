@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	parallelFetch        int
+	parallelChunkSize    byteSize = 8 << 20
+	parallelChunkRetries int
+)
+
+func init() {
+	CommandLine.IntVar(&parallelFetch, "parallel-fetch", 0, "fetch large files from the origin with this many parallel range requests, for origins throttling single connections, 0 or 1 streams over one connection")
+	CommandLine.Var(&parallelChunkSize, "parallel-chunk-size", "`size` of the ranges fetched in parallel, each transfer buffers up to -parallel-fetch of them")
+	CommandLine.IntVar(&parallelChunkRetries, "parallel-chunk-retries", 3, "how often a failed parallel range is fetched again before the transfer fails")
+}
+
+var parallelChunksTotal = newCounterVec("openlist_proxy_parallel_chunks_total", "Ranges fetched by parallel origin transfers, by result.", "result")
+
+// chunk is one range of a parallel transfer, done is closed once buf or err is set.
+type chunk struct {
+	start, end int64
+	buf        []byte
+	err        error
+	done       chan struct{}
+}
+
+// parallelBody streams a body from ranges fetched ahead in parallel, handed out in order.
+// The original response serves the first range while the following ones are fetched.
+type parallelBody struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	req       *http.Request
+	validator string
+
+	// body is the original response, read until the first range ending at firstEnd is done.
+	body      io.ReadCloser
+	firstEnd  int64
+	firstLeft int64
+	firstDone bool
+	// offset is the start of the next range to schedule, end the end of the body, both absolute.
+	offset, end int64
+	queue       []*chunk
+	cur         []byte
+}
+
+// accelerate replaces res.Body by a parallelBody if -parallel-fetch is on and the origin serves ranges.
+func accelerate(res *http.Response) {
+	if parallelFetch <= 1 || res.Request == nil || res.Request.Method != http.MethodGet {
+		return
+	}
+	switch res.Body.(type) {
+	case *spliceBody, *rangeWindow:
+		return
+	}
+	validator := ifRangeValidator(res.Header)
+	if validator == "" {
+		return
+	}
+	start, end, ok := bodyRange(res)
+	size := int64(parallelChunkSize)
+	if !ok || size <= 0 || end-start <= size {
+		return
+	}
+	ctx, cancel := context.WithCancel(res.Request.Context())
+	b := &parallelBody{
+		ctx:       ctx,
+		cancel:    cancel,
+		req:       res.Request,
+		validator: validator,
+		body:      res.Body,
+		firstEnd:  start + size,
+		firstLeft: size,
+		offset:    start + size,
+		end:       end,
+	}
+	b.schedule()
+	res.Body = b
+}
+
+// schedule starts fetching ranges until -parallel-fetch of them are in flight or buffered.
+func (b *parallelBody) schedule() {
+	for len(b.queue) < parallelFetch-1 && b.offset < b.end {
+		c := &chunk{start: b.offset, end: min(b.offset+int64(parallelChunkSize), b.end), done: make(chan struct{})}
+		b.offset = c.end
+		b.queue = append(b.queue, c)
+		go b.fetch(c)
+	}
+}
+
+// fetch reads the range of c, trying again after a backoff doubling from -link-retry-backoff when it fails.
+func (b *parallelBody) fetch(c *chunk) {
+	defer close(c.done)
+	backoff := linkRetryBackoff
+	for attempt := 0; ; attempt++ {
+		c.buf, c.err = b.fetchRange(c.start, c.end)
+		if c.err == nil {
+			parallelChunksTotal.inc("fetched")
+			return
+		}
+		if attempt >= parallelChunkRetries || b.ctx.Err() != nil {
+			parallelChunksTotal.inc("failed")
+			logf(levelWarn, "failed to fetch bytes %d-%d of %s: %s", c.start, c.end-1, b.req.URL.Redacted(), c.err.Error())
+			return
+		}
+		parallelChunksTotal.inc("retried")
+		select {
+		case <-time.After(backoff):
+		case <-b.ctx.Done():
+		}
+		backoff *= 2
+	}
+}
+
+func (b *parallelBody) fetchRange(start, end int64) ([]byte, error) {
+	req := b.req.Clone(b.ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	req.Header.Set("If-Range", b.validator)
+	res, err := HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if s, e, ok := parseContentRange(res.Header.Get("Content-Range")); res.StatusCode != http.StatusPartialContent || !ok || s != start || e != end {
+		return nil, fmt.Errorf("origin answered the range with %s", res.Status)
+	}
+	buf := make([]byte, end-start)
+	if _, err := io.ReadFull(res.Body, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (b *parallelBody) Read(p []byte) (int, error) {
+	if !b.firstDone {
+		n, err := b.body.Read(p[:min(int64(len(p)), b.firstLeft)])
+		b.firstLeft -= int64(n)
+		if err != nil || b.firstLeft == 0 {
+			b.firstDone = true
+			_ = b.body.Close()
+			if b.firstLeft > 0 {
+				// fetch the rest of the first range like any other
+				c := &chunk{start: b.firstEnd - b.firstLeft, end: b.firstEnd, done: make(chan struct{})}
+				b.queue = append([]*chunk{c}, b.queue...)
+				go b.fetch(c)
+			}
+		}
+		if n > 0 || !b.firstDone {
+			return n, nil
+		}
+	}
+	for len(b.cur) == 0 {
+		if len(b.queue) == 0 {
+			return 0, io.EOF
+		}
+		c := b.queue[0]
+		select {
+		case <-c.done:
+		case <-b.ctx.Done():
+			return 0, b.ctx.Err()
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		b.queue = b.queue[1:]
+		b.cur = c.buf
+		b.schedule()
+	}
+	n := copy(p, b.cur)
+	b.cur = b.cur[n:]
+	return n, nil
+}
+
+func (b *parallelBody) Close() error {
+	b.cancel()
+	return b.body.Close()
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	accessLogFile      string
+	accessLogRetention logRetention
+)
+
+func init() {
+	CommandLine.StringVar(&accessLogFile, "access-log", "", "file the requests are logged to as json lines, - logs to stdout, empty disables the access log")
+	retentionFlags("access-log", &accessLogRetention)
+}
+
+// accessLogEntry is one line of the access log.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Client    string    `json:"client"`
+	Identity  string    `json:"identity"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	Outcome   string    `json:"outcome,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+}
+
+var accessLog io.Writer
+
+func setupAccessLog() error {
+	switch accessLogFile {
+	case "":
+	case "-":
+		accessLog = os.Stdout
+	default:
+		rf, err := openRotatingFile(accessLogFile, accessLogRetention)
+		if err != nil {
+			return err
+		}
+		accessLog = rf
+	}
+	return nil
+}
+
+// accessLogHandler logs every request once it is answered, to the access log and the log
+// sinks, it must run inside requestInfoHandler.
+func accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := newStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+		e := accessLogEntry{
+			Time:      start,
+			RequestID: getRequestInfo(r).id,
+			Client:    clientIP(r),
+			Identity:  clientIdentity(r),
+			Method:    r.Method,
+			Host:      r.Host,
+			Path:      r.URL.Path,
+			Proto:     r.Proto,
+			Status:    rec.status,
+			Bytes:     rec.bytes,
+			Duration:  time.Since(start).Seconds(),
+			Outcome:   getRequestInfo(r).outcome,
+			UserAgent: r.UserAgent(),
+			Referer:   r.Referer(),
+		}
+		sendLog(levelInfo, fmt.Sprintf("%s %s%s %d %d", e.Method, e.Host, e.Path, e.Status, e.Bytes), e.fields()...)
+		if accessLog == nil {
+			return
+		}
+		b, _ := json.Marshal(e)
+		if _, err := accessLog.Write(append(b, '\n')); err != nil {
+			noticef(levelError, "failed to write the access log: %s", err.Error())
+		}
+	})
+}
+
+// fields returns the entry as the structured fields of the log sinks.
+func (e accessLogEntry) fields() []logField {
+	fields := []logField{
+		{"request_id", e.RequestID}, {"client", e.Client}, {"identity", e.Identity}, {"method", e.Method}, {"host", e.Host}, {"path", e.Path},
+		{"proto", e.Proto}, {"status", strconv.Itoa(e.Status)}, {"bytes", strconv.FormatInt(e.Bytes, 10)}, {"duration", strconv.FormatFloat(e.Duration, 'f', 3, 64)},
+	}
+	for _, f := range []logField{{"outcome", e.Outcome}, {"user_agent", e.UserAgent}, {"referer", e.Referer}} {
+		if f.value != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	allowCIDRs, denyCIDRs       stringList
+	allowCIDRFile, denyCIDRFile string
+)
+
+func init() {
+	CommandLine.Var(&allowCIDRs, "allow-cidr", "only allow clients in this cidr or ip, repeatable")
+	CommandLine.Var(&denyCIDRs, "deny-cidr", "reject clients in this cidr or ip, repeatable, takes precedence over -allow-cidr")
+	CommandLine.StringVar(&allowCIDRFile, "allow-cidr-file", "", "file with allowed cidrs, one per line, reloaded on change or SIGHUP")
+	CommandLine.StringVar(&denyCIDRFile, "deny-cidr-file", "", "file with denied cidrs, one per line, reloaded on change or SIGHUP")
+}
+
+// ipACL is an allow and deny list of networks, an empty allow list allows everyone not denied.
+type ipACL struct {
+	allow, deny []netip.Prefix
+}
+
+var acl atomic.Pointer[ipACL]
+
+func parsePrefix(v string) (netip.Prefix, error) {
+	if strings.Contains(v, "/") {
+		p, err := netip.ParsePrefix(v)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// readPrefixes parses networks from the given values and the lines of file,
+// ignoring blank lines and # comments.
+func readPrefixes(values []string, file string) ([]netip.Prefix, error) {
+	values = append([]string(nil), values...)
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line, _, _ := strings.Cut(sc.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				values = append(values, line)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		p, err := parsePrefix(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", v)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+func loadACL() error {
+	allow, err := readPrefixes(allowCIDRs, allowCIDRFile)
+	if err != nil {
+		return err
+	}
+	deny, err := readPrefixes(denyCIDRs, denyCIDRFile)
+	if err != nil {
+		return err
+	}
+	acl.Store(&ipACL{allow: allow, deny: deny})
+	return nil
+}
+
+func reloadACL() {
+	if err := loadACL(); err != nil {
+		noticef(levelError, "failed to reload cidr lists, keeping the previous ones: %s", err.Error())
+		return
+	}
+	fmt.Println("reloaded cidr lists")
+}
+
+func aclEnabled() bool {
+	return len(allowCIDRs) > 0 || len(denyCIDRs) > 0 || allowCIDRFile != "" || denyCIDRFile != ""
+}
+
+func setupACL() error {
+	if err := loadACL(); err != nil {
+		return err
+	}
+	onReload(reloadACL)
+	for _, file := range []string{allowCIDRFile, denyCIDRFile} {
+		if file != "" {
+			watchFile(file, reloadACL)
+		}
+	}
+	return nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the client address ip passes the lists.
+func (a *ipACL) allowed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if containsAddr(a.deny, addr) {
+		return false
+	}
+	return len(a.allow) == 0 || containsAddr(a.allow, addr)
+}
+
+func aclHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acl.Load().allowed(clientIP(r)) {
+			auditEvent(r, "acl_denied", http.StatusForbidden, "")
+			errorResponseWithStatus(w, http.StatusForbidden, http.StatusForbidden, "client address not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
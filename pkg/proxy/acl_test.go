@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadPrefixes(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", true},
+		// host bits are masked off
+		{"10.1.2.3/8", "10.0.0.0/8", true},
+		{"192.0.2.1", "192.0.2.1/32", true},
+		{" 192.0.2.1 ", "192.0.2.1/32", true},
+		{"2001:db8::/32", "2001:db8::/32", true},
+		{"2001:db8::1", "2001:db8::1/128", true},
+		{"0.0.0.0/0", "0.0.0.0/0", true},
+		{"10.0.0.0/", "", false},
+		{"10.0.0.0/33", "", false},
+		{"10.0.0.0/8/", "", false},
+		{"/8", "", false},
+		{"10.0.0", "", false},
+		{"example.com", "", false},
+	} {
+		prefixes, err := readPrefixes([]string{tc.value}, "")
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: error %v, expected ok %v", tc.value, err, tc.ok)
+			continue
+		}
+		if tc.ok && prefixes[0].String() != tc.want {
+			t.Errorf("%q parsed as %s, expected %s", tc.value, prefixes[0], tc.want)
+		}
+	}
+}
+
+func TestReadPrefixesFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cidrs")
+	if err := os.WriteFile(file, []byte("# office\n198.51.100.0/24 # vpn\n\n  203.0.113.7  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	prefixes, err := readPrefixes([]string{"10.0.0.0/8"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range prefixes {
+		got = append(got, p.String())
+	}
+	if len(got) != 3 || got[0] != "10.0.0.0/8" || got[1] != "198.51.100.0/24" || got[2] != "203.0.113.7/32" {
+		t.Errorf("read %v", got)
+	}
+}
+
+func TestIPACLAllowed(t *testing.T) {
+	newACL := func(allow, deny []string) *ipACL {
+		a, err := readPrefixes(allow, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := readPrefixes(deny, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &ipACL{allow: a, deny: d}
+	}
+	for _, tc := range []struct {
+		name        string
+		allow, deny []string
+		ip          string
+		allowed     bool
+	}{
+		{"empty lists", nil, nil, "192.0.2.1", true},
+		{"in the allow list", []string{"192.0.2.0/24"}, nil, "192.0.2.77", true},
+		{"outside the allow list", []string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{"first address of the network", []string{"192.0.2.0/24"}, nil, "192.0.2.0", true},
+		{"last address of the network", []string{"192.0.2.0/24"}, nil, "192.0.2.255", true},
+		{"one below the network", []string{"192.0.2.0/24"}, nil, "192.0.1.255", false},
+		{"one above the network", []string{"192.0.2.0/24"}, nil, "192.0.3.0", false},
+		{"a single allowed ip", []string{"192.0.2.1"}, nil, "192.0.2.2", false},
+		{"denied", nil, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"not denied", nil, []string{"192.0.2.0/24"}, "192.0.3.1", true},
+		// the deny list takes precedence, whatever the order or width of the networks
+		{"denied within the allowed", []string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, "192.0.2.200", false},
+		{"allowed next to the denied", []string{"192.0.2.0/24"}, []string{"192.0.2.128/25"}, "192.0.2.127", true},
+		{"allowed within the denied", []string{"192.0.2.1"}, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"allowed everywhere, denied once", []string{"0.0.0.0/0", "::/0"}, []string{"192.0.2.1"}, "192.0.2.1", false},
+		{"ipv4-mapped ipv6 in an ipv4 network", []string{"192.0.2.0/24"}, nil, "::ffff:192.0.2.1", true},
+		{"ipv4-mapped ipv6 denied", nil, []string{"192.0.2.0/24"}, "::ffff:192.0.2.1", false},
+		{"ipv6 in the network", []string{"2001:db8::/32"}, nil, "2001:db8:ffff::1", true},
+		{"ipv6 outside the network", []string{"2001:db8::/32"}, nil, "2001:db9::1", false},
+		{"ipv4 against an ipv6 list", []string{"::/0"}, nil, "192.0.2.1", false},
+		{"unparsable client address", nil, nil, "not-an-ip", false},
+		{"empty client address", nil, nil, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := newACL(tc.allow, tc.deny).allowed(tc.ip); got != tc.allowed {
+				t.Errorf("allowed(%q) = %v, expected %v", tc.ip, got, tc.allowed)
+			}
+		})
+	}
+}
+
+func TestACLHandler(t *testing.T) {
+	old := acl.Load()
+	t.Cleanup(func() { acl.Store(old) })
+	setFlags(t, map[string]string{"allow-cidr": "192.0.2.0/24", "deny-cidr": "192.0.2.66"})
+	if err := loadACL(); err != nil {
+		t.Fatal(err)
+	}
+	handler := aclHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for remote, status := range map[string]int{
+		"192.0.2.1:1234":    http.StatusNoContent,
+		"192.0.2.66:1234":   http.StatusForbidden,
+		"198.51.100.1:1234": http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/file.bin", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("%s answered %d, expected %d", remote, w.Code, status)
+		}
+	}
+}
+
+// pathWithin matches the path prefixes granting access, of api keys and jwt claims.
+func TestPathWithin(t *testing.T) {
+	for _, tc := range []struct {
+		path, prefix string
+		within       bool
+	}{
+		{"/dir", "/dir", true},
+		{"/dir/a.txt", "/dir", true},
+		{"/dir/a.txt", "/dir/", true},
+		{"/dir", "/dir/", true},
+		{"/dir/sub/a.txt", "/dir//", false},
+		{"/directory/a.txt", "/dir", false},
+		{"/directory/a.txt", "/dir/", false},
+		{"/dir", "/dir/sub", false},
+		{"/a.txt", "/", true},
+		{"/a.txt", "", true},
+	} {
+		if got := pathWithin(tc.path, tc.prefix); got != tc.within {
+			t.Errorf("pathWithin(%q, %q) = %v, expected %v", tc.path, tc.prefix, got, tc.within)
+		}
+	}
+}
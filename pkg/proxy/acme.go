@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	acmeDomains     stringList
+	acmeEmail       string
+	acmeDirectory   string
+	acmeHTTPAddress string
+)
+
+func init() {
+	CommandLine.Var(&acmeDomains, "acme-domain", "`domain` the https listener obtains and renews a certificate for through -acme-directory instead of -cert and -key, repeatable")
+	CommandLine.StringVar(&acmeEmail, "acme-email", "", "contact address of the acme account issuing certificates of -acme-domain and of tenants with acme: true")
+	CommandLine.StringVar(&acmeDirectory, "acme-directory", acme.LetsEncryptURL, "directory url of the acme ca")
+	CommandLine.StringVar(&acmeHTTPAddress, "acme-http-address", "", "address such as :80 answering http-01 challenges and redirecting everything else to https, "+
+		"empty only answers tls-alpn-01 on the https listener")
+}
+
+// acmeManager issues and renews the certificates of -acme-domain and acme tenants, nil
+// when neither is configured.
+var acmeManager *autocert.Manager
+
+func setupACME() error {
+	if len(acmeDomains) == 0 && tenantsFile == "" {
+		return nil
+	}
+	for i, d := range acmeDomains {
+		if !https {
+			return errors.New("-acme-domain needs -https")
+		}
+		if strings.HasPrefix(d, "*.") {
+			// wildcard certificates need dns challenges, which autocert can't answer
+			return fmt.Errorf("acme can't issue the wildcard %s, use -cert and -key", d)
+		}
+		acmeDomains[i] = strings.ToLower(strings.TrimSuffix(d, "."))
+	}
+	acmeManager = &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Email:  acmeEmail,
+		Client: &acme.Client{DirectoryURL: acmeDirectory},
+		HostPolicy: func(_ context.Context, host string) error {
+			if slices.Contains(acmeDomains, host) {
+				return nil
+			}
+			if t := tenantFor(host); t == nil || !t.ACME {
+				return fmt.Errorf("host %s is no -acme-domain and has no acme tenant", host)
+			}
+			return nil
+		},
+	}
+	if dataDir != "" {
+		acmeManager.Cache = autocert.DirCache(filepath.Join(dataDir, "acme"))
+	}
+	return nil
+}
+
+// acmeTLSConfig serves the certificates of -acme-domain and answers tls-alpn-01 challenges.
+// It takes over -cert and -key.
+func acmeTLSConfig(cfg *tls.Config) {
+	cfg.GetCertificate = acmeManager.GetCertificate
+	cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+}
+
+// startACMEHTTP answers http-01 challenges on -acme-http-address.
+func startACMEHTTP() {
+	if acmeHTTPAddress == "" || acmeManager == nil {
+		return
+	}
+	fmt.Printf("listen and serve acme challenges: %s\n", acmeHTTPAddress)
+	ln, err := handoffListen("acme "+acmeHTTPAddress, acmeHTTPAddress, false)
+	if err != nil {
+		noticef(levelError, "failed to serve acme challenges: %s", err.Error())
+		return
+	}
+	go func() {
+		if err := http.Serve(ln, acmeManager.HTTPHandler(nil)); err != nil && !closedListener(err) {
+			noticef(levelError, "failed to serve acme challenges: %s", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+//go:embed admin.html
+var adminPage []byte
+
+// adminMux holds the admin endpoints, features register their own routes on it.
+var adminMux = http.NewServeMux()
+
+var (
+	adminAddress string
+	adminToken   string
+	publicURL    string
+)
+
+func init() {
+	CommandLine.StringVar(&adminAddress, "admin-address", "", "address to serve the admin ui and api on, e.g. 127.0.0.1:5244, empty disables it")
+	CommandLine.StringVar(&adminToken, "admin-token", "", "token required by the admin api")
+	CommandLine.StringVar(&publicURL, "public-url", "", "public base url of the proxy used in generated links, e.g. https://dl.example.com")
+
+	adminMux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(adminPage)
+	})
+	adminMux.Handle("GET /api/fs/list", adminAuth(adminList))
+	adminMux.Handle("POST /api/share", adminAuth(adminShare))
+}
+
+// adminAuth rejects requests without the admin token as a bearer token.
+func adminAuth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validBearer(r, adminToken) {
+			auditEvent(r, "admin", http.StatusUnauthorized, "invalid admin token")
+			errorResponseWithStatus(w, http.StatusUnauthorized, 401, "invalid admin token")
+			return
+		}
+		if r.Method == http.MethodGet {
+			next(w, r)
+			return
+		}
+		// changes are audited, reads would drown them
+		rec := newStatusRecorder(w)
+		next(rec, r)
+		auditEvent(r, "admin", rec.status, "")
+	})
+}
+
+// validBearer reports whether r carries token as its bearer token.
+func validBearer(r *http.Request, token string) bool {
+	got, _ := bearerToken(r)
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func jsonResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+type fsListResp struct {
+	Content []fsObject `json:"content"`
+	Total   int        `json:"total"`
+}
+
+func adminList(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		p = "/"
+	}
+	list, err := postAPI[fsListResp]("/api/fs/list", p, Json{
+		"page":     1,
+		"per_page": 0,
+	})
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+	jsonResponse(w, list)
+}
+
+type shareReq struct {
+	Path string `json:"path"`
+	// Expires is the validity in seconds, 0 never expires.
+	Expires int64 `json:"expires"`
+	Short   bool  `json:"short"`
+}
+
+type shareResp struct {
+	URL      string `json:"url"`
+	ShortURL string `json:"short_url,omitempty"`
+	QRCode   string `json:"qr_code"`
+}
+
+func adminShare(w http.ResponseWriter, r *http.Request) {
+	var req shareReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !strings.HasPrefix(req.Path, "/") || req.Expires < 0 {
+		errorResponse(w, 400, "invalid share request")
+		return
+	}
+	// links verifySign would reject are refused, as by the sign api
+	if signMaxAge > 0 && (req.Expires == 0 || time.Duration(req.Expires)*time.Second > signMaxAge) {
+		errorResponse(w, 400, errSignTooLong.Error())
+		return
+	}
+	var expire int64
+	if req.Expires > 0 {
+		expire = time.Now().Unix() + req.Expires
+	}
+	target := signedPath(req.Path, expire)
+	base := strings.TrimSuffix(publicURL, "/")
+	resp := shareResp{URL: base + target}
+	qrTarget := resp.URL
+	if req.Short {
+		code, err := shortLinks.create(req.Path, target, expire)
+		if err != nil {
+			errorResponse(w, 500, err.Error())
+			return
+		}
+		resp.ShortURL = base + shortLinkPrefix + code
+		qrTarget = resp.ShortURL
+	}
+	png, err := qrcode.Encode(qrTarget, qrcode.Medium, 256)
+	if err != nil {
+		errorResponse(w, 500, err.Error())
+		return
+	}
+	resp.QRCode = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+	jsonResponse(w, resp)
+}
+
+// loopbackAddress reports whether the listen address addr only accepts local connections.
+func loopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+func startAdminServer() error {
+	if adminToken == "" {
+		return errors.New("-admin-token is required when -admin-address is set")
+	}
+	fmt.Printf("serve admin: %s\n", adminAddress)
+	if !loopbackAddress(adminAddress) {
+		noticef(levelWarn, "warning: the admin api on %s is reachable from other hosts, bind it to 127.0.0.1 unless they need it", adminAddress)
+	}
+	ln, err := handoffListen("admin "+adminAddress, adminAddress, false)
+	if err != nil {
+		noticef(levelError, "failed to serve admin: %s", err.Error())
+		return nil
+	}
+	go func() {
+		if err := http.Serve(ln, adminMux); err != nil && !closedListener(err) {
+			noticef(levelError, "failed to serve admin: %s", err.Error())
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAdminShareSignMaxAge(t *testing.T) {
+	setFlags(t, map[string]string{"admin-token": "admintoken", "sign-max-age": "1h", "public-url": "https://dl.example.com"})
+	for _, tc := range []struct {
+		name    string
+		expires int64
+		status  int
+	}{
+		{"never expires", 0, http.StatusBadRequest},
+		{"beyond the max age", 7200, http.StatusBadRequest},
+		{"negative", -1, http.StatusBadRequest},
+		{"within the max age", 600, http.StatusOK},
+		{"at the max age", 3600, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body, _ := json.Marshal(shareReq{Path: "/dir/file.bin", Expires: tc.expires})
+			r := httptest.NewRequest(http.MethodPost, "/api/share", strings.NewReader(string(body)))
+			r.Header.Set("Authorization", "Bearer admintoken")
+			w := httptest.NewRecorder()
+			adminMux.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("answered %d, expected %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			var resp shareResp
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(resp.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code, err := verifySign(u.Path, u.Query().Get("sign")); err != nil {
+				t.Errorf("the shared link is answered %d: %v", code, err)
+			}
+		})
+	}
+}
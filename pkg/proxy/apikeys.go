@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	apiKeysFile  string
+	apiKeyHeader string
+)
+
+// apiKeyQuery is the query parameter api keys may be passed in instead of the header.
+const apiKeyQuery = "api_key"
+
+func init() {
+	CommandLine.StringVar(&apiKeysFile, "api-keys-file", "", "yaml file of api keys (name, key, paths, rate_limit, rate_burst, quota, class), reloaded on change or SIGHUP; more keys can be created in the admin api")
+	CommandLine.StringVar(&apiKeyHeader, "api-key-header", "X-API-Key", "header carrying an api key, the "+apiKeyQuery+" query parameter works as well")
+
+	registerState("apikeys", func() any { return &apiKeyStore{} })
+	adminMux.Handle("GET /api/keys", adminAuth(adminListKeys))
+	adminMux.Handle("POST /api/keys", adminAuth(adminCreateKey))
+	adminMux.Handle("DELETE /api/keys/{name}", adminAuth(adminRevokeKey))
+}
+
+// apiKey is a named credential with its own permissions and limits, zero limits fall back to the global ones.
+type apiKey struct {
+	Name string `json:"name"`
+	// Hash is the hex sha256 of the secret key, the key itself is only shown on creation.
+	Hash      string   `json:"hash"`
+	Paths     []string `json:"paths,omitempty"`
+	RateLimit float64  `json:"rate_limit,omitempty"`
+	RateBurst int      `json:"rate_burst,omitempty"`
+	Quota     int64    `json:"quota,omitempty"`
+	// Class is the -bandwidth-class of the transfers of the key.
+	Class   string    `json:"class,omitempty"`
+	Created time.Time `json:"created"`
+	// static keys come from -api-keys-file and cannot be revoked at runtime
+	static bool
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// allows reports whether the key grants access to filePath.
+func (k *apiKey) allows(filePath string) bool {
+	if len(k.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range k.Paths {
+		if pathWithin(filePath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyStore holds the keys created in the admin api, persisted as state.
+type apiKeyStore struct {
+	mu   sync.Mutex
+	Keys map[string]*apiKey `json:"keys"`
+}
+
+var apiKeys = &apiKeyStore{Keys: map[string]*apiKey{}}
+
+// staticAPIKeys are the keys of -api-keys-file by name.
+var staticAPIKeys atomic.Pointer[map[string]*apiKey]
+
+func loadAPIKeys() error {
+	apiKeys.mu.Lock()
+	defer apiKeys.mu.Unlock()
+	if err := loadState("apikeys", apiKeys); err != nil {
+		return err
+	}
+	if apiKeys.Keys == nil {
+		apiKeys.Keys = map[string]*apiKey{}
+	}
+	return nil
+}
+
+type apiKeyFileEntry struct {
+	Name      string   `yaml:"name"`
+	Key       string   `yaml:"key"`
+	Paths     []string `yaml:"paths"`
+	RateLimit float64  `yaml:"rate_limit"`
+	RateBurst int      `yaml:"rate_burst"`
+	Quota     string   `yaml:"quota"`
+	Class     string   `yaml:"class"`
+}
+
+func loadAPIKeysFile() error {
+	keys := map[string]*apiKey{}
+	if apiKeysFile != "" {
+		b, err := os.ReadFile(apiKeysFile)
+		if err != nil {
+			return err
+		}
+		var entries []apiKeyFileEntry
+		if err := yaml.Unmarshal(b, &entries); err != nil {
+			return fmt.Errorf("%s: %w", apiKeysFile, err)
+		}
+		for _, e := range entries {
+			if e.Name == "" || e.Key == "" {
+				return fmt.Errorf("%s: every key needs a name and a key", apiKeysFile)
+			}
+			k := &apiKey{Name: e.Name, Hash: hashAPIKey(e.Key), Paths: e.Paths, RateLimit: e.RateLimit, RateBurst: e.RateBurst, Class: e.Class, static: true}
+			if err := validBandwidthClass(e.Class); err != nil {
+				return fmt.Errorf("%s: key %q: %w", apiKeysFile, e.Name, err)
+			}
+			if e.Quota != "" {
+				q, err := parseSize(e.Quota)
+				if err != nil {
+					return fmt.Errorf("%s: key %q: %w", apiKeysFile, e.Name, err)
+				}
+				k.Quota = q
+			}
+			keys[e.Name] = k
+		}
+	}
+	staticAPIKeys.Store(&keys)
+	return nil
+}
+
+func reloadAPIKeysFile() {
+	if err := loadAPIKeysFile(); err != nil {
+		noticef(levelError, "failed to reload api keys, keeping the previous ones: %s", err.Error())
+		return
+	}
+	fmt.Println("reloaded api keys")
+}
+
+func setupAPIKeys() error {
+	if err := loadAPIKeys(); err != nil {
+		return err
+	}
+	if err := loadAPIKeysFile(); err != nil {
+		return err
+	}
+	if apiKeysFile != "" {
+		onReload(reloadAPIKeysFile)
+		watchFile(apiKeysFile, reloadAPIKeysFile)
+	}
+	return nil
+}
+
+// lookupAPIKey returns the key with the secret key.
+func lookupAPIKey(key string) (*apiKey, bool) {
+	hash := hashAPIKey(key)
+	for _, k := range *staticAPIKeys.Load() {
+		if k.Hash == hash {
+			return k, true
+		}
+	}
+	apiKeys.mu.Lock()
+	defer apiKeys.mu.Unlock()
+	for _, k := range apiKeys.Keys {
+		if k.Hash == hash {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// keyLimiters are the per-key rate limiters, recreated when the limits of a key change.
+var keyLimiters = struct {
+	sync.Mutex
+	m map[string]*rate.Limiter
+}{m: map[string]*rate.Limiter{}}
+
+func keyLimiter(k *apiKey) *rate.Limiter {
+	keyLimiters.Lock()
+	defer keyLimiters.Unlock()
+	burst := k.RateBurst
+	if burst <= 0 {
+		burst = max(int(math.Ceil(k.RateLimit)), 1)
+	}
+	l, ok := keyLimiters.m[k.Name]
+	if !ok || l.Limit() != rate.Limit(k.RateLimit) || l.Burst() != burst {
+		l = rate.NewLimiter(rate.Limit(k.RateLimit), burst)
+		keyLimiters.m[k.Name] = l
+	}
+	return l
+}
+
+// apiKeyHandler identifies requests carrying an api key and applies its rate limit.
+// Access to paths is checked in authorize, quotas are accounted to the key.
+func apiKeyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(apiKeyHeader)
+		if key == "" {
+			key = r.URL.Query().Get(apiKeyQuery)
+		}
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		k, ok := lookupAPIKey(key)
+		if !ok {
+			errorResponseWithStatus(w, http.StatusUnauthorized, 401, "invalid api key")
+			return
+		}
+		if k.RateLimit > 0 {
+			l := keyLimiter(k)
+			if ok, retryAfter := allowShared("key:"+k.Name, k.RateLimit, l.Burst(), l); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				errorResponseWithStatus(w, http.StatusTooManyRequests, http.StatusTooManyRequests, "too many requests")
+				return
+			}
+		}
+		// the key is for the proxy, not the origin
+		r.Header.Del(apiKeyHeader)
+		info := getRequestInfo(r)
+		info.apiKey, info.bandwidthClass = k, k.Class
+		next.ServeHTTP(w, r)
+	})
+}
+
+type apiKeyInfo struct {
+	*apiKey
+	Source string `json:"source"`
+}
+
+func adminListKeys(w http.ResponseWriter, _ *http.Request) {
+	var list []apiKeyInfo
+	for _, k := range *staticAPIKeys.Load() {
+		list = append(list, apiKeyInfo{k, "file"})
+	}
+	apiKeys.mu.Lock()
+	for _, k := range apiKeys.Keys {
+		list = append(list, apiKeyInfo{k, "admin"})
+	}
+	apiKeys.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	jsonResponse(w, list)
+}
+
+type createKeyResp struct {
+	*apiKey
+	Key string `json:"key"`
+}
+
+func adminCreateKey(w http.ResponseWriter, r *http.Request) {
+	var k apiKey
+	if err := json.NewDecoder(r.Body).Decode(&k); err != nil || k.Name == "" || strings.ContainsAny(k.Name, "/ ") {
+		errorResponse(w, 400, "invalid key request, a name without spaces or slashes is required")
+		return
+	}
+	for _, p := range k.Paths {
+		if !strings.HasPrefix(p, "/") {
+			errorResponse(w, 400, "paths must be absolute")
+			return
+		}
+	}
+	if err := validBandwidthClass(k.Class); err != nil {
+		errorResponse(w, 400, err.Error())
+		return
+	}
+	secret := "olp_" + randomToken()
+	k.Hash = hashAPIKey(secret)
+	k.Created = time.Now()
+	if err := apiKeys.add(&k); err != nil {
+		errorResponse(w, 400, err.Error())
+		return
+	}
+	jsonResponse(w, createKeyResp{&k, secret})
+}
+
+func (st *apiKeyStore) add(k *apiKey) error {
+	if _, ok := (*staticAPIKeys.Load())[k.Name]; ok {
+		return errors.New("a key named " + k.Name + " already exists")
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.Keys[k.Name]; ok {
+		return errors.New("a key named " + k.Name + " already exists")
+	}
+	st.Keys[k.Name] = k
+	return saveState("apikeys", st)
+}
+
+func adminRevokeKey(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := (*staticAPIKeys.Load())[name]; ok {
+		errorResponse(w, 400, "key "+name+" is defined in -api-keys-file")
+		return
+	}
+	apiKeys.mu.Lock()
+	defer apiKeys.mu.Unlock()
+	if _, ok := apiKeys.Keys[name]; !ok {
+		errorResponse(w, 404, "key not found")
+		return
+	}
+	delete(apiKeys.Keys, name)
+	if err := saveState("apikeys", apiKeys); err != nil {
+		errorResponse(w, 500, err.Error())
+		return
+	}
+	jsonResponse(w, Result{Code: 200, Msg: "revoked"})
+}
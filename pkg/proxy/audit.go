@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	auditLogFile       string
+	auditLogRetention  logRetention
+	auditSyslogAddress string
+)
+
+func init() {
+	CommandLine.StringVar(&auditLogFile, "audit-log", "", "append-only `file` of hash chained security events: sign and auth failures, acl denials, admin api changes, "+
+		"exhausted quotas and reloads, empty disables it")
+	retentionFlags("audit-log", &auditLogRetention)
+	CommandLine.StringVar(&auditSyslogAddress, "audit-syslog", "", "also send audit events to syslog: local, or udp://host:514 or tcp://host:514")
+	commands["audit"] = command{
+		usage: "audit verify file... checks the hash chain of -audit-log files, oldest first, rotated segments included",
+		run:   runAudit,
+	}
+}
+
+// auditEntry is a line of the audit log. Hash is the sha256 of the entry encoded with an
+// empty hash, Prev the hash of the entry before, so removing or editing an entry breaks the
+// chain of all later ones.
+type auditEntry struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	Identity string    `json:"identity,omitempty"`
+	Method   string    `json:"method,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Prev     string    `json:"prev"`
+	Hash     string    `json:"hash"`
+}
+
+func (e *auditEntry) sum() string {
+	c := *e
+	c.Hash = ""
+	b, _ := json.Marshal(c)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+var audit = struct {
+	sync.Mutex
+	file   *rotatingFile
+	syslog io.Writer
+	last   auditEntry
+}{}
+
+func auditEnabled() bool {
+	return audit.file != nil || audit.syslog != nil
+}
+
+func setupAudit() error {
+	if auditLogFile != "" {
+		last, err := lastAuditEntry(auditLogFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the last entry of %s: %w", auditLogFile, err)
+		}
+		rf, err := openRotatingFile(auditLogFile, auditLogRetention)
+		if err != nil {
+			return err
+		}
+		audit.file, audit.last = rf, last
+	}
+	if auditSyslogAddress != "" {
+		w, err := dialAuditSyslog(auditSyslogAddress)
+		if err != nil {
+			return fmt.Errorf("invalid -audit-syslog: %w", err)
+		}
+		audit.syslog = w
+	}
+	return nil
+}
+
+// lastAuditEntry returns the entry the chain continues from: the last one of the log, or of
+// its newest rotated segment when the log was just rotated.
+func lastAuditEntry(path string) (auditEntry, error) {
+	var last auditEntry
+	files, _ := filepath.Glob(path + ".[0-9]*")
+	sort.Strings(files)
+	if len(files) > 0 {
+		files = files[len(files)-1:]
+	}
+	for _, name := range append(files, path) {
+		err := readAuditLog(name, func(e auditEntry) error {
+			last = e
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return last, err
+		}
+	}
+	return last, nil
+}
+
+// readAuditLog calls f with the entries of the audit log file name, gzipped or not.
+func readAuditLog(name string, f func(auditEntry) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	var r io.Reader = file
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		if err := f(e); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+	return sc.Err()
+}
+
+// auditEvent records a security event, about request r unless it is nil.
+func auditEvent(r *http.Request, event string, status int, detail string) {
+	if !auditEnabled() {
+		return
+	}
+	e := auditEntry{Time: time.Now().UTC(), Event: event, Status: status, Detail: detail}
+	if r != nil {
+		e.ClientIP, e.Identity, e.Method, e.Path = clientIP(r), clientIdentity(r), r.Method, r.URL.Path
+	}
+	audit.Lock()
+	defer audit.Unlock()
+	e.Seq, e.Prev = audit.last.Seq+1, audit.last.Hash
+	e.Hash = e.sum()
+	b, _ := json.Marshal(e)
+	if audit.file != nil {
+		if _, err := audit.file.Write(append(b, '\n')); err != nil {
+			noticef(levelError, "failed to write the audit log: %s", err.Error())
+			return
+		}
+	}
+	if audit.syslog != nil {
+		if _, err := audit.syslog.Write(b); err != nil {
+			noticef(levelError, "failed to send an audit event to syslog: %s", err.Error())
+		}
+	}
+	audit.last = e
+}
+
+func runAudit(args []string) error {
+	if len(args) < 2 || args[0] != "verify" {
+		return errors.New("usage: audit verify file...")
+	}
+	var prev auditEntry
+	n := 0
+	for _, name := range args[1:] {
+		err := readAuditLog(name, func(e auditEntry) error {
+			if e.Hash != e.sum() {
+				return fmt.Errorf("entry %d was modified", e.Seq)
+			}
+			if n > 0 && (e.Prev != prev.Hash || e.Seq != prev.Seq+1) {
+				return fmt.Errorf("entries are missing between %d and %d", prev.Seq, e.Seq)
+			}
+			prev = e
+			n++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%d entries verified, the last is %d of %s\n", n, prev.Seq, prev.Time.Format(time.DateTime))
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// dialAuditSyslog connects to the syslog of -audit-syslog, logging to the auth facility.
+func dialAuditSyslog(addr string) (io.Writer, error) {
+	network, raddr := "", ""
+	if addr != "local" {
+		var ok bool
+		if network, raddr, ok = strings.Cut(addr, "://"); !ok {
+			network, raddr = "udp", addr
+		}
+	}
+	return syslog.Dial(network, raddr, syslog.LOG_AUTH|syslog.LOG_NOTICE, "openlist-proxy")
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package proxy
+
+import (
+	"errors"
+	"io"
+)
+
+func dialAuditSyslog(string) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
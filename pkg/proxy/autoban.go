@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var (
+	autobanSignFailures int
+	autobanClientErrors int
+	autobanWindow       time.Duration
+	autobanDuration     time.Duration
+	autobanExempt       stringList
+)
+
+func init() {
+	CommandLine.IntVar(&autobanSignFailures, "autoban-sign-failures", 0, "ban an ip after this many sign and auth failures within -autoban-window, 0 never does")
+	CommandLine.IntVar(&autobanClientErrors, "autoban-4xx", 0, "ban an ip after this many 4xx responses within -autoban-window, 0 never does")
+	CommandLine.DurationVar(&autobanWindow, "autoban-window", 10*time.Minute, "window the failures of -autoban-sign-failures and -autoban-4xx are counted in")
+	CommandLine.DurationVar(&autobanDuration, "autoban-duration", time.Hour, "length of automatic bans, listed and lifted like the bans of the admin api")
+	CommandLine.Var(&autobanExempt, "autoban-exempt", "`cidr` never banned automatically, such as monitoring, repeatable")
+}
+
+// autobanCounts are the failures of an ip in the window starting at start.
+type autobanCounts struct {
+	start        time.Time
+	signFailures int
+	clientErrors int
+}
+
+var autoban = struct {
+	sync.Mutex
+	ips    map[string]*autobanCounts
+	exempt []netip.Prefix
+}{ips: map[string]*autobanCounts{}}
+
+func autobanEnabled() bool {
+	return autobanSignFailures > 0 || autobanClientErrors > 0
+}
+
+func setupAutoban() error {
+	if !autobanEnabled() {
+		return nil
+	}
+	if autobanWindow <= 0 || autobanDuration <= 0 {
+		return fmt.Errorf("-autoban-window and -autoban-duration must be positive")
+	}
+	exempt, err := readPrefixes(autobanExempt, "")
+	if err != nil {
+		return fmt.Errorf("invalid -autoban-exempt: %w", err)
+	}
+	autoban.exempt = exempt
+	go func() {
+		for range time.Tick(autobanWindow) {
+			autoban.Lock()
+			for ip, c := range autoban.ips {
+				if time.Since(c.start) > autobanWindow {
+					delete(autoban.ips, ip)
+				}
+			}
+			autoban.Unlock()
+		}
+	}()
+	return nil
+}
+
+// autobanSignFailure counts a failed sign or credential of r.
+func autobanSignFailure(r *http.Request) {
+	if autobanSignFailures > 0 {
+		countAutoban(r, func(c *autobanCounts) bool {
+			c.signFailures++
+			return c.signFailures >= autobanSignFailures
+		}, "sign and auth failures", autobanSignFailures)
+	}
+}
+
+// autobanResponse counts the response status of r.
+func autobanResponse(r *http.Request, status int) {
+	if autobanClientErrors > 0 && status/100 == 4 {
+		countAutoban(r, func(c *autobanCounts) bool {
+			c.clientErrors++
+			return c.clientErrors >= autobanClientErrors
+		}, "4xx responses", autobanClientErrors)
+	}
+}
+
+// countAutoban applies count to the failures of the ip of r and bans it once count reports
+// the limit is reached.
+func countAutoban(r *http.Request, count func(*autobanCounts) bool, what string, limit int) {
+	ip := clientIP(r)
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return
+	}
+	addr = addr.Unmap()
+	if containsAddr(autoban.exempt, addr) {
+		return
+	}
+	now := time.Now()
+	autoban.Lock()
+	c, ok := autoban.ips[ip]
+	if !ok || now.Sub(c.start) > autobanWindow {
+		c = &autobanCounts{start: now}
+		autoban.ips[ip] = c
+	}
+	reached := count(c)
+	if reached {
+		delete(autoban.ips, ip)
+	}
+	autoban.Unlock()
+	if !reached {
+		return
+	}
+	p := netip.PrefixFrom(addr, addr.BitLen())
+	b := &ban{
+		CIDR:    p.String(),
+		Reason:  fmt.Sprintf("auto: %d %s within %s", limit, what, autobanWindow),
+		Created: now,
+		Expire:  now.Add(autobanDuration).Unix(),
+		prefix:  p,
+	}
+	if err := bans.add(b); err != nil {
+		logf(levelError, "failed to save the automatic ban of %s: %s", ip, err.Error())
+	}
+	logf(levelWarn, "banned %s for %s: %s", ip, autobanDuration, b.Reason)
+	auditEvent(r, "autoban", 0, b.Reason)
+}
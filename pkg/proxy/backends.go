@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	backendRetry   time.Duration
+	healthInterval time.Duration
+)
+
+func init() {
+	CommandLine.DurationVar(&backendRetry, "backend-retry", 30*time.Second, "how long a failed backend of -address is skipped before it is tried again")
+	CommandLine.DurationVar(&healthInterval, "health-interval", 10*time.Second, "how often backends are probed in the background, 0 only notices failures of requests")
+}
+
+var (
+	backendUp     = newGaugeVec("openlist_proxy_backend_up", "Whether each openlist backend is considered healthy.", "backend")
+	backendServed = newCounterVec("openlist_proxy_backend_requests_total", "Downloads by the openlist backend that resolved their link.", "backend")
+	backendErrors = newCounterVec("openlist_proxy_backend_errors_total", "Failed openlist api calls and health probes, by backend.", "backend")
+	breakerOpen   = newCounterVec("openlist_proxy_backend_unavailable_total", "Requests failed fast because every backend they could use was down.")
+)
+
+// errBackendsDown is returned without calling a backend while all of them are marked down.
+var errBackendsDown = &apiError{Code: 503, Message: "openlist is unavailable, try again later"}
+
+// backendHealth tracks one of the comma separated -address backends.
+type backendHealth struct {
+	address   string
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+var backends []*backendHealth
+
+// setupBackends splits -address into the backends failed over between,
+// leaving the first one in address.
+func setupBackends() {
+	backends = parseBackends(address)
+	if len(backends) > 0 {
+		address = backends[0].address
+	}
+}
+
+// parseBackends returns the health trackers of a comma separated address list.
+func parseBackends(list string) []*backendHealth {
+	var hs []*backendHealth
+	for _, a := range strings.Split(list, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			hs = append(hs, &backendHealth{address: a})
+			backendUp.set(1, a)
+		}
+	}
+	return hs
+}
+
+func (h *backendHealth) healthy(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !now.Before(h.downUntil)
+}
+
+func (h *backendHealth) fail(err error) {
+	h.mu.Lock()
+	wasUp := !time.Now().Before(h.downUntil)
+	h.downUntil = time.Now().Add(backendRetry)
+	h.mu.Unlock()
+	backendErrors.inc(h.address)
+	if wasUp {
+		backendUp.set(0, h.address)
+		logf(levelWarn, "backend %s failed, skipping it for %s: %s", h.address, backendRetry, err.Error())
+	}
+}
+
+func (h *backendHealth) succeed() {
+	h.mu.Lock()
+	wasDown := !h.downUntil.IsZero()
+	h.downUntil = time.Time{}
+	h.mu.Unlock()
+	if wasDown {
+		backendUp.set(1, h.address)
+		logf(levelInfo, "backend %s is healthy again", h.address)
+	}
+}
+
+// healthyBackends returns the backends of hs not marked down, in configured order.
+// A backend is tried again once -backend-retry passed without a failed probe.
+func healthyBackends(hs []*backendHealth) []*backendHealth {
+	now := time.Now()
+	var up []*backendHealth
+	for _, h := range hs {
+		if h.healthy(now) {
+			up = append(up, h)
+		}
+	}
+	return up
+}
+
+// withFailover calls f with each -address backend until one answers.
+func withFailover[T any](f func(b backend) (T, error)) (T, error) {
+	if len(backends) == 0 {
+		return f(defaultBackend())
+	}
+	return failover(backends, apiToken(), f)
+}
+
+// failover calls f with each healthy backend of hs until one answers. Errors returned in an api
+// response are answers, only unreachable or broken backends are failed over. While all
+// backends are down it fails fast instead of waiting for doomed calls.
+func failover[T any](hs []*backendHealth, token string, f func(b backend) (T, error)) (T, error) {
+	var (
+		v   T
+		err error
+	)
+	up := healthyBackends(hs)
+	if len(up) == 0 {
+		breakerOpen.inc()
+		return v, errBackendsDown
+	}
+	for _, h := range up {
+		v, err = f(backend{address: h.address, token: token})
+		var apiErr *apiError
+		if err == nil || errors.As(err, &apiErr) {
+			h.succeed()
+			return v, err
+		}
+		h.fail(err)
+	}
+	return v, err
+}
+
+// allBackends returns the backends of -address and of every route.
+func allBackends() []*backendHealth {
+	hs := append([]*backendHealth(nil), backends...)
+	if rs := routes.Load(); rs != nil {
+		for _, rt := range *rs {
+			hs = append(hs, rt.backends...)
+		}
+	}
+	return hs
+}
+
+// startHealthChecks probes every backend each -health-interval, so failures are noticed
+// without traffic and down backends return as soon as they answer again.
+func startHealthChecks() {
+	if healthInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(healthInterval) {
+			for _, h := range allBackends() {
+				go h.probe()
+			}
+		}
+	}()
+}
+
+// probe checks the backend with the openlist /ping endpoint.
+func (h *backendHealth) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), min(healthInterval, 5*time.Second))
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(h.address, "/")+"/ping", nil)
+	res, err := apiClient.Do(req)
+	if err == nil {
+		_ = res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			err = fmt.Errorf("ping responded %s", res.Status)
+		}
+	}
+	if err != nil {
+		h.fail(err)
+		return
+	}
+	h.succeed()
+}
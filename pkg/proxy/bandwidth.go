@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	maxBandwidth     byteSize
+	maxConnBandwidth byteSize
+)
+
+func init() {
+	CommandLine.Var(&maxBandwidth, "max-bandwidth", "max `size` per second sent to all clients together, e.g. 20M, 0 is unlimited")
+	CommandLine.Var(&maxConnBandwidth, "max-conn-bandwidth", "max `size` per second sent to a single client transfer, e.g. 2M, 0 is unlimited")
+}
+
+// minBurst keeps the token bucket large enough for a single copy buffer at low rates.
+const minBurst = 64 << 10
+
+// globalBandwidth is shared by all transfers, nil when -max-bandwidth is not set.
+var globalBandwidth *rate.Limiter
+
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), max(int(bytesPerSecond), minBurst))
+}
+
+func setupBandwidth() {
+	if maxBandwidth > 0 {
+		globalBandwidth = newBandwidthLimiter(int64(maxBandwidth))
+	}
+}
+
+// throttledWriter delays writes so they stay within all of its limiters.
+type throttledWriter struct {
+	w        io.Writer
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+// throttle wraps w with the global and a fresh limiter of perTransfer bytes per second,
+// returning w unchanged when no limit is configured.
+func throttle(ctx context.Context, w io.Writer, perTransfer int64) io.Writer {
+	var limiters []*rate.Limiter
+	if globalBandwidth != nil {
+		limiters = append(limiters, globalBandwidth)
+	}
+	if perTransfer > 0 {
+		limiters = append(limiters, newBandwidthLimiter(perTransfer))
+	}
+	if len(limiters) == 0 {
+		return w
+	}
+	return &throttledWriter{w: w, ctx: ctx, limiters: limiters}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		for _, l := range t.limiters {
+			n = min(n, l.Burst())
+		}
+		for _, l := range t.limiters {
+			if err := l.WaitN(t.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerState("bans", func() any { return &banStore{} })
+	adminMux.Handle("GET /api/bans", adminAuth(adminListBans))
+	adminMux.Handle("POST /api/bans", adminAuth(adminAddBan))
+	adminMux.Handle("DELETE /api/bans", adminAuth(adminRemoveBan))
+}
+
+// ban blocks a client network added at runtime through the admin api.
+type ban struct {
+	CIDR    string    `json:"cidr"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	// Expire is the unix time the ban ends, 0 never.
+	Expire int64 `json:"expire"`
+
+	prefix netip.Prefix
+}
+
+func (b *ban) expired(now time.Time) bool {
+	return b.Expire > 0 && now.Unix() > b.Expire
+}
+
+type banStore struct {
+	mu   sync.Mutex
+	Bans map[string]*ban `json:"bans"`
+}
+
+var bans = &banStore{Bans: map[string]*ban{}}
+
+// banRefreshInterval is how often the bans are read from redis, besides when an instance
+// announces a change.
+const banRefreshInterval = 30 * time.Second
+
+func loadBans() error {
+	if rdb != nil {
+		if err := bans.refresh(); err != nil {
+			return err
+		}
+		go watchRedisBans()
+		return nil
+	}
+	bans.mu.Lock()
+	defer bans.mu.Unlock()
+	if err := loadState("bans", bans); err != nil {
+		return err
+	}
+	if bans.Bans == nil {
+		bans.Bans = map[string]*ban{}
+	}
+	for cidr, b := range bans.Bans {
+		p, err := parsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid ban %q: %w", cidr, err)
+		}
+		b.prefix = p
+	}
+	return nil
+}
+
+// refresh replaces the bans by the ones in redis, dropping expired ones there.
+func (st *banStore) refresh() error {
+	ctx, cancel := redisContext()
+	defer cancel()
+	m, err := rdb.HGetAll(ctx, redisKey("bans")).Result()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	list := make(map[string]*ban, len(m))
+	var expired []string
+	for cidr, v := range m {
+		b := &ban{}
+		p, err := parsePrefix(cidr)
+		if err == nil {
+			err = json.Unmarshal([]byte(v), b)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid ban %q: %w", cidr, err)
+		}
+		if b.expired(now) {
+			expired = append(expired, cidr)
+			continue
+		}
+		b.prefix = p
+		list[cidr] = b
+	}
+	if len(expired) > 0 {
+		rdb.HDel(ctx, redisKey("bans"), expired...)
+	}
+	st.mu.Lock()
+	st.Bans = list
+	st.mu.Unlock()
+	return nil
+}
+
+// watchRedisBans refreshes the bans whenever an instance changes them.
+func watchRedisBans() {
+	sub := rdb.Subscribe(context.Background(), redisKey("bans"))
+	changes := sub.Channel()
+	tick := time.Tick(banRefreshInterval)
+	for {
+		select {
+		case <-changes:
+		case <-tick:
+		}
+		if err := bans.refresh(); err != nil {
+			logf(levelWarn, "failed to read the bans from redis: %s", err.Error())
+		}
+	}
+}
+
+// announceBans stores or removes the ban of cidr in redis, b nil removes it, and tells the
+// other instances. It reports whether a ban was removed.
+func announceBans(cidr string, b *ban) (bool, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	removed := false
+	if b != nil {
+		v, _ := json.Marshal(b)
+		if err := rdb.HSet(ctx, redisKey("bans"), cidr, v).Err(); err != nil {
+			return false, err
+		}
+	} else {
+		n, err := rdb.HDel(ctx, redisKey("bans"), cidr).Result()
+		if err != nil {
+			return false, err
+		}
+		removed = n > 0
+	}
+	if err := rdb.Publish(ctx, redisKey("bans"), cidr).Err(); err != nil {
+		return removed, err
+	}
+	return removed, bans.refresh()
+}
+
+// banned reports whether the client address ip is banned.
+func (st *banStore) banned(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	now := time.Now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, b := range st.Bans {
+		if !b.expired(now) && b.prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// save drops expired bans and persists the others, mu must be held.
+func (st *banStore) save() error {
+	now := time.Now()
+	for cidr, b := range st.Bans {
+		if b.expired(now) {
+			delete(st.Bans, cidr)
+		}
+	}
+	return saveState("bans", st)
+}
+
+func banHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bans.banned(clientIP(r)) {
+			errorResponseWithStatus(w, http.StatusForbidden, http.StatusForbidden, "client address banned")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminListBans(w http.ResponseWriter, _ *http.Request) {
+	bans.mu.Lock()
+	now := time.Now()
+	list := make([]ban, 0, len(bans.Bans))
+	for _, b := range bans.Bans {
+		if !b.expired(now) {
+			list = append(list, *b)
+		}
+	}
+	bans.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	jsonResponse(w, list)
+}
+
+type banReq struct {
+	CIDR   string `json:"cidr"`
+	Reason string `json:"reason"`
+	// Duration is the length of the ban in seconds, 0 bans until removed.
+	Duration int64 `json:"duration"`
+}
+
+func adminAddBan(w http.ResponseWriter, r *http.Request) {
+	var req banReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Duration < 0 {
+		errorResponseWithStatus(w, http.StatusBadRequest, 400, "invalid ban request")
+		return
+	}
+	p, err := parsePrefix(req.CIDR)
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusBadRequest, 400, "invalid cidr: "+err.Error())
+		return
+	}
+	b := &ban{CIDR: p.String(), Reason: req.Reason, Created: time.Now(), prefix: p}
+	if req.Duration > 0 {
+		b.Expire = b.Created.Unix() + req.Duration
+	}
+	if err := bans.add(b); err != nil {
+		errorResponse(w, 500, err.Error())
+		return
+	}
+	jsonResponse(w, b)
+}
+
+// add bans b.prefix, replacing a ban of the same network, and persists the bans.
+func (st *banStore) add(b *ban) error {
+	if rdb != nil {
+		_, err := announceBans(b.CIDR, b)
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.Bans[b.CIDR] = b
+	return st.save()
+}
+
+func adminRemoveBan(w http.ResponseWriter, r *http.Request) {
+	p, err := parsePrefix(r.URL.Query().Get("cidr"))
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusBadRequest, 400, "invalid cidr: "+err.Error())
+		return
+	}
+	ok, err := bans.remove(p.String())
+	if !ok && err == nil {
+		errorResponseWithStatus(w, http.StatusNotFound, 404, "no such ban")
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, err.Error())
+		return
+	}
+	jsonResponse(w, Result{Code: 200, Msg: "removed"})
+}
+
+// remove lifts the ban of cidr, persists the bans and reports whether there was one.
+func (st *banStore) remove(cidr string) (bool, error) {
+	if rdb != nil {
+		return announceBans(cidr, nil)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, ok := st.Bans[cidr]
+	delete(st.Bans, cidr)
+	return ok, st.save()
+}
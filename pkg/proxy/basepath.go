@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var basePath string
+
+func init() {
+	CommandLine.StringVar(&basePath, "base-path", "", "path prefix the proxy is mounted under behind a reverse proxy, e.g. /dl, stripped before signatures are checked and links resolved, "+
+		"other paths are not found, -public-url must include it")
+}
+
+func validateBasePath() error {
+	if basePath == "" {
+		return nil
+	}
+	p := strings.TrimSuffix(basePath, "/")
+	if !strings.HasPrefix(p, "/") || path.Clean(p) != p {
+		return fmt.Errorf("invalid -base-path %q, expected a clean absolute path such as /dl", basePath)
+	}
+	basePath = p
+	return nil
+}
+
+// basePathHandler strips -base-path from requests, rejecting those outside of it.
+func basePathHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := strings.CutPrefix(r.URL.Path, basePath)
+		if !ok || p != "" && p[0] != '/' {
+			errorResponseWithStatus(w, http.StatusNotFound, 404, "not found")
+			return
+		}
+		if p == "" {
+			p = "/"
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = p
+		r2.URL.RawPath = ""
+		if rp, ok := strings.CutPrefix(r.URL.RawPath, basePath); ok {
+			r2.URL.RawPath = rp
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	basicAuthUsers stringList
+	basicAuthFile  string
+	basicAuthRealm string
+)
+
+func init() {
+	CommandLine.Var(&basicAuthUsers, "basic-auth", "`user:password` allowed to download without a sign, repeatable")
+	CommandLine.StringVar(&basicAuthFile, "basic-auth-file", "", "htpasswd file (bcrypt, {SHA} or plain passwords) of users allowed to download without a sign, reloaded on change or SIGHUP")
+	CommandLine.StringVar(&basicAuthRealm, "basic-auth-realm", "OpenList-Proxy", "realm shown by browsers when asking for basic auth credentials")
+}
+
+// htpasswd maps user names to password hashes as found in an htpasswd file.
+type htpasswd map[string]string
+
+var basicAuth atomic.Pointer[htpasswd]
+
+// basicAuthVerified caches successful checks by user and password digest, bcrypt is too slow
+// to run for every range request of a player.
+var basicAuthVerified sync.Map
+
+// maxBasicAuthVerified bounds the verification cache, it starts over when full.
+const maxBasicAuthVerified = 1024
+
+var basicAuthVerifiedCount atomic.Int64
+
+func basicAuthEnabled() bool {
+	return len(basicAuthUsers) > 0 || basicAuthFile != ""
+}
+
+func loadBasicAuth() error {
+	users := htpasswd{}
+	for _, v := range basicAuthUsers {
+		user, pass, ok := strings.Cut(v, ":")
+		if !ok || user == "" {
+			return errors.New("invalid -basic-auth value, expected user:password")
+		}
+		users[user] = pass
+	}
+	if basicAuthFile != "" {
+		f, err := os.Open(basicAuthFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, hash, ok := strings.Cut(line, ":")
+			if !ok || user == "" {
+				return fmt.Errorf("%s: invalid line %q", basicAuthFile, line)
+			}
+			if strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "$1$") {
+				noticef(levelWarn, "warning: %s: md5 password of %q is not supported, use bcrypt (htpasswd -B)", basicAuthFile, user)
+				continue
+			}
+			users[user] = hash
+		}
+		if err := sc.Err(); err != nil {
+			return err
+		}
+	}
+	basicAuth.Store(&users)
+	basicAuthVerified.Clear()
+	basicAuthVerifiedCount.Store(0)
+	return nil
+}
+
+func reloadBasicAuth() {
+	if err := loadBasicAuth(); err != nil {
+		noticef(levelError, "failed to reload basic auth users, keeping the previous ones: %s", err.Error())
+		return
+	}
+	fmt.Println("reloaded basic auth users")
+}
+
+func setupBasicAuth() error {
+	if err := loadBasicAuth(); err != nil {
+		return err
+	}
+	onReload(reloadBasicAuth)
+	if basicAuthFile != "" {
+		watchFile(basicAuthFile, reloadBasicAuth)
+	}
+	return nil
+}
+
+// checkPassword compares pass with an htpasswd hash.
+func checkPassword(hash, pass string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(pass)) == 1
+}
+
+// validBasicAuth reports whether user and pass belong to an allowed user.
+func validBasicAuth(user, pass string) bool {
+	hash, ok := (*basicAuth.Load())[user]
+	if !ok {
+		return false
+	}
+	digest := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + pass))
+	key := string(digest[:])
+	if _, ok := basicAuthVerified.Load(key); ok {
+		return true
+	}
+	if !checkPassword(hash, pass) {
+		return false
+	}
+	if basicAuthVerifiedCount.Add(1) > maxBasicAuthVerified {
+		basicAuthVerified.Clear()
+		basicAuthVerifiedCount.Store(1)
+	}
+	basicAuthVerified.Store(key, struct{}{})
+	return true
+}
+
+// basicAuthChallenge asks the client for credentials with a real 401, so browsers prompt.
+func basicAuthChallenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", basicAuthRealm))
+	errorResponseWithStatus(w, http.StatusUnauthorized, 401, "authentication required")
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setBasicAuth loads the users of -basic-auth and an htpasswd file of lines, restoring the
+// previous users afterwards.
+func setBasicAuth(t *testing.T, users []string, lines ...string) {
+	t.Helper()
+	old := basicAuth.Load()
+	t.Cleanup(func() {
+		basicAuth.Store(old)
+		basicAuthVerified.Clear()
+		basicAuthVerifiedCount.Store(0)
+	})
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	content := ""
+	for _, l := range lines {
+		content += l + "\n"
+	}
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, map[string]string{"basic-auth-file": file})
+	saved := basicAuthUsers
+	t.Cleanup(func() { basicAuthUsers = saved })
+	basicAuthUsers = users
+	if err := loadBasicAuth(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testHtpasswd(t *testing.T) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("sha-pass"))
+	setBasicAuth(t, []string{"plain:plain-pass", "colon:pass:with:colons"},
+		"# comment",
+		"",
+		"bcrypt:"+string(hash),
+		"sha:{SHA}"+base64.StdEncoding.EncodeToString(sum[:]),
+		"md5:$apr1$salt$hash",
+	)
+}
+
+func TestValidBasicAuth(t *testing.T) {
+	testHtpasswd(t)
+	for _, tc := range []struct {
+		user, pass string
+		valid      bool
+	}{
+		{"plain", "plain-pass", true},
+		{"plain", "plain-pas", false},
+		{"plain", "plain-pass2", false},
+		{"plain", "PLAIN-PASS", false},
+		{"plain", "", false},
+		{"colon", "pass:with:colons", true},
+		{"colon", "pass", false},
+		{"bcrypt", "bcrypt-pass", true},
+		{"bcrypt", "bcrypt-pas", false},
+		// a plain compare with the hash itself must not pass
+		{"bcrypt", "", false},
+		{"sha", "sha-pass", true},
+		{"sha", "sha-pas", false},
+		{"sha", "{SHA}", false},
+		// md5 hashes are skipped with a warning
+		{"md5", "$apr1$salt$hash", false},
+		{"unknown", "plain-pass", false},
+		{"", "", false},
+	} {
+		// twice, the second answer comes from the verification cache if the first was valid
+		for range 2 {
+			if got := validBasicAuth(tc.user, tc.pass); got != tc.valid {
+				t.Errorf("validBasicAuth(%q, %q) = %v, expected %v", tc.user, tc.pass, got, tc.valid)
+			}
+		}
+	}
+}
+
+func TestValidBasicAuthCache(t *testing.T) {
+	testHtpasswd(t)
+	if !validBasicAuth("bcrypt", "bcrypt-pass") {
+		t.Fatal("the password was rejected")
+	}
+	if validBasicAuth("bcrypt", "wrong") {
+		t.Error("a wrong password passed once the right one was cached")
+	}
+	// a changed password invalidates the cache, the digest covers the hash
+	setBasicAuth(t, []string{"bcrypt:new-pass"})
+	if validBasicAuth("bcrypt", "bcrypt-pass") {
+		t.Error("the old password passed after a reload")
+	}
+	if !validBasicAuth("bcrypt", "new-pass") {
+		t.Error("the new password was rejected")
+	}
+}
+
+func TestAuthorizeBasicAuthHeaders(t *testing.T) {
+	testHtpasswd(t)
+	setFlags(t, map[string]string{"disable-sign": "false"})
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+	for _, tc := range []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"valid", basic("plain:plain-pass"), true},
+		{"lower case scheme", "basic " + base64.StdEncoding.EncodeToString([]byte("plain:plain-pass")), true},
+		{"wrong password", basic("plain:wrong"), false},
+		{"unknown user", basic("nobody:plain-pass"), false},
+		{"no colon", basic("plain"), false},
+		{"invalid base64", "Basic !!!not-base64", false},
+		{"empty credentials", "Basic ", false},
+		{"no scheme", base64.StdEncoding.EncodeToString([]byte("plain:plain-pass")), false},
+		{"other scheme", "Digest username=\"plain\"", false},
+		{"none", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/file.bin", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			ok := authorize(w, r, &downloadRequest{Path: "/file.bin"})
+			if ok != tc.ok {
+				t.Fatalf("authorized %v, expected %v", ok, tc.ok)
+			}
+			if ok {
+				if r.Header.Get("Authorization") != "" {
+					t.Error("the credentials would be sent to the origin")
+				}
+				return
+			}
+			if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("answered %d with WWW-Authenticate %q, expected a 401 challenge", w.Code, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var multiRangesTotal = newCounterVec("openlist_proxy_multi_range_requests_total", "Requests for several ranges, by how they were answered: multipart, single or full.", "result")
+
+// rangeHosts remembers whether an origin host answered range requests with ranges, for the
+// Accept-Ranges of its full responses.
+var rangeHosts = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+// observeRanges notes whether the origin answering res honoured the Range of req.
+func observeRanges(req *http.Request, res *http.Response) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") == "" || req.Header.Get("If-Range") != "" {
+		// an If-Range not matching yields the whole file from origins supporting ranges too
+		return
+	}
+	var supported bool
+	switch res.StatusCode {
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		supported = true
+	case http.StatusOK:
+	default:
+		return
+	}
+	rangeHosts.Lock()
+	rangeHosts.m[res.Request.URL.Host] = supported
+	rangeHosts.Unlock()
+}
+
+// advertiseRanges sets the Accept-Ranges of a full response to what the proxy can serve of
+// the file: ranges if the origin answered them before or they are synthesized, none if the
+// origin ignored them, and whatever the origin says while it is not known.
+func advertiseRanges(res *http.Response) {
+	if res.StatusCode != http.StatusOK || res.Request == nil || res.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	host := res.Request.URL.Host
+	if synthesizesRanges(host) && res.ContentLength >= 0 {
+		res.Header.Set("Accept-Ranges", "bytes")
+		return
+	}
+	rangeHosts.Lock()
+	supported, known := rangeHosts.m[host]
+	rangeHosts.Unlock()
+	switch {
+	case !known:
+	case supported:
+		res.Header.Set("Accept-Ranges", "bytes")
+	default:
+		res.Header.Set("Accept-Ranges", "none")
+	}
+}
+
+// rangeSpec formats r as in a Range header.
+func rangeSpec(r byteRange) string {
+	switch {
+	case r.Start < 0:
+		return "-" + strconv.FormatInt(r.End, 10)
+	case r.End < 0:
+		return strconv.FormatInt(r.Start, 10) + "-"
+	}
+	return strconv.FormatInt(r.Start, 10) + "-" + strconv.FormatInt(r.End, 10)
+}
+
+// firstRange asks the origin for the first of several ranges only, few origins answer more
+// than one; multiRange adds the others.
+func firstRange(req *downloadRequest, originReq *http.Request) {
+	if len(req.Ranges) > 1 && originReq.Method == http.MethodGet {
+		originReq.Header.Set("Range", "bytes="+rangeSpec(req.Ranges[0]))
+	}
+}
+
+// multiRange turns the 206 of the first range into the multipart/byteranges response of all
+// ranges the client asked for, fetching the others from the origin as the parts are read.
+func multiRange(r *http.Request, req *downloadRequest, res *http.Response) {
+	if len(req.Ranges) <= 1 || r.Method != http.MethodGet {
+		return
+	}
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		skipUnsatisfiable(req, res)
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		if res.StatusCode == http.StatusOK {
+			multiRangesTotal.inc("full")
+		}
+		return
+	}
+	start, end, size, ok := parseContentRangeSize(res.Header.Get("Content-Range"))
+	if !ok {
+		return
+	}
+	type part struct {
+		offset, length int64
+	}
+	parts := []part{{start, end - start}}
+	sum := end - start
+	for _, br := range req.Ranges[1:] {
+		if offset, length, ok := br.resolve(size); ok {
+			parts = append(parts, part{offset, length})
+			sum += length
+		}
+	}
+	if len(parts) == 1 || sum > size {
+		// more bytes than the file is abuse, the first range is a valid answer
+		multiRangesTotal.inc("single")
+		return
+	}
+	multiRangesTotal.inc("multipart")
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	contentType := res.Header.Get("Content-Type")
+	b := &multipartBody{req: res.Request, validator: ifRangeValidator(res.Header), body: res.Body}
+	length := int64(0)
+	for _, p := range parts {
+		h := textproto.MIMEHeader{}
+		if contentType != "" {
+			h.Set("Content-Type", contentType)
+		}
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", p.offset, p.offset+p.length-1, size))
+		_, _ = mw.CreatePart(h)
+		b.parts = append(b.parts, multipartPart{header: bytes.Clone(buf.Bytes()), offset: p.offset, length: p.length})
+		length += int64(buf.Len()) + p.length
+		buf.Reset()
+	}
+	_ = mw.Close()
+	b.closing = bytes.Clone(buf.Bytes())
+	length += int64(len(b.closing))
+	b.pending = b.parts[0].header
+
+	res.Header.Del("Content-Range")
+	res.Header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	res.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	res.ContentLength = length
+	res.Body = b
+}
+
+// skipUnsatisfiable drops the ranges beyond the end of the file from a request whose first
+// range the origin answered with a 416, and turns res into the 206 of the first range left.
+// A 416 is only right when none of the ranges can be satisfied.
+func skipUnsatisfiable(req *downloadRequest, res *http.Response) {
+	total, ok := strings.CutPrefix(res.Header.Get("Content-Range"), "bytes */")
+	size, err := parseRangeInt(total)
+	if !ok || err != nil || res.Request == nil {
+		return
+	}
+	var ranges []byteRange
+	for _, br := range req.Ranges {
+		if _, _, ok := br.resolve(size); ok {
+			ranges = append(ranges, br)
+		}
+	}
+	if len(ranges) == 0 {
+		return
+	}
+	offset, length, _ := ranges[0].resolve(size)
+	first, err := fetchRange(res.Request, ifRangeValidator(res.Header), offset, length)
+	if err != nil {
+		logf(levelWarn, "failed to fetch the first satisfiable range of %s: %s", res.Request.URL.Redacted(), err.Error())
+		return
+	}
+	_ = res.Body.Close()
+	req.Ranges = ranges
+	*res = *first
+}
+
+// fetchRange requests the length bytes at offset of the file of req from the origin, failing
+// unless it answers exactly these. A validator makes it fail if the file changed as well.
+func fetchRange(req *http.Request, validator string, offset, length int64) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+	res, err := HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if start, end, ok := parseContentRange(res.Header.Get("Content-Range")); res.StatusCode != http.StatusPartialContent || !ok || start != offset || end != offset+length {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("origin answered the range %d-%d with %s", offset, offset+length-1, res.Status)
+	}
+	return res, nil
+}
+
+// parseContentRangeSize is parseContentRange returning the size of the file as well.
+func parseContentRangeSize(v string) (int64, int64, int64, bool) {
+	start, end, ok := parseContentRange(v)
+	_, total, found := strings.Cut(v, "/")
+	if !ok || !found {
+		return 0, 0, 0, false
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil || size < end {
+		return 0, 0, 0, false
+	}
+	return start, end, size, true
+}
+
+type multipartPart struct {
+	header         []byte
+	offset, length int64
+}
+
+// multipartBody streams the parts of a multipart/byteranges response, the first from the
+// response of the first range and the others from range requests of their own.
+type multipartBody struct {
+	req       *http.Request
+	validator string
+	parts     []multipartPart
+	closing   []byte
+
+	// pending is the header not read yet, body the part being read, next its index
+	pending []byte
+	body    io.ReadCloser
+	next    int
+	mu      sync.Mutex
+	closed  bool
+}
+
+func (b *multipartBody) Read(p []byte) (int, error) {
+	for {
+		if len(b.pending) > 0 {
+			n := copy(p, b.pending)
+			b.pending = b.pending[n:]
+			return n, nil
+		}
+		if b.next > len(b.parts) {
+			return 0, io.EOF
+		}
+		if b.next == len(b.parts) {
+			b.next++
+			b.pending = b.closing
+			continue
+		}
+		if b.body == nil {
+			body, err := b.fetch(b.parts[b.next])
+			if err != nil {
+				return 0, err
+			}
+			b.mu.Lock()
+			b.body = body
+			b.mu.Unlock()
+		}
+		n, err := b.body.Read(p)
+		if err == io.EOF {
+			_ = b.body.Close()
+			b.mu.Lock()
+			b.body = nil
+			b.mu.Unlock()
+			if b.next++; b.next < len(b.parts) {
+				b.pending = b.parts[b.next].header
+			}
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// fetch requests the bytes of a part after the first from the origin.
+func (b *multipartBody) fetch(p multipartPart) (io.ReadCloser, error) {
+	res, err := fetchRange(b.req, b.validator, p.offset, p.length)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		_ = res.Body.Close()
+		return nil, errors.New("transfer closed")
+	}
+	return res.Body, nil
+}
+
+func (b *multipartBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.body != nil {
+		return b.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMultiRangeUnsatisfiableFirst(t *testing.T) {
+	newOpenlistStub(t)
+	setFlags(t, map[string]string{"disable-sign": "true"})
+	size := len(stubFile)
+	beyond := fmt.Sprintf("%d-", size)
+	for _, tc := range []struct {
+		name   string
+		ranges string
+		status int
+		// parts are the ranges served, as start and end inclusive
+		parts [][2]int
+	}{
+		{"satisfiable ranges after it", "bytes=" + beyond + ",0-9,100-199", http.StatusPartialContent, [][2]int{{0, 9}, {100, 199}}},
+		{"unsatisfiable ranges between", "bytes=" + beyond + ",10-19," + beyond + ",-5", http.StatusPartialContent, [][2]int{{10, 19}, {size - 5, size - 1}}},
+		{"a single satisfiable range", "bytes=" + beyond + ",0-9", http.StatusPartialContent, [][2]int{{0, 9}}},
+		{"none satisfiable", "bytes=" + beyond + "," + beyond, http.StatusRequestedRangeNotSatisfiable, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/file.bin", nil)
+			r.Header.Set("Range", tc.ranges)
+			w := httptest.NewRecorder()
+			newHandler().ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("answered %d, expected %d", w.Code, tc.status)
+			}
+			switch len(tc.parts) {
+			case 0:
+				if got, want := w.Header().Get("Content-Range"), fmt.Sprintf("bytes */%d", size); got != want {
+					t.Errorf("Content-Range is %q, expected %q", got, want)
+				}
+			case 1:
+				p := tc.parts[0]
+				if got, want := w.Header().Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", p[0], p[1], size); got != want {
+					t.Errorf("Content-Range is %q, expected %q", got, want)
+				}
+				if w.Body.String() != stubFile[p[0]:p[1]+1] {
+					t.Errorf("sent %q", w.Body)
+				}
+			default:
+				mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+				if err != nil || mediaType != "multipart/byteranges" {
+					t.Fatalf("Content-Type is %q", w.Header().Get("Content-Type"))
+				}
+				mr := multipart.NewReader(w.Body, params["boundary"])
+				for _, p := range tc.parts {
+					part, err := mr.NextPart()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got, want := part.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", p[0], p[1], size); got != want {
+						t.Errorf("part Content-Range is %q, expected %q", got, want)
+					}
+					if b, _ := io.ReadAll(part); string(b) != stubFile[p[0]:p[1]+1] {
+						t.Errorf("part %v is %q", p, b)
+					}
+				}
+				if _, err := mr.NextPart(); err != io.EOF {
+					t.Errorf("more parts than expected: %v", err)
+				}
+			}
+		})
+	}
+}
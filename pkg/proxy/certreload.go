@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+)
+
+// listenerCert is the certificate of -cert and -key, swapped when the files change so
+// renewals are served without a restart.
+var listenerCert atomic.Pointer[tls.Certificate]
+
+func loadListenerCert(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	listenerCert.Store(&cert)
+	return nil
+}
+
+// setupListenerCert loads -cert and -key, generated by -auto-cert, and reloads them on change or SIGHUP.
+func setupListenerCert() error {
+	// the flags are cleared once GetCertificate takes over
+	cf, kf := certFile, keyFile
+	if autoCert {
+		if err := ensureSelfSignedCert(cf, kf); err != nil {
+			return err
+		}
+	}
+	if err := loadListenerCert(cf, kf); err != nil {
+		return err
+	}
+	reload := func() {
+		// renewals write cert and key one after another, a mismatch resolves with the second write
+		if err := loadListenerCert(cf, kf); err != nil {
+			noticef(levelError, "failed to reload the certificate, keeping the previous one: %s", err.Error())
+			return
+		}
+		fmt.Println("reloaded the certificate")
+	}
+	onReload(reload)
+	watchFile(cf, reload)
+	watchFile(kf, reload)
+	return nil
+}
+
+func listenerCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return listenerCert.Load(), nil
+}
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+var checkConfigOnly bool
+
+func init() {
+	commands["check"] = command{
+		usage: "check validates the options and rule files and runs the tests: block of the -config files against the access and routing rules",
+		run:   runCheck,
+	}
+	CommandLine.BoolVar(&checkConfigOnly, "check-config", false, "validate the options, rule files, cidrs, certificates, cache settings and the connection to openlist and redis, "+
+		"print the effective configuration with secrets redacted and exit, non-zero on any problem")
+}
+
+// ruleTest is a sample request of a tests: block and the decision the rules must make for it.
+type ruleTest struct {
+	Name string `yaml:"name"`
+	// Path is the requested path, before a tenant root is prepended.
+	Path    string            `yaml:"path"`
+	Client  string            `yaml:"client"`
+	Host    string            `yaml:"host"`
+	Headers map[string]string `yaml:"headers"`
+	Expect  ruleExpect        `yaml:"expect"`
+}
+
+// ruleExpect are the expected decisions, fields left out are not checked.
+type ruleExpect struct {
+	Allow *bool `yaml:"allow"`
+	// Status is the http status the rules answer with, 200 for allowed requests.
+	Status int     `yaml:"status"`
+	Tenant *string `yaml:"tenant"`
+	// Backend is the openlist address asked for the link, or direct for -direct mounts.
+	Backend *string `yaml:"backend"`
+	// Path is the path sent to the backend.
+	Path *string `yaml:"path"`
+}
+
+var ruleTests []ruleTest
+
+func loadRuleTests(b []byte, file string) error {
+	var doc struct {
+		Tests []ruleTest `yaml:"tests"`
+	}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("%s: tests: %w", file, err)
+	}
+	for i, t := range doc.Tests {
+		if !strings.HasPrefix(t.Path, "/") {
+			return fmt.Errorf("%s: test %d needs an absolute path", file, i+1)
+		}
+		if t.Name == "" {
+			t.Name = t.Path
+		}
+		ruleTests = append(ruleTests, t)
+	}
+	return nil
+}
+
+// ruleDecision is what the rules made of a test request.
+type ruleDecision struct {
+	allow   bool
+	status  int
+	tenant  string
+	backend string
+	path    string
+}
+
+// configCheck is one validation of the configuration.
+type configCheck struct {
+	name string
+	run  func() error
+}
+
+// configChecks returns the validations of the options and the files they name, with online
+// the ones connecting to openlist and redis too.
+func configChecks(online bool) []configCheck {
+	checks := []configCheck{
+		{"metrics", validateMetrics}, {"default scheme", validateDefaultScheme}, {"directory listing", validateDirListing}, {"landing", setupLanding},
+		{"referer", validateReferer}, {"user agent rules", setupUserAgentRules}, {"file type rules", setupFileTypeRules}, {"s3", setupS3}, {"sftp", setupSFTP},
+		{"webdav", validateWebDAV}, {"min rate", validateMinRate}, {"progress", setupProgress}, {"log sinks", validateLogSinks}, {"request limits", setupRequestLimits}, {"maintenance", setupMaintenance},
+		{"autoban", setupAutoban}, {"state store", validateStateStore}, {"bans", loadBans}, {"bandwidth classes", setupBandwidthClasses}, {"api keys", setupAPIKeys}, {"tenants", setupTenants}, {"routes", setupRoutes},
+		{"policies", loadPolicies}, {"wasm plugins", setupWASMPlugins}, {"direct drivers", setupDirectDrivers},
+		{"cidrs", checkCIDRs}, {"certificates", checkCertificates}, {"cache", checkCache},
+	}
+	if geoIPDB != "" {
+		checks = append(checks, configCheck{"geoip", setupGeoIP})
+	}
+	if online {
+		checks = append(checks, configCheck{"redis", setupRedis}, configCheck{"limits backend", setupSharedLimits}, configCheck{"openlist", checkBackends})
+	}
+	return checks
+}
+
+func runCheck([]string) error {
+	for _, c := range configChecks(false) {
+		if err := c.run(); err != nil {
+			return err
+		}
+	}
+	if len(ruleTests) == 0 {
+		fmt.Println("configuration ok, the -config files have no tests")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "TEST\tRESULT\tDETAIL")
+	failed := 0
+	for _, t := range ruleTests {
+		d := t.decide()
+		result, detail := "pass", d.String()
+		if problems := t.Expect.compare(d); len(problems) > 0 {
+			result, detail = "FAIL", strings.Join(problems, ", ")
+			failed++
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", t.Name, result, detail)
+	}
+	_ = tw.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tests failed", failed, len(ruleTests))
+	}
+	return nil
+}
+
+// request returns the request of the test as a client would send it.
+func (t ruleTest) request() *http.Request {
+	r := httptest.NewRequest(http.MethodGet, escapePath(t.Path), nil)
+	client := t.Client
+	if client == "" {
+		client = "192.0.2.1"
+	}
+	r.RemoteAddr = net.JoinHostPort(client, "1234")
+	if t.Host != "" {
+		r.Host = t.Host
+	}
+	for k, v := range t.Headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+// decide sends the test request through the access rules and resolves its route like a download.
+func (t ruleTest) decide() ruleDecision {
+	r := t.request()
+	var d ruleDecision
+	rec := httptest.NewRecorder()
+	accessRules(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		d.allow = true
+		if tn := requestTenant(r); tn != nil {
+			d.tenant = tn.Name
+		}
+		p := tenantPath(r, t.Path)
+		if _, _, ok := directDriverFor(p); ok {
+			d.backend, d.path = "direct", p
+		} else if rt, rp, ok := routeFor(p); ok {
+			d.backend, d.path = rt.backends[0].address, rp
+		} else {
+			d.backend, d.path = address, p
+		}
+	})).ServeHTTP(rec, r)
+	d.status = rec.Code
+	return d
+}
+
+func (d ruleDecision) String() string {
+	if !d.allow {
+		return fmt.Sprintf("denied with %d", d.status)
+	}
+	s := "allowed, " + d.backend + " " + d.path
+	if d.tenant != "" {
+		s += " for tenant " + d.tenant
+	}
+	return s
+}
+
+// compare returns how d differs from the expectation.
+func (e ruleExpect) compare(d ruleDecision) []string {
+	var problems []string
+	if e.Allow != nil && *e.Allow != d.allow {
+		problems = append(problems, fmt.Sprintf("expected allow %t, %s", *e.Allow, d))
+	}
+	if e.Status != 0 && e.Status != d.status {
+		problems = append(problems, fmt.Sprintf("expected status %d, got %d", e.Status, d.status))
+	}
+	if !d.allow {
+		if e.Tenant != nil || e.Backend != nil || e.Path != nil {
+			problems = append(problems, "expected a route but the request is denied")
+		}
+		return problems
+	}
+	for _, f := range []struct {
+		name     string
+		expected *string
+		actual   string
+	}{{"tenant", e.Tenant, d.tenant}, {"backend", e.Backend, d.backend}, {"path", e.Path, d.path}} {
+		if f.expected != nil && *f.expected != f.actual {
+			problems = append(problems, fmt.Sprintf("expected %s %q, got %q", f.name, *f.expected, f.actual))
+		}
+	}
+	return problems
+}
+
+// checkCIDRs parses the cidrs of the options and files not parsed by another check.
+func checkCIDRs() error {
+	if err := setupTrustedProxies(); err != nil {
+		return fmt.Errorf("-trusted-proxy: %w", err)
+	}
+	if _, err := readPrefixes(geoBypassCIDRs, ""); err != nil {
+		return fmt.Errorf("-geo-bypass-cidr: %w", err)
+	}
+	if aclEnabled() {
+		return setupACL()
+	}
+	return nil
+}
+
+// checkCertificates loads the certificates and CAs of the listeners and the upstreams.
+func checkCertificates() error {
+	if https && certFile != "" && vaultTLSSecret == "" && len(acmeDomains) == 0 {
+		_, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if autoCert && errors.Is(err, os.ErrNotExist) {
+			// generated when serving
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("-cert and -key: %w", err)
+		}
+	}
+	if clientCA != "" {
+		if _, err := clientCATLSConfig(); err != nil {
+			return fmt.Errorf("-client-ca: %w", err)
+		}
+	}
+	return setupUpstreamTLS()
+}
+
+// checkCache validates the content cache options and that -cache-dir is a writable directory,
+// without touching the files cached there.
+func checkCache() error {
+	if cacheDir == "" {
+		return setupPeerCache()
+	}
+	if cacheSize <= 0 {
+		return errors.New("-cache-size must be positive")
+	}
+	if cacheTTL < 0 {
+		return errors.New("-cache-ttl must not be negative")
+	}
+	if err := validateSegmentCache(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(cacheDir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("-cache-dir %s is not a directory", cacheDir)
+		}
+		f, err := os.CreateTemp(cacheDir, ".check-*")
+		if err != nil {
+			return fmt.Errorf("-cache-dir is not writable: %w", err)
+		}
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("-cache-dir: %w", err)
+	}
+	return setupPeerCache()
+}
+
+// checkBackends asks every openlist of -address and the routes for its public settings.
+func checkBackends() error {
+	if len(backends) == 0 {
+		return errors.New("-address is required")
+	}
+	addrs := make([]string, 0, len(backends))
+	for _, b := range backends {
+		addrs = append(addrs, b.address)
+	}
+	for _, rt := range *routes.Load() {
+		for _, b := range rt.backends {
+			addrs = append(addrs, b.address)
+		}
+	}
+	var problems []string
+	for _, a := range addrs {
+		if err := checkBackend(a); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func checkBackend(addr string) error {
+	req, err := http.NewRequest(http.MethodGet, addr+"/api/public/settings", nil)
+	if err != nil {
+		return fmt.Errorf("invalid address %s: %w", addr, err)
+	}
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s is unreachable: %w", addr, err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	var resp settingsResp
+	if err := decodeAPIResponse(res, &resp); err != nil {
+		return fmt.Errorf("%s is not an openlist: %w", addr, err)
+	}
+	if resp.Code != 200 {
+		return fmt.Errorf("%s answered %d: %s", addr, resp.Code, resp.Message)
+	}
+	return nil
+}
+
+// runCheckConfig runs every check, reporting all problems rather than the first, and prints
+// the options that are not at their defaults.
+func runCheckConfig() error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	failed := 0
+	checks := configChecks(true)
+	for _, c := range checks {
+		result, detail := "ok", ""
+		if err := c.run(); err != nil {
+			result, detail = "FAIL", err.Error()
+			failed++
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", c.name, result, detail)
+	}
+	_ = tw.Flush()
+	fmt.Println()
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "OPTION\tVALUE\tSOURCE")
+	defaults := 0
+	for _, e := range effectiveConfig() {
+		if e.Source == "default" {
+			defaults++
+			continue
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Name, e.Value, e.Source)
+	}
+	_ = tw.Flush()
+	fmt.Printf("%d other options have their defaults\n", defaults)
+	closeRedis()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
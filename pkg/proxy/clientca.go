@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+)
+
+var clientCA string
+
+func init() {
+	CommandLine.StringVar(&clientCA, "client-ca", "", "pem `file` of CAs whose client certificates are required to connect, needs -https")
+}
+
+var clientCertRequests = newCounterVec("openlist_proxy_client_cert_requests_total", "Requests by common name of the verified client certificate.", "cn")
+
+// clientCATLSConfig returns the listener tls config requiring certificates of -client-ca.
+func clientCATLSConfig() (*tls.Config, error) {
+	if !https {
+		return nil, errors.New("-client-ca needs -https")
+	}
+	b, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates found in " + clientCA)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}, nil
+}
+
+// clientCN returns the common name of the verified client certificate of r, if any.
+func clientCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+func clientCertHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCertRequests.inc(clientCN(r))
+		next.ServeHTTP(w, r)
+	})
+}
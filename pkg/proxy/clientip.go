@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var (
+	trustedProxyCIDRs stringList
+	realIPHeader      string
+)
+
+func init() {
+	CommandLine.Var(&trustedProxyCIDRs, "trusted-proxy", "cidr or ip of a reverse proxy or load balancer whose forwarded client address is believed, repeatable, "+
+		"peers of unix sockets are always trusted")
+	CommandLine.StringVar(&realIPHeader, "real-ip-header", "X-Forwarded-For", "header trusted proxies pass the client address in, e.g. X-Real-IP or CF-Connecting-IP, "+
+		"X-Forwarded-For is walked from the right past the trusted proxies")
+}
+
+var trustedProxies []netip.Prefix
+
+func setupTrustedProxies() error {
+	prefixes, err := readPrefixes(trustedProxyCIDRs, "")
+	if err != nil {
+		return err
+	}
+	trustedProxies = prefixes
+	return nil
+}
+
+// peerIP returns the address of the connection r arrived on.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trustedPeer reports whether the forwarding headers set by peer are believed.
+func trustedPeer(peer string) bool {
+	addr, err := netip.ParseAddr(peer)
+	if err != nil {
+		// unix socket, only reachable by local processes with its permissions
+		return true
+	}
+	return containsAddr(trustedProxies, addr.Unmap())
+}
+
+// clientIP returns the address identifying the client of r, the one forwarded by trusted
+// proxies in front of the proxy. Everything keyed by client uses it: logs, limits and acls.
+func clientIP(r *http.Request) string {
+	peer := peerIP(r)
+	if !trustedPeer(peer) {
+		return peer
+	}
+	values := r.Header.Values(realIPHeader)
+	if len(values) == 0 {
+		return peer
+	}
+	if !strings.EqualFold(realIPHeader, "X-Forwarded-For") {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(values[len(values)-1])); err == nil {
+			return addr.Unmap().String()
+		}
+		return peer
+	}
+	// every proxy appends the address it was reached from, the rightmost untrusted one is
+	// the client, anything left of it may be forged
+	hops := strings.Split(strings.Join(values, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		peer = addr.Unmap().String()
+		if !containsAddr(trustedProxies, addr.Unmap()) {
+			break
+		}
+	}
+	return peer
+}
+
+// clientIdentity returns the key traffic is accounted to for r.
+func clientIdentity(r *http.Request) string {
+	if k := getRequestInfo(r).apiKey; k != nil {
+		return "key:" + k.Name
+	}
+	return "ip:" + clientIP(r)
+}
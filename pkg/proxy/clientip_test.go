@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setTrustedProxies trusts the proxies of -trusted-proxy for one test.
+func setTrustedProxies(t *testing.T, flags map[string]string) {
+	t.Helper()
+	old := trustedProxies
+	t.Cleanup(func() { trustedProxies = old })
+	setFlags(t, flags)
+	if err := setupTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	// 10.0.0.1 is the load balancer, 10.0.1.0/24 the tier of proxies behind it
+	setFlags(t, map[string]string{"trusted-proxy": "10.0.0.1"})
+	// the repeatable flag adds the second value
+	setTrustedProxies(t, map[string]string{"trusted-proxy": "10.0.1.0/24"})
+	for _, tc := range []struct {
+		name   string
+		remote string
+		xff    []string
+		client string
+	}{
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"untrusted peer", "203.0.113.9:1234", []string{"198.51.100.7"}, "203.0.113.9"},
+		{"untrusted peer forging a trusted hop", "203.0.113.9:1234", []string{"198.51.100.7, 10.0.0.1"}, "203.0.113.9"},
+		{"single hop", "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"rightmost untrusted hop", "10.0.0.1:1234", []string{"192.0.2.66, 198.51.100.7, 10.0.1.5"}, "198.51.100.7"},
+		{"forged hops left of the client", "10.0.0.1:1234", []string{"1.1.1.1, 2.2.2.2, 198.51.100.7"}, "198.51.100.7"},
+		{"multiple headers", "10.0.0.1:1234", []string{"192.0.2.66, 198.51.100.7", "10.0.1.5"}, "198.51.100.7"},
+		{"multiple headers with the client last", "10.0.0.1:1234", []string{"10.0.1.5", "198.51.100.7"}, "198.51.100.7"},
+		{"all trusted", "10.0.0.1:1234", []string{"10.0.1.9, 10.0.1.5"}, "10.0.1.9"},
+		{"whitespace", "10.0.0.1:1234", []string{"  198.51.100.7 ,10.0.1.5  "}, "198.51.100.7"},
+		{"ipv4-mapped hop", "10.0.0.1:1234", []string{"::ffff:198.51.100.7"}, "198.51.100.7"},
+		{"ipv6 hop", "10.0.0.1:1234", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"ipv4-mapped trusted peer", "[::ffff:10.0.0.1]:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		// the walk stops at garbage, keeping the last hop it could believe
+		{"garbage hop", "10.0.0.1:1234", []string{"198.51.100.7, unknown, 10.0.1.5"}, "10.0.1.5"},
+		{"hop with a port", "10.0.0.1:1234", []string{"198.51.100.7:4711"}, "10.0.0.1"},
+		{"empty header", "10.0.0.1:1234", []string{""}, "10.0.0.1"},
+		{"unix socket peer", "@", []string{"198.51.100.7"}, "198.51.100.7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/file.bin", nil)
+			r.RemoteAddr = tc.remote
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r); got != tc.client {
+				t.Errorf("clientIP = %q, expected %q", got, tc.client)
+			}
+		})
+	}
+}
+
+func TestClientIPRealIPHeader(t *testing.T) {
+	setTrustedProxies(t, map[string]string{"trusted-proxy": "10.0.0.1", "real-ip-header": "CF-Connecting-IP"})
+	for _, tc := range []struct {
+		name   string
+		remote string
+		values []string
+		client string
+	}{
+		{"trusted peer", "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"untrusted peer", "203.0.113.9:1234", []string{"198.51.100.7"}, "203.0.113.9"},
+		{"the last of several values", "10.0.0.1:1234", []string{"192.0.2.66", "198.51.100.7"}, "198.51.100.7"},
+		{"a list is no address", "10.0.0.1:1234", []string{"198.51.100.7, 10.0.0.1"}, "10.0.0.1"},
+		{"garbage", "10.0.0.1:1234", []string{"unknown"}, "10.0.0.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/file.bin", nil)
+			r.RemoteAddr = tc.remote
+			// forwarded for is ignored once another header is configured
+			r.Header.Set("X-Forwarded-For", "192.0.2.1")
+			for _, v := range tc.values {
+				r.Header.Add("CF-Connecting-IP", v)
+			}
+			if got := clientIP(r); got != tc.client {
+				t.Errorf("clientIP = %q, expected %q", got, tc.client)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is a subcommand run instead of the proxy, e.g. `openlist-proxy export`.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{}
+
+func init() {
+	CommandLine.Usage = func() {
+		out := CommandLine.Output()
+		_, _ = fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+		CommandLine.PrintDefaults()
+		_, _ = fmt.Fprintf(out, "\nCommands:\n%s", commandsUsage())
+	}
+}
+
+// runCommand runs the subcommand named by the first positional argument.
+func runCommand(args []string) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Printf("unknown command %q, available commands:\n%s", args[0], commandsUsage())
+		os.Exit(2)
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Printf("%s: %s\n", args[0], err.Error())
+		os.Exit(1)
+	}
+}
+
+func commandsUsage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %s\n        %s\n", name, commands[name].usage)
+	}
+	return b.String()
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var checkVersion bool
+
+func init() {
+	CommandLine.BoolVar(&checkVersion, "check-version", true, "detect the openlist version at startup and warn about unsupported versions")
+}
+
+// backendVersion is the OpenList (or AList) version detected at startup, empty if unknown.
+var backendVersion string
+
+// backendMajor is the major version of backendVersion, 0 if unknown. It only selects the
+// warnings, the api is handled the same way for every version.
+var backendMajor int
+
+// supportedMajors lists the backend major versions the proxy is known to work with.
+var supportedMajors = map[int]bool{3: true, 4: true}
+
+type settingsResp struct {
+	Code    int            `json:"code"`
+	Message string         `json:"message"`
+	Data    map[string]any `json:"data"`
+}
+
+// detectBackendVersion queries the public settings of the backend and records its version.
+// Failures only produce warnings, the proxy still starts.
+func detectBackendVersion() {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/public/settings", address), nil)
+	res, err := apiClient.Do(req)
+	if err != nil {
+		noticef(levelWarn, "warning: failed to detect openlist version: %s", err.Error())
+		return
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	var resp settingsResp
+	if err := decodeAPIResponse(res, &resp); err != nil {
+		noticef(levelWarn, "warning: failed to detect openlist version, is %s an openlist address? %s", address, err.Error())
+		return
+	}
+	v, _ := resp.Data["version"].(string)
+	if resp.Code != 200 || v == "" {
+		noticef(levelWarn, "warning: openlist did not report its version (code %d: %s)", resp.Code, resp.Message)
+		return
+	}
+	backendVersion = v
+	backendMajor = parseMajor(v)
+	fmt.Printf("openlist version: %s\n", v)
+	if !supportedMajors[backendMajor] {
+		noticef(levelWarn, "warning: openlist %s is not a supported version, link resolution may fail", v)
+	}
+}
+
+func parseMajor(v string) int {
+	v = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "v")
+	major, _, _ := strings.Cut(v, ".")
+	n, _ := strconv.Atoi(major)
+	return n
+}
+
+// unexpectedResponse wraps a decoding error of an API response with the detected backend version,
+// so users of unsupported versions get a hint instead of a bare JSON error.
+func unexpectedResponse(err error) error {
+	if backendVersion != "" && !supportedMajors[backendMajor] {
+		return fmt.Errorf("unexpected response from unsupported openlist %s: %w", backendVersion, err)
+	}
+	return fmt.Errorf("unexpected response from openlist: %w", err)
+}
+
+// UnmarshalJSON accepts link headers both as {"k": ["v"]} (v4, recent v3) and
+// {"k": "v"} (older v3 releases), whatever version was detected. The expiration is a
+// duration in nanoseconds, null when unknown.
+func (l *Link) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Url        string                     `json:"url"`
+		Header     map[string]json.RawMessage `json:"header"`
+		URLs       []string                   `json:"urls"`
+		Expiration *int64                     `json:"expiration"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	l.Url, l.URLs = raw.Url, raw.URLs
+	if raw.Expiration != nil && *raw.Expiration > 0 {
+		l.Expiration = time.Duration(*raw.Expiration)
+	}
+	l.Header = make(http.Header, len(raw.Header))
+	for k, v := range raw.Header {
+		var values []string
+		if err := json.Unmarshal(v, &values); err != nil {
+			var value string
+			if err := json.Unmarshal(v, &value); err != nil {
+				return fmt.Errorf("invalid link header %q: %w", k, err)
+			}
+			values = []string{value}
+		}
+		l.Header[k] = values
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	compress        bool
+	compressTypes   string
+	compressMinSize int64
+)
+
+func init() {
+	CommandLine.BoolVar(&compress, "compress", false, "compress compressible responses for clients sending Accept-Encoding")
+	CommandLine.StringVar(&compressTypes, "compress-types", "text/*,application/json,application/javascript,application/xml,application/x-subrip,image/svg+xml", "comma separated MIME types to compress, a trailing /* matches a whole type")
+	CommandLine.Int64Var(&compressMinSize, "compress-min-size", 1024, "minimum response size in bytes to compress")
+}
+
+// incompressibleTypes are never compressed, even when matched by a wildcard in -compress-types.
+var incompressibleTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-bzip2":          true,
+	"application/x-rar-compressed": true,
+	"application/x-xz":             true,
+	"application/pdf":              true,
+	"application/octet-stream":     true,
+}
+
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if incompressibleTypes[mediaType] || strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml" ||
+		strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") {
+		return false
+	}
+	for _, t := range strings.Split(compressTypes, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks the preferred supported encoding from an Accept-Encoding header.
+func negotiateEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	for _, enc := range []string{"zstd", "gzip"} {
+		if accepted[enc] || accepted["*"] {
+			return enc
+		}
+	}
+	return ""
+}
+
+func compressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if enc == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: enc}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter decides on the first WriteHeader whether the response should be compressed.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	wroteHeader bool
+	enc         io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	h := cw.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if code != http.StatusOK || h.Get("Content-Encoding") != "" || !compressibleType(h.Get("Content-Type")) {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n < compressMinSize {
+			cw.ResponseWriter.WriteHeader(code)
+			return
+		}
+	}
+	switch cw.encoding {
+	case "zstd":
+		zw, err := zstd.NewWriter(cw.ResponseWriter, zstdOptions()...)
+		if err != nil {
+			cw.ResponseWriter.WriteHeader(code)
+			return
+		}
+		cw.enc = zw
+	case "gzip":
+		cw.enc = gzip.NewWriter(cw.ResponseWriter)
+	}
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressWriter) Close() {
+	if cw.enc != nil {
+		_ = cw.enc.Close()
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
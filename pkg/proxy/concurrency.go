@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxConns           int
+	maxConnsPerIP      int
+	connQueueTimeout   time.Duration
+	connQueueSize      int
+	overloadRetryAfter time.Duration
+)
+
+func init() {
+	CommandLine.IntVar(&maxConns, "max-conns", 0, "max simultaneous transfers in total, 0 is unlimited")
+	CommandLine.IntVar(&maxConnsPerIP, "max-conns-per-ip", 0, "max simultaneous transfers per client ip, 0 is unlimited")
+	CommandLine.DurationVar(&connQueueTimeout, "conn-queue-timeout", 0, "how long a request over the transfer limits waits for a free slot before it is rejected, "+
+		"with 503 over -max-conns and 429 over -max-conns-per-ip")
+	CommandLine.IntVar(&connQueueSize, "conn-queue-size", 0, "max requests waiting for a -max-conns slot, further ones are rejected with 503 at once, 0 does not limit the queue")
+	CommandLine.DurationVar(&overloadRetryAfter, "overload-retry-after", 5*time.Second, "Retry-After of the 503 of requests rejected over -max-conns")
+}
+
+var (
+	queuedRequests   = newGaugeVec("openlist_proxy_queued_requests", "Requests waiting for a -max-conns slot.")
+	overloadRejected = newCounterVec("openlist_proxy_overload_rejected_total", "Requests rejected over -max-conns, by reason: queue_full or timeout.", "reason")
+)
+
+// queued counts the requests waiting for a -max-conns slot.
+var queued atomic.Int64
+
+// acquireQueued takes a slot of sem, waiting in the queue of -conn-queue-size until ctx is
+// done, and returns why it got none.
+func acquireQueued(ctx context.Context, sem semaphore) (bool, string) {
+	select {
+	case sem <- struct{}{}:
+		return true, ""
+	default:
+	}
+	if n := queued.Add(1); connQueueSize > 0 && n > int64(connQueueSize) {
+		queued.Add(-1)
+		return false, "queue_full"
+	}
+	queuedRequests.add(1)
+	defer func() {
+		queued.Add(-1)
+		queuedRequests.add(-1)
+	}()
+	if !sem.acquire(ctx) {
+		return false, "timeout"
+	}
+	return true, ""
+}
+
+// semaphore limits concurrency to its capacity.
+type semaphore chan struct{}
+
+// acquire waits for a free slot until ctx is done.
+func (sem semaphore) acquire(ctx context.Context) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (sem semaphore) release() {
+	<-sem
+}
+
+// ipSemaphores hands out one semaphore per client ip, dropping it once unused.
+type ipSemaphores struct {
+	mu   sync.Mutex
+	sems map[string]*ipSemaphore
+	size int
+}
+
+type ipSemaphore struct {
+	sem   semaphore
+	users int
+}
+
+func (s *ipSemaphores) get(ip string) semaphore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	is, ok := s.sems[ip]
+	if !ok {
+		is = &ipSemaphore{sem: make(semaphore, s.size)}
+		s.sems[ip] = is
+	}
+	is.users++
+	return is.sem
+}
+
+func (s *ipSemaphores) put(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if is := s.sems[ip]; is != nil {
+		is.users--
+		if is.users == 0 {
+			delete(s.sems, ip)
+		}
+	}
+}
+
+func concurrencyHandler(next http.Handler) http.Handler {
+	var global semaphore
+	if maxConns > 0 {
+		global = make(semaphore, maxConns)
+	}
+	perIP := &ipSemaphores{sems: map[string]*ipSemaphore{}, size: maxConnsPerIP}
+	reject := func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "1")
+		errorResponseWithStatus(w, http.StatusTooManyRequests, http.StatusTooManyRequests, "too many simultaneous transfers")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), connQueueTimeout)
+		defer cancel()
+		if maxConnsPerIP > 0 {
+			ip := clientIP(r)
+			sem := perIP.get(ip)
+			defer perIP.put(ip)
+			if !sem.acquire(ctx) {
+				reject(w)
+				return
+			}
+			defer sem.release()
+		}
+		if global != nil {
+			ok, reason := acquireQueued(ctx, global)
+			if !ok {
+				if r.Context().Err() != nil {
+					// the client gave up waiting
+					return
+				}
+				overloadRejected.inc(reason)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(overloadRetryAfter.Seconds()))))
+				errorResponseWithStatus(w, http.StatusServiceUnavailable, http.StatusServiceUnavailable, "server overloaded, try again later")
+				return
+			}
+			defer global.release()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var configFiles stringList
+
+func init() {
+	CommandLine.Var(&configFiles, "config", "yaml config `file`, repeatable, later files are deep-merged over earlier ones and command line flags override both")
+
+	adminMux.Handle("GET /api/config", adminAuth(adminConfig))
+}
+
+// configSource records where the effective value of each flag came from.
+var configSource = map[string]string{}
+
+// mergeConfig deep-merges src into dst, recording file as the source of every leaf key.
+func mergeConfig(dst, src map[string]any, prefix, file string, sources map[string]string) {
+	for k, v := range src {
+		key := prefix + k
+		if sm, ok := v.(map[string]any); ok {
+			dm, ok := dst[k].(map[string]any)
+			if !ok {
+				dm = map[string]any{}
+				dst[k] = dm
+			}
+			mergeConfig(dm, sm, key+"-", file, sources)
+			continue
+		}
+		dst[k] = v
+		sources[key] = file
+	}
+}
+
+// flattenConfig turns nested config maps into flag names joined with "-",
+// e.g. {tls: {min-version: 1.2}} becomes tls-min-version.
+func flattenConfig(m map[string]any, prefix string, out map[string]any) {
+	for k, v := range m {
+		if sm, ok := v.(map[string]any); ok {
+			flattenConfig(sm, prefix+k+"-", out)
+			continue
+		}
+		out[prefix+k] = v
+	}
+}
+
+// loadConfigFiles applies the -config files to every flag not set on the command line.
+func loadConfigFiles() error {
+	set := map[string]bool{}
+	CommandLine.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+		configSource[f.Name] = "flag"
+	})
+	merged := map[string]any{}
+	sources := map[string]string{}
+	for _, file := range configFiles {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var m map[string]any
+		if err := yaml.Unmarshal(b, &m); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if _, ok := m["tests"]; ok {
+			// rule tests are run by the check command, they are no option
+			if err := loadRuleTests(b, file); err != nil {
+				return err
+			}
+			delete(m, "tests")
+		}
+		mergeConfig(merged, m, "", file, sources)
+	}
+	flat := map[string]any{}
+	flattenConfig(merged, "", flat)
+	names := make([]string, 0, len(flat))
+	for name := range flat {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := CommandLine.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s: unknown option %q", sources[name], name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := setFlag(f, flat[name]); err != nil {
+			return fmt.Errorf("%s: option %q: %w", sources[name], name, err)
+		}
+		configSource[name] = sources[name]
+	}
+	return nil
+}
+
+func setFlag(f *flag.Flag, v any) error {
+	list, isList := v.([]any)
+	if !isList {
+		return f.Value.Set(configString(v))
+	}
+	if _, repeatable := f.Value.(*stringList); repeatable {
+		for _, item := range list {
+			if err := f.Value.Set(configString(item)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	items := make([]string, len(list))
+	for i, item := range list {
+		items[i] = configString(item)
+	}
+	return f.Value.Set(strings.Join(items, ","))
+}
+
+func configString(v any) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// secretURLFlags are the flags whose urls carry credentials outside their userinfo too, such
+// as the key of a sentry dsn or the token in the path of a webhook.
+var secretURLFlags = map[string]bool{
+	"sentry-dsn": true, "redis-url": true, "webhook": true, "error-webhook": true, "slo-webhook": true,
+	"events-url": true, "vault-role-id": true,
+}
+
+// secretFlag reports whether the value of the flag name must not be displayed.
+func secretFlag(name string) bool {
+	if secretURLFlags[name] {
+		return true
+	}
+	for _, word := range []string{"token", "secret", "password", "key"} {
+		if strings.Contains(name, word) && !strings.HasSuffix(name, "-file") {
+			return true
+		}
+	}
+	return false
+}
+
+// redactUserinfo strips the user and password of the urls in a comma separated value.
+func redactUserinfo(value string) string {
+	items := strings.Split(value, ",")
+	for i, item := range items {
+		if u, err := url.Parse(item); err == nil && u.User != nil {
+			u.User = nil
+			items[i] = u.String()
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+type configEntry struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// effectiveConfig lists the value of every option with secrets redacted, and where it came from.
+func effectiveConfig() []configEntry {
+	var entries []configEntry
+	CommandLine.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlag(f.Name) && value != "" {
+			value = "<redacted>"
+		} else {
+			value = redactUserinfo(value)
+		}
+		source := configSource[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		entries = append(entries, configEntry{Name: f.Name, Value: value, Source: source})
+	})
+	return entries
+}
+
+func adminConfig(w http.ResponseWriter, _ *http.Request) {
+	jsonResponse(w, effectiveConfig())
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	adminMux.Handle("GET /api/connections", adminAuth(adminConnections))
+	adminMux.Handle("DELETE /api/connections/{id}", adminAuth(adminKillConnection))
+}
+
+type connectionInfo struct {
+	ID       string    `json:"id"`
+	Client   string    `json:"client"`
+	Path     string    `json:"path"`
+	Upstream string    `json:"upstream"`
+	Started  time.Time `json:"started"`
+	// Bytes sent so far, spliced transfers only report them when done.
+	Bytes int64 `json:"bytes"`
+	// Rate is the bytes per second sent over the last -progress-interval.
+	Rate int64 `json:"rate"`
+	// Upload is set for uploads, whose bytes are the ones received from the client.
+	Upload bool `json:"upload,omitempty"`
+}
+
+// activeTransfer is a proxied body transfer in progress.
+type activeTransfer struct {
+	connectionInfo
+	sent atomic.Int64
+	// measured is what was sent when rate was last measured
+	measured, rate atomic.Int64
+	body           io.Closer
+	killed         atomic.Bool
+}
+
+var transfers = struct {
+	sync.Mutex
+	m      map[string]*activeTransfer
+	nextID int64
+}{m: map[string]*activeTransfer{}}
+
+// trackTransfer registers the transfer of res to the client of r until untrack.
+func trackTransfer(r *http.Request, res *http.Response) *activeTransfer {
+	return track(&activeTransfer{body: res.Body, connectionInfo: connectionInfo{
+		Client:   clientIdentity(r),
+		Path:     r.URL.Path,
+		Upstream: res.Request.URL.Host,
+		Started:  time.Now(),
+	}})
+}
+
+// trackUpload registers the upload of the body of r to upstream until untrack.
+func trackUpload(r *http.Request, upstream string) *activeTransfer {
+	return track(&activeTransfer{body: r.Body, connectionInfo: connectionInfo{
+		Client:   clientIdentity(r),
+		Path:     r.URL.Path,
+		Upstream: upstream,
+		Started:  time.Now(),
+		Upload:   true,
+	}})
+}
+
+func track(t *activeTransfer) *activeTransfer {
+	transfers.Lock()
+	transfers.nextID++
+	t.ID = strconv.FormatInt(transfers.nextID, 10)
+	transfers.m[t.ID] = t
+	transfers.Unlock()
+	return t
+}
+
+func (t *activeTransfer) untrack() {
+	transfers.Lock()
+	delete(transfers.m, t.ID)
+	transfers.Unlock()
+}
+
+// kill aborts the transfer by closing its upstream body.
+func (t *activeTransfer) kill() {
+	t.killed.Store(true)
+	_ = t.body.Close()
+}
+
+func adminConnections(w http.ResponseWriter, _ *http.Request) {
+	transfers.Lock()
+	list := make([]connectionInfo, 0, len(transfers.m))
+	for _, t := range transfers.m {
+		info := t.connectionInfo
+		info.Bytes, info.Rate = t.sent.Load(), t.rate.Load()
+		list = append(list, info)
+	}
+	transfers.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	jsonResponse(w, list)
+}
+
+func adminKillConnection(w http.ResponseWriter, r *http.Request) {
+	transfers.Lock()
+	t, ok := transfers.m[r.PathValue("id")]
+	transfers.Unlock()
+	if !ok {
+		errorResponseWithStatus(w, http.StatusNotFound, 404, "no such connection")
+		return
+	}
+	t.kill()
+	jsonResponse(w, Result{Code: 200, Msg: "killed"})
+}
@@ -0,0 +1,427 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cacheDir  string
+	cacheSize byteSize = 10 << 30
+	cacheTTL  time.Duration
+)
+
+func init() {
+	CommandLine.StringVar(&cacheDir, "cache-dir", "", "directory caching downloaded files, filled while they stream to the first client, empty disables the content cache")
+	CommandLine.Var(&cacheSize, "cache-size", "`size` the content cache is kept under by evicting the least recently used files")
+	CommandLine.DurationVar(&cacheTTL, "cache-ttl", time.Hour, "how long cached files are served without asking openlist again, 0 serves them until evicted")
+}
+
+var (
+	contentCacheTotal = newCounterVec("openlist_proxy_content_cache_total", "Content cache hits and fills, by result.", "result")
+	contentCacheBytes = newGaugeVec("openlist_proxy_content_cache_bytes", "Bytes of the files in the content cache.")
+)
+
+// maxCacheFills bounds the background transfers completing files whose first client went away.
+const maxCacheFills = 2
+
+// cachedObject is a complete file in the content cache, stored as cacheDir/<key> with
+// its metadata in cacheDir/<key>.json.
+type cachedObject struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	Stored       time.Time `json:"stored"`
+
+	used time.Time
+}
+
+type contentCacheStore struct {
+	mu      sync.Mutex
+	objects map[string]*cachedObject
+	// filling are the keys being written, so concurrent first requests fill a file once.
+	filling map[string]bool
+	bytes   int64
+	fills   chan struct{}
+}
+
+var contentCache = &contentCacheStore{
+	objects: map[string]*cachedObject{},
+	filling: map[string]bool{},
+	fills:   make(chan struct{}, maxCacheFills),
+}
+
+func cacheKey(filePath string) string {
+	sum := sha256.Sum256([]byte(filePath))
+	return hex.EncodeToString(sum[:])
+}
+
+func cacheFile(key string) string {
+	return filepath.Join(cacheDir, key)
+}
+
+// setupContentCache indexes the files a previous run left in -cache-dir.
+func setupContentCache() error {
+	if cacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return err
+	}
+	c := contentCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".part") {
+			// the previous run stopped while filling it
+			_ = os.Remove(filepath.Join(cacheDir, name))
+			continue
+		}
+		key, ok := strings.CutSuffix(name, ".json")
+		if !ok {
+			continue
+		}
+		o := &cachedObject{}
+		b, err := os.ReadFile(filepath.Join(cacheDir, name))
+		if err == nil {
+			err = json.Unmarshal(b, o)
+		}
+		if info, serr := os.Stat(cacheFile(key)); err != nil || serr != nil || info.Size() != o.Size || cacheKey(o.Path) != key {
+			c.remove(key)
+			continue
+		}
+		o.used = o.Stored
+		c.objects[key] = o
+		c.bytes += o.Size
+	}
+	c.evict()
+	return nil
+}
+
+// lookup returns the cached file of filePath, nil if there is none or it expired.
+func (c *contentCacheStore) lookup(filePath string) *cachedObject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o := c.objects[cacheKey(filePath)]
+	if o == nil || cacheTTL > 0 && time.Since(o.Stored) >= cacheTTL {
+		return nil
+	}
+	o.used = time.Now()
+	return o
+}
+
+// remove deletes the files of key and forgets it, mu must be held.
+func (c *contentCacheStore) remove(key string) {
+	if o, ok := c.objects[key]; ok {
+		c.bytes -= o.Size
+		delete(c.objects, key)
+	}
+	_ = os.Remove(cacheFile(key))
+	_ = os.Remove(cacheFile(key) + ".json")
+	contentCacheBytes.set(float64(c.bytes))
+}
+
+// evict removes the least recently used files until the cache is under -cache-size, mu must be held.
+func (c *contentCacheStore) evict() {
+	if c.bytes > int64(cacheSize) {
+		keys := make([]string, 0, len(c.objects))
+		for key := range c.objects {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return c.objects[keys[i]].used.Before(c.objects[keys[j]].used) })
+		for _, key := range keys {
+			if c.bytes <= int64(cacheSize) {
+				break
+			}
+			c.remove(key)
+			contentCacheTotal.inc("evicted")
+		}
+	}
+	contentCacheBytes.set(float64(c.bytes))
+}
+
+// purge removes the cached files and segments of prefix and the paths below it and returns
+// how many files they were of.
+func (c *contentCacheStore) purge(prefix string) int {
+	n := segmentCache.purge(prefix)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, o := range c.objects {
+		if pathWithin(o.Path, prefix) {
+			c.remove(key)
+			n++
+		}
+	}
+	return n
+}
+
+// serveCached answers a download of a fresh cached file from disk and reports whether it did.
+func serveCached(w http.ResponseWriter, r *http.Request, req *downloadRequest) bool {
+	if cacheDir == "" || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	o := contentCache.lookup(req.Path)
+	if o == nil {
+		return false
+	}
+	if !fileSizeAllowed(w, r, o.Size) || !fileTypeAllowed(w, req.Path, o.ContentType, true) {
+		return true
+	}
+	f, err := os.Open(cacheFile(cacheKey(req.Path)))
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := w.Header()
+	if o.ContentType != "" {
+		h.Set("Content-Type", o.ContentType)
+	}
+	if o.ETag != "" {
+		h.Set("ETag", o.ETag)
+	}
+	modified, _ := http.ParseTime(o.LastModified)
+	if signMaxUses > 0 && req.Sign != "" {
+		signUses.served(req.Sign, clientIdentity(r), h)
+	}
+	contentCacheTotal.inc("hit")
+	logf(levelInfo, "cache: %s", req.Path)
+	setCORSHeaders(w, r)
+	http.ServeContent(w, r, "", modified, f)
+	return true
+}
+
+// cacheTee writes the body of a full origin response to the cache while it is read.
+type cacheTee struct {
+	body      io.ReadCloser
+	file      *os.File
+	key       string
+	obj       *cachedObject
+	req       *http.Request
+	validator string
+	// hashes check the rest fetched once the client went away, nil without -verify-hashes
+	hashes *fileHashes
+
+	// mu guards the fields below against a Close from another goroutine, e.g. a killed transfer.
+	mu      sync.Mutex
+	written int64
+	closed  bool
+	done    bool
+}
+
+// teeCache makes res.Body fill the cache entry of filePath as it streams to the client.
+// Bodies cut down by synthesizeRange are cached whole below the window.
+func teeCache(res *http.Response, filePath string) {
+	if cacheDir == "" || res.Request == nil || res.Request.Method != http.MethodGet || res.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	if !ownsPath(filePath) {
+		// only the peer owning the path caches it
+		return
+	}
+	size := res.ContentLength
+	target := &res.Body
+	if w, ok := res.Body.(*rangeWindow); ok {
+		size, target = w.size, &w.body
+	} else if res.StatusCode != http.StatusOK {
+		return
+	}
+	if size < 0 || size > int64(cacheSize) {
+		return
+	}
+	key := cacheKey(filePath)
+	c := contentCache
+	c.mu.Lock()
+	if c.filling[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.filling[key] = true
+	c.mu.Unlock()
+	f, err := os.OpenFile(cacheFile(key)+".part", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		logf(levelError, "failed to cache %s: %s", filePath, err.Error())
+		c.release(key)
+		return
+	}
+	tee := &cacheTee{
+		body: *target,
+		file: f,
+		key:  key,
+		obj: &cachedObject{
+			Path:         filePath,
+			Size:         size,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+			ContentType:  res.Header.Get("Content-Type"),
+		},
+		req:       res.Request,
+		validator: ifRangeValidator(res.Header),
+	}
+	if b, ok := tee.body.(*integrityBody); ok {
+		tee.hashes = b.hashes
+	}
+	*target = tee
+}
+
+func (c *contentCacheStore) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.filling, key)
+}
+
+func (t *cacheTee) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return n, err
+	}
+	if n > 0 && !t.done {
+		if _, werr := t.file.Write(p[:n]); werr != nil {
+			logf(levelError, "failed to cache %s: %s", t.obj.Path, werr.Error())
+			t.abandon()
+		}
+		t.written += int64(n)
+	}
+	if err == io.EOF && !t.done && t.written == t.obj.Size {
+		t.finish()
+	}
+	return n, err
+}
+
+// Close keeps filling the entry in the background when the client went away early
+// and the rest can be fetched as a range, the partial file is dropped otherwise.
+func (t *cacheTee) Close() error {
+	err := t.body.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || t.done {
+		return err
+	}
+	// later reads are not written, the rest is filled in the background
+	t.closed = true
+	if t.written >= t.obj.Size || t.validator == "" {
+		t.abandon()
+		return err
+	}
+	select {
+	case contentCache.fills <- struct{}{}:
+		go func() {
+			defer func() {
+				<-contentCache.fills
+			}()
+			if ferr := t.fillRest(); ferr != nil {
+				logf(levelError, "failed to finish caching %s: %s", t.obj.Path, ferr.Error())
+				t.abandon()
+			}
+		}()
+	default:
+		t.abandon()
+	}
+	return err
+}
+
+// fillRest fetches the bytes the client did not read, skipping them in a full response
+// from origins ignoring the range.
+func (t *cacheTee) fillRest() error {
+	req := t.req.Clone(context.Background())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", t.written))
+	req.Header.Set("If-Range", t.validator)
+	res, err := HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	switch start, _, ok := parseContentRange(res.Header.Get("Content-Range")); {
+	case res.StatusCode == http.StatusPartialContent && ok && start == t.written:
+	case res.StatusCode == http.StatusOK && ifRangeValidator(res.Header) == t.validator && res.ContentLength == t.obj.Size:
+		if _, err := io.CopyN(io.Discard, res.Body, t.written); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("origin answered with %s", res.Status)
+	}
+	n, err := io.Copy(t.file, res.Body)
+	if t.written += n; err == nil && t.written != t.obj.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && t.hashes != nil {
+		err = t.hashes.verifyFile(t.file.Name())
+	}
+	if err != nil {
+		return err
+	}
+	contentCacheTotal.inc("completed")
+	t.finish()
+	return nil
+}
+
+// finish moves the complete file into the cache.
+func (t *cacheTee) finish() {
+	t.done = true
+	defer contentCache.release(t.key)
+	if err := t.file.Close(); err != nil {
+		_ = os.Remove(t.file.Name())
+		return
+	}
+	t.obj.Stored = time.Now()
+	t.obj.used = t.obj.Stored
+	b, _ := json.Marshal(t.obj)
+	err := os.WriteFile(cacheFile(t.key)+".json.tmp", b, 0o600)
+	if err == nil {
+		err = os.Rename(t.file.Name(), cacheFile(t.key))
+	}
+	if err == nil {
+		err = os.Rename(cacheFile(t.key)+".json.tmp", cacheFile(t.key)+".json")
+	}
+	c := contentCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.objects[t.key]; ok {
+		c.bytes -= old.Size
+		delete(c.objects, t.key)
+	}
+	if err != nil {
+		logf(levelError, "failed to cache %s: %s", t.obj.Path, err.Error())
+		c.remove(t.key)
+		return
+	}
+	c.objects[t.key] = t.obj
+	c.bytes += t.obj.Size
+	contentCacheTotal.inc("stored")
+	c.evict()
+}
+
+// abandon drops the partial file.
+func (t *cacheTee) abandon() {
+	if t.done {
+		return
+	}
+	t.done = true
+	_ = t.file.Close()
+	_ = os.Remove(t.file.Name())
+	contentCacheTotal.inc("abandoned")
+	contentCache.release(t.key)
+}
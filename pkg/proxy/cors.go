@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	corsOrigins       stringList
+	corsMethods       string
+	corsHeaders       string
+	corsExposeHeaders string
+	corsCredentials   bool
+	corsMaxAge        time.Duration
+)
+
+func init() {
+	CommandLine.Var(&corsOrigins, "cors-origin", "origin browsers may fetch from, * for any, a pattern such as https://*.example.com or a case-insensitive regexp prefixed with ~, "+
+		"repeatable, none allows any origin")
+	CommandLine.StringVar(&corsMethods, "cors-methods", "GET, OPTIONS", "methods allowed to cross-origin requests")
+	CommandLine.StringVar(&corsHeaders, "cors-headers", "range", "request headers allowed to cross-origin requests, authorization is added with -jwt-secret or -basic-auth")
+	CommandLine.StringVar(&corsExposeHeaders, "cors-expose-headers", "", "response headers scripts of other origins may read, e.g. Content-Range, Content-Disposition")
+	CommandLine.BoolVar(&corsCredentials, "cors-credentials", false, "allow cross-origin requests with cookies and authorization, the matching origin is echoed instead of *")
+	CommandLine.DurationVar(&corsMaxAge, "cors-max-age", 0, "how long browsers may cache a preflight response, 0 leaves it to the browser")
+}
+
+// corsRule is one -cors-origin.
+type corsRule struct {
+	any     bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+var corsRules []corsRule
+
+func setupCORS() error {
+	corsRules = nil
+	for _, o := range corsOrigins {
+		rule := corsRule{any: o == "*", pattern: strings.ToLower(strings.TrimSuffix(o, "/"))}
+		if expr, ok := strings.CutPrefix(o, "~"); ok {
+			re, err := regexp.Compile("(?i)" + expr)
+			if err != nil {
+				return fmt.Errorf("invalid -cors-origin %q: %w", o, err)
+			}
+			rule.re = re
+		} else if _, err := path.Match(rule.pattern, ""); err != nil {
+			return fmt.Errorf("invalid -cors-origin %q", o)
+		}
+		corsRules = append(corsRules, rule)
+	}
+	return nil
+}
+
+// corsAnyOrigin reports whether every origin is allowed.
+func corsAnyOrigin() bool {
+	if len(corsRules) == 0 {
+		return true
+	}
+	for _, rule := range corsRules {
+		if rule.any {
+			return true
+		}
+	}
+	return false
+}
+
+func corsOriginAllowed(origin string) bool {
+	if corsAnyOrigin() {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, rule := range corsRules {
+		if rule.re != nil {
+			if rule.re.MatchString(origin) {
+				return true
+			}
+		} else if ok, _ := path.Match(rule.pattern, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// setCORSHeaders allows browsers on the origins of -cors-origin to fetch and seek proxied files.
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	origin := r.Header.Get("Origin")
+	switch {
+	case corsAnyOrigin() && !corsCredentials:
+		h.Set("Access-Control-Allow-Origin", "*")
+	case origin != "" && corsOriginAllowed(origin):
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		if corsCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	default:
+		// caches must not hand the answer to another origin its headers
+		h.Add("Vary", "Origin")
+		return
+	}
+	h.Set("Access-Control-Allow-Methods", corsMethods)
+	h.Set("Access-Control-Allow-Headers", corsHeaders)
+	if jwtEnabled() || basicAuthEnabled() {
+		h.Add("Access-Control-Allow-Headers", "authorization")
+	}
+	if corsExposeHeaders != "" {
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+	}
+	if corsMaxAge > 0 && r.Method == http.MethodOptions {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	}
+}
+
+// preflightHandler answers OPTIONS requests with the CORS policy, without signature checks
+// or any call to openlist or the origin.
+func preflightHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		setCORSHeaders(w, r)
+		if _, ok := davPath(r.URL.Path); ok {
+			// webdav clients probe the dav class with OPTIONS
+			w.Header().Set("DAV", "1")
+			w.Header().Set("Allow", davMethods)
+		} else {
+			w.Header().Set("Allow", corsMethods)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
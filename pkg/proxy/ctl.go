@@ -0,0 +1,479 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	commands["ctl"] = command{
+		usage: "ctl [-url url] [-token token] login|logout|status|stats|history|traffic|connections|kill|purge-cache|prefetch|bans|ban|unban|quota|maintenance|log-level|trace manages a running proxy through its admin api",
+		run:   runCtl,
+	}
+}
+
+// ctlSession is the admin api a `ctl login` saved for later commands.
+type ctlSession struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+func ctlSessionFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "openlist-proxy", "ctl.json"), nil
+}
+
+// loadCtlSession returns the saved session, an empty one if there is none.
+func loadCtlSession() ctlSession {
+	var s ctlSession
+	if file, err := ctlSessionFile(); err == nil {
+		if b, err := os.ReadFile(file); err == nil {
+			_ = json.Unmarshal(b, &s)
+		}
+	}
+	return s
+}
+
+func saveCtlSession(s ctlSession) error {
+	file, err := ctlSessionFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	b, _ := json.MarshalIndent(s, "", "  ")
+	return os.WriteFile(file, b, 0o600)
+}
+
+type ctlClient struct {
+	ctlSession
+	client *http.Client
+}
+
+func (c *ctlClient) call(method, apiPath string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.URL, "/")+apiPath, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var result Result
+	if json.Unmarshal(b, &result) == nil && result.Code != 0 && result.Code != 200 {
+		return fmt.Errorf("%d: %s", result.Code, result.Msg)
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("admin api responded %s", res.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+func runCtl(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	u := fs.String("url", "", "admin url of the proxy, defaults to the session saved by login or -admin-address")
+	token := fs.String("token", "", "admin token, defaults to the session saved by login or -admin-token")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing command: login, logout, status, stats, history, traffic, connections, kill, purge-cache, prefetch, bans, ban, unban, quota, maintenance, log-level or trace")
+	}
+	c := &ctlClient{ctlSession: loadCtlSession(), client: &http.Client{Timeout: 30 * time.Second}}
+	if c.URL == "" && adminAddress != "" {
+		c.URL = "http://" + adminAddress
+		if strings.HasPrefix(adminAddress, ":") {
+			c.URL = "http://127.0.0.1" + adminAddress
+		}
+	}
+	if c.Token == "" {
+		c.Token = adminToken
+	}
+	if *u != "" {
+		c.URL = *u
+	}
+	if *token != "" {
+		c.Token = *token
+	}
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	if cmd == "logout" {
+		file, err := ctlSessionFile()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if c.URL == "" {
+		return errors.New("no admin url, pass -url or run ctl -url ... -token ... login first")
+	}
+	switch cmd {
+	case "login":
+		if err := c.call("GET", "/api/status", nil, nil); err != nil {
+			return err
+		}
+		if err := saveCtlSession(c.ctlSession); err != nil {
+			return err
+		}
+		fmt.Printf("logged in to %s\n", c.URL)
+		return nil
+	case "status":
+		return c.status()
+	case "connections":
+		return c.connections()
+	case "kill":
+		if len(rest) == 0 {
+			return errors.New("usage: ctl kill id...")
+		}
+		for _, id := range rest {
+			if err := c.call("DELETE", "/api/connections/"+url.PathEscape(id), nil, nil); err != nil {
+				return fmt.Errorf("kill %s: %w", id, err)
+			}
+		}
+		return nil
+	case "purge-cache":
+		prefix := "/"
+		if len(rest) > 0 {
+			prefix = rest[0]
+		}
+		var res purgeResp
+		if err := c.call("POST", "/api/cache/purge", purgeReq{Prefix: prefix}, &res); err != nil {
+			return err
+		}
+		fmt.Printf("purged %d cached links and files\n", res.Purged)
+		return nil
+	case "prefetch":
+		return c.prefetch(rest)
+	case "bans":
+		return c.bans()
+	case "ban":
+		return c.ban(rest)
+	case "unban":
+		if len(rest) == 0 {
+			return errors.New("usage: ctl unban cidr...")
+		}
+		for _, cidr := range rest {
+			if err := c.call("DELETE", "/api/bans?cidr="+url.QueryEscape(cidr), nil, nil); err != nil {
+				return fmt.Errorf("unban %s: %w", cidr, err)
+			}
+		}
+		return nil
+	case "quota":
+		return c.quota(rest)
+	case "stats":
+		return c.stats()
+	case "history":
+		return c.history(rest)
+	case "traffic":
+		return c.traffic(rest)
+	case "maintenance":
+		return c.maintenance(rest)
+	case "trace":
+		return c.trace(rest)
+	case "log-level":
+		var req logLevelReq
+		if len(rest) == 0 {
+			if err := c.call("GET", "/api/log-level", nil, &req); err != nil {
+				return err
+			}
+		} else if err := c.call("PUT", "/api/log-level", logLevelReq{Level: rest[0]}, &req); err != nil {
+			return err
+		}
+		fmt.Println(req.Level)
+		return nil
+	}
+	return fmt.Errorf("unknown ctl command %q", cmd)
+}
+
+func (c *ctlClient) status() error {
+	var s statusResp
+	if err := c.call("GET", "/api/status", nil, &s); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "version\t%s\n", s.Version)
+	if s.BackendVersion != "" {
+		_, _ = fmt.Fprintf(tw, "openlist\t%s\n", s.BackendVersion)
+	}
+	_, _ = fmt.Fprintf(tw, "uptime\t%s\n", time.Duration(s.Uptime)*time.Second)
+	_, _ = fmt.Fprintf(tw, "cpus\t%d of %d\n", s.GOMAXPROCS, s.NumCPU)
+	_, _ = fmt.Fprintf(tw, "heap in use\t%d\n", s.HeapInUse)
+	if s.MemoryLimit > 0 && s.MemoryLimit < math.MaxInt64 {
+		_, _ = fmt.Fprintf(tw, "memory limit\t%d\n", s.MemoryLimit)
+	}
+	_, _ = fmt.Fprintf(tw, "goroutines\t%d\n", s.Goroutines)
+	return tw.Flush()
+}
+
+func (c *ctlClient) stats() error {
+	var s statsResp
+	if err := c.call("GET", "/api/stats", nil, &s); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "uptime\t%s\n", time.Duration(s.Uptime)*time.Second)
+	_, _ = fmt.Fprintf(tw, "requests\t%.0f (%.0f 4xx, %.0f 5xx)\n", s.Requests, s.ClientErrors, s.ServerErrors)
+	_, _ = fmt.Fprintf(tw, "response bytes\t%.0f\n", s.ResponseBytes)
+	_, _ = fmt.Fprintf(tw, "active\t%.0f requests, %d transfers\n", s.ActiveRequests, s.ActiveTransfers)
+	_, _ = fmt.Fprintf(tw, "transfers\t%.0f completed, %.0f aborted, %.0f upstream errors\n", s.Transfers["completed"], s.Transfers["aborted"], s.Transfers["upstream_error"])
+	_, _ = fmt.Fprintf(tw, "maintenance\t%t\n", s.Maintenance)
+	return tw.Flush()
+}
+
+func (c *ctlClient) history(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	from := fs.String("from", "", "first day, 2006-01-02, defaults to 29 days ago")
+	to := fs.String("to", "", "last day, defaults to today")
+	_ = fs.Parse(args)
+	var resp statsDaysResp
+	if err := c.call("GET", "/api/stats/days?from="+url.QueryEscape(*from)+"&to="+url.QueryEscape(*to), nil, &resp); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "DAY\tREQUESTS\t5XX\tBYTES\tUNIQUE IPS")
+	for _, d := range append(resp.Days, resp.Total) {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", d.Day, d.Requests, d.Errors, d.Bytes, d.UniqueIPs)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(resp.Total.TopPaths) == 0 {
+		return nil
+	}
+	_, _ = fmt.Fprintln(tw, "\nPATH\tREQUESTS\t5XX\tBYTES")
+	for _, p := range resp.Total.TopPaths {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", p.Path, p.Requests, p.Errors, p.Bytes)
+	}
+	return tw.Flush()
+}
+
+func (c *ctlClient) traffic(args []string) error {
+	fs := flag.NewFlagSet("traffic", flag.ExitOnError)
+	by := fs.String("by", "prefix", "prefix or client")
+	n := fs.Int("n", 10, "number of consumers")
+	_ = fs.Parse(args)
+	var resp trafficResp
+	if err := c.call("GET", "/api/traffic?by="+url.QueryEscape(*by)+"&n="+strconv.Itoa(*n), nil, &resp); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "%s\tBYTES\tSHARE\n", strings.ToUpper(resp.By))
+	for _, k := range resp.Top {
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%.1f%%\n", k.Key, k.Bytes, 100*float64(k.Bytes)/float64(resp.Total))
+	}
+	_, _ = fmt.Fprintf(tw, "total of the last %s\t%d\t\n", time.Duration(resp.Window)*time.Second, resp.Total)
+	return tw.Flush()
+}
+
+func (c *ctlClient) trace(args []string) error {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	client := fs.String("client", "", "ip of the client, defaults to a documentation address")
+	host := fs.String("host", "", "Host header of the request")
+	rng := fs.String("range", "", "Range header of the request, e.g. bytes=0-99")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: ctl trace [-client ip] [-host host] [-range range] url")
+	}
+	q := url.Values{"url": {fs.Arg(0)}, "client": {*client}, "host": {*host}, "range": {*rng}}
+	var resp traceResp
+	if err := c.call("GET", "/api/trace?"+q.Encode(), nil, &resp); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, s := range resp.Steps {
+		detail := s.Detail
+		if s.Status != 0 {
+			detail = fmt.Sprintf("%d %s", s.Status, detail)
+		}
+		if s.URL != "" {
+			detail += " " + s.URL
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Step, s.Result, detail)
+		for _, name := range slices.Sorted(maps.Keys(s.Header)) {
+			for _, v := range s.Header[name] {
+				_, _ = fmt.Fprintf(tw, "\t\t  %s: %s\n", name, v)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func (c *ctlClient) prefetch(args []string) error {
+	fs := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	dir := fs.String("dir", "", "also prefetch the files of this directory")
+	recursive := fs.Bool("r", false, "include the subdirectories of -dir")
+	wait := fs.Bool("wait", true, "follow the progress until the prefetch finished")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 && *dir == "" {
+		return errors.New("usage: ctl prefetch [-dir dir [-r]] [-wait=false] [path...]")
+	}
+	var job prefetchJob
+	if err := c.call("POST", "/api/cache/prefetch", prefetchReq{Paths: fs.Args(), Dir: *dir, Recursive: *recursive}, &job); err != nil {
+		return err
+	}
+	fmt.Printf("prefetch %s started\n", job.ID)
+	if !*wait {
+		return nil
+	}
+	for job.Finished.IsZero() {
+		time.Sleep(time.Second)
+		if err := c.call("GET", "/api/cache/prefetch/"+job.ID, nil, &job); err != nil {
+			return err
+		}
+		fmt.Printf("\r%s: %d of %d fetched, %d already cached, %d failed, %d bytes  ", job.State, job.Fetched, job.Total, job.Cached, job.Failed, job.Bytes)
+	}
+	fmt.Println()
+	for _, e := range job.Errors {
+		fmt.Printf("%s: %s\n", e.Path, e.Error)
+	}
+	return nil
+}
+
+func (c *ctlClient) maintenance(args []string) error {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	message := fs.String("message", "", "message answered to clients")
+	retryAfter := fs.Duration("retry-after", 0, "Retry-After sent to clients, 0 sends the default")
+	_ = fs.Parse(args)
+	var state maintenanceState
+	switch fs.Arg(0) {
+	case "":
+		if err := c.call("GET", "/api/maintenance", nil, &state); err != nil {
+			return err
+		}
+	case "on", "off":
+		req := maintenanceState{Enabled: fs.Arg(0) == "on", Message: *message, RetryAfter: int64(retryAfter.Seconds())}
+		if err := c.call("PUT", "/api/maintenance", req, &state); err != nil {
+			return err
+		}
+	default:
+		return errors.New("usage: ctl maintenance [-message text] [-retry-after 10m] [on|off]")
+	}
+	if !state.Enabled {
+		fmt.Println("maintenance off")
+		return nil
+	}
+	if state.Scheduled {
+		fmt.Printf("scheduled maintenance from %s until %s\n", state.Since.Format(time.DateTime), state.Until.Format(time.DateTime))
+		return nil
+	}
+	fmt.Printf("maintenance on since %s\n", state.Since.Format(time.DateTime))
+	return nil
+}
+
+func (c *ctlClient) connections() error {
+	var list []connectionInfo
+	if err := c.call("GET", "/api/connections", nil, &list); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tCLIENT\tPATH\tUPSTREAM\tAGE\tBYTES")
+	for _, t := range list {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", t.ID, t.Client, t.Path, t.Upstream, time.Since(t.Started).Round(time.Second), t.Bytes)
+	}
+	return tw.Flush()
+}
+
+func (c *ctlClient) bans() error {
+	var list []ban
+	if err := c.call("GET", "/api/bans", nil, &list); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "CIDR\tUNTIL\tREASON")
+	for _, b := range list {
+		until := "unban"
+		if b.Expire > 0 {
+			until = time.Unix(b.Expire, 0).Format(time.DateTime)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", b.CIDR, until, b.Reason)
+	}
+	return tw.Flush()
+}
+
+func (c *ctlClient) ban(args []string) error {
+	fs := flag.NewFlagSet("ban", flag.ExitOnError)
+	duration := fs.Duration("for", 0, "length of the ban, 0 bans until unban")
+	reason := fs.String("reason", "", "note shown in the ban list")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("usage: ctl ban [-for 1h] [-reason text] cidr...")
+	}
+	for _, cidr := range fs.Args() {
+		req := banReq{CIDR: cidr, Reason: *reason, Duration: int64(duration.Seconds())}
+		if err := c.call("POST", "/api/bans", req, nil); err != nil {
+			return fmt.Errorf("ban %s: %w", cidr, err)
+		}
+	}
+	return nil
+}
+
+func (c *ctlClient) quota(args []string) error {
+	fs := flag.NewFlagSet("quota", flag.ExitOnError)
+	reset := fs.Bool("reset", false, "forget the traffic of the given identities in the current period")
+	_ = fs.Parse(args)
+	if *reset {
+		if fs.NArg() == 0 {
+			return errors.New("usage: ctl quota -reset identity...")
+		}
+		for _, id := range fs.Args() {
+			if err := c.call("DELETE", "/api/quotas/"+url.PathEscape(id), nil, nil); err != nil {
+				return fmt.Errorf("reset %s: %w", id, err)
+			}
+		}
+		return nil
+	}
+	var list quotaList
+	if err := c.call("GET", "/api/quotas", nil, &list); err != nil {
+		return err
+	}
+	filter := map[string]bool{}
+	for _, id := range fs.Args() {
+		filter[id] = true
+	}
+	fmt.Printf("limit %d per identity, period resets %s\n", list.Limit, list.ResetAt.Local().Format(time.DateTime))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "IDENTITY\tUSED\tABORTED")
+	for _, u := range list.Usage {
+		if len(filter) == 0 || filter[u.Identity] {
+			_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\n", u.Identity, u.Used, u.Aborted)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+func init() {
+	adminMux.HandleFunc("GET /dashboard", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(dashboardPage)
+	})
+	adminMux.Handle("GET /api/top-paths", adminAuth(adminTopPaths))
+}
+
+// topPathsSize bounds the paths counted by topPaths.
+const topPathsSize = 256
+
+// pathCount is what topPaths counted of a path since the start.
+type pathCount struct {
+	Path     string `json:"path"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// topPathCounter counts the most requested paths in bounded memory: once full, a new path
+// takes the place of the least requested one and its counts, which makes the counts of
+// rare paths estimates, the frequent ones stay exact enough.
+type topPathCounter struct {
+	mu    sync.Mutex
+	paths map[string]*pathCount
+}
+
+var topPaths = newTopPathCounter()
+
+func newTopPathCounter() *topPathCounter {
+	return &topPathCounter{paths: map[string]*pathCount{}}
+}
+
+func (c *topPathCounter) add(p string, status int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.paths[p]
+	if !ok {
+		e = &pathCount{Path: p}
+		if len(c.paths) >= topPathsSize {
+			var least *pathCount
+			for _, v := range c.paths {
+				if least == nil || v.Requests < least.Requests {
+					least = v
+				}
+			}
+			delete(c.paths, least.Path)
+			*e = *least
+			e.Path = p
+		}
+		c.paths[p] = e
+	}
+	e.Requests++
+	e.Bytes += bytes
+	if status >= 500 {
+		e.Errors++
+	}
+}
+
+// top returns the n paths with the most of by, requests or bytes.
+func (c *topPathCounter) top(n int, by string) []pathCount {
+	c.mu.Lock()
+	list := make([]pathCount, 0, len(c.paths))
+	for _, v := range c.paths {
+		list = append(list, *v)
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if by == "bytes" {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Requests > list[j].Requests
+	})
+	return list[:min(n, len(list))]
+}
+
+func adminTopPaths(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = 10
+	}
+	jsonResponse(w, topPaths.top(n, r.URL.Query().Get("by")))
+}
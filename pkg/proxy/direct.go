@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var directDrivers stringList
+
+func init() {
+	CommandLine.Var(&directDrivers, "direct", "serve a path prefix straight from storage without asking openlist, as `prefix=url` "+
+		"with a file:///dir or s3://bucket/dir?region=&endpoint= url, s3 credentials come from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY, repeatable")
+}
+
+// directDriver serves the files below a prefix of the proxy namespace from storage the operator controls.
+type directDriver interface {
+	// serve handles the download of name, the path below the prefix. It returns a link to proxy
+	// like one returned by openlist, or nil when it has written the response itself.
+	serve(w http.ResponseWriter, r *http.Request, name string) *Link
+}
+
+type directMount struct {
+	prefix string
+	driver directDriver
+}
+
+// directMounts are sorted by descending prefix length so the most specific one matches.
+var directMounts []directMount
+
+func setupDirectDrivers() error {
+	directMounts = nil
+	for _, v := range directDrivers {
+		prefix, raw, ok := strings.Cut(v, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("invalid -direct %q, expected /prefix=url", v)
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return fmt.Errorf("invalid -direct url %q: %w", raw, err)
+		}
+		var d directDriver
+		switch u.Scheme {
+		case "file":
+			d, err = newLocalDriver(u.Path)
+		case "s3":
+			d, err = newS3Driver(u)
+		default:
+			err = fmt.Errorf("unsupported -direct storage %q, use file or s3", u.Scheme)
+		}
+		if err != nil {
+			return err
+		}
+		directMounts = append(directMounts, directMount{prefix: strings.TrimSuffix(prefix, "/"), driver: d})
+	}
+	sort.Slice(directMounts, func(i, j int) bool { return len(directMounts[i].prefix) > len(directMounts[j].prefix) })
+	return nil
+}
+
+// directDriverFor returns the driver serving filePath and the path below its prefix.
+func directDriverFor(filePath string) (directDriver, string, bool) {
+	for _, m := range directMounts {
+		if m.prefix == "" || pathWithin(filePath, m.prefix) {
+			name := strings.TrimPrefix(filePath, m.prefix)
+			if name == "" {
+				name = "/"
+			}
+			return m.driver, name, true
+		}
+	}
+	return nil, "", false
+}
+
+// localDriver serves files of a local directory, never following paths out of it.
+type localDriver struct {
+	root *os.Root
+}
+
+func newLocalDriver(dir string) (*localDriver, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, fmt.Errorf("-direct: %w", err)
+	}
+	return &localDriver{root: root}, nil
+}
+
+func (d *localDriver) serve(w http.ResponseWriter, r *http.Request, name string) *Link {
+	f, err := d.root.Open(strings.TrimPrefix(name, "/"))
+	if errors.Is(err, fs.ErrNotExist) {
+		errorResponse(w, 404, "object not found")
+		return nil
+	}
+	if err != nil {
+		errorResponse(w, 500, err.Error())
+		return nil
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		errorResponse(w, 500, err.Error())
+		return nil
+	}
+	if info.IsDir() {
+		errorResponse(w, 404, "object not found")
+		return nil
+	}
+	logf(levelInfo, "direct: %s", name)
+	setCORSHeaders(w, r)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return nil
+}
+
+// s3PresignExpiry is how long presigned s3 urls stay valid.
+const s3PresignExpiry = time.Hour
+
+// s3Driver resolves files of a bucket to presigned urls, which are proxied like openlist links.
+type s3Driver struct {
+	bucket, dir, region string
+	// endpoint is set for s3 compatible services, which are addressed path-style.
+	endpoint *url.URL
+}
+
+func newS3Driver(u *url.URL) (*s3Driver, error) {
+	d := &s3Driver{bucket: u.Host, dir: strings.Trim(u.Path, "/"), region: u.Query().Get("region")}
+	if d.bucket == "" {
+		return nil, errors.New("-direct s3 url needs a bucket")
+	}
+	if d.region == "" {
+		d.region = "us-east-1"
+	}
+	if e := u.Query().Get("endpoint"); e != "" {
+		endpoint, err := url.Parse(e)
+		if err != nil || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid -direct s3 endpoint %q", e)
+		}
+		d.endpoint = endpoint
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		return nil, errors.New("-direct s3 needs $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	}
+	return d, nil
+}
+
+func (d *s3Driver) serve(_ http.ResponseWriter, _ *http.Request, name string) *Link {
+	key := strings.TrimPrefix(d.dir+name, "/")
+	return &Link{
+		Url:        d.presign(key, time.Now().UTC()),
+		Header:     http.Header{},
+		Expiration: s3PresignExpiry,
+		resolved:   time.Now(),
+		backend:    "s3://" + d.bucket,
+	}
+}
+
+// presign returns a sigv4 query-signed GET url of key.
+func (d *s3Driver) presign(key string, now time.Time) string {
+	u := url.URL{Scheme: "https", Host: d.bucket + ".s3." + d.region + ".amazonaws.com", Path: "/" + key}
+	if d.endpoint != nil {
+		u = url.URL{Scheme: d.endpoint.Scheme, Host: d.endpoint.Host, Path: "/" + d.bucket + "/" + key}
+	}
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := date + "/" + d.region + "/s3/aws4_request"
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {os.Getenv("AWS_ACCESS_KEY_ID") + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {fmt.Sprint(int(s3PresignExpiry.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if t := os.Getenv("AWS_SESSION_TOKEN"); t != "" {
+		q.Set("X-Amz-Security-Token", t)
+	}
+	query := awsEncodeQuery(q)
+	path := awsEscape(u.Path, false)
+	canonical := strings.Join([]string{"GET", path, query, "host:" + u.Host + "\n", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	k := []byte("AWS4" + os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	for _, part := range []string{date, d.region, "s3", "aws4_request", toSign} {
+		k = hmacSHA256(k, part)
+	}
+	return u.Scheme + "://" + u.Host + path + "?" + query + "&X-Amz-Signature=" + hex.EncodeToString(k)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEncodeQuery encodes q sorted by key with the escaping sigv4 requires.
+func awsEncodeQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, awsEscape(k, true)+"="+awsEscape(q.Get(k), true))
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and slashes unless escapeSlash is set.
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 || c == '/' && !escapeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
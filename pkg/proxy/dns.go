@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	dnsServers  stringList
+	dnsOverHTTP string
+	staticHosts stringList
+)
+
+func init() {
+	CommandLine.Var(&dnsServers, "dns-server", "`address` of a dns server resolving upstream hosts instead of the system resolver, such as 1.1.1.1 or [2606:4700::1111]:53, "+
+		"repeatable, tried in turn")
+	CommandLine.StringVar(&dnsOverHTTP, "dns-over-https", "", "`url` of a dns-over-https endpoint resolving upstream hosts, such as https://1.1.1.1/dns-query")
+	CommandLine.Var(&staticHosts, "static-host", "`name=ip[,ip]` resolving an upstream host to fixed addresses like an /etc/hosts entry, repeatable")
+}
+
+// upstreamResolver resolves the hosts of backends and origins, nil uses the system resolver.
+var upstreamResolver *net.Resolver
+
+// hostOverrides maps lowercase host names to the addresses of -static-host.
+var hostOverrides map[string][]string
+
+func setupDNS() error {
+	hostOverrides = map[string][]string{}
+	for _, entry := range staticHosts {
+		name, addrs, ok := strings.Cut(entry, "=")
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+		if !ok || name == "" {
+			return fmt.Errorf("invalid -static-host %q, expected name=ip[,ip]", entry)
+		}
+		for _, a := range strings.Split(addrs, ",") {
+			ip, err := netip.ParseAddr(strings.TrimSpace(a))
+			if err != nil {
+				return fmt.Errorf("invalid address %q of -static-host %s", a, name)
+			}
+			hostOverrides[name] = append(hostOverrides[name], ip.String())
+		}
+	}
+	switch {
+	case len(dnsServers) > 0 && dnsOverHTTP != "":
+		return errors.New("-dns-server and -dns-over-https are exclusive")
+	case len(dnsServers) > 0:
+		servers := make([]string, len(dnsServers))
+		for i, s := range dnsServers {
+			if _, err := netip.ParseAddr(s); err == nil {
+				s = net.JoinHostPort(s, "53")
+			}
+			if _, err := netip.ParseAddrPort(s); err != nil {
+				return fmt.Errorf("invalid -dns-server %q, expected an ip with an optional port", s)
+			}
+			servers[i] = s
+		}
+		var next atomic.Uint32
+		d := net.Dialer{Timeout: upstreamDialTimeout}
+		upstreamResolver = &net.Resolver{
+			PreferGo: true,
+			// the go resolver retries on failure, each attempt takes the next server
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, network, servers[int(next.Add(1)-1)%len(servers)])
+			},
+		}
+	case dnsOverHTTP != "":
+		u, err := url.Parse(dnsOverHTTP)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid -dns-over-https %q, expected an https url", dnsOverHTTP)
+		}
+		// the endpoint itself is resolved by the system resolver or -static-host
+		dial := overrideHosts(&net.Dialer{Timeout: upstreamDialTimeout})
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dial,
+			DialTLSContext:      insecureTLSDialer(dial),
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: upstreamTLSTimeout,
+			TLSClientConfig:     upstreamTLSConfig.Clone(),
+			IdleConnTimeout:     upstreamIdleTimeout,
+		}}
+		upstreamResolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: client}, nil
+			},
+		}
+	}
+	return nil
+}
+
+// overrideHosts returns the DialContext of d that connects -static-host names to their
+// addresses, trying each in turn.
+func overrideHosts(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		ips := hostOverrides[strings.ToLower(strings.TrimSuffix(host, "."))]
+		if err != nil || len(ips) == 0 {
+			return d.DialContext(ctx, network, addr)
+		}
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+}
+
+// dohConn hands the queries of the go resolver to -dns-over-https. It is no PacketConn, so
+// the resolver frames messages as over tcp and never sees truncated answers.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	deadline time.Time
+	res      bytes.Reader
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	if len(p) < 2 || int(p[0])<<8|int(p[1]) != len(p)-2 {
+		return 0, errors.New("dns over https: unframed query")
+	}
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dnsOverHTTP, bytes.NewReader(p[2:]))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("dns over https: %s", res.Status)
+	}
+	msg, err := io.ReadAll(io.LimitReader(res.Body, 65535))
+	if err != nil {
+		return 0, err
+	}
+	c.res.Reset(append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...))
+	return len(p), nil
+}
+
+func (c *dohConn) Read(p []byte) (int, error)         { return c.res.Read(p) }
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(time.Time) error    { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "https" }
+func (dohAddr) String() string  { return dnsOverHTTP }
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	legacyErrorStatus bool
+	errorPagesDir     string
+)
+
+func init() {
+	CommandLine.BoolVar(&legacyErrorStatus, "legacy-error-status", false, "answer errors with http 200 and the status only in the code of the json body, as older versions did")
+	CommandLine.StringVar(&errorPagesDir, "error-pages", "", "directory of html templates rendered for browsers instead of the json error, looked up as 404.html, 4xx.html, then error.html, "+
+		"with .Status, .StatusText and .Message")
+}
+
+const defaultErrorPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>{{.Status}} {{.StatusText}}</title>
+<style>body{font-family:system-ui,sans-serif;max-width:40em;margin:4em auto;padding:0 1em;color:#333}h1{font-weight:400}</style></head>
+<body><h1>{{.Status}} {{.StatusText}}</h1><p>{{.Message}}</p></body></html>
+`
+
+var errorPages map[string]*template.Template
+
+func setupErrorPages() error {
+	errorPages = map[string]*template.Template{"error.html": template.Must(template.New("error.html").Parse(defaultErrorPage))}
+	if errorPagesDir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(errorPagesDir, "*.html"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		t, err := template.New(filepath.Base(f)).Parse(string(b))
+		if err != nil {
+			return fmt.Errorf("error page %s: %w", f, err)
+		}
+		errorPages[filepath.Base(f)] = t
+	}
+	return nil
+}
+
+// errorPage returns the template of status, by exact code, then class, then the fallback.
+func errorPage(status int) *template.Template {
+	for _, name := range []string{strconv.Itoa(status) + ".html", strconv.Itoa(status/100) + "xx.html", "error.html"} {
+		if t, ok := errorPages[name]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// errorStatus is the http status an error with the json code is answered with.
+func errorStatus(code int) int {
+	if legacyErrorStatus || code < 400 || code > 599 {
+		return http.StatusOK
+	}
+	return code
+}
+
+// prefersHTML reports whether the Accept header of r ranks html above json, as browsers do.
+func prefersHTML(r *http.Request) bool {
+	html, json := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+		switch strings.ToLower(mediaType) {
+		case "text/html":
+			html = q
+		case "application/json":
+			json = q
+		}
+	}
+	return html > 0 && html > json
+}
+
+// errorPageWriter carries the request to errorResponseWithStatus, which only gets the writer.
+type errorPageWriter struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// ReadFrom keeps the zero-copy path of -splice open through the wrapper.
+func (ew *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	return readFrom(ew.ResponseWriter, src)
+}
+
+// errorPagesHandler lets errors of the proxy listener be rendered as html for browsers.
+func errorPagesHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&errorPageWriter{ResponseWriter: w, r: r}, r)
+	})
+}
+
+// writerRequest returns the request answered through w, nil outside errorPagesHandler.
+func writerRequest(w http.ResponseWriter) *http.Request {
+	if ew, ok := unwrapWriter[*errorPageWriter](w); ok {
+		return ew.r
+	}
+	return nil
+}
+
+// unwrapWriter returns the writer of type T among w and the writers it wraps.
+func unwrapWriter[T http.ResponseWriter](w http.ResponseWriter) (T, bool) {
+	for w != nil {
+		if t, ok := w.(T); ok {
+			return t, true
+		}
+		uw, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = uw.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// writeErrorPage renders the html error page when the request behind w prefers it.
+func writeErrorPage(w http.ResponseWriter, status int, msg string) bool {
+	if r := writerRequest(w); r == nil || !prefersHTML(r) {
+		return false
+	}
+	t := errorPage(status)
+	if t == nil {
+		return false
+	}
+	var b bytes.Buffer
+	err := t.Execute(&b, struct {
+		Status     int
+		StatusText string
+		Message    string
+	}{status, http.StatusText(status), msg})
+	if err != nil {
+		noticef(levelError, "failed to render error page: %s", err.Error())
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write(b.Bytes())
+	return true
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// readFromRecorder is a response writer recording the readers its ReadFrom is handed, as
+// the one of the http server passes them to the sendfile or splice of the socket.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	sources []io.Reader
+}
+
+func (rec *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	rec.sources = append(rec.sources, src)
+	return io.Copy(writerOnly{rec.ResponseRecorder}, src)
+}
+
+// spliced reports whether one of the readers is the origin socket, which the kernel can
+// splice from.
+func (rec *readFromRecorder) spliced() bool {
+	for _, src := range rec.sources {
+		if lr, ok := src.(*io.LimitedReader); ok {
+			src = lr.R
+		}
+		if _, ok := src.(*net.TCPConn); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSpliceThroughHandlerChain(t *testing.T) {
+	newOpenlistStub(t)
+	setFlags(t, map[string]string{"splice": "true", "disable-sign": "true"})
+	// a browser-like Accept makes the error pages wrap the writer as for every request
+	r := httptest.NewRequest(http.MethodGet, "/file.bin", nil)
+	r.Header.Set("Accept", "text/html,*/*")
+	rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	newHandler().ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("answered %d: %s", rec.Code, rec.Body)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), []byte(stubFile)) {
+		t.Fatalf("sent %d bytes, expected the %d of the file", rec.Body.Len(), len(stubFile))
+	}
+	if !rec.spliced() {
+		types := make([]string, len(rec.sources))
+		for i, src := range rec.sources {
+			types[i] = fmt.Sprintf("%T", src)
+		}
+		t.Errorf("the origin socket never reached the ReadFrom of the server, got %v", types)
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+var (
+	sentryDSN           string
+	sentryEnvironment   string
+	errorWebhookURL     string
+	errorReportInterval time.Duration
+)
+
+func init() {
+	CommandLine.StringVar(&sentryDSN, "sentry-dsn", "", "sentry `dsn` panics and 5xx errors of the proxy are reported to, empty reports nothing")
+	CommandLine.StringVar(&sentryEnvironment, "sentry-environment", "", "environment tagging the sentry reports, e.g. production")
+	CommandLine.StringVar(&errorWebhookURL, "error-webhook", "", "`url` panics and 5xx errors of the proxy are posted to as json, signed with -webhook-secret")
+	CommandLine.DurationVar(&errorReportInterval, "error-report-interval", time.Minute, "min time between two reports of the same kind of error, the ones between are counted")
+}
+
+// errorReportQueueSize bounds the reports waiting for -error-webhook, more are dropped.
+const errorReportQueueSize = 100
+
+// errorReport is a panic or 5xx error with the context of its request.
+type errorReport struct {
+	Time time.Time `json:"time"`
+	// Kind is panic, openlist_api (unexpected openlist responses), origin_tls or error.
+	Kind      string `json:"kind"`
+	Status    int    `json:"status"`
+	Message   string `json:"message"`
+	Method    string `json:"method"`
+	Host      string `json:"host"`
+	Path      string `json:"path"`
+	RequestID string `json:"request_id"`
+	ClientIP  string `json:"client_ip"`
+	Version   string `json:"version"`
+	Stack     string `json:"stack,omitempty"`
+	// Suppressed counts the reports of the kind left out since the last one.
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+var errorReports = struct {
+	sync.Mutex
+	queue chan []byte
+	// last is when a report of a key was sent, suppressed how many were left out since
+	last       map[string]time.Time
+	suppressed map[string]int
+}{last: map[string]time.Time{}, suppressed: map[string]int{}}
+
+func errorReporting() bool {
+	return sentryDSN != "" || errorWebhookURL != ""
+}
+
+func setupErrorReporting() error {
+	if sentryDSN != "" {
+		err := sentry.Init(sentry.ClientOptions{
+			Dsn:         sentryDSN,
+			Environment: sentryEnvironment,
+			Release:     "openlist-proxy@" + Version,
+		})
+		if err != nil {
+			return fmt.Errorf("invalid -sentry-dsn: %w", err)
+		}
+	}
+	if errorWebhookURL != "" {
+		errorReports.queue = make(chan []byte, errorReportQueueSize)
+		go func() {
+			for b := range errorReports.queue {
+				deliverWebhook(errorWebhookURL, b)
+			}
+		}()
+	}
+	if errorReporting() {
+		AddHooks(Hooks{OnError: func(r *http.Request, code int, msg string) {
+			if code >= 500 && !getRequestInfo(r).errorReported {
+				reportError(r, errorKind(msg), code, msg, "")
+			}
+		}})
+	}
+	return nil
+}
+
+// errorKind classifies the message of an error answered to a client.
+func errorKind(msg string) string {
+	switch {
+	case strings.Contains(msg, "unexpected response from") && strings.Contains(msg, "openlist"):
+		return "openlist_api"
+	case strings.Contains(msg, "tls:") || strings.Contains(msg, "x509:"):
+		return "origin_tls"
+	}
+	return "error"
+}
+
+// reportError reports an error of r to sentry and -error-webhook, unless one of its kind and
+// message was reported less than -error-report-interval ago.
+func reportError(r *http.Request, kind string, status int, msg, stack string) {
+	if !errorReporting() {
+		return
+	}
+	getRequestInfo(r).errorReported = true
+	key := kind + "\xff" + msg
+	errorReports.Lock()
+	if time.Since(errorReports.last[key]) < errorReportInterval {
+		errorReports.suppressed[key]++
+		errorReports.Unlock()
+		return
+	}
+	suppressed := errorReports.suppressed[key]
+	errorReports.last[key] = time.Now()
+	delete(errorReports.suppressed, key)
+	if len(errorReports.last) > 10000 {
+		// forget the keys of the past interval rather than grow without bound
+		for k, t := range errorReports.last {
+			if time.Since(t) >= errorReportInterval {
+				delete(errorReports.last, k)
+			}
+		}
+	}
+	errorReports.Unlock()
+	report := errorReport{
+		Time:       time.Now(),
+		Kind:       kind,
+		Status:     status,
+		Message:    msg,
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		RequestID:  getRequestInfo(r).id,
+		ClientIP:   clientIP(r),
+		Version:    Version,
+		Stack:      stack,
+		Suppressed: suppressed,
+	}
+	if sentryDSN != "" {
+		sentry.CaptureEvent(report.sentryEvent())
+	}
+	if errorReports.queue != nil {
+		b, _ := json.Marshal(report)
+		select {
+		case errorReports.queue <- b:
+		default:
+		}
+	}
+}
+
+// flushErrorReports waits a little for the sentry reports in flight when stopping.
+func flushErrorReports() {
+	if sentryDSN != "" {
+		sentry.Flush(2 * time.Second)
+	}
+}
+
+func (e *errorReport) sentryEvent() *sentry.Event {
+	ev := sentry.NewEvent()
+	ev.Level = sentry.LevelError
+	ev.Message = e.Message
+	ev.Timestamp = e.Time
+	ev.Tags = map[string]string{"kind": e.Kind, "status": fmt.Sprint(e.Status), "request_id": e.RequestID}
+	// the query may hold signs and the headers credentials, neither is sent
+	ev.Request = &sentry.Request{Method: e.Method, URL: "http://" + e.Host + e.Path}
+	ev.User = sentry.User{IPAddress: e.ClientIP}
+	ev.Extra = map[string]any{"suppressed": e.Suppressed}
+	if e.Kind == "panic" {
+		ev.Exception = []sentry.Exception{{Type: "panic", Value: e.Message, Stacktrace: sentry.NewStacktrace()}}
+	}
+	return ev
+}
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/segmentio/kafka-go"
+)
+
+var (
+	eventsURL    string
+	eventsBatch  int
+	eventsFlush  time.Duration
+	eventsBuffer int
+)
+
+func init() {
+	CommandLine.StringVar(&eventsURL, "events-url", "", "stream an event of every request to nats://host:4222/subject (jetstream) or kafka://broker1:9092,broker2:9092/topic, "+
+		"delivered at least once")
+	CommandLine.IntVar(&eventsBatch, "events-batch", 100, "max events published together to -events-url")
+	CommandLine.DurationVar(&eventsFlush, "events-flush", time.Second, "how long events wait for a full batch before they are published")
+	CommandLine.IntVar(&eventsBuffer, "events-buffer", 100000, "events kept while -events-url is unreachable, newer ones are dropped")
+}
+
+var eventsTotal = newCounterVec("openlist_proxy_events_total", "Request events of -events-url, by result published, dropped (buffer full) or retried (batches).", "result")
+
+// requestEvent is the event of a request streamed to -events-url.
+type requestEvent struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration int64     `json:"duration"`
+	ClientIP string    `json:"client_ip"`
+	Client   string    `json:"client"`
+	// Outcome is the outcome of a proxied transfer: completed, aborted or upstream_error.
+	Outcome   string `json:"outcome,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// event is a queued event, its key keeps the events of a client in order on kafka.
+type event struct {
+	key  string
+	data []byte
+}
+
+// eventSink publishes batches to a broker, returning once the broker stored all of them.
+type eventSink interface {
+	publish(ctx context.Context, batch []event) error
+	close()
+}
+
+var (
+	eventQueue  chan event
+	eventsDone  chan struct{}
+	eventsClose context.CancelFunc
+)
+
+func setupEvents() error {
+	if eventsURL == "" {
+		return nil
+	}
+	if eventsBatch < 1 || eventsBuffer < 1 {
+		return errors.New("-events-batch and -events-buffer must be at least 1")
+	}
+	sink, err := newEventSink(eventsURL)
+	if err != nil {
+		return fmt.Errorf("invalid -events-url: %w", err)
+	}
+	eventQueue = make(chan event, eventsBuffer)
+	eventsDone = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	eventsClose = cancel
+	go runEvents(ctx, sink)
+	return nil
+}
+
+func newEventSink(rawURL string) (eventSink, error) {
+	scheme, rest, _ := strings.Cut(rawURL, "://")
+	hosts, name, _ := strings.Cut(rest, "/")
+	if hosts == "" || name == "" {
+		return nil, errors.New("expected nats://host:port/subject or kafka://broker:port/topic")
+	}
+	switch scheme {
+	case "nats", "tls":
+		// the url may hold credentials; events wait in the buffer until the server is reachable
+		nc, err := nats.Connect(scheme+"://"+hosts, nats.Name("openlist-proxy"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+		if err != nil {
+			return nil, err
+		}
+		js, err := jetstream.New(nc)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		return &natsSink{nc: nc, js: js, subject: name}, nil
+	case "kafka":
+		return &kafkaSink{w: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(hosts, ",")...),
+			Topic:        name,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchSize:    eventsBatch,
+			BatchTimeout: time.Millisecond,
+		}}, nil
+	}
+	return nil, fmt.Errorf("unknown scheme %q, expected nats or kafka", scheme)
+}
+
+// runEvents publishes the queued events in batches, retrying a failed batch until it is
+// stored, and drains the queue once ctx is done.
+func runEvents(ctx context.Context, sink eventSink) {
+	defer close(eventsDone)
+	defer sink.close()
+	batch := make([]event, 0, eventsBatch)
+	timer := time.NewTimer(eventsFlush)
+	flush := func() {
+		delay := time.Second
+		for len(batch) > 0 {
+			pctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+			err := sink.publish(pctx, batch)
+			cancel()
+			if err == nil {
+				eventsTotal.add(float64(len(batch)), "published")
+				batch = batch[:0]
+				break
+			}
+			eventsTotal.inc("retried")
+			logf(levelError, "failed to publish %d events, retrying in %s: %s", len(batch), delay, err.Error())
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			delay = min(delay*2, 30*time.Second)
+		}
+		timer.Reset(eventsFlush)
+	}
+	for {
+		select {
+		case e := <-eventQueue:
+			if batch = append(batch, e); len(batch) >= eventsBatch {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		case <-ctx.Done():
+			// one attempt for what is left, the process is stopping
+			for len(eventQueue) > 0 || len(batch) > 0 {
+				for len(batch) < eventsBatch && len(eventQueue) > 0 {
+					batch = append(batch, <-eventQueue)
+				}
+				pctx, cancel := context.WithTimeout(context.Background(), apiTimeout)
+				if err := sink.publish(pctx, batch); err != nil {
+					logf(levelError, "failed to publish %d events when stopping: %s", len(batch), err.Error())
+				}
+				cancel()
+				batch = batch[:0]
+			}
+			return
+		}
+	}
+}
+
+// publishRequestEvent queues the event of a served request.
+func publishRequestEvent(r *http.Request, status int, bytes int64, start time.Time) {
+	if eventQueue == nil {
+		return
+	}
+	client := clientIdentity(r)
+	b, _ := json.Marshal(requestEvent{
+		Time:      start,
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+		Status:    status,
+		Bytes:     bytes,
+		Duration:  time.Since(start).Milliseconds(),
+		ClientIP:  clientIP(r),
+		Client:    client,
+		Outcome:   getRequestInfo(r).outcome,
+		UserAgent: r.UserAgent(),
+	})
+	select {
+	case eventQueue <- event{key: client, data: b}:
+	default:
+		eventsTotal.inc("dropped")
+	}
+}
+
+// closeEvents publishes the queued events when stopping.
+func closeEvents() {
+	if eventsClose != nil {
+		eventsClose()
+		<-eventsDone
+	}
+}
+
+type natsSink struct {
+	nc      *nats.Conn
+	js      jetstream.JetStream
+	subject string
+}
+
+func (s *natsSink) publish(ctx context.Context, batch []event) error {
+	futures := make([]jetstream.PubAckFuture, 0, len(batch))
+	for _, e := range batch {
+		f, err := s.js.PublishAsync(s.subject, e.data)
+		if err != nil {
+			return err
+		}
+		futures = append(futures, f)
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Ok():
+		case err := <-f.Err():
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *natsSink) close() {
+	s.nc.Close()
+}
+
+type kafkaSink struct {
+	w *kafka.Writer
+}
+
+func (s *kafkaSink) publish(ctx context.Context, batch []event) error {
+	msgs := make([]kafka.Message, len(batch))
+	for i, e := range batch {
+		msgs[i] = kafka.Message{Key: []byte(e.key), Value: e.data}
+	}
+	return s.w.WriteMessages(ctx, msgs...)
+}
+
+func (s *kafkaSink) close() {
+	_ = s.w.Close()
+}
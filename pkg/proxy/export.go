@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+func init() {
+	commands["export"] = command{
+		usage: "export [-o file] writes the proxy-local state of -state-store as json",
+		run:   exportState,
+	}
+	commands["import"] = command{
+		usage: "import [file] restores proxy-local state exported before into -state-store, stop the proxy first",
+		run:   importState,
+	}
+}
+
+// stateSections maps every persisted state section to a constructor of its value,
+// used to validate imported data.
+var stateSections = map[string]func() any{}
+
+func registerState(name string, newValue func() any) {
+	stateSections[name] = newValue
+}
+
+const stateFormat = 1
+
+type stateExport struct {
+	Format   int                        `json:"format"`
+	Version  string                     `json:"version"`
+	Sections map[string]json.RawMessage `json:"sections"`
+}
+
+func exportState(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "output file, defaults to stdout")
+	_ = fs.Parse(args)
+	if dataDir == "" && stateStoreKind != "redis" {
+		return errors.New("-data-dir is required")
+	}
+	export := stateExport{Format: stateFormat, Version: Version, Sections: map[string]json.RawMessage{}}
+	names := make([]string, 0, len(stateSections))
+	for name := range stateSections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	store, err := stateStore()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		b, err := store.get(name)
+		if err != nil {
+			return err
+		}
+		if b != nil {
+			export.Sections[name] = b
+		}
+	}
+	b, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(append(b, '\n'))
+		return err
+	}
+	return os.WriteFile(*out, b, 0o600)
+}
+
+func importState(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if dataDir == "" && stateStoreKind != "redis" {
+		return errors.New("-data-dir is required")
+	}
+	var in io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		in = f
+	}
+	var export stateExport
+	if err := json.NewDecoder(in).Decode(&export); err != nil {
+		return fmt.Errorf("invalid export: %w", err)
+	}
+	if export.Format != stateFormat {
+		return fmt.Errorf("unsupported export format %d", export.Format)
+	}
+	values := map[string]any{}
+	for name, raw := range export.Sections {
+		newValue, ok := stateSections[name]
+		if !ok {
+			return fmt.Errorf("unknown state section %q", name)
+		}
+		v := newValue()
+		if err := json.Unmarshal(raw, v); err != nil {
+			return fmt.Errorf("invalid state section %q: %w", name, err)
+		}
+		values[name] = v
+	}
+	for name, v := range values {
+		if err := saveState(name, v); err != nil {
+			return err
+		}
+		fmt.Printf("imported %s\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net/http"
+)
+
+var (
+	maxFileSize     byteSize
+	maxTransferSize byteSize
+)
+
+func init() {
+	CommandLine.Var(&maxFileSize, "max-file-size", "max `size` of the files served, larger ones are answered 403 by their length, "+
+		"or cut off there when the origin does not tell it; 0 is unlimited")
+	CommandLine.Var(&maxTransferSize, "max-transfer-size", "max `size` a single response sends, it is cut off there, ranges of larger files still being served; 0 is unlimited")
+}
+
+var sizeLimitedTotal = newCounterVec("openlist_proxy_size_limited_total", "Downloads stopped by -max-file-size or -max-transfer-size, by limit and action (rejected, truncated).", "limit", "action")
+
+var (
+	errFileTooLarge     = errors.New("file larger than -max-file-size")
+	errTransferTooLarge = errors.New("transfer larger than -max-transfer-size")
+)
+
+// fileSizeAllowed answers downloads of files larger than -max-file-size with 403 and
+// reports whether size is within it. Negative sizes are unknown.
+func fileSizeAllowed(w http.ResponseWriter, r *http.Request, size int64) bool {
+	if maxFileSize <= 0 || size <= int64(maxFileSize) {
+		return true
+	}
+	sizeLimitedTotal.inc("file", "rejected")
+	logf(levelInfo, "refused %s of %d bytes, larger than -max-file-size", r.URL.Path, size)
+	errorResponse(w, http.StatusForbidden, errFileTooLarge.Error())
+	return false
+}
+
+// responseFileSize returns the size of the whole file res is about, -1 if unknown.
+func responseFileSize(res *http.Response) int64 {
+	if _, _, size, ok := parseContentRangeSize(res.Header.Get("Content-Range")); ok {
+		return size
+	}
+	if res.StatusCode == http.StatusOK {
+		return res.ContentLength
+	}
+	return -1
+}
+
+// limitFileSize checks an origin response against -max-file-size, cutting off bodies of
+// unknown size there, and reports whether it may be served.
+func limitFileSize(w http.ResponseWriter, r *http.Request, res *http.Response) bool {
+	if maxFileSize <= 0 || res.StatusCode/100 != 2 {
+		return true
+	}
+	size := responseFileSize(res)
+	if size < 0 && res.StatusCode == http.StatusOK {
+		res.Body = &sizeLimitBody{ReadCloser: res.Body, left: int64(maxFileSize)}
+		return true
+	}
+	return fileSizeAllowed(w, r, size)
+}
+
+// sizeLimitBody fails a body of unknown length once it passed -max-file-size.
+type sizeLimitBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *sizeLimitBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, errFileTooLarge
+	}
+	n, err := b.ReadCloser.Read(p[:min(int64(len(p)), b.left+1)])
+	if b.left -= int64(n); b.left < 0 {
+		sizeLimitedTotal.inc("file", "truncated")
+		return n - 1, errFileTooLarge
+	}
+	return n, err
+}
+
+// limitTransfer cuts responses off at -max-transfer-size, from the cache, peers and origins alike.
+func limitTransfer(w http.ResponseWriter) http.ResponseWriter {
+	if maxTransferSize <= 0 {
+		return w
+	}
+	return &transferLimitWriter{ResponseWriter: w, left: int64(maxTransferSize)}
+}
+
+type transferLimitWriter struct {
+	http.ResponseWriter
+	left int64
+}
+
+func (tw *transferLimitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= tw.left {
+		n, err := tw.ResponseWriter.Write(p)
+		tw.left -= int64(n)
+		return n, err
+	}
+	n, err := tw.ResponseWriter.Write(p[:tw.left])
+	tw.left -= int64(n)
+	if err == nil {
+		sizeLimitedTotal.inc("transfer", "truncated")
+		err = errTransferTooLarge
+	}
+	return n, err
+}
+
+// ReadFrom keeps the zero-copy path of -splice open, handing on at most what is left of the
+// allowance. The limit of a *io.LimitedReader is narrowed in place rather than wrapped, as
+// net.TCPConn only splices from a connection behind a single one.
+func (tw *transferLimitWriter) ReadFrom(src io.Reader) (int64, error) {
+	lr, ok := src.(*io.LimitedReader)
+	if !ok {
+		lr = &io.LimitedReader{R: src, N: math.MaxInt64}
+	}
+	n, err := readFrom(tw.ResponseWriter, &io.LimitedReader{R: lr.R, N: min(lr.N, tw.left)})
+	lr.N -= n
+	tw.left -= n
+	if err != nil || tw.left > 0 || lr.N <= 0 {
+		return n, err
+	}
+	// a single byte more tells that the response is cut off
+	if m, _ := lr.Read(make([]byte, 1)); m > 0 {
+		sizeLimitedTotal.inc("transfer", "truncated")
+		err = errTransferTooLarge
+	}
+	return n, err
+}
+
+func (tw *transferLimitWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
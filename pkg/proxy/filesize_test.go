@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSpliceMaxTransferSize(t *testing.T) {
+	newOpenlistStub(t)
+	// beyond what the header parsing buffers, which is written before the socket is spliced
+	setFlags(t, map[string]string{"splice": "true", "disable-sign": "true", "max-transfer-size": "100000"})
+	rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	newHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file.bin", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("answered %d", rec.Code)
+	}
+	if rec.Body.String() != stubFile[:100000] {
+		t.Errorf("sent %d bytes, expected the first 100000 of the file", rec.Body.Len())
+	}
+	if !rec.spliced() {
+		t.Error("the origin socket never reached the ReadFrom of the server")
+	}
+}
+
+func TestTransferLimitWriterReadFrom(t *testing.T) {
+	setFlags(t, map[string]string{"max-transfer-size": "10"})
+	for _, tc := range []struct {
+		name string
+		src  func() io.Reader
+		sent string
+		err  error
+	}{
+		{"shorter", func() io.Reader { return strings.NewReader("0123") }, "0123", nil},
+		{"exact", func() io.Reader { return strings.NewReader("0123456789") }, "0123456789", nil},
+		{"longer", func() io.Reader { return strings.NewReader("0123456789abc") }, "0123456789", errTransferTooLarge},
+		{"limited to the allowance", func() io.Reader {
+			return &io.LimitedReader{R: strings.NewReader("0123456789abc"), N: 10}
+		}, "0123456789", nil},
+		{"limited beyond the allowance", func() io.Reader {
+			return &io.LimitedReader{R: strings.NewReader("0123456789abc"), N: 12}
+		}, "0123456789", errTransferTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+			w := limitTransfer(rec)
+			n, err := w.(io.ReaderFrom).ReadFrom(tc.src())
+			if !errors.Is(err, tc.err) {
+				t.Errorf("failed with %v, expected %v", err, tc.err)
+			}
+			if rec.Body.String() != tc.sent || n != int64(len(tc.sent)) {
+				t.Errorf("sent %q, reported %d, expected %q", rec.Body, n, tc.sent)
+			}
+			if _, ok := rec.sources[0].(*io.LimitedReader); !ok || len(rec.sources) != 1 {
+				t.Errorf("handed on %d readers, expected a single *io.LimitedReader", len(rec.sources))
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var allowTypes, denyTypes stringList
+
+func init() {
+	CommandLine.Var(&allowTypes, "allow-type", "only serve files of these comma separated extensions or mime types, e.g. video/*,audio/*,.mkv, "+
+		"optionally followed by =message for the 403 of the others, repeatable")
+	CommandLine.Var(&denyTypes, "deny-type", "refuse files of these comma separated extensions or mime types with 403, e.g. .exe,.iso=no installers here, "+
+		"repeatable, takes precedence over -allow-type")
+}
+
+var fileTypeRejected = newCounterVec("openlist_proxy_file_type_rejected_total", "Downloads refused by -deny-type or -allow-type rules, by rule.", "rule")
+
+// typeRule is a -allow-type or -deny-type value: extensions like .exe and mime types like
+// video/* or application/pdf.
+type typeRule struct {
+	spec     string
+	patterns []string
+	message  string
+}
+
+var typeAllowRules, typeDenyRules []typeRule
+
+func parseTypeRules(values []string, flagName string) ([]typeRule, error) {
+	rules := make([]typeRule, 0, len(values))
+	for _, v := range values {
+		list, message, _ := strings.Cut(v, "=")
+		rule := typeRule{spec: strings.TrimSpace(list), message: strings.TrimSpace(message)}
+		for _, p := range strings.Split(list, ",") {
+			p = strings.ToLower(strings.TrimSpace(p))
+			switch {
+			case p == "":
+				continue
+			case strings.HasPrefix(p, "."):
+			case strings.Count(p, "/") == 1 && !strings.HasPrefix(p, "/") && !strings.HasSuffix(p, "/"):
+			default:
+				return nil, fmt.Errorf("invalid %s pattern %q, neither an extension like .exe nor a mime type like video/*", flagName, p)
+			}
+			rule.patterns = append(rule.patterns, p)
+		}
+		if len(rule.patterns) == 0 {
+			return nil, fmt.Errorf("-%s %q names no type", flagName, v)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func setupFileTypeRules() error {
+	var err error
+	if typeAllowRules, err = parseTypeRules(allowTypes, "allow-type"); err != nil {
+		return err
+	}
+	typeDenyRules, err = parseTypeRules(denyTypes, "deny-type")
+	return err
+}
+
+// matches reports whether the extension or one of the mime types of a file is in the rule.
+func (t *typeRule) matches(ext string, types []string) bool {
+	for _, p := range t.patterns {
+		if strings.HasPrefix(p, ".") {
+			if p == ext {
+				return true
+			}
+			continue
+		}
+		for _, ct := range types {
+			if p == ct || strings.HasSuffix(p, "/*") && strings.HasPrefix(ct, p[:len(p)-1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fileTypeDenied checks filePath against the type rules, by its extension, the mime type of
+// the extension and contentType, the type the origin or the cache tells, empty while not
+// known yet. The allow rules only refuse once final, when no other type is to come.
+func fileTypeDenied(filePath, contentType string, final bool) (string, bool) {
+	if len(typeAllowRules) == 0 && len(typeDenyRules) == 0 {
+		return "", false
+	}
+	ext := strings.ToLower(path.Ext(filePath))
+	var types []string
+	if t, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+		types = append(types, t)
+	}
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		types = append(types, t)
+	}
+	for i := range typeDenyRules {
+		if rule := &typeDenyRules[i]; rule.matches(ext, types) {
+			fileTypeRejected.inc(rule.spec)
+			return cmp.Or(rule.message, "file type not allowed"), true
+		}
+	}
+	if len(typeAllowRules) == 0 {
+		return "", false
+	}
+	message := ""
+	for i := range typeAllowRules {
+		rule := &typeAllowRules[i]
+		if rule.matches(ext, types) {
+			return "", false
+		}
+		if message == "" {
+			message = rule.message
+		}
+	}
+	if !final {
+		return "", false
+	}
+	fileTypeRejected.inc("allow")
+	return cmp.Or(message, "file type not allowed"), true
+}
+
+// fileTypeAllowed answers the downloads fileTypeDenied refuses with 403 and reports whether
+// filePath may be served.
+func fileTypeAllowed(w http.ResponseWriter, filePath, contentType string, final bool) bool {
+	message, denied := fileTypeDenied(filePath, contentType, final)
+	if denied {
+		errorResponse(w, http.StatusForbidden, message)
+	}
+	return !denied
+}
@@ -0,0 +1,15 @@
+package proxy
+
+import "strings"
+
+// stringList is a flag value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
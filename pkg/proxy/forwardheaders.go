@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	forwardHeaders     string
+	passthroughHeaders stringList
+)
+
+func init() {
+	CommandLine.StringVar(&forwardHeaders, "forward-headers", "Range,If-Range,Accept,User-Agent", "comma separated client request headers forwarded to origins, "+
+		"the others such as Cookie, Authorization and X-Forwarded-For stay with the proxy")
+	CommandLine.Var(&passthroughHeaders, "passthrough-header", "`name` of a client request header forwarded to origins besides -forward-headers, repeatable, "+
+		"* forwards all of them")
+}
+
+// forwardedHeaders are the canonical names of the client headers sent to origins, nil when
+// all of them are.
+var forwardedHeaders []string
+
+func setupForwardHeaders() {
+	names := append(strings.Split(forwardHeaders, ","), passthroughHeaders...)
+	forwardedHeaders = []string{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "*" {
+			forwardedHeaders = nil
+			return
+		}
+		if name = http.CanonicalHeaderKey(name); name != "" && !slices.Contains(forwardedHeaders, name) {
+			forwardedHeaders = append(forwardedHeaders, name)
+		}
+	}
+}
+
+// forwardClientHeaders copies the headers of the client request r that origins may see to
+// the origin request req: the forwarded ones and those the matching policies set or added.
+func forwardClientHeaders(req, r *http.Request) {
+	if forwardedHeaders == nil {
+		maps.Copy(req.Header, r.Header)
+		return
+	}
+	for _, names := range [][]string{forwardedHeaders, getRequestInfo(r).policyHeaders} {
+		for _, name := range names {
+			if v, ok := r.Header[name]; ok {
+				req.Header[name] = v
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var (
+	geoIPDB         string
+	geoAllow        stringList
+	geoDeny         stringList
+	geoBypassCIDRs  stringList
+	geoAllowUnknown bool
+)
+
+var (
+	geoReader             *maxminddb.Reader
+	geoAllowed, geoDenied map[string]bool
+	geoBypass             []netip.Prefix
+
+	geoBlockedTotal = newCounterVec("openlist_proxy_geo_blocked_total", "Requests rejected by geoip access control, by country code.", "country")
+)
+
+func init() {
+	CommandLine.StringVar(&geoIPDB, "geoip-db", "", "maxmind geolite2/geoip2 country or city database `file` enabling geoip access control")
+	CommandLine.Var(&geoAllow, "geo-allow", "only allow clients from these ISO country codes, comma separated, repeatable")
+	CommandLine.Var(&geoDeny, "geo-deny", "reject clients from these ISO country codes, comma separated, repeatable")
+	CommandLine.Var(&geoBypassCIDRs, "geo-bypass-cidr", "cidr or ip never subject to geoip access control, repeatable")
+	CommandLine.BoolVar(&geoAllowUnknown, "geo-allow-unknown", false, "allow clients whose country is unknown when -geo-allow is set")
+}
+
+func countrySet(lists stringList) map[string]bool {
+	set := map[string]bool{}
+	for _, list := range lists {
+		for _, code := range strings.Split(list, ",") {
+			if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+				set[code] = true
+			}
+		}
+	}
+	return set
+}
+
+func setupGeoIP() error {
+	var err error
+	geoReader, err = maxminddb.Open(geoIPDB)
+	if err != nil {
+		return err
+	}
+	geoBypass, err = readPrefixes(geoBypassCIDRs, "")
+	if err != nil {
+		return err
+	}
+	geoAllowed, geoDenied = countrySet(geoAllow), countrySet(geoDeny)
+	return nil
+}
+
+// country returns the ISO country code of ip, empty if unknown.
+func country(ip string) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || geoReader.Lookup(parsed, &record) != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// geoAllowedIP reports whether ip passes the geoip rules and the country it was decided for.
+func geoAllowedIP(ip string) (bool, string) {
+	if addr, err := netip.ParseAddr(ip); err == nil && containsAddr(geoBypass, addr.Unmap()) {
+		return true, ""
+	}
+	code := country(ip)
+	if geoDenied[code] {
+		return false, code
+	}
+	if len(geoAllowed) > 0 && !geoAllowed[code] && !(code == "" && geoAllowUnknown) {
+		return false, code
+	}
+	return true, code
+}
+
+func geoIPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, code := geoAllowedIP(clientIP(r)); !ok {
+			geoBlockedTotal.inc(code)
+			errorResponseWithStatus(w, http.StatusForbidden, http.StatusForbidden, "access from your region is not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
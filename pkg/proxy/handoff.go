@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	upgradeTimeout time.Duration
+	pidFile        string
+)
+
+func init() {
+	CommandLine.DurationVar(&upgradeTimeout, "upgrade-timeout", time.Minute, "how long the process started by an upgrade on SIGUSR2 may take to serve "+
+		"before the running one gives up and keeps serving")
+	CommandLine.StringVar(&pidFile, "pid-file", "", "`file` the process id is written to, rewritten by the process an upgrade starts")
+}
+
+// upgradeFdsEnv lists the names of the sockets an upgrade passes to the new process, one per
+// line. They are the file descriptors from listenFdsStart on, followed by the pipe the new
+// process reports on once it serves.
+const upgradeFdsEnv = "OPENLIST_PROXY_UPGRADE_FDS"
+
+// handoffSocket is a socket passed on by upgrades.
+type handoffSocket struct {
+	name   string
+	socket interface{ File() (*os.File, error) }
+	// close stops serving on it once the new process took over, nil for the client facing
+	// listeners, which are shut down gracefully
+	close func() error
+}
+
+var handoff = struct {
+	sync.Mutex
+	once sync.Once
+	// names are the sockets passed by the process upgraded from, inherited the ones not
+	// taken yet
+	names     []string
+	inherited map[string]*os.File
+	ready     *os.File
+	sockets   []handoffSocket
+}{inherited: map[string]*os.File{}}
+
+// loadInherited takes the sockets passed by the process upgraded from out of the environment.
+func loadInherited() {
+	handoff.once.Do(func() {
+		list, ok := os.LookupEnv(upgradeFdsEnv)
+		if !ok {
+			return
+		}
+		// they describe this process only
+		_ = os.Unsetenv(upgradeFdsEnv)
+		if list != "" {
+			handoff.names = strings.Split(list, "\n")
+		}
+		for i, name := range handoff.names {
+			handoff.inherited[name] = os.NewFile(uintptr(listenFdsStart+i), name)
+		}
+		handoff.ready = os.NewFile(uintptr(listenFdsStart+len(handoff.names)), "upgrade")
+	})
+}
+
+// upgraded reports whether this process was started by an upgrade.
+func upgraded() bool {
+	loadInherited()
+	return handoff.ready != nil
+}
+
+// takeInherited returns the inherited socket named name, or nil.
+func takeInherited(name string) *os.File {
+	loadInherited()
+	handoff.Lock()
+	defer handoff.Unlock()
+	f := handoff.inherited[name]
+	delete(handoff.inherited, name)
+	return f
+}
+
+// registerHandoff notes a socket to pass on to the process of the next upgrade.
+func registerHandoff(name string, s any, closeFunc func() error) {
+	socket, ok := s.(interface{ File() (*os.File, error) })
+	if !ok {
+		return
+	}
+	handoff.Lock()
+	defer handoff.Unlock()
+	handoff.sockets = append(handoff.sockets, handoffSocket{name: name, socket: socket, close: closeFunc})
+}
+
+// handoffListen is listen for the socket named name, taken over from the process upgraded from
+// when it passed one. Sockets of the client facing listeners are registered with close nil,
+// the others are closed once an upgrade succeeded.
+func handoffListen(name, addr string, client bool) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if f := takeInherited(name); f != nil {
+		ln, err = net.FileListener(f)
+		_ = f.Close()
+	} else {
+		ln, err = listen(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var closeFunc func() error
+	if !client {
+		closeFunc = ln.Close
+	}
+	registerHandoff(name, ln, closeFunc)
+	return ln, nil
+}
+
+// handoffListenPacket is handoffListen for udp sockets.
+func handoffListenPacket(name, addr string) (net.PacketConn, error) {
+	var conn net.PacketConn
+	var err error
+	if f := takeInherited(name); f != nil {
+		conn, err = net.FilePacketConn(f)
+		_ = f.Close()
+	} else {
+		conn, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	registerHandoff(name, conn, conn.Close)
+	return conn, nil
+}
+
+// inheritedSystemdListeners returns the socket activated listeners the process upgraded from
+// had inherited from systemd, which replace the addresses like they did there.
+func inheritedSystemdListeners() ([]net.Listener, []string, error) {
+	loadInherited()
+	var lns []net.Listener
+	var addrs []string
+	for _, name := range handoff.names {
+		fdName, ok := strings.CutPrefix(name, "systemd ")
+		if !ok {
+			continue
+		}
+		f := takeInherited(name)
+		if f == nil {
+			continue
+		}
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, l := range lns {
+				_ = l.Close()
+			}
+			return nil, nil, fmt.Errorf("%s: %w", fdName, err)
+		}
+		registerHandoff(name, ln, nil)
+		lns = append(lns, ln)
+		addrs = append(addrs, name+" "+ln.Addr().String())
+	}
+	return lns, addrs, nil
+}
+
+// handoffReady tells the process upgraded from that this one serves, so it stops, and closes
+// the inherited sockets no option of this one listens on anymore.
+func handoffReady() {
+	writePidFile()
+	if !upgraded() {
+		return
+	}
+	handoff.Lock()
+	for name, f := range handoff.inherited {
+		_ = f.Close()
+		delete(handoff.inherited, name)
+	}
+	handoff.Unlock()
+	if _, err := handoff.ready.Write([]byte("ready\n")); err != nil {
+		noticef(levelError, "failed to report the upgrade: %s", err.Error())
+	}
+	_ = handoff.ready.Close()
+}
+
+func writePidFile() {
+	if pidFile == "" {
+		return
+	}
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		noticef(levelError, "failed to write -pid-file: %s", err.Error())
+	}
+}
+
+// closedListener reports whether serving stopped because an upgrade closed the listener.
+func closedListener(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	headerRulesFile string
+	originHeaders   stringList
+	originUserAgent string
+)
+
+func init() {
+	CommandLine.StringVar(&headerRulesFile, "header-rules-file", "", "yaml file of rules (path, origin, request, response) adding, removing and rewriting the headers sent to origins "+
+		"and back to clients, reloaded on change or SIGHUP")
+	CommandLine.Var(&originHeaders, "origin-header", "`Name: value` header set on every origin request over the client and link headers, repeatable, "+
+		"-header-rules-file scopes them to hosts and paths")
+	CommandLine.StringVar(&originUserAgent, "origin-user-agent", "", "User-Agent sent to origins instead of the one of the client")
+}
+
+// headerRule edits the headers of downloads whose path and origin host match, every
+// matching rule applies in file order.
+type headerRule struct {
+	// Path is a path.Match pattern of the requested path, a trailing / matches everything below.
+	Path string `yaml:"path"`
+	// Origin is a pattern of the origin host such as *.example.com.
+	Origin   string      `yaml:"origin"`
+	Request  headerEdits `yaml:"request"`
+	Response headerEdits `yaml:"response"`
+}
+
+// headerEdits are applied in the order remove, set, add, rewrite.
+type headerEdits struct {
+	Remove  []string          `yaml:"remove"`
+	Set     map[string]string `yaml:"set"`
+	Add     map[string]string `yaml:"add"`
+	Rewrite []headerRewrite   `yaml:"rewrite"`
+}
+
+// headerRewrite replaces the matches of a regexp in the values of a header.
+type headerRewrite struct {
+	Name    string `yaml:"name"`
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
+
+	re *regexp.Regexp
+}
+
+var headerRules atomic.Pointer[[]*headerRule]
+
+func loadHeaderRules() error {
+	var rules []*headerRule
+	if headerRulesFile != "" {
+		b, err := os.ReadFile(headerRulesFile)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(b, &rules); err != nil {
+			return fmt.Errorf("%s: %w", headerRulesFile, err)
+		}
+		for i, rule := range rules {
+			if err := rule.setup(); err != nil {
+				return fmt.Errorf("%s: rule %d: %w", headerRulesFile, i+1, err)
+			}
+		}
+	}
+	global, err := originHeaderRule()
+	if err != nil {
+		return err
+	}
+	if global != nil {
+		// the file refines the flags, so they go first
+		rules = append([]*headerRule{global}, rules...)
+	}
+	headerRules.Store(&rules)
+	return nil
+}
+
+// originHeaderRule is the rule of -origin-header and -origin-user-agent, matching every download.
+func originHeaderRule() (*headerRule, error) {
+	if len(originHeaders) == 0 && originUserAgent == "" {
+		return nil, nil
+	}
+	set := map[string]string{}
+	for _, h := range originHeaders {
+		name, value, ok := strings.Cut(h, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return nil, fmt.Errorf("invalid -origin-header %q, expected Name: value", h)
+		}
+		set[name] = strings.TrimSpace(value)
+	}
+	if originUserAgent != "" {
+		set["User-Agent"] = originUserAgent
+	}
+	return &headerRule{Request: headerEdits{Set: set}}, nil
+}
+
+func (rule *headerRule) setup() error {
+	if _, err := path.Match(rule.Path, ""); err != nil {
+		return fmt.Errorf("invalid path %q", rule.Path)
+	}
+	if _, err := path.Match(rule.Origin, ""); err != nil {
+		return fmt.Errorf("invalid origin %q", rule.Origin)
+	}
+	if err := rule.Request.setup(); err != nil {
+		return err
+	}
+	return rule.Response.setup()
+}
+
+// setup compiles the regexps of the rewrites.
+func (e *headerEdits) setup() error {
+	for i := range e.Rewrite {
+		rw := &e.Rewrite[i]
+		re, err := regexp.Compile(rw.Match)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite of %s: %w", rw.Name, err)
+		}
+		rw.re = re
+	}
+	return nil
+}
+
+func reloadHeaderRules() {
+	if err := loadHeaderRules(); err != nil {
+		noticef(levelError, "failed to reload header rules, keeping the previous ones: %s", err.Error())
+		return
+	}
+	fmt.Println("reloaded header rules")
+}
+
+func setupHeaderRules() error {
+	if err := loadHeaderRules(); err != nil {
+		return err
+	}
+	if headerRulesFile != "" {
+		onReload(reloadHeaderRules)
+		watchFile(headerRulesFile, reloadHeaderRules)
+	}
+	return nil
+}
+
+func (rule *headerRule) matches(filePath, originHost string) bool {
+	switch {
+	case rule.Path == "":
+	case strings.HasSuffix(rule.Path, "/"):
+		if !strings.HasPrefix(filePath, rule.Path) {
+			return false
+		}
+	default:
+		if ok, _ := path.Match(rule.Path, filePath); !ok {
+			return false
+		}
+	}
+	return rule.Origin == "" || matchHost([]string{rule.Origin}, strings.ToLower(originHost))
+}
+
+func (e *headerEdits) apply(h http.Header) {
+	for _, name := range e.Remove {
+		h.Del(name)
+	}
+	for name, value := range e.Set {
+		h.Set(name, value)
+	}
+	for name, value := range e.Add {
+		h.Add(name, value)
+	}
+	for _, rw := range e.Rewrite {
+		values := h.Values(rw.Name)
+		if len(values) == 0 {
+			continue
+		}
+		rewritten := make([]string, len(values))
+		for i, v := range values {
+			rewritten[i] = rw.re.ReplaceAllString(v, rw.Replace)
+		}
+		h[http.CanonicalHeaderKey(rw.Name)] = rewritten
+	}
+}
+
+// names returns the canonical names of the headers e sets or adds.
+func (e *headerEdits) names() []string {
+	names := make([]string, 0, len(e.Set)+len(e.Add))
+	for _, m := range []map[string]string{e.Set, e.Add} {
+		for name := range m {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+func (e *headerEdits) empty() bool {
+	return len(e.Remove) == 0 && len(e.Set) == 0 && len(e.Add) == 0 && len(e.Rewrite) == 0
+}
+
+// rewritesRequestHeaders reports whether a rule edits the request to the origin at rawURL,
+// which a redirect of the client could not carry.
+func rewritesRequestHeaders(filePath, rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	for _, rule := range *headerRules.Load() {
+		if !rule.Request.empty() && rule.matches(filePath, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteRequestHeaders applies the request edits of the matching rules to a request to an origin.
+func rewriteRequestHeaders(filePath string, req *http.Request) {
+	for _, rule := range *headerRules.Load() {
+		if rule.matches(filePath, req.URL.Hostname()) {
+			rule.Request.apply(req.Header)
+		}
+	}
+}
+
+// rewriteResponseHeaders applies the response edits of the matching rules to an origin response.
+func rewriteResponseHeaders(filePath string, res *http.Response) {
+	for _, rule := range *headerRules.Load() {
+		if rule.matches(filePath, res.Request.URL.Hostname()) {
+			rule.Response.apply(res.Header)
+		}
+	}
+}
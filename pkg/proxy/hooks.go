@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var pluginFiles stringList
+
+func init() {
+	CommandLine.Var(&pluginFiles, "plugin", "go plugin `file` (.so) registering hooks with proxy.AddHooks from its init, built against the same version of the proxy, repeatable")
+}
+
+// Hooks are extension points of downloads for integrators, any of them may be nil.
+type Hooks struct {
+	// OnRequest runs first for every request of the proxy listener, after the access rules.
+	// Returning false ends the request, the hook having answered it, e.g. for custom auth.
+	OnRequest func(w http.ResponseWriter, r *http.Request) bool
+	// OnLinkResolved sees the link filePath resolved to before it is fetched or redirected
+	// to, and may change its url and headers. An error is answered instead of the download.
+	OnLinkResolved func(r *http.Request, filePath string, link *Link) error
+	// OnResponse sees the origin response before its status and headers are passed on, and
+	// may change its headers. An error is answered instead of the response.
+	OnResponse func(r *http.Request, res *http.Response) error
+	// OnError is told about every error answered to a client, with its code and message.
+	OnError func(r *http.Request, code int, msg string)
+}
+
+// HTTPError is an error of a hook answered with its code, other errors are answered with 500.
+type HTTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+var hooks []Hooks
+
+// AddHooks registers h, to be called after the hooks registered before. Hooks are
+// registered before serving starts, typically before New or from the init of a -plugin.
+func AddHooks(h Hooks) {
+	hooks = append(hooks, h)
+}
+
+// hookRequest runs the OnRequest hooks and reports whether the request goes on.
+func hookRequest(w http.ResponseWriter, r *http.Request) bool {
+	for _, h := range hooks {
+		if h.OnRequest != nil && !h.OnRequest(w, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// hookLinkResolved runs the OnLinkResolved hooks on a copy of link, which may be shared with
+// the link cache.
+func hookLinkResolved(r *http.Request, filePath string, link *Link) (*Link, error) {
+	if len(hooks) == 0 {
+		return link, nil
+	}
+	l := *link
+	l.Header = link.Header.Clone()
+	for _, h := range hooks {
+		if h.OnLinkResolved != nil {
+			if err := h.OnLinkResolved(r, filePath, &l); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &l, nil
+}
+
+func hookResponse(r *http.Request, res *http.Response) error {
+	for _, h := range hooks {
+		if h.OnResponse != nil {
+			if err := h.OnResponse(r, res); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hookError answers err of a hook.
+func hookError(w http.ResponseWriter, err error) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		errorResponse(w, httpErr.Code, httpErr.Message)
+		return
+	}
+	errorResponse(w, 500, err.Error())
+}
+
+// hookErrorResponse tells the OnError hooks about an error answered through w.
+func hookErrorResponse(w http.ResponseWriter, code int, msg string) {
+	if len(hooks) == 0 {
+		return
+	}
+	r := writerRequest(w)
+	if r == nil {
+		return
+	}
+	for _, h := range hooks {
+		if h.OnError != nil {
+			h.OnError(r, code, msg)
+		}
+	}
+}
+
+func loadPlugins() error {
+	for _, file := range pluginFiles {
+		if err := openPlugin(file); err != nil {
+			return fmt.Errorf("failed to load plugin %s: %w", file, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func init() {
+	adminMux.Handle("GET /api/hotspots", adminAuth(adminHotspots))
+}
+
+// hotspotWindows are the windows /api/hotspots can be asked for.
+var hotspotWindows = []struct {
+	name   string
+	length time.Duration
+}{{"5m", 5 * time.Minute}, {"1h", time.Hour}, {"24h", 24 * time.Hour}}
+
+// hotspotCounters counts the requests of paths, the bytes of clients and the error responses
+// of paths over one window, in the bounded memory of windowCounter.
+type hotspotCounters struct {
+	paths, clients, errors *windowCounter
+}
+
+var hotspots = func() []hotspotCounters {
+	counters := make([]hotspotCounters, len(hotspotWindows))
+	for i, w := range hotspotWindows {
+		counters[i] = hotspotCounters{newWindowCounter(w.length), newWindowCounter(w.length), newWindowCounter(w.length)}
+	}
+	return counters
+}()
+
+// recordHotspots counts a response to r in every window.
+func recordHotspots(r *http.Request, status int, bytes int64) {
+	client := clientIdentity(r)
+	for _, c := range hotspots {
+		c.paths.add(r.URL.Path, 1)
+		if bytes > 0 {
+			c.clients.add(client, bytes)
+		}
+		if status >= 400 {
+			c.errors.add(strconv.Itoa(status)+" "+r.URL.Path, 1)
+		}
+	}
+}
+
+// hotspotCount is a key of /api/hotspots with its count over the window.
+type hotspotCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+type hotspotList struct {
+	Total int64          `json:"total"`
+	Top   []hotspotCount `json:"top"`
+}
+
+type hotspotsResp struct {
+	Window string `json:"window"`
+	// Paths counts requests, Clients response bytes and Errors 4xx and 5xx responses, by
+	// status and path.
+	Paths   hotspotList `json:"paths"`
+	Clients hotspotList `json:"clients"`
+	Errors  hotspotList `json:"errors"`
+}
+
+func hotspotTop(c *windowCounter, n int) hotspotList {
+	top, total := c.top(n)
+	list := hotspotList{Total: total, Top: make([]hotspotCount, len(top))}
+	for i, k := range top {
+		list.Top[i] = hotspotCount{Key: k.Key, Count: k.Bytes}
+	}
+	return list
+}
+
+func adminHotspots(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = 10
+	}
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "1h"
+	}
+	for i, hw := range hotspotWindows {
+		if hw.name == window {
+			c := hotspots[i]
+			jsonResponse(w, hotspotsResp{Window: window, Paths: hotspotTop(c.paths, n), Clients: hotspotTop(c.clients, n), Errors: hotspotTop(c.errors, n)})
+			return
+		}
+	}
+	errorResponseWithStatus(w, http.StatusBadRequest, 400, "invalid window, expected 5m, 1h or 24h")
+}
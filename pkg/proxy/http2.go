@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+var (
+	http2Enabled      bool
+	h2c               bool
+	http2MaxStreams   int
+	http2PingInterval time.Duration
+	http2WriteTimeout time.Duration
+)
+
+func init() {
+	CommandLine.BoolVar(&http2Enabled, "http2", true, "serve http/2 to clients negotiating it over tls")
+	CommandLine.BoolVar(&h2c, "h2c", false, "also accept plaintext http/2 with prior knowledge, for load balancers terminating tls and speaking h2c to the proxy")
+	CommandLine.IntVar(&http2MaxStreams, "http2-max-streams", 250, "concurrent streams a client may open on one http/2 connection, e.g. the segments a player fetches in parallel")
+	CommandLine.DurationVar(&http2PingInterval, "http2-ping-interval", 30*time.Second, "ping http/2 connections idle this long and close them if the ping is not answered, so streams of vanished clients are freed, 0 disables")
+	CommandLine.DurationVar(&http2WriteTimeout, "http2-write-timeout", 2*time.Minute, "close http/2 connections that accept no data for this long, e.g. a client stalling its flow control window, 0 disables")
+}
+
+// configureHTTP2 sets the protocols and http/2 settings of the client facing server.
+func configureHTTP2(srv *http.Server) {
+	srv.Protocols = &http.Protocols{}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(http2Enabled)
+	srv.Protocols.SetUnencryptedHTTP2(h2c)
+	srv.HTTP2 = &http.HTTP2Config{
+		MaxConcurrentStreams: http2MaxStreams,
+		SendPingTimeout:      http2PingInterval,
+		WriteByteTimeout:     http2WriteTimeout,
+		// downloads carry almost no request bodies, small receive windows save memory per stream
+		MaxReceiveBufferPerStream: 64 << 10,
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+var (
+	http3Enabled bool
+	http3Port    int
+)
+
+func init() {
+	CommandLine.BoolVar(&http3Enabled, "http3", false, "also serve http/3 over quic on udp and advertise it with Alt-Svc, needs -https")
+	CommandLine.IntVar(&http3Port, "http3-port", 0, "udp port of the http/3 listener, 0 uses the port of the first tcp -listen or -port")
+}
+
+// startHTTP3 serves handler over quic with the certificates of the tls listener.
+func startHTTP3(tlsConfig *tls.Config, handler http.Handler) (*http3.Server, error) {
+	if !https {
+		return nil, errors.New("-http3 needs -https")
+	}
+	cfg := &tls.Config{}
+	if tlsConfig != nil {
+		cfg = tlsConfig.Clone()
+	}
+	p := http3Port
+	if p == 0 {
+		if p = httpsListenPort(); p == 0 {
+			return nil, errors.New("-http3 next to unix sockets only needs -http3-port")
+		}
+	}
+	srv := &http3.Server{
+		Addr:      fmt.Sprintf(":%d", p),
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(cfg),
+	}
+	fmt.Printf("listen and serve http/3: %s\n", srv.Addr)
+	conn, err := handoffListenPacket("http3 "+srv.Addr, srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := srv.Serve(conn); err != nil && !closedListener(err) {
+			noticef(levelError, "failed to serve http/3: %s", err.Error())
+		}
+	}()
+	return srv, nil
+}
+
+// altSvcHandler announces the http/3 listener to clients of the tcp one.
+func altSvcHandler(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			// fails only until the listener is up
+			_ = h3.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
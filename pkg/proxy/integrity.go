@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var verifyHashes bool
+
+func init() {
+	CommandLine.BoolVar(&verifyHashes, "verify-hashes", false, "check whole file downloads against the sha256, sha1 or md5 openlist knows of the file, "+
+		"logging mismatches and never caching them; costs an /api/fs/get call per download")
+}
+
+// integrityTrailer is the trailer telling clients supporting trailers how the check went,
+// such as "sha256=ok" or "sha256=mismatch".
+const integrityTrailer = "X-Content-Integrity"
+
+var integrityChecksTotal = newCounterVec("openlist_proxy_integrity_checks_total", "Downloads checked against the hashes of openlist, by result: ok, mismatch or unknown.", "result")
+
+// errIntegrity ends a body whose bytes do not match the hash of the file.
+var errIntegrity = errors.New("content does not match the hash of openlist")
+
+// hashAlgorithms are the hashes of openlist checked, strongest first.
+var hashAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+	{"md5", md5.New},
+}
+
+// fileHashes is the expected hash of a file, looked up while the origin is asked for it.
+type fileHashes struct {
+	done chan struct{}
+	algo string
+	want string
+	new  func() hash.Hash
+}
+
+// lookupHashes starts looking up the hashes of filePath for a download verifyIntegrity
+// checks, nil for the others.
+func lookupHashes(r *http.Request, filePath string) *fileHashes {
+	if !verifyHashes || r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+		return nil
+	}
+	h := &fileHashes{done: make(chan struct{})}
+	go func() {
+		defer close(h.done)
+		obj, err := statObject(filePath)
+		if err != nil {
+			logf(levelDebug, "failed to look up the hashes of %s: %s", filePath, err.Error())
+			return
+		}
+		for _, a := range hashAlgorithms {
+			if v := strings.ToLower(strings.TrimSpace(obj.HashInfo[a.name])); v != "" {
+				h.algo, h.want, h.new = a.name, v, a.new
+				return
+			}
+		}
+	}()
+	return h
+}
+
+// known waits for the lookup and reports whether openlist knows a hash of the file.
+func (h *fileHashes) known() bool {
+	<-h.done
+	return h.new != nil
+}
+
+// verifyFile checks a stored file, the cache fills the client did not read to the end.
+func (h *fileHashes) verifyFile(name string) error {
+	if !h.known() {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	sum := h.new()
+	if _, err := io.Copy(sum, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != h.want {
+		integrityChecksTotal.inc("mismatch")
+		return fmt.Errorf("%w, %s", errIntegrity, h.algo)
+	}
+	integrityChecksTotal.inc("ok")
+	return nil
+}
+
+// integrityBody hashes a whole file body and fails its end when the hash does not match.
+type integrityBody struct {
+	io.ReadCloser
+	hashes   *fileHashes
+	w        http.ResponseWriter
+	filePath string
+	sum      hash.Hash
+	started  bool
+	checked  bool
+}
+
+// verifyIntegrity makes the body of a whole file download check the bytes against
+// the hashes looked up, before teeCache so corrupt content never reaches the cache.
+func verifyIntegrity(w http.ResponseWriter, res *http.Response, filePath string, hashes *fileHashes) {
+	if hashes == nil || res.StatusCode != http.StatusOK || res.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	res.Body = &integrityBody{ReadCloser: res.Body, hashes: hashes, w: w, filePath: filePath}
+}
+
+func (b *integrityBody) Read(p []byte) (int, error) {
+	if !b.started {
+		b.started = true
+		if b.hashes.known() {
+			b.sum = b.hashes.new()
+		} else {
+			integrityChecksTotal.inc("unknown")
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.sum == nil {
+		return n, err
+	}
+	b.sum.Write(p[:n])
+	if err == io.EOF && !b.checked {
+		b.checked = true
+		if hex.EncodeToString(b.sum.Sum(nil)) != b.hashes.want {
+			integrityChecksTotal.inc("mismatch")
+			logf(levelError, "%s of %s does not match openlist, the origin served corrupt or truncated content", b.hashes.algo, b.filePath)
+			b.w.Header().Set(http.TrailerPrefix+integrityTrailer, b.hashes.algo+"=mismatch")
+			return n, fmt.Errorf("%w, %s", errIntegrity, b.hashes.algo)
+		}
+		integrityChecksTotal.inc("ok")
+		b.w.Header().Set(http.TrailerPrefix+integrityTrailer, b.hashes.algo+"=ok")
+	}
+	return n, err
+}
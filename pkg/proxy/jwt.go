@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	jwtSecret      string
+	jwtJWKSURL     string
+	jwtJWKSRefresh time.Duration
+	jwtIssuer      string
+	jwtAudience    string
+	jwtPathClaim   string
+	jwtRequired    bool
+)
+
+func init() {
+	CommandLine.StringVar(&jwtSecret, "jwt-secret", "", "shared secret accepting HS256/384/512 signed jwt bearer tokens instead of path signs")
+	CommandLine.StringVar(&jwtJWKSURL, "jwt-jwks-url", "", "jwks url accepting RS, PS, ES and EdDSA signed jwt bearer tokens instead of path signs")
+	CommandLine.DurationVar(&jwtJWKSRefresh, "jwt-jwks-refresh", time.Hour, "how often the -jwt-jwks-url keys are refetched")
+	CommandLine.StringVar(&jwtIssuer, "jwt-issuer", "", "required iss claim of jwt bearer tokens")
+	CommandLine.StringVar(&jwtAudience, "jwt-audience", "", "required aud claim of jwt bearer tokens")
+	CommandLine.StringVar(&jwtPathClaim, "jwt-path-claim", "paths", "claim listing the path prefixes a jwt grants access to, tokens without it may access any path")
+	CommandLine.BoolVar(&jwtRequired, "jwt-required", false, "require a jwt bearer token on every download, path signs are no longer accepted")
+}
+
+func jwtEnabled() bool {
+	return jwtSecret != "" || jwtJWKSURL != ""
+}
+
+// bearerToken returns the bearer token of r, if it has one.
+func bearerToken(r *http.Request) (string, bool) {
+	t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return t, ok && t != ""
+}
+
+func setupJWT() error {
+	if jwtRequired && !jwtEnabled() {
+		return errors.New("-jwt-required needs -jwt-secret or -jwt-jwks-url")
+	}
+	if jwtJWKSURL == "" {
+		return nil
+	}
+	jwks.url = jwtJWKSURL
+	if err := jwks.refresh(); err != nil {
+		noticef(levelWarn, "warning: failed to fetch jwks: %s", err.Error())
+	}
+	go func() {
+		for range time.Tick(jwtJWKSRefresh) {
+			if err := jwks.refresh(); err != nil {
+				noticef(levelError, "failed to refresh jwks: %s", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// verifyJWT checks a bearer token for filePath and returns its claims, or the error code to
+// report on failure: 403 for expired tokens or paths outside the granted prefixes, 401 otherwise.
+func verifyJWT(raw, filePath string) (jwt.MapClaims, int, error) {
+	var methods []string
+	if jwtSecret != "" {
+		methods = append(methods, "HS256", "HS384", "HS512")
+	}
+	if jwtJWKSURL != "" {
+		methods = append(methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA")
+	}
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired()}
+	if jwtIssuer != "" {
+		opts = append(opts, jwt.WithIssuer(jwtIssuer))
+	}
+	if jwtAudience != "" {
+		opts = append(opts, jwt.WithAudience(jwtAudience))
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.NewParser(opts...).ParseWithClaims(raw, claims, jwtKey)
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, 403, err
+	}
+	if err != nil {
+		return nil, 401, err
+	}
+	prefixes, ok, err := claimStrings(claims, jwtPathClaim)
+	if err != nil {
+		return nil, 401, err
+	}
+	if !ok {
+		return claims, 0, nil
+	}
+	for _, prefix := range prefixes {
+		if pathWithin(filePath, prefix) {
+			return claims, 0, nil
+		}
+	}
+	return nil, 403, errors.New("token does not grant access to this path")
+}
+
+func jwtKey(t *jwt.Token) (any, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		return []byte(jwtSecret), nil
+	}
+	kid, _ := t.Header["kid"].(string)
+	return jwks.key(kid)
+}
+
+// claimStrings returns a claim holding a string or a list of strings.
+func claimStrings(claims jwt.MapClaims, name string) ([]string, bool, error) {
+	v, ok := claims[name]
+	if !ok {
+		return nil, false, nil
+	}
+	switch v := v.(type) {
+	case string:
+		return []string{v}, true, nil
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, true, fmt.Errorf("invalid %s claim", name)
+			}
+			list = append(list, s)
+		}
+		return list, true, nil
+	}
+	return nil, true, fmt.Errorf("invalid %s claim", name)
+}
+
+// pathWithin reports whether p is prefix or below it, on path segment boundaries.
+func pathWithin(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// jwkSet caches the public keys of a jwks url by key id.
+type jwkSet struct {
+	url     string
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// jwks holds the keys of -jwt-jwks-url.
+var jwks = &jwkSet{}
+
+// jwksMinRefresh limits refetches triggered by unknown key ids.
+const jwksMinRefresh = time.Minute
+
+func (ks *jwkSet) key(kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	key, ok := ks.keys[kid]
+	stale := time.Since(ks.fetched) > jwksMinRefresh
+	ks.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if stale {
+		// the issuer may have rotated its keys
+		if err := ks.refresh(); err != nil {
+			return nil, err
+		}
+		ks.mu.Lock()
+		key, ok = ks.keys[kid]
+		ks.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (ks *jwkSet) refresh() error {
+	ks.mu.Lock()
+	ks.fetched = time.Now()
+	ks.mu.Unlock()
+	res, err := apiClient.Get(ks.url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks responded %s", res.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, res.Body, maxAPIResponseSize)).Decode(&set); err != nil {
+		return err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			noticef(levelWarn, "warning: skipping jwks key %q: %s", k.Kid, err.Error())
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
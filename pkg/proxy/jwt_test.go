@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testJWTSecret   = "jwt-test-secret"
+	testJWTIssuer   = "https://issuer.example.com"
+	testJWTAudience = "openlist-proxy"
+)
+
+// newJWKSStub serves the public half of a fresh rsa key as the key k1 of a jwks and points
+// -jwt-jwks-url at it.
+func newJWKSStub(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Json{"keys": []jwk{{
+			Kty: "RSA",
+			Kid: "k1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(s.Close)
+	old := jwks
+	t.Cleanup(func() { jwks = old })
+	jwks = &jwkSet{url: s.URL}
+	setFlags(t, map[string]string{"jwt-jwks-url": s.URL})
+	if err := jwks.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaKey := newJWKSStub(t)
+	setFlags(t, map[string]string{"jwt-secret": testJWTSecret, "jwt-issuer": testJWTIssuer, "jwt-audience": testJWTAudience})
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: must(x509.MarshalPKIXPublicKey(&rsaKey.PublicKey))})
+
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":   testJWTIssuer,
+			"aud":   testJWTAudience,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"paths": []string{"/dir"},
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	hs256 := func(c jwt.MapClaims) string {
+		return must(jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(testJWTSecret)))
+	}
+	rs256 := func(kid string, c jwt.MapClaims) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+		tok.Header["kid"] = kid
+		return must(tok.SignedString(rsaKey))
+	}
+	for _, tc := range []struct {
+		name  string
+		token string
+		path  string
+		// code is what verifyJWT reports, 0 for a valid token
+		code int
+	}{
+		{"hs256", hs256(claims(nil)), "/dir/file.bin", 0},
+		{"rs256 from the jwks", rs256("k1", claims(nil)), "/dir/file.bin", 0},
+		{"the granted prefix itself", hs256(claims(nil)), "/dir", 0},
+		{"no paths claim", hs256(claims(func(c jwt.MapClaims) { delete(c, "paths") })), "/other/file.bin", 0},
+		{"one of several audiences", hs256(claims(func(c jwt.MapClaims) { c["aud"] = []string{"else", testJWTAudience} })), "/dir/a", 0},
+
+		{"expired", hs256(claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })), "/dir/a", 403},
+		{"not yet valid", hs256(claims(func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Hour).Unix() })), "/dir/a", 401},
+		{"without exp", hs256(claims(func(c jwt.MapClaims) { delete(c, "exp") })), "/dir/a", 401},
+		{"path outside the prefixes", hs256(claims(nil)), "/other/file.bin", 403},
+		{"path sharing the prefix string", hs256(claims(nil)), "/directory/file.bin", 403},
+		{"invalid paths claim", hs256(claims(func(c jwt.MapClaims) { c["paths"] = 42 })), "/dir/a", 401},
+		{"audience mismatch", hs256(claims(func(c jwt.MapClaims) { c["aud"] = "someone-else" })), "/dir/a", 401},
+		{"without audience", hs256(claims(func(c jwt.MapClaims) { delete(c, "aud") })), "/dir/a", 401},
+		{"issuer mismatch", hs256(claims(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" })), "/dir/a", 401},
+		{"wrong secret", must(jwt.NewWithClaims(jwt.SigningMethodHS256, claims(nil)).SignedString([]byte("guessed"))), "/dir/a", 401},
+		{"unknown kid", rs256("k2", claims(nil)), "/dir/a", 401},
+		{"alg none", must(jwt.NewWithClaims(jwt.SigningMethodNone, claims(nil)).SignedString(jwt.UnsafeAllowNoneSignatureType)), "/dir/a", 401},
+		// an hmac keyed with the public key of the jwks must not pass for the rsa signature
+		{"hs256 keyed with the rsa public key", func() string {
+			tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(nil))
+			tok.Header["kid"] = "k1"
+			return must(tok.SignedString(publicPEM))
+		}(), "/dir/a", 401},
+		{"malformed", "not.a.jwt", "/dir/a", 401},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, code, err := verifyJWT(tc.token, tc.path)
+			if code != tc.code {
+				t.Fatalf("reported %d (%v), expected %d", code, err, tc.code)
+			}
+			if (err == nil) != (tc.code == 0) || (got == nil) != (tc.code != 0) {
+				t.Errorf("returned the claims %v and the error %v", got, err)
+			}
+		})
+	}
+}
+
+func TestVerifyJWTOnlyJWKS(t *testing.T) {
+	rsaKey := newJWKSStub(t)
+	setFlags(t, map[string]string{"jwt-secret": ""})
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: must(x509.MarshalPKIXPublicKey(&rsaKey.PublicKey))})
+	c := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+	// without -jwt-secret no hmac is accepted, whatever it is keyed with
+	for name, secret := range map[string][]byte{"empty secret": {}, "rsa public key": publicPEM} {
+		tok := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
+		tok.Header["kid"] = "k1"
+		if _, code, err := verifyJWT(must(tok.SignedString(secret)), "/file.bin"); code != 401 {
+			t.Errorf("hs256 with the %s reported %d (%v), expected 401", name, code, err)
+		}
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	tok.Header["kid"] = "k1"
+	if _, code, err := verifyJWT(must(tok.SignedString(rsaKey)), "/file.bin"); code != 0 {
+		t.Errorf("rs256 reported %d: %v", code, err)
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+)
+
+var (
+	landingMode     string
+	landingTemplate string
+	robotsTxt       string
+)
+
+func init() {
+	CommandLine.StringVar(&landingMode, "landing", "page", "response for the root path: page (an html page, see -landing-template), json (the version and status) or off (resolved in openlist like any other path)")
+	CommandLine.StringVar(&landingTemplate, "landing-template", "", "html template `file` of the -landing page, with .Host, .Version and .Status, empty shows a plain page")
+	CommandLine.StringVar(&robotsTxt, "robots-txt", "disallow", "answer for /robots.txt: disallow (keeps crawlers out), allow, off (resolved in openlist like any other path) or a `file` served as it is")
+}
+
+const defaultLandingPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>{{.Host}}</title>
+<style>body{font-family:system-ui,sans-serif;max-width:40em;margin:4em auto;padding:0 1em;color:#333}h1{font-weight:400}</style></head>
+<body><h1>{{.Host}}</h1><p>This server delivers the files of an OpenList through the links it hands out.</p></body></html>
+`
+
+var (
+	landingPage *template.Template
+	robotsBody  []byte
+)
+
+func setupLanding() error {
+	switch landingMode {
+	case "page", "json", "off":
+	default:
+		return fmt.Errorf("invalid -landing %q, expected page, json or off", landingMode)
+	}
+	page := template.Must(template.New("landing").Parse(defaultLandingPage))
+	if landingTemplate != "" {
+		b, err := os.ReadFile(landingTemplate)
+		if err != nil {
+			return fmt.Errorf("-landing-template: %w", err)
+		}
+		if page, err = template.New("landing").Parse(string(b)); err != nil {
+			return fmt.Errorf("-landing-template: %w", err)
+		}
+	}
+	landingPage = page
+	switch robotsTxt {
+	case "disallow":
+		robotsBody = []byte("User-agent: *\nDisallow: /\n")
+	case "allow":
+		robotsBody = []byte("User-agent: *\nDisallow:\n")
+	case "off":
+		robotsBody = nil
+	default:
+		b, err := os.ReadFile(robotsTxt)
+		if err != nil {
+			return fmt.Errorf("-robots-txt: %w", err)
+		}
+		robotsBody = b
+	}
+	return nil
+}
+
+// landingInfo is what the -landing page and json show.
+type landingInfo struct {
+	Name    string `json:"name"`
+	Host    string `json:"-"`
+	Version string `json:"version"`
+	// Status is ok, or degraded while none of the openlist backends answers.
+	Status string `json:"status"`
+}
+
+// serveLanding answers the root path and /robots.txt unless -landing and -robots-txt leave
+// them to openlist, and reports whether it did.
+func serveLanding(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	switch {
+	case r.URL.Path == "/robots.txt" && robotsBody != nil:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		_, _ = w.Write(robotsBody)
+		return true
+	case r.URL.Path != "/" || landingMode == "off" || r.URL.RawQuery != "":
+		// queries on the root path are downloads of it, e.g. signed
+		return false
+	}
+	info := landingInfo{Name: "OpenList-Proxy", Host: r.Host, Version: Version, Status: "ok"}
+	if len(backends) > 0 && len(healthyBackends(backends)) == 0 {
+		info.Status = "degraded"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if landingMode == "json" {
+		jsonResponse(w, info)
+		return true
+	}
+	var buf bytes.Buffer
+	if err := landingPage.Execute(&buf, info); err != nil {
+		errorResponse(w, 500, "failed to render the landing page: "+err.Error())
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+	return true
+}
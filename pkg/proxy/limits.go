@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	allowedMethods string
+	maxHeaderBytes byteSize = 64 << 10
+	maxBodySize    byteSize = 64 << 10
+)
+
+func init() {
+	CommandLine.StringVar(&allowedMethods, "allowed-methods", "GET, HEAD, OPTIONS", "methods of downloads passed on to origins, others are answered 405")
+	CommandLine.Var(&maxHeaderBytes, "max-header-bytes", "max `size` of request headers, larger ones are answered 431, the server tolerates 4K above it")
+	CommandLine.Var(&maxBodySize, "max-body-size", "max `size` of request bodies, larger ones are answered 413, 0 is unlimited")
+}
+
+var allowedMethodSet map[string]bool
+
+func setupRequestLimits() error {
+	allowedMethodSet = map[string]bool{}
+	for _, m := range strings.Split(allowedMethods, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		if strings.IndexFunc(m, func(c rune) bool { return c < 'A' || c > 'Z' }) >= 0 {
+			return fmt.Errorf("invalid method %q in -allowed-methods", m)
+		}
+		allowedMethodSet[m] = true
+	}
+	if len(allowedMethodSet) == 0 {
+		return fmt.Errorf("-allowed-methods allows nothing")
+	}
+	return nil
+}
+
+// configureLimits bounds the request headers the server reads.
+func configureLimits(srv *http.Server) {
+	srv.MaxHeaderBytes = int(maxHeaderBytes)
+}
+
+// methodAllowed answers downloads of methods outside -allowed-methods with 405.
+func methodAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if allowedMethodSet[r.Method] {
+		return true
+	}
+	w.Header().Set("Allow", allowedMethods)
+	errorResponse(w, 405, "method "+r.Method+" not allowed")
+	return false
+}
+
+// requestLimitsHandler rejects request bodies larger than -max-body-size, by their length
+// up front or by failing the read of bodies that don't announce it. Uploads have
+// -upload-max-size instead.
+func requestLimitsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && uploadEnabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > int64(maxBodySize) {
+			errorResponse(w, 413, "request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxBodySize))
+		next.ServeHTTP(w, r)
+	})
+}
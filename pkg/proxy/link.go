@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+)
+
+var maxAPIResponseSize int64
+
+func init() {
+	CommandLine.Int64Var(&maxAPIResponseSize, "max-api-response-size", 1<<20, "max size in bytes of an openlist api response")
+}
+
+type Link struct {
+	Url    string      `json:"url"`
+	Header http.Header `json:"header"`
+	// URLs are alternative urls of the same file some drivers return, raced and resumed from
+	// when Url fails.
+	URLs []string `json:"urls,omitempty"`
+	// Expiration is how long the url stays valid after resolution, 0 if the backend does not say.
+	Expiration time.Duration `json:"expiration,omitempty"`
+	// resolved is when the backend returned the link.
+	resolved time.Time
+	// backend is the address of the backend that returned the link.
+	backend string
+}
+
+// expires returns when the url of l stops working, zero if unknown.
+func (l *Link) expires() time.Time {
+	if l.Expiration <= 0 {
+		return time.Time{}
+	}
+	return l.resolved.Add(l.Expiration)
+}
+
+// apiResponse is the envelope of every OpenList API response.
+type apiResponse[T any] struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    T      `json:"data"`
+}
+
+type LinkResp = apiResponse[Link]
+
+type fsObject struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	IsDir    bool      `json:"is_dir"`
+	Modified time.Time `json:"modified"`
+	// HashInfo maps hash names such as md5, sha1 or sha256 to the hex hashes the storage knows.
+	HashInfo map[string]string `json:"hash_info"`
+}
+
+// apiError is a non-200 code returned in an OpenList API response body.
+type apiError struct {
+	Code    int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("openlist api error %d: %s", e.Code, e.Message)
+}
+
+// backend is an OpenList instance the proxy resolves links with.
+type backend struct {
+	address, token string
+}
+
+// defaultBackend is the instance configured with -address and -token.
+func defaultBackend() backend {
+	return backend{address: address, token: apiToken()}
+}
+
+// postAPI calls the OpenList API at apiPath about filePath, sent as the path field of body,
+// on the backend filePath is routed to and returns the response data.
+func postAPI[T any](apiPath, filePath string, body Json) (*T, error) {
+	return routedAPI(filePath, func(b backend, p string) (*T, error) {
+		body["path"] = p
+		return postBackendAPI[T](b, apiPath, body)
+	})
+}
+
+// postBackendAPI is postAPI against a specific backend.
+func postBackendAPI[T any](b backend, apiPath string, body any) (*T, error) {
+	return postBackendAPIContext[T](context.Background(), b, apiPath, body)
+}
+
+// postBackendAPIContext is postBackendAPI giving up once ctx is done.
+func postBackendAPIContext[T any](ctx context.Context, b backend, apiPath string, body any) (*T, error) {
+	dataByte, _ := json.Marshal(body)
+	req, _ := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s%s", b.address, apiPath), bytes.NewBuffer(dataByte))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", b.token)
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	var resp apiResponse[T]
+	if err = decodeAPIResponse(res, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Code != 200 {
+		return nil, &apiError{Code: resp.Code, Message: resp.Message}
+	}
+	return &resp.Data, nil
+}
+
+// fetchLink resolves filePath to an origin link via the OpenList /api/fs/link API,
+// reusing links of the link cache and of prepared paths. It stops waiting once ctx is done,
+// the resolution goes on for the other requests of the file and the link cache.
+func fetchLink(ctx context.Context, filePath string) (*Link, error) {
+	return linkCache.resolve(ctx, filePath, linkCacheTTL)
+}
+
+func fetchBackendLink(b backend, filePath string) (*Link, error) {
+	// resolving a link has no side effects, transient errors are retried before failing over
+	link, err := withRetry(func() (*Link, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), linkTimeout)
+		defer cancel()
+		return postBackendAPIContext[Link](ctx, b, "/api/fs/link", Json{
+			"path": filePath,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if link.Url == "" {
+		return nil, &apiError{Code: 500, Message: "storage returned no direct link for this file, it can only be served through OpenList itself"}
+	}
+	link.resolved = time.Now()
+	link.backend = b.address
+	return link, nil
+}
+
+// decodeAPIResponse stream-decodes an OpenList API response into v, rejecting
+// non-JSON content types and bodies larger than -max-api-response-size.
+func decodeAPIResponse(res *http.Response, v any) error {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return fmt.Errorf("unexpected response from openlist: status %s, content type %q", res.Status, res.Header.Get("Content-Type"))
+	}
+	err := json.NewDecoder(http.MaxBytesReader(nil, res.Body, maxAPIResponseSize)).Decode(v)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return fmt.Errorf("openlist api response exceeds %d bytes", maxAPIResponseSize)
+	}
+	if err != nil {
+		return unexpectedResponse(err)
+	}
+	return nil
+}
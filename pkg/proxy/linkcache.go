@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	linkCacheTTL     time.Duration
+	negativeCacheTTL time.Duration
+)
+
+var linkCacheTotal = newCounterVec("openlist_proxy_link_cache_total", "Link resolutions with -link-cache-ttl, by result hit or miss.", "result")
+
+func init() {
+	CommandLine.DurationVar(&linkCacheTTL, "link-cache-ttl", 0, "how long resolved links are reused for further requests of a path, 0 resolves every request")
+	CommandLine.DurationVar(&negativeCacheTTL, "negative-cache-ttl", 0, "how long paths openlist reports not found are answered so without asking it again, 0 asks every request")
+	adminMux.Handle("POST /api/cache/purge", adminAuth(adminPurgeCache))
+}
+
+type linkCacheEntry struct {
+	link Link
+	// err is the not found error of a negative entry.
+	err    error
+	expire time.Time
+}
+
+// sharedLinkEntry is a linkCacheEntry as kept in redis.
+type sharedLinkEntry struct {
+	Link     Link      `json:"link"`
+	Resolved time.Time `json:"resolved"`
+	Backend  string    `json:"backend"`
+	// NotFound is the openlist error of a negative entry.
+	NotFound *apiError `json:"not_found,omitempty"`
+}
+
+// linkCall is a resolution in flight, later requests of the same path wait for it.
+type linkCall struct {
+	done chan struct{}
+	link *Link
+	err  error
+}
+
+// linkCacheStore keeps resolved links and deduplicates concurrent resolutions of a path.
+type linkCacheStore struct {
+	mu       sync.Mutex
+	entries  map[string]linkCacheEntry
+	inflight map[string]*linkCall
+}
+
+var linkCache = &linkCacheStore{entries: map[string]linkCacheEntry{}, inflight: map[string]*linkCall{}}
+
+func init() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			linkCache.prune()
+		}
+	}()
+}
+
+// copyLink returns a copy of l callers may modify.
+func copyLink(l Link) *Link {
+	l.Header = l.Header.Clone()
+	return &l
+}
+
+// resolve returns the link of filePath from the cache or the backend, keeping it for ttl and
+// not found errors for -negative-cache-ttl.
+func (c *linkCacheStore) resolve(ctx context.Context, filePath string, ttl time.Duration) (*Link, error) {
+	if e, ok := c.get(filePath); ok {
+		linkCacheTotal.inc("hit")
+		if e.err != nil {
+			return nil, e.err
+		}
+		return copyLink(e.link), nil
+	}
+	linkCacheTotal.inc("miss")
+	c.mu.Lock()
+	call, ok := c.inflight[filePath]
+	if !ok {
+		call = &linkCall{done: make(chan struct{})}
+		c.inflight[filePath] = call
+		go func() {
+			call.link, call.err = routedAPI(filePath, fetchBackendLink)
+			if call.err == nil && call.link.Expiration > 0 {
+				// never reuse a link past the expiration the backend reported
+				ttl = min(ttl, call.link.Expiration)
+			}
+			switch {
+			case call.err == nil && ttl > 0:
+				c.set(filePath, linkCacheEntry{link: *copyLink(*call.link)}, ttl)
+			case negativeCacheTTL > 0 && notFound(call.err):
+				c.set(filePath, linkCacheEntry{err: call.err}, negativeCacheTTL)
+			}
+			c.mu.Lock()
+			delete(c.inflight, filePath)
+			close(call.done)
+			c.mu.Unlock()
+		}()
+	}
+	c.mu.Unlock()
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	return copyLink(*call.link), nil
+}
+
+// get returns the unexpired entry of filePath, from redis with -redis-url.
+func (c *linkCacheStore) get(filePath string) (linkCacheEntry, bool) {
+	if rdb == nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		e, ok := c.entries[filePath]
+		return e, ok && time.Now().Before(e.expire)
+	}
+	ctx, cancel := redisContext()
+	defer cancel()
+	b, err := rdb.Get(ctx, redisKey("link", filePath)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			logf(levelWarn, "failed to get the cached link of %s from redis: %s", filePath, err.Error())
+		}
+		return linkCacheEntry{}, false
+	}
+	var se sharedLinkEntry
+	if err := json.Unmarshal(b, &se); err != nil {
+		return linkCacheEntry{}, false
+	}
+	if se.NotFound != nil {
+		return linkCacheEntry{err: se.NotFound}, true
+	}
+	se.Link.resolved, se.Link.backend = se.Resolved, se.Backend
+	return linkCacheEntry{link: se.Link}, true
+}
+
+// set keeps e as the entry of filePath for ttl, in redis with -redis-url.
+func (c *linkCacheStore) set(filePath string, e linkCacheEntry, ttl time.Duration) {
+	if rdb == nil {
+		e.expire = time.Now().Add(ttl)
+		c.mu.Lock()
+		c.entries[filePath] = e
+		c.mu.Unlock()
+		return
+	}
+	se := sharedLinkEntry{Link: e.link, Resolved: e.link.resolved, Backend: e.link.backend}
+	if e.err != nil {
+		var apiErr *apiError
+		errors.As(e.err, &apiErr)
+		se.NotFound = apiErr
+	}
+	b, _ := json.Marshal(se)
+	ctx, cancel := redisContext()
+	defer cancel()
+	if err := rdb.Set(ctx, redisKey("link", filePath), b, ttl).Err(); err != nil {
+		logf(levelWarn, "failed to cache the link of %s in redis: %s", filePath, err.Error())
+	}
+}
+
+func (c *linkCacheStore) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for p, e := range c.entries {
+		if now.After(e.expire) {
+			delete(c.entries, p)
+		}
+	}
+}
+
+// purge drops the cached links of prefix and the paths below it and returns how many.
+func (c *linkCacheStore) purge(prefix string) int {
+	if rdb != nil {
+		return purgeRedisLinks(prefix)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for p := range c.entries {
+		if pathWithin(p, prefix) {
+			delete(c.entries, p)
+			n++
+		}
+	}
+	return n
+}
+
+// purgeRedisLinks drops the links of prefix and below from redis, for all instances.
+func purgeRedisLinks(prefix string) int {
+	ctx, cancel := redisContext()
+	defer cancel()
+	keyPrefix := redisKey("link", "")
+	iter := rdb.Scan(ctx, 0, redisGlobEscape(keyPrefix+prefix)+"*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		if pathWithin(strings.TrimPrefix(iter.Val(), keyPrefix), prefix) {
+			keys = append(keys, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		logf(levelWarn, "failed to list the cached links of %s in redis: %s", prefix, err.Error())
+	}
+	if len(keys) == 0 {
+		return 0
+	}
+	n, err := rdb.Del(ctx, keys...).Result()
+	if err != nil {
+		logf(levelWarn, "failed to purge the cached links of %s from redis: %s", prefix, err.Error())
+	}
+	return int(n)
+}
+
+type purgeReq struct {
+	Prefix string `json:"prefix"`
+}
+
+type purgeResp struct {
+	Purged int `json:"purged"`
+}
+
+func adminPurgeCache(w http.ResponseWriter, r *http.Request) {
+	req := purgeReq{Prefix: "/"}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) || !strings.HasPrefix(req.Prefix, "/") {
+		errorResponseWithStatus(w, http.StatusBadRequest, 400, "invalid purge request")
+		return
+	}
+	jsonResponse(w, purgeResp{Purged: linkCache.purge(req.Prefix) + contentCache.purge(req.Prefix)})
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+var refreshExpiredLinks bool
+
+func init() {
+	CommandLine.BoolVar(&refreshExpiredLinks, "refresh-expired-links", true, "resolve the link of a file again and retry once when its origin answers 401, 403 or 410, as the presigned urls of s3 and onedrive do once expired")
+}
+
+var linkRefreshes = newCounterVec("openlist_proxy_link_refreshes_total", "Origin answers of 401, 403 or 410 retried with a new link, by result: retried, unchanged (openlist returned the same link) or failed.", "result")
+
+// linkExpired reports whether the origin answer res is that of an expired url.
+func linkExpired(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// retryExpiredLink fetches req once more from the link relink resolves anew when the origin
+// answered res as to an expired url, and returns the request, link, answer and mirrors to go
+// on with, those given when there is nothing to retry or the retry failed.
+func retryExpiredLink(r, req *http.Request, filePath string, link *Link, res *http.Response, mirrors []string, relink func() (*Link, error)) (*http.Request, *Link, *http.Response, []string) {
+	if !refreshExpiredLinks || !linkExpired(res) || req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return req, link, res, mirrors
+	}
+	if _, _, ok := directDriverFor(filePath); ok {
+		// their links are made by the proxy, not by openlist
+		return req, link, res, mirrors
+	}
+	fresh, err := relink()
+	if err != nil {
+		linkRefreshes.inc("failed")
+		logf(levelWarn, "failed to refresh the link of %s after %s: %s", filePath, res.Status, err.Error())
+		return req, link, res, mirrors
+	}
+	if fresh.Url == link.Url && maps.EqualFunc(fresh.Header, link.Header, slices.Equal) {
+		linkRefreshes.inc("unchanged")
+		return req, link, res, mirrors
+	}
+	u, err := url.Parse(fresh.Url)
+	if err != nil {
+		linkRefreshes.inc("failed")
+		return req, link, res, mirrors
+	}
+	retry := req.Clone(req.Context())
+	retry.URL, retry.Host = u, u.Host
+	for name := range link.Header {
+		retry.Header.Del(name)
+	}
+	maps.Copy(retry.Header, fresh.Header)
+	rewriteRequestHeaders(filePath, retry)
+	res2, mirrors2, err := fetchLinkURL(r, retry, fresh)
+	if err != nil {
+		linkRefreshes.inc("failed")
+		logf(levelWarn, "failed to retry %s with a new link: %s", filePath, err.Error())
+		return req, link, res, mirrors
+	}
+	_ = res.Body.Close()
+	linkRefreshes.inc("retried")
+	logf(levelInfo, "origin answered %s for %s, retried with a new link: %s", res.Status, filePath, res2.Status)
+	return retry, fresh, res2, mirrors2
+}
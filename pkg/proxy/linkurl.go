@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var (
+	defaultScheme string
+	preferHTTPS   bool
+)
+
+func init() {
+	CommandLine.StringVar(&defaultScheme, "default-scheme", "http", "scheme assumed for resolved links without one, http or https")
+	CommandLine.BoolVar(&preferHTTPS, "prefer-https", false, "fetch resolved links over https, upgrading http links and ignoring -default-scheme")
+}
+
+func validateDefaultScheme() error {
+	if defaultScheme != "http" && defaultScheme != "https" {
+		return fmt.Errorf("invalid -default-scheme %q", defaultScheme)
+	}
+	return nil
+}
+
+// escapeZone percent-encodes a raw IPv6 zone in the bracketed host of raw,
+// e.g. http://[fe80::1%eth0]/x, which url.Parse only accepts as %25eth0.
+func escapeZone(raw string) string {
+	start := strings.Index(raw, "[")
+	end := strings.Index(raw, "]")
+	if start < 0 || end < start {
+		return raw
+	}
+	host := raw[start:end]
+	if i := strings.Index(host, "%"); i >= 0 && !strings.HasPrefix(host[i:], "%25") {
+		host = host[:i] + "%25" + host[i+1:]
+	}
+	return raw[:start] + host + raw[end:]
+}
+
+// looksLikeHost reports whether the first segment of a scheme-less url is a host
+// (an IPv6 literal, or a name with a dot or port) rather than a relative path.
+func looksLikeHost(raw string) bool {
+	first, _, _ := strings.Cut(raw, "/")
+	return strings.HasPrefix(first, "[") || strings.ContainsAny(first, ".:") && first != "." && first != ".."
+}
+
+// normalizeLinkURL turns the url returned by the link API into an absolute http(s) url.
+// Relative urls are resolved against base, the address of the backend that returned them.
+// Protocol-relative urls and urls without a scheme get -default-scheme, or https with -prefer-https.
+func normalizeLinkURL(raw, base string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	scheme := defaultScheme
+	if preferHTTPS {
+		scheme = "https"
+	}
+	switch {
+	case strings.Contains(raw, "://") || strings.HasPrefix(raw, "//"):
+	case !strings.HasPrefix(raw, "/") && looksLikeHost(raw):
+		raw = "//" + raw
+	default:
+		b, err := url.Parse(base)
+		if err != nil {
+			return "", fmt.Errorf("invalid openlist address: %w", err)
+		}
+		ref, err := url.Parse(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid link url: %w", err)
+		}
+		return b.ResolveReference(ref).String(), nil
+	}
+	if strings.HasPrefix(raw, "//") {
+		raw = scheme + ":" + raw
+	}
+	u, err := url.Parse(escapeZone(raw))
+	if err != nil {
+		return "", fmt.Errorf("invalid link url: %w", err)
+	}
+	if u.Scheme == "http" && preferHTTPS {
+		u.Scheme = "https"
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported link url scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("link url %q has no host", raw)
+	}
+	return u.String(), nil
+}
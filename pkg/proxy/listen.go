@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	listenAddrs      stringList
+	socketMode       string
+	httpsPort        int
+	httpsListenAddrs stringList
+	redirectHTTPS    bool
+)
+
+func init() {
+	CommandLine.Var(&listenAddrs, "listen", "`address` to listen on as host:port, [::1]:port or unix:/path for a unix socket a reverse proxy on the same host connects to, "+
+		"repeatable to serve on several interfaces at once, overrides -port")
+	CommandLine.StringVar(&socketMode, "socket-mode", "0660", "octal permissions of the unix sockets of -listen")
+	CommandLine.IntVar(&httpsPort, "https-port", 0, "also serve https on this port while -port or -listen serve plain http, with the certificates of -https, which it implies")
+	CommandLine.Var(&httpsListenAddrs, "https-listen", "`address` serving https next to the plain listeners like -listen, repeatable, overrides -https-port")
+	CommandLine.BoolVar(&redirectHTTPS, "redirect-https", false, "redirect the requests of the plain listeners to the https one, apart from acme http-01 challenges, "+
+		"needs -https-port or -https-listen")
+}
+
+// listenAddresses returns the addresses of the client facing listeners.
+func listenAddresses() []string {
+	if len(listenAddrs) > 0 {
+		return listenAddrs
+	}
+	return []string{fmt.Sprintf(":%d", port)}
+}
+
+// httpsAddresses returns the addresses of the https listeners serving next to the plain ones,
+// none unless -https-port or -https-listen are set.
+func httpsAddresses() []string {
+	if len(httpsListenAddrs) > 0 {
+		return httpsListenAddrs
+	}
+	if httpsPort > 0 {
+		return []string{fmt.Sprintf(":%d", httpsPort)}
+	}
+	return nil
+}
+
+// dualListeners reports whether plain http and https are served on listeners of their own.
+func dualListeners() bool {
+	return len(httpsAddresses()) > 0
+}
+
+func setupDualListeners() error {
+	if dualListeners() {
+		https = true
+	} else if redirectHTTPS {
+		return errors.New("-redirect-https needs -https-port or -https-listen")
+	}
+	return nil
+}
+
+// httpsListenPort returns the port of the first tcp listener serving https, or 0 when there
+// is none.
+func httpsListenPort() int {
+	addrs := httpsAddresses()
+	if addrs == nil {
+		addrs = listenAddresses()
+	}
+	for _, addr := range addrs {
+		if _, p, err := net.SplitHostPort(addr); err == nil && !strings.HasPrefix(addr, "unix:") {
+			n, _ := strconv.Atoi(p)
+			return n
+		}
+	}
+	return 0
+}
+
+// serveListeners serves srv on every address until one of the listeners fails. All of them
+// are opened first, so a taken address fails the start instead of leaving some running.
+// Sockets passed by systemd socket activation replace the addresses, the ones of the process
+// upgraded from are taken over. The https addresses serve tls next to the plain ones.
+func serveListeners(srv *http.Server, addrs []string) error {
+	lns, activated, err := systemdListeners()
+	if err == nil && lns == nil {
+		lns, activated, err = inheritedSystemdListeners()
+	}
+	if err != nil {
+		return err
+	}
+	secure := make([]bool, 0, len(lns))
+	if lns != nil {
+		addrs = activated
+		for _, a := range addrs {
+			// sockets named https serve tls next to plain ones
+			secure = append(secure, https && (!dualListeners() || strings.HasPrefix(a, "systemd https ")))
+		}
+	} else {
+		for range addrs {
+			secure = append(secure, https && !dualListeners())
+		}
+		for range httpsAddresses() {
+			secure = append(secure, true)
+		}
+		addrs = append(slices.Clone(addrs), httpsAddresses()...)
+		if lns, err = listenAll(addrs); err != nil {
+			return err
+		}
+	}
+	if proxyProtocol {
+		for i, ln := range lns {
+			lns[i] = proxyProtoListener{ln}
+		}
+	}
+	errs := make(chan error, len(lns))
+	for i, ln := range lns {
+		if dualListeners() && secure[i] {
+			fmt.Printf("listen and serve https: %s\n", addrs[i])
+		} else {
+			fmt.Printf("listen and serve: %s\n", addrs[i])
+		}
+		go func() {
+			if !secure[i] {
+				errs <- srv.Serve(ln)
+			} else {
+				errs <- srv.ServeTLS(ln, certFile, keyFile)
+			}
+		}()
+	}
+	if !upgraded() {
+		// the process upgraded from hands the service over to this one
+		sdNotify("READY=1")
+	}
+	handoffReady()
+	startWatchdog()
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-shutdownDone
+	return nil
+}
+
+func listenAll(addrs []string) ([]net.Listener, error) {
+	lns := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := handoffListen("listen "+addr, addr, true)
+		if err != nil {
+			for _, l := range lns {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// listen opens the listener of addr, a tcp host:port or unix:/path.
+func listen(addr string) (net.Listener, error) {
+	socket, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -socket-mode %q", socketMode)
+	}
+	// a socket left behind by a killed run would make listening fail
+	if info, err := os.Lstat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(socket)
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, os.FileMode(mode)); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// plainHandler answers acme http-01 challenges on the plain listeners serving next to https
+// ones, and redirects their other requests to https with -redirect-https.
+func plainHandler(next http.Handler) http.Handler {
+	plain := next
+	if redirectHTTPS {
+		plain = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, peerCachePath+"/") {
+				// peers authenticate themselves, the redirect would lose the token
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Redirect(w, r, httpsURL(r), http.StatusPermanentRedirect)
+		})
+	}
+	if acmeManager != nil {
+		plain = acmeManager.HTTPHandler(plain)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		plain.ServeHTTP(w, r)
+	})
+}
+
+// httpsURL is the url of r on the https listener.
+func httpsURL(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if p := httpsListenPort(); p != 0 && p != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(p))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevel filters the messages of logf, the startup and configuration messages are always printed.
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+var currentLogLevel atomic.Int32
+
+func init() {
+	currentLogLevel.Store(int32(levelInfo))
+	CommandLine.Var(logLevelFlag{}, "log-level", "least severe `level` of the messages logged about requests: debug, info, warn or error, adjustable at runtime in the admin api")
+	adminMux.Handle("GET /api/log-level", adminAuth(adminGetLogLevel))
+	adminMux.Handle("PUT /api/log-level", adminAuth(adminSetLogLevel))
+}
+
+func parseLogLevel(v string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(v, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", v)
+}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// logLevelFlag sets currentLogLevel, which the admin api changes at runtime.
+type logLevelFlag struct{}
+
+func (logLevelFlag) Set(v string) error {
+	l, err := parseLogLevel(v)
+	if err != nil {
+		return err
+	}
+	currentLogLevel.Store(int32(l))
+	return nil
+}
+
+func (logLevelFlag) String() string {
+	return logLevel(currentLogLevel.Load()).String()
+}
+
+// logf prints a message at level when the log level lets it through, and sends it to the
+// log sinks.
+func logf(level logLevel, format string, args ...any) {
+	if int32(level) < currentLogLevel.Load() {
+		return
+	}
+	noticef(level, format, args...)
+}
+
+// noticef prints a startup or runtime message whatever the log level, as warnings and
+// failures of the proxy itself are, and sends it to the log sinks at level.
+func noticef(level logLevel, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Println(msg)
+	sendLog(level, msg)
+}
+
+type logLevelReq struct {
+	Level string `json:"level"`
+}
+
+func adminGetLogLevel(w http.ResponseWriter, _ *http.Request) {
+	jsonResponse(w, logLevelReq{Level: logLevelFlag{}.String()})
+}
+
+func adminSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevelReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, 400, "invalid log level request")
+		return
+	}
+	if err := (logLevelFlag{}).Set(req.Level); err != nil {
+		errorResponse(w, 400, err.Error())
+		return
+	}
+	fmt.Printf("log level set to %s\n", req.Level)
+	jsonResponse(w, req)
+}
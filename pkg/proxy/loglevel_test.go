@@ -0,0 +1,25 @@
+package proxy
+
+import "testing"
+
+func TestNoticefReachesLogSinks(t *testing.T) {
+	setFlags(t, map[string]string{"log-level": "error"})
+	old := logSinks
+	t.Cleanup(func() { logSinks = old })
+	sink := &logSink{name: "test", records: make(chan logRecord, 4)}
+	logSinks = []*logSink{sink}
+
+	logf(levelWarn, "filtered by the log level")
+	noticef(levelWarn, "warning: %s", "startup warning")
+	select {
+	case rec := <-sink.records:
+		if rec.msg != "warning: startup warning" || rec.level != levelWarn {
+			t.Errorf("sent %q at %s, expected the warning", rec.msg, rec.level)
+		}
+	default:
+		t.Fatal("the warning was not sent to the log sink")
+	}
+	if len(sink.records) != 0 {
+		t.Errorf("%d more records were sent", len(sink.records))
+	}
+}
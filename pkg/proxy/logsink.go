@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	logSyslog         string
+	logSyslogFacility string
+	logJournald       bool
+)
+
+func init() {
+	CommandLine.StringVar(&logSyslog, "log-syslog", "", "also send the access log and the messages of -log-level to a syslog server as rfc 5424: udp://host:514, tcp://host:514, tls://host:6514 or local")
+	CommandLine.StringVar(&logSyslogFacility, "log-syslog-facility", "daemon", "syslog facility of -log-syslog: user, daemon or local0 to local7")
+	CommandLine.BoolVar(&logJournald, "log-journald", false, "also send the access log and the messages of -log-level to the systemd journal with native fields")
+}
+
+var logSinkDropped = newCounterVec("openlist_proxy_log_sink_dropped_total", "Log records not sent to -log-syslog or -log-journald because the sink was behind or unreachable, by sink.", "sink")
+
+// logField is a structured field of a log record, a lower case name and its value.
+type logField struct{ key, value string }
+
+// logRecord is a message for the log sinks.
+type logRecord struct {
+	time   time.Time
+	level  logLevel
+	msg    string
+	fields []logField
+}
+
+// logSink sends records to a log server in the background, so logging never waits for it.
+type logSink struct {
+	name    string
+	connect func() (net.Conn, error)
+	format  func(logRecord) []byte
+	records chan logRecord
+}
+
+var logSinks []*logSink
+
+// logSinkRetry is how long a sink that failed to connect drops its records before retrying.
+const logSinkRetry = 5 * time.Second
+
+func setupLogSinks() error {
+	sinks, err := newLogSinks()
+	if err != nil {
+		return err
+	}
+	for _, s := range sinks {
+		go s.run()
+	}
+	logSinks = sinks
+	return nil
+}
+
+func validateLogSinks() error {
+	_, err := newLogSinks()
+	return err
+}
+
+func newLogSinks() ([]*logSink, error) {
+	var sinks []*logSink
+	if logSyslog != "" {
+		s, err := newSyslogSink(logSyslog)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -log-syslog: %w", err)
+		}
+		sinks = append(sinks, s)
+	}
+	if logJournald {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("-log-journald is only supported on linux")
+		}
+		sinks = append(sinks, &logSink{
+			name: "journald",
+			connect: func() (net.Conn, error) {
+				return net.Dial("unixgram", "/run/systemd/journal/socket")
+			},
+			format:  formatJournal,
+			records: make(chan logRecord, 1024),
+		})
+	}
+	return sinks, nil
+}
+
+// sendLog passes a record to the log sinks, dropping it for those too far behind.
+func sendLog(level logLevel, msg string, fields ...logField) {
+	if len(logSinks) == 0 {
+		return
+	}
+	rec := logRecord{time: time.Now(), level: level, msg: msg, fields: fields}
+	for _, s := range logSinks {
+		select {
+		case s.records <- rec:
+		default:
+			logSinkDropped.inc(s.name)
+		}
+	}
+}
+
+func (s *logSink) run() {
+	var conn net.Conn
+	var retry time.Time
+	for rec := range s.records {
+		b := s.format(rec)
+		sent := false
+		// a connection closed by the server is noticed on the first write, so write twice
+		for attempt := 0; attempt < 2 && !sent && time.Now().After(retry); attempt++ {
+			if conn == nil {
+				c, err := s.connect()
+				if err != nil {
+					fmt.Printf("failed to connect to the %s log sink: %s\n", s.name, err.Error())
+					retry = time.Now().Add(logSinkRetry)
+					break
+				}
+				conn = c
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(logSinkRetry))
+			if _, err := conn.Write(b); err != nil {
+				_ = conn.Close()
+				conn = nil
+				continue
+			}
+			sent = true
+		}
+		if !sent {
+			logSinkDropped.inc(s.name)
+		}
+	}
+}
+
+var syslogFacilities = func() map[string]int {
+	m := map[string]int{"user": 1, "daemon": 3}
+	for i := range 8 {
+		m["local"+strconv.Itoa(i)] = 16 + i
+	}
+	return m
+}()
+
+// newSyslogSink returns the sink of -log-syslog. Stream transports frame the messages by
+// their length as rfc 6587 and rfc 5425 ask, datagrams carry one message each.
+func newSyslogSink(addr string) (*logSink, error) {
+	facility, ok := syslogFacilities[logSyslogFacility]
+	if !ok {
+		return nil, fmt.Errorf("unknown -log-syslog-facility %q", logSyslogFacility)
+	}
+	network, raddr, ok := strings.Cut(addr, "://")
+	if addr == "local" {
+		network, ok = "local", true
+	}
+	if !ok {
+		network, raddr = "udp", addr
+	}
+	var connect func() (net.Conn, error)
+	switch network {
+	case "udp", "tcp":
+		if _, _, err := net.SplitHostPort(raddr); err != nil {
+			return nil, err
+		}
+		connect = func() (net.Conn, error) {
+			return net.DialTimeout(network, raddr, logSinkRetry)
+		}
+	case "tls":
+		host, _, err := net.SplitHostPort(raddr)
+		if err != nil {
+			return nil, err
+		}
+		connect = func() (net.Conn, error) {
+			// verified against the system roots and -upstream-ca
+			cfg := upstreamTLSConfig.Clone()
+			if cfg == nil {
+				cfg = &tls.Config{}
+			}
+			cfg.ServerName = host
+			return tls.DialWithDialer(&net.Dialer{Timeout: logSinkRetry}, "tcp", raddr, cfg)
+		}
+	case "local":
+		if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+			return nil, fmt.Errorf("no local syslog on %s", runtime.GOOS)
+		}
+		connect = func() (net.Conn, error) {
+			var err error
+			for _, p := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+				var conn net.Conn
+				if conn, err = net.Dial("unixgram", p); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported network %q, expected udp, tcp, tls or local", network)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	framed := network == "tcp" || network == "tls"
+	return &logSink{
+		name:    "syslog",
+		connect: connect,
+		format: func(rec logRecord) []byte {
+			b := formatSyslog(rec, facility, hostname)
+			if framed {
+				return append([]byte(strconv.Itoa(len(b))+" "), b...)
+			}
+			return b
+		},
+		records: make(chan logRecord, 1024),
+	}, nil
+}
+
+// syslogSeverity maps the log levels to the severities of syslog and the journal.
+func syslogSeverity(level logLevel) int {
+	switch level {
+	case levelDebug:
+		return 7
+	case levelWarn:
+		return 4
+	case levelError:
+		return 3
+	}
+	return 6
+}
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// formatSyslog formats rec as rfc 5424, with the level and fields as the structured data
+// element openlist@32473, 32473 being the enterprise number rfc 5612 sets aside for
+// examples as openlist has none of its own.
+func formatSyslog(rec logRecord, facility int, hostname string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s openlist-proxy %d - [openlist@32473 level=\"%s\"",
+		facility*8+syslogSeverity(rec.level), rec.time.Format("2006-01-02T15:04:05.000000Z07:00"), hostname, os.Getpid(), rec.level)
+	for _, f := range rec.fields {
+		fmt.Fprintf(&b, " %s=\"%s\"", f.key, sdEscaper.Replace(f.value))
+	}
+	b.WriteString("] ")
+	b.WriteString(rec.msg)
+	return b.Bytes()
+}
+
+// formatJournal formats rec in the native protocol of journald, the fields upper cased
+// with an OPENLIST_ prefix.
+func formatJournal(rec logRecord) []byte {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", rec.msg)
+	journalField(&b, "PRIORITY", strconv.Itoa(syslogSeverity(rec.level)))
+	journalField(&b, "SYSLOG_IDENTIFIER", "openlist-proxy")
+	journalField(&b, "OPENLIST_LEVEL", rec.level.String())
+	for _, f := range rec.fields {
+		journalField(&b, "OPENLIST_"+strings.ToUpper(f.key), f.value)
+	}
+	return b.Bytes()
+}
+
+// journalField appends a field, values with newlines as their length and bytes.
+func journalField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key + "=" + value + "\n")
+		return
+	}
+	b.WriteString(key + "\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
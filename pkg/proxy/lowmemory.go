@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	lowMemory   bool
+	memoryLimit byteSize
+)
+
+func init() {
+	CommandLine.BoolVar(&lowMemory, "low-memory", false, "tune defaults for devices with 256-512MB of memory: smaller buffers, a connection limit, a soft memory limit and a more aggressive gc; options set explicitly still win")
+	CommandLine.Var(&memoryLimit, "memory-limit", "soft memory `size` limit the gc works to stay under, e.g. 128M, 0 keeps the go runtime default")
+}
+
+// lowMemoryDefaults are the values -low-memory gives options not set explicitly.
+var lowMemoryDefaults = map[string]string{
+	"max-conns":                  "32",
+	"max-api-response-size":      "262144",
+	"memory-limit":               "128M",
+	"upstream-max-idle-per-host": "8",
+}
+
+// zstdOptions keeps the encoder's window and workers small under -low-memory.
+func zstdOptions() []zstd.EOption {
+	if !lowMemory {
+		return nil
+	}
+	return []zstd.EOption{zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1 << 20)}
+}
+
+// copyBufferSize is the buffer used by transfers that cannot be spliced or sent directly.
+var copyBufferSize = 32 << 10
+
+var copyBuffers = sync.Pool{New: func() any {
+	b := make([]byte, copyBufferSize)
+	return &b
+}}
+
+// applyLowMemoryProfile sets the -low-memory defaults, after config files are loaded.
+func applyLowMemoryProfile() error {
+	if !lowMemory {
+		return nil
+	}
+	names := make([]string, 0, len(lowMemoryDefaults))
+	for name := range lowMemoryDefaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if configSource[name] != "" {
+			continue
+		}
+		if err := CommandLine.Set(name, lowMemoryDefaults[name]); err != nil {
+			return fmt.Errorf("low-memory option %q: %w", name, err)
+		}
+		configSource[name] = "low-memory"
+	}
+	copyBufferSize = 8 << 10
+	debug.SetGCPercent(50)
+	return nil
+}
+
+func setupMemoryLimit() {
+	if configSource["memory-limit"] == "low-memory" && os.Getenv("GOMEMLIMIT") != "" {
+		return
+	}
+	if memoryLimit > 0 {
+		debug.SetMemoryLimit(int64(memoryLimit))
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestMain configures the proxy as the command does, with its state in a temporary -data-dir,
+// so the tests see the flags at their defaults unless they set them.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "openlist-proxy-test")
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	code := func() int {
+		defer func() {
+			_ = os.RemoveAll(dir)
+		}()
+		if err := CommandLine.Parse([]string{"-data-dir", dir, "-check-version=false"}); err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		if err := configure(); err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		if err := setup(); err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		return m.Run()
+	}()
+	os.Exit(code)
+}
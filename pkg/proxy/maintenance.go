@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	maintenanceWindows stringList
+	maintenanceMessage string
+)
+
+func init() {
+	CommandLine.Var(&maintenanceWindows, "maintenance-window", "`window` of scheduled maintenance, repeatable: weekly in local time such as \"sun 02:00-04:00\", "+
+		"\"mon-fri 23:30-00:30\" or \"daily 03:00-03:15\", or once such as 2026-11-01T02:00:00Z/2026-11-01T04:00:00Z")
+	CommandLine.StringVar(&maintenanceMessage, "maintenance-message", "", "message answered during maintenance without one of its own")
+	adminMux.Handle("GET /api/maintenance", adminAuth(adminGetMaintenance))
+	adminMux.Handle("PUT /api/maintenance", adminAuth(adminSetMaintenance))
+}
+
+// maintenanceState is the maintenance toggle of the admin api, or a -maintenance-window. In
+// maintenance new requests are answered 503, transfers already running go on.
+type maintenanceState struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+	// RetryAfter is sent to clients in seconds, 0 sends the default.
+	RetryAfter int64     `json:"retry_after,omitempty"`
+	Since      time.Time `json:"since,omitzero"`
+	// Until is the end of a scheduled window, Scheduled tells the state is one.
+	Until     time.Time `json:"until,omitzero"`
+	Scheduled bool      `json:"scheduled,omitempty"`
+}
+
+var maintenance = struct {
+	sync.RWMutex
+	state   maintenanceState
+	windows []maintenanceWindow
+}{}
+
+// defaultRetryAfter is the Retry-After of maintenance without one of its own.
+const defaultRetryAfter = 5 * time.Minute
+
+// maintenanceWindow is a weekly window starting on days at start, minutes after midnight,
+// for length, or a one-off window from from to to.
+type maintenanceWindow struct {
+	days     [7]bool
+	start    int
+	length   int
+	from, to time.Time
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseMaintenanceWindow(s string) (maintenanceWindow, error) {
+	var w maintenanceWindow
+	if from, to, ok := strings.Cut(s, "/"); ok {
+		var err1, err2 error
+		w.from, err1 = time.Parse(time.RFC3339, from)
+		w.to, err2 = time.Parse(time.RFC3339, to)
+		if err := errors.Join(err1, err2); err != nil {
+			return w, err
+		}
+		if !w.to.After(w.from) {
+			return w, errors.New("the window ends before it starts")
+		}
+		return w, nil
+	}
+	days, hours, ok := strings.Cut(strings.ToLower(strings.TrimSpace(s)), " ")
+	if !ok {
+		return w, errors.New("want days and hours such as \"sun 02:00-04:00\"")
+	}
+	for _, d := range strings.Split(days, ",") {
+		if d == "daily" {
+			w.days = [7]bool{true, true, true, true, true, true, true}
+			continue
+		}
+		first, last, _ := strings.Cut(d, "-")
+		if last == "" {
+			last = first
+		}
+		from, ok1 := weekdays[first]
+		to, ok2 := weekdays[last]
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("invalid days %q", d)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	start, end, ok := strings.Cut(strings.TrimSpace(hours), "-")
+	t1, err1 := time.Parse("15:04", start)
+	t2, err2 := time.Parse("15:04", end)
+	if !ok || err1 != nil || err2 != nil {
+		return w, fmt.Errorf("invalid hours %q, want 02:00-04:00", hours)
+	}
+	w.start = t1.Hour()*60 + t1.Minute()
+	// a window ending at or before its start ends the next day
+	w.length = ((t2.Hour()*60+t2.Minute()-w.start)+1439)%1440 + 1
+	return w, nil
+}
+
+// activeAt returns when the occurrence of w covering t started and ends, ok is false if none does.
+func (w maintenanceWindow) activeAt(t time.Time) (start, end time.Time, ok bool) {
+	if !w.from.IsZero() {
+		return w.from, w.to, !t.Before(w.from) && t.Before(w.to)
+	}
+	for back := 0; back <= 1; back++ {
+		day := t.AddDate(0, 0, -back)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		y, m, d := day.Date()
+		start = time.Date(y, m, d, w.start/60, w.start%60, 0, 0, t.Location())
+		end = start.Add(time.Duration(w.length) * time.Minute)
+		if !t.Before(start) && t.Before(end) {
+			return start, end, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+func setupMaintenance() error {
+	for _, s := range maintenanceWindows {
+		w, err := parseMaintenanceWindow(s)
+		if err != nil {
+			return fmt.Errorf("invalid -maintenance-window %q: %w", s, err)
+		}
+		maintenance.windows = append(maintenance.windows, w)
+	}
+	if len(maintenance.windows) > 0 {
+		go logMaintenanceWindows()
+	}
+	return nil
+}
+
+// logMaintenanceWindows logs when scheduled maintenance starts and ends.
+func logMaintenanceWindows() {
+	var active bool
+	for range time.Tick(10 * time.Second) {
+		m := currentMaintenance()
+		if m.Scheduled != active {
+			active = m.Scheduled
+			if active {
+				logf(levelWarn, "scheduled maintenance until %s", m.Until.Format(time.DateTime))
+			} else {
+				logf(levelWarn, "scheduled maintenance over")
+			}
+		}
+	}
+}
+
+// currentMaintenance returns the toggle of the admin api when on, else the window of now.
+func currentMaintenance() maintenanceState {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	if maintenance.state.Enabled {
+		return maintenance.state
+	}
+	now := time.Now()
+	for _, w := range maintenance.windows {
+		if start, end, ok := w.activeAt(now); ok {
+			return maintenanceState{
+				Enabled:    true,
+				Message:    maintenanceMessage,
+				RetryAfter: max(int64(time.Until(end).Seconds()), 1),
+				Since:      start,
+				Until:      end,
+				Scheduled:  true,
+			}
+		}
+	}
+	return maintenance.state
+}
+
+func maintenanceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := currentMaintenance()
+		if !m.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		retryAfter := m.RetryAfter
+		if retryAfter <= 0 {
+			retryAfter = int64(defaultRetryAfter.Seconds())
+		}
+		msg := m.Message
+		if msg == "" {
+			msg = maintenanceMessage
+		}
+		if msg == "" {
+			msg = "down for maintenance, please retry later"
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		errorResponseWithStatus(w, http.StatusServiceUnavailable, 503, msg)
+	})
+}
+
+func adminGetMaintenance(w http.ResponseWriter, _ *http.Request) {
+	jsonResponse(w, currentMaintenance())
+}
+
+func adminSetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceState
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RetryAfter < 0 || req.Scheduled || !req.Until.IsZero() {
+		errorResponse(w, 400, "invalid maintenance request")
+		return
+	}
+	maintenance.Lock()
+	if req.Enabled && !maintenance.state.Enabled {
+		req.Since = time.Now()
+	} else if req.Enabled {
+		req.Since = maintenance.state.Since
+	} else {
+		req.Since = time.Time{}
+	}
+	maintenance.state = req
+	maintenance.Unlock()
+	if m := currentMaintenance(); m.Scheduled {
+		// turning the toggle off leaves the window of the schedule in place
+		req = m
+	}
+	if req.Enabled {
+		logf(levelWarn, "maintenance mode on")
+	} else {
+		logf(levelWarn, "maintenance mode off")
+	}
+	jsonResponse(w, req)
+}
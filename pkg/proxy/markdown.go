@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRule    = regexp.MustCompile(`^\s*(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	mdBullet  = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdOrdered = regexp.MustCompile(`^\s*\d{1,9}[.)]\s+(.*)$`)
+)
+
+// renderMarkdown renders the common subset of markdown to html: headings, paragraphs, lists,
+// quotes, fenced and indented code, rules, emphasis, code spans, links and images. Raw html
+// is escaped, so a preview never runs what the file contains.
+func renderMarkdown(src string) string {
+	var out strings.Builder
+	var para []string
+	list := ""
+	flush := func() {
+		if len(para) > 0 {
+			out.WriteString("<p>" + mdInline(strings.Join(para, "\n")) + "</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			flush()
+			closeList()
+			fence := trimmed[:3]
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case trimmed == "":
+			flush()
+			closeList()
+		case strings.HasPrefix(line, "    ") && len(para) == 0 && list == "":
+			var code []string
+			for ; i < len(lines) && (strings.HasPrefix(lines[i], "    ") || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			i--
+			out.WriteString("<pre><code>" + html.EscapeString(strings.TrimRight(strings.Join(code, "\n"), "\n")) + "</code></pre>\n")
+		case mdHeading.MatchString(trimmed):
+			flush()
+			closeList()
+			m := mdHeading.FindStringSubmatch(trimmed)
+			n := strconv.Itoa(len(m[1]))
+			out.WriteString("<h" + n + ">" + mdInline(m[2]) + "</h" + n + ">\n")
+		case mdRule.MatchString(line):
+			flush()
+			closeList()
+			out.WriteString("<hr>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			closeList()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				q := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quote = append(quote, strings.TrimPrefix(q, " "))
+			}
+			i--
+			out.WriteString("<blockquote>\n" + renderMarkdown(strings.Join(quote, "\n")) + "</blockquote>\n")
+		case mdBullet.MatchString(line), mdOrdered.MatchString(line):
+			flush()
+			kind, m := "ul", mdBullet.FindStringSubmatch(line)
+			if m == nil {
+				kind, m = "ol", mdOrdered.FindStringSubmatch(line)
+			}
+			if list != kind {
+				closeList()
+				list = kind
+				out.WriteString("<" + kind + ">\n")
+			}
+			out.WriteString("<li>" + mdInline(m[1]) + "</li>\n")
+		default:
+			if list != "" && strings.HasPrefix(line, " ") {
+				// continuation of the last item, joined to the list as a plain line
+				out.WriteString("<li>" + mdInline(trimmed) + "</li>\n")
+				continue
+			}
+			closeList()
+			para = append(para, trimmed)
+		}
+	}
+	flush()
+	closeList()
+	return out.String()
+}
+
+// mdInline renders code spans, emphasis, links and images of a block of text.
+func mdInline(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()#+-.!>", s[i+1]) >= 0:
+			i++
+			out.WriteString(html.EscapeString(s[i : i+1]))
+		case c == '`':
+			n := 1
+			for i+n < len(s) && s[i+n] == '`' {
+				n++
+			}
+			delim := s[i : i+n]
+			if end := strings.Index(s[i+n:], delim); end >= 0 {
+				out.WriteString("<code>" + html.EscapeString(strings.TrimSpace(s[i+n:i+n+end])) + "</code>")
+				i += n + end + n - 1
+				continue
+			}
+			out.WriteString(delim)
+			i += n - 1
+		case c == '!' && i+1 < len(s) && s[i+1] == '[':
+			if text, target, n, ok := mdLink(s[i+1:]); ok {
+				out.WriteString(`<img src="` + html.EscapeString(mdSafeURL(target)) + `" alt="` + html.EscapeString(text) + `">`)
+				i += n
+				continue
+			}
+			out.WriteString("!")
+		case c == '[':
+			if text, target, n, ok := mdLink(s[i:]); ok {
+				out.WriteString(`<a href="` + html.EscapeString(mdSafeURL(target)) + `">` + mdInline(text) + "</a>")
+				i += n - 1
+				continue
+			}
+			out.WriteString("[")
+		case c == '_' && i > 0 && mdWordByte(s[i-1]):
+			// snake_case names stay as they are
+			out.WriteString("_")
+		case c == '*' || c == '_':
+			delim := s[i : i+1]
+			if i+1 < len(s) && s[i+1] == c {
+				delim = s[i : i+2]
+			}
+			rest := s[i+len(delim):]
+			if end := strings.Index(rest, delim); end > 0 && rest[0] != ' ' {
+				tag := "em"
+				if len(delim) == 2 {
+					tag = "strong"
+				}
+				out.WriteString("<" + tag + ">" + mdInline(rest[:end]) + "</" + tag + ">")
+				i += len(delim) + end + len(delim) - 1
+				continue
+			}
+			out.WriteString(delim)
+			i += len(delim) - 1
+		case c == '\n':
+			out.WriteString("\n")
+		default:
+			out.WriteString(html.EscapeString(s[i : i+1]))
+		}
+	}
+	return out.String()
+}
+
+func mdWordByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// mdLink parses [text](target) at the start of s, n is its length.
+func mdLink(s string) (text, target string, n int, ok bool) {
+	closeText := strings.Index(s, "](")
+	if closeText < 0 {
+		return "", "", 0, false
+	}
+	closeTarget := strings.IndexByte(s[closeText+2:], ')')
+	if closeTarget < 0 {
+		return "", "", 0, false
+	}
+	target, _, _ = strings.Cut(strings.TrimSpace(s[closeText+2:closeText+2+closeTarget]), " ")
+	return s[1:closeText], target, closeText + 3 + closeTarget, true
+}
+
+// mdSafeURL keeps relative urls and http, https and mailto ones, javascript: and the like are dropped.
+func mdSafeURL(u string) string {
+	scheme, _, found := strings.Cut(u, ":")
+	if !found || strings.ContainsAny(scheme, "/?#") {
+		return u
+	}
+	switch strings.ToLower(scheme) {
+	case "http", "https", "mailto":
+		return u
+	}
+	return "#"
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	metricsAddress     string
+	metricsPathMode    string
+	metricsPathDepth   int
+	metricsPathBuckets int
+)
+
+func init() {
+	CommandLine.StringVar(&metricsAddress, "metrics-address", "", "address to serve prometheus metrics on, e.g. 127.0.0.1:9100, empty disables metrics")
+	CommandLine.StringVar(&metricsPathMode, "metrics-path-mode", "none", "how to label metrics by request path: none, top (leading folders), hash (hash buckets) or full")
+	CommandLine.IntVar(&metricsPathDepth, "metrics-path-depth", 1, "number of leading path segments kept with -metrics-path-mode top")
+	CommandLine.IntVar(&metricsPathBuckets, "metrics-path-buckets", 64, "number of buckets with -metrics-path-mode hash")
+}
+
+var (
+	requestsTotal = newCounterVec("openlist_proxy_requests_total", "Requests handled, by status code and aggregated path.", "code", "path")
+	bytesSent     = newCounterVec("openlist_proxy_response_bytes_total", "Response body bytes sent to clients, by aggregated path.", "path")
+	activeReqs    = newGaugeVec("openlist_proxy_active_requests", "Requests currently being served.")
+)
+
+// metric is a metric family that can write itself in the prometheus text format.
+type metric interface {
+	metricName() string
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// series holds the values of one metric family keyed by its label values.
+type series struct {
+	name, help, kind string
+	labels           []string
+	mu               sync.Mutex
+	values           map[string]float64
+}
+
+func newSeries(kind, name, help string, labels []string) *series {
+	return &series{name: name, help: help, kind: kind, labels: labels, values: map[string]float64{}}
+}
+
+func (s *series) metricName() string {
+	return s.name
+}
+
+func (s *series) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	s.mu.Lock()
+	s.values[key] += v
+	s.mu.Unlock()
+}
+
+func (s *series) set(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	s.mu.Lock()
+	s.values[key] = v
+	s.mu.Unlock()
+}
+
+func (s *series) value(labelValues ...string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[strings.Join(labelValues, "\xff")]
+}
+
+// total sums the values of all series of the family.
+func (s *series) total() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sum float64
+	for _, v := range s.values {
+		sum += v
+	}
+	return sum
+}
+
+func (s *series) write(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.kind)
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", s.name, formatLabels(s.labels, k), formatValue(s.values[k]))
+	}
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = name + `="` + escapeLabel(v) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a monotonically increasing metric family.
+type counterVec struct{ *series }
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{newSeries("counter", name, help, labels)}
+	register(c)
+	return c
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+// gaugeVec is a metric family whose values can go up and down.
+type gaugeVec struct{ *series }
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{newSeries("gauge", name, help, labels)}
+	register(g)
+	return g
+}
+
+// metricsPath aggregates a request path into a bounded label value according to -metrics-path-mode.
+func metricsPath(p string) string {
+	switch metricsPathMode {
+	case "full":
+		return p
+	case "top":
+		segments := strings.Split(strings.Trim(p, "/"), "/")
+		if len(segments) > metricsPathDepth {
+			segments = segments[:metricsPathDepth]
+		}
+		return "/" + strings.Join(segments, "/")
+	case "hash":
+		h := fnv.New32a()
+		_, _ = io.WriteString(h, p)
+		return "bucket-" + strconv.Itoa(int(h.Sum32()%uint32(max(metricsPathBuckets, 1))))
+	default:
+		return ""
+	}
+}
+
+func metricsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activeReqs.add(1)
+		defer activeReqs.add(-1)
+		start := time.Now()
+		rec := newStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+		observeSLOs(r, rec, start)
+		path := metricsPath(r.URL.Path)
+		topPaths.add(r.URL.Path, rec.status, rec.bytes)
+		recordDailyStats(r, rec.status, rec.bytes)
+		accountTraffic(r, rec.bytes)
+		recordHotspots(r, rec.status, rec.bytes)
+		autobanResponse(r, rec.status)
+		publishRequestEvent(r, rec.status, rec.bytes, start)
+		requestsTotal.inc(strconv.Itoa(rec.status), path)
+		bytesSent.add(float64(rec.bytes), path)
+	})
+}
+
+func serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	registryMu.Lock()
+	families := append([]metric(nil), registry...)
+	registryMu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].metricName() < families[j].metricName() })
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range families {
+		m.write(w)
+	}
+}
+
+func validateMetrics() error {
+	switch metricsPathMode {
+	case "none", "top", "hash", "full":
+		return nil
+	}
+	return fmt.Errorf("invalid -metrics-path-mode %q", metricsPathMode)
+}
+
+func startMetricsServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	fmt.Printf("serve metrics: %s\n", metricsAddress)
+	ln, err := handoffListen("metrics "+metricsAddress, metricsAddress, false)
+	if err != nil {
+		noticef(levelError, "failed to serve metrics: %s", err.Error())
+		return
+	}
+	go func() {
+		if err := http.Serve(ln, mux); err != nil && !closedListener(err) {
+			noticef(levelError, "failed to serve metrics: %s", err.Error())
+		}
+	}()
+}
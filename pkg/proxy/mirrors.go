@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var mirrorRaceDelay time.Duration
+
+func init() {
+	CommandLine.DurationVar(&mirrorRaceDelay, "mirror-race-delay", 250*time.Millisecond, "when openlist returns several urls of a file, how long the mirror known to be fastest "+
+		"may take to answer before the next one is raced against it, happy eyeballs style; 0 only tries the next one when a mirror fails")
+}
+
+// mirrorRetryAfter is how long a mirror host that failed is tried after the others.
+const mirrorRetryAfter = 30 * time.Second
+
+var mirrorsTotal = newCounterVec("openlist_proxy_mirror_requests_total", "Origin requests of links with several urls, by the mirror answering: first, other or none.", "result")
+
+// mirrorHost is what is known of a host serving mirrors.
+type mirrorHost struct {
+	// latency is a moving average of the time to the response headers
+	latency time.Duration
+	failed  time.Time
+}
+
+var mirrorHosts = struct {
+	sync.Mutex
+	m map[string]*mirrorHost
+}{m: map[string]*mirrorHost{}}
+
+// mirrors returns the normalized urls of l, Url first, leaving out invalid ones.
+func (l *Link) mirrors() []string {
+	urls := []string{l.Url}
+	for _, raw := range l.URLs {
+		u, err := normalizeLinkURL(raw, l.backend)
+		if err == nil && !slices.Contains(urls, u) {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// orderMirrors sorts urls by the latency seen from their hosts, hosts that failed lately last
+// and unknown ones where they were.
+func orderMirrors(urls []string) []string {
+	urls = slices.Clone(urls)
+	type rank struct {
+		failed  bool
+		latency time.Duration
+	}
+	ranks := map[string]rank{}
+	mirrorHosts.Lock()
+	for _, u := range urls {
+		if h := mirrorHosts.m[mirrorHostOf(u)]; h != nil {
+			ranks[u] = rank{time.Since(h.failed) < mirrorRetryAfter, h.latency}
+		}
+	}
+	mirrorHosts.Unlock()
+	sort.SliceStable(urls, func(i, j int) bool {
+		a, b := ranks[urls[i]], ranks[urls[j]]
+		if a.failed != b.failed {
+			return !a.failed
+		}
+		return a.latency < b.latency
+	})
+	return urls
+}
+
+func mirrorHostOf(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Host
+}
+
+// observeMirror records how long the host of raw took to answer, or that it failed.
+func observeMirror(raw string, latency time.Duration, failed bool) {
+	mirrorHosts.Lock()
+	defer mirrorHosts.Unlock()
+	host := mirrorHostOf(raw)
+	h := mirrorHosts.m[host]
+	if h == nil {
+		h = &mirrorHost{latency: latency}
+		mirrorHosts.m[host] = h
+	}
+	if failed {
+		h.failed = time.Now()
+		return
+	}
+	h.failed = time.Time{}
+	h.latency = (h.latency*3 + latency) / 4
+}
+
+// mirrorFailed reports whether a mirror answering res does not have the file, so another
+// one is tried.
+func mirrorFailed(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusForbidden, http.StatusNotFound, http.StatusRequestTimeout, http.StatusGone, http.StatusTooManyRequests:
+		return true
+	}
+	return res.StatusCode >= 500
+}
+
+type mirrorAttempt struct {
+	url     string
+	res     *http.Response
+	err     error
+	latency time.Duration
+}
+
+// fetchLinkURL fetches req from the origin of link. With several urls they are raced, and
+// the urls not answering are returned to resume a broken transfer from.
+func fetchLinkURL(r, req *http.Request, link *Link) (*http.Response, []string, error) {
+	urls := link.mirrors()
+	if len(urls) == 1 {
+		res, err := fetchOrigin(r, req)
+		return res, nil, err
+	}
+	urls = orderMirrors(urls)
+	results := make(chan mirrorAttempt, len(urls))
+	cancels := map[string]context.CancelFunc{}
+	start := func(raw string) {
+		u, err := url.Parse(raw)
+		if err != nil {
+			results <- mirrorAttempt{url: raw, err: err}
+			return
+		}
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[raw] = cancel
+		mreq := req.Clone(ctx)
+		mreq.URL, mreq.Host = u, u.Host
+		go func() {
+			begin := time.Now()
+			res, err := HttpClient.Do(mreq)
+			results <- mirrorAttempt{url: raw, res: res, err: err, latency: time.Since(begin)}
+		}()
+	}
+	next, running := 0, 0
+	var lastRes *http.Response
+	var lastErr error
+	for next < len(urls) || running > 0 {
+		if running == 0 {
+			start(urls[next])
+			next++
+			running++
+		}
+		var race <-chan time.Time
+		if mirrorRaceDelay > 0 && next < len(urls) {
+			race = time.After(mirrorRaceDelay)
+		}
+		select {
+		case <-race:
+			start(urls[next])
+			next++
+			running++
+		case a := <-results:
+			running--
+			if a.err == nil && !mirrorFailed(a.res) {
+				observeMirror(a.url, a.latency, false)
+				// the winner's context stays, resuming its transfer clones the request
+				for u, cancel := range cancels {
+					if u != a.url {
+						cancel()
+					}
+				}
+				// the losers of the race are closed as they come in
+				go func() {
+					for range running {
+						if l := <-results; l.res != nil {
+							_ = l.res.Body.Close()
+						}
+					}
+				}()
+				if a.url == urls[0] {
+					mirrorsTotal.inc("first")
+				} else {
+					mirrorsTotal.inc("other")
+				}
+				rest := slices.DeleteFunc(slices.Clone(urls), func(u string) bool { return u == a.url })
+				return a.res, rest, nil
+			}
+			observeMirror(a.url, 0, true)
+			if a.err != nil {
+				lastErr = a.err
+				if cancel := cancels[a.url]; cancel != nil {
+					cancel()
+				}
+				continue
+			}
+			logf(levelWarn, "mirror %s answered %s, trying the next one", a.res.Request.URL.Redacted(), a.res.Status)
+			if lastRes != nil {
+				_ = lastRes.Body.Close()
+			}
+			lastRes = a.res
+		}
+	}
+	mirrorsTotal.inc("none")
+	if lastRes != nil {
+		return lastRes, nil, nil
+	}
+	return nil, nil, lastErr
+}
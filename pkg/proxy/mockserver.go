@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing/fstest"
+	"time"
+)
+
+func init() {
+	commands["mockserver"] = command{
+		usage: "mockserver [-listen 127.0.0.1:5244] [-root dir] emulates the openlist link api and a range-capable storage for local testing",
+		run:   runMockServer,
+	}
+}
+
+// mockEpoch is the modification time of the built-in mock files, fixed so runs are reproducible.
+var mockEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// mockFiles returns the built-in files served when mockserver has no -root.
+func mockFiles() fs.FS {
+	random := make([]byte, 1<<20)
+	r := rand.NewChaCha8([32]byte{})
+	_, _ = r.Read(random)
+	file := func(data []byte) *fstest.MapFile {
+		return &fstest.MapFile{Data: data, Mode: 0o644, ModTime: mockEpoch}
+	}
+	return fstest.MapFS{
+		"hello.txt":       file([]byte(strings.Repeat("hello world\n", 100))),
+		"random.bin":      file(random),
+		"empty.txt":       file(nil),
+		"dir/nested.txt":  file([]byte("nested\n")),
+		"dir/sub/deep.md": file([]byte("# deep\n")),
+	}
+}
+
+type mockServer struct {
+	files    fs.FS
+	root     string
+	token    string
+	base     string
+	delay    time.Duration
+	noRange  bool
+	relative bool
+	expire   time.Duration
+}
+
+func runMockServer(args []string) error {
+	flags := flag.NewFlagSet("mockserver", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:5244", "address to listen on")
+	root := flags.String("root", "", "directory to serve, empty serves built-in files: /hello.txt, /random.bin (1MiB), /empty.txt and /dir")
+	mockToken := flags.String("token", "", "token the api requires in the Authorization header, empty accepts any")
+	delay := flags.Duration("delay", 0, "delay of every api response, to reproduce slow drivers")
+	noRange := flags.Bool("no-range", false, "ignore Range headers like some storages do")
+	relative := flags.Bool("relative-urls", false, "return links as paths relative to the mock server")
+	expire := flags.Duration("expiration", 0, "expiration reported with links, 0 reports none")
+	_ = flags.Parse(args)
+	m := &mockServer{
+		files:    mockFiles(),
+		token:    *mockToken,
+		base:     "http://" + *listen,
+		delay:    *delay,
+		noRange:  *noRange,
+		relative: *relative,
+		expire:   *expire,
+	}
+	if *root != "" {
+		m.files = os.DirFS(*root)
+		m.root = *root
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/fs/link", m.api(m.link))
+	mux.HandleFunc("POST /api/fs/get", m.api(m.get))
+	mux.HandleFunc("POST /api/fs/list", m.api(m.list))
+	mux.HandleFunc("PUT /api/fs/put", m.put)
+	mux.HandleFunc("GET /ping", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "pong")
+	})
+	mux.HandleFunc("GET /api/public/settings", func(w http.ResponseWriter, _ *http.Request) {
+		jsonResponse(w, apiResponse[Json]{Code: 200, Message: "success", Data: Json{"version": "v4.0.0-mock"}})
+	})
+	mux.HandleFunc("GET /d/", m.serveFile)
+	fmt.Printf("mock openlist listening on %s, run the proxy with -address %s\n", *listen, m.base)
+	return http.ListenAndServe(*listen, mux)
+}
+
+// put stores an upload below -root, without one the body is read and dropped.
+func (m *mockServer) put(w http.ResponseWriter, r *http.Request) {
+	if m.token != "" && r.Header.Get("Authorization") != m.token {
+		jsonResponse(w, apiResponse[any]{Code: 401, Message: "token is invalidated"})
+		return
+	}
+	p, err := url.PathUnescape(r.Header.Get("File-Path"))
+	if err != nil || fsName(p) == "." {
+		jsonResponse(w, apiResponse[any]{Code: 400, Message: "invalid File-Path"})
+		return
+	}
+	dst := io.Discard
+	if m.root != "" {
+		name := filepath.Join(m.root, filepath.FromSlash(fsName(p)))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			jsonResponse(w, apiResponse[any]{Code: 500, Message: err.Error()})
+			return
+		}
+		f, err := os.Create(name)
+		if err != nil {
+			jsonResponse(w, apiResponse[any]{Code: 500, Message: err.Error()})
+			return
+		}
+		defer f.Close()
+		dst = f
+	}
+	if n, err := io.Copy(dst, r.Body); err != nil || n != r.ContentLength {
+		jsonResponse(w, apiResponse[any]{Code: 500, Message: fmt.Sprintf("received %d of %d bytes", n, r.ContentLength)})
+		return
+	}
+	jsonResponse(w, apiResponse[any]{Code: 200, Message: "success"})
+}
+
+// fsName turns an api path into a name of m.files.
+func fsName(p string) string {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// api decodes the path of an fs api request and wraps the result in the openlist envelope.
+func (m *mockServer) api(handle func(p string) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(m.delay)
+		if m.token != "" && r.Header.Get("Authorization") != m.token {
+			jsonResponse(w, apiResponse[any]{Code: 401, Message: "token is invalidated"})
+			return
+		}
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonResponse(w, apiResponse[any]{Code: 400, Message: err.Error()})
+			return
+		}
+		data, err := handle(req.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			jsonResponse(w, apiResponse[any]{Code: 500, Message: "object not found"})
+			return
+		}
+		if err != nil {
+			jsonResponse(w, apiResponse[any]{Code: 500, Message: err.Error()})
+			return
+		}
+		jsonResponse(w, apiResponse[any]{Code: 200, Message: "success", Data: data})
+	}
+}
+
+func mockObject(fi fs.FileInfo) fsObject {
+	size := fi.Size()
+	if fi.IsDir() {
+		size = 0
+	}
+	return fsObject{Name: fi.Name(), Size: size, IsDir: fi.IsDir(), Modified: fi.ModTime()}
+}
+
+func (m *mockServer) link(p string) (any, error) {
+	fi, err := fs.Stat(m.files, fsName(p))
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, errors.New("not a file")
+	}
+	u := "/d" + escapePath(path.Clean("/"+p))
+	if !m.relative {
+		u = m.base + u
+	}
+	return Link{Url: u, Header: http.Header{}, Expiration: m.expire}, nil
+}
+
+func (m *mockServer) get(p string) (any, error) {
+	fi, err := fs.Stat(m.files, fsName(p))
+	if err != nil {
+		return nil, err
+	}
+	return mockObject(fi), nil
+}
+
+func (m *mockServer) list(p string) (any, error) {
+	entries, err := fs.ReadDir(m.files, fsName(p))
+	if err != nil {
+		return nil, err
+	}
+	list := fsListResp{Content: []fsObject{}}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		list.Content = append(list.Content, mockObject(fi))
+	}
+	list.Total = len(list.Content)
+	return list, nil
+}
+
+func (m *mockServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	name := fsName(strings.TrimPrefix(r.URL.Path, "/d"))
+	f, err := m.files.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	fi, err := f.Stat()
+	rs, ok := f.(io.ReadSeeker)
+	if err != nil || fi.IsDir() || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if m.noRange {
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+		if r.Method != http.MethodHead {
+			_, _ = io.Copy(w, rs)
+		}
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), rs)
+}
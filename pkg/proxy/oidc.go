@@ -0,0 +1,376 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// oidcPrefix is the path under which the login callback is served on the proxy listener.
+const oidcPrefix = "/__oidc/"
+
+const (
+	oidcSessionCookie = "olp_session"
+	oidcStateCookie   = "olp_oidc_state"
+	oidcStateTTL      = 10 * time.Minute
+)
+
+var (
+	oidcIssuer       string
+	oidcClientID     string
+	oidcClientSecret string
+	oidcRedirectURL  string
+	oidcScopes       string
+	oidcAllowEmails  stringList
+	oidcSessionTTL   time.Duration
+	oidcCookieSecret string
+)
+
+func init() {
+	CommandLine.StringVar(&oidcIssuer, "oidc-issuer", "", "openid connect issuer url; browsers opening unsigned urls log in there and may then download without signs")
+	CommandLine.StringVar(&oidcClientID, "oidc-client-id", "", "openid connect client id")
+	CommandLine.StringVar(&oidcClientSecret, "oidc-client-secret", "", "openid connect client secret")
+	CommandLine.StringVar(&oidcRedirectURL, "oidc-redirect-url", "", "login callback url registered at the provider, defaults to -public-url followed by "+oidcPrefix+"callback")
+	CommandLine.StringVar(&oidcScopes, "oidc-scopes", "openid email profile", "space separated scopes requested at login")
+	CommandLine.Var(&oidcAllowEmails, "oidc-allow-email", "only allow users with a verified email matching this pattern, e.g. *@example.com, repeatable, empty allows every user of the provider")
+	CommandLine.DurationVar(&oidcSessionTTL, "oidc-session-ttl", 12*time.Hour, "how long a login stays valid")
+	CommandLine.StringVar(&oidcCookieSecret, "oidc-cookie-secret", "", "secret protecting session cookies, defaults to one derived from the sign key")
+}
+
+func oidcEnabled() bool {
+	return oidcIssuer != ""
+}
+
+// oidcProvider is the part of the provider's discovery document the login flow needs.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+var (
+	oidcMu     sync.Mutex
+	oidcConfig *oidcProvider
+	oidcKeys   = &jwkSet{}
+)
+
+func setupOIDC() error {
+	if oidcClientID == "" {
+		return errors.New("-oidc-issuer needs -oidc-client-id")
+	}
+	if oidcRedirectURL == "" {
+		if publicURL == "" {
+			return errors.New("-oidc-issuer needs -oidc-redirect-url or -public-url")
+		}
+		oidcRedirectURL = strings.TrimSuffix(publicURL, "/") + oidcPrefix + "callback"
+	}
+	if _, err := discoverOIDC(); err != nil {
+		// retried on the first login
+		noticef(levelWarn, "warning: failed to discover openid connect provider: %s", err.Error())
+	}
+	return nil
+}
+
+// discoverOIDC fetches the provider configuration once it is needed and caches it.
+func discoverOIDC() (*oidcProvider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcConfig != nil {
+		return oidcConfig, nil
+	}
+	issuer := strings.TrimSuffix(oidcIssuer, "/")
+	res, err := apiClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery responded %s", res.Status)
+	}
+	var p oidcProvider
+	if err := json.NewDecoder(http.MaxBytesReader(nil, res.Body, maxAPIResponseSize)).Decode(&p); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("provider reports issuer %q", p.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks endpoints")
+	}
+	oidcKeys.url = p.JWKSURI
+	oidcConfig = &p
+	return oidcConfig, nil
+}
+
+func oidcCookieKey() []byte {
+	secret := oidcCookieSecret
+	if secret == "" {
+		secret = signingKey()
+	}
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte("openlist-proxy oidc cookie"))
+	return m.Sum(nil)
+}
+
+// sealCookie encodes v with a mac so clients cannot forge it.
+func sealCookie(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	m := hmac.New(sha256.New, oidcCookieKey())
+	m.Write(b)
+	return base64.RawURLEncoding.EncodeToString(b) + "." + base64.RawURLEncoding.EncodeToString(m.Sum(nil)), nil
+}
+
+// openCookie decodes a value of sealCookie into v, reporting whether it is authentic.
+func openCookie(value string, v any) bool {
+	payload, mac, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil {
+		return false
+	}
+	m := hmac.New(sha256.New, oidcCookieKey())
+	m.Write(b)
+	if !hmac.Equal(got, m.Sum(nil)) {
+		return false
+	}
+	return json.Unmarshal(b, v) == nil
+}
+
+type oidcSession struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Expire  int64  `json:"exp"`
+}
+
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+	Expire   int64  `json:"exp"`
+}
+
+// oidcUser returns the session of a logged in browser.
+func oidcUser(r *http.Request) (oidcSession, bool) {
+	var sess oidcSession
+	c, err := r.Cookie(oidcSessionCookie)
+	if err != nil || !openCookie(c.Value, &sess) {
+		return oidcSession{}, false
+	}
+	return sess, time.Now().Unix() < sess.Expire
+}
+
+// stripCookie removes the cookie name from r, so it is not forwarded to origins.
+func stripCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func secureCookies() bool {
+	return strings.HasPrefix(oidcRedirectURL, "https://")
+}
+
+// oidcLogin redirects browsers to the provider and rejects other clients.
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		errorResponseWithStatus(w, http.StatusUnauthorized, 401, "login required")
+		return
+	}
+	p, err := discoverOIDC()
+	if err != nil {
+		errorResponse(w, 500, "openid connect provider unavailable: "+err.Error())
+		return
+	}
+	st := oidcState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Return:   basePath + r.URL.RequestURI(),
+		Expire:   time.Now().Add(oidcStateTTL).Unix(),
+	}
+	value, err := sealCookie(st)
+	if err != nil {
+		errorResponse(w, 500, err.Error())
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcStateCookie, Value: value, Path: basePath + oidcPrefix, MaxAge: int(oidcStateTTL.Seconds()),
+		HttpOnly: true, Secure: secureCookies(), SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcClientID},
+		"redirect_uri":          {oidcRedirectURL},
+		"scope":                 {oidcScopes},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// serveOIDC handles the reserved login paths.
+func serveOIDC(w http.ResponseWriter, r *http.Request, action string) {
+	switch action {
+	case "callback":
+		oidcCallback(w, r)
+	case "logout":
+		http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie, Path: basePath + "/", MaxAge: -1, HttpOnly: true, Secure: secureCookies()})
+		errorResponse(w, 200, "logged out")
+	default:
+		errorResponse(w, 404, "not found")
+	}
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	var st oidcState
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || !openCookie(c.Value, &st) || time.Now().Unix() > st.Expire {
+		errorResponseWithStatus(w, http.StatusBadRequest, 400, "login expired, open the link again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: basePath + oidcPrefix, MaxAge: -1, HttpOnly: true, Secure: secureCookies()})
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		errorResponseWithStatus(w, http.StatusForbidden, 403, "login failed: "+e)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(st.State)) != 1 {
+		errorResponseWithStatus(w, http.StatusBadRequest, 400, "login state mismatch")
+		return
+	}
+	sess, err := oidcExchange(q.Get("code"), st)
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusForbidden, 403, "login failed: "+err.Error())
+		return
+	}
+	value, err := sealCookie(sess)
+	if err != nil {
+		errorResponse(w, 500, err.Error())
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcSessionCookie, Value: value, Path: basePath + "/", Expires: time.Unix(sess.Expire, 0),
+		HttpOnly: true, Secure: secureCookies(), SameSite: http.SameSiteLaxMode,
+	})
+	target := st.Return
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		// only ever return to this proxy
+		target = basePath + "/"
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// oidcExchange redeems the authorization code and verifies the returned id token.
+func oidcExchange(code string, st oidcState) (oidcSession, error) {
+	p, err := discoverOIDC()
+	if err != nil {
+		return oidcSession{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURL},
+		"code_verifier": {st.Verifier},
+	}
+	req, _ := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(oidcClientID), url.QueryEscape(oidcClientSecret))
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return oidcSession{}, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, res.Body, maxAPIResponseSize)).Decode(&token); err != nil {
+		return oidcSession{}, fmt.Errorf("token endpoint responded %s", res.Status)
+	}
+	if token.IDToken == "" {
+		return oidcSession{}, fmt.Errorf("no id token: %s", token.Error)
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(oidcClientID),
+		jwt.WithExpirationRequired(),
+	).ParseWithClaims(token.IDToken, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return oidcKeys.key(kid)
+	})
+	if err != nil {
+		return oidcSession{}, err
+	}
+	if nonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(nonce), []byte(st.Nonce)) != 1 {
+		return oidcSession{}, errors.New("nonce mismatch")
+	}
+	sess := oidcSession{Expire: time.Now().Add(oidcSessionTTL).Unix()}
+	sess.Subject, _ = claims["sub"].(string)
+	sess.Email, _ = claims["email"].(string)
+	if !oidcEmailAllowed(sess.Email, claims["email_verified"]) {
+		return oidcSession{}, fmt.Errorf("user %q is not allowed", sess.Email)
+	}
+	return sess, nil
+}
+
+func oidcEmailAllowed(email string, verified any) bool {
+	if len(oidcAllowEmails) == 0 {
+		return true
+	}
+	if email == "" || verified == false {
+		return false
+	}
+	for _, pattern := range oidcAllowEmails {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(email)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	signMaxUses      int
+	signUseTTL       time.Duration
+	signResumeWindow time.Duration
+)
+
+func init() {
+	CommandLine.IntVar(&signMaxUses, "sign-max-uses", 0, "how many times a sign can be used, e.g. 1 for one-time links, 0 is unlimited")
+	CommandLine.DurationVar(&signUseTTL, "sign-use-ttl", 7*24*time.Hour, "how long uses of signs that never expire are remembered")
+	CommandLine.DurationVar(&signResumeWindow, "sign-resume-window", 24*time.Hour, "range requests of a client within this time of its last request with a sign resume its download and are not counted as another use")
+
+	registerState("signuses", func() any { return &signUseStore{} })
+}
+
+const signUseSaveInterval = 30 * time.Second
+
+type signUse struct {
+	Uses int `json:"uses"`
+	// Expire is the unix time the record can be forgotten.
+	Expire int64 `json:"expire"`
+	// Clients are the client identities that used the sign, to recognize resumed downloads.
+	Clients map[string]*signClient `json:"clients,omitempty"`
+}
+
+type signClient struct {
+	// Use is the use the download of the client was counted as.
+	Use int `json:"use"`
+	// Seen is the unix time of the last request of the client.
+	Seen int64 `json:"seen"`
+	// Validator is the ETag or Last-Modified the client was served, resumes must match it.
+	Validator string `json:"validator,omitempty"`
+}
+
+// maxSignClients bounds the clients remembered per sign.
+const maxSignClients = 64
+
+// signUseStore counts the uses of signs until they expire.
+type signUseStore struct {
+	mu    sync.Mutex
+	Signs map[string]*signUse `json:"signs"`
+	dirty bool
+}
+
+var signUses = &signUseStore{Signs: map[string]*signUse{}}
+
+func loadSignUses() error {
+	if rdb != nil {
+		// the instances count the uses in redis
+		return nil
+	}
+	signUses.mu.Lock()
+	defer signUses.mu.Unlock()
+	if err := loadState("signuses", signUses); err != nil {
+		return err
+	}
+	if signUses.Signs == nil {
+		signUses.Signs = map[string]*signUse{}
+	}
+	go func() {
+		for range time.Tick(signUseSaveInterval) {
+			signUses.save()
+		}
+	}()
+	return nil
+}
+
+func (st *signUseStore) save() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now().Unix()
+	for k, u := range st.Signs {
+		if u.Expire < now {
+			delete(st.Signs, k)
+			st.dirty = true
+		}
+	}
+	if !st.dirty {
+		return
+	}
+	if err := saveState("signuses", st); err != nil {
+		noticef(levelError, "failed to save sign uses: %s", err.Error())
+		return
+	}
+	st.dirty = false
+}
+
+// use records a use of the sign value by client and returns which use it is, including this one.
+// A ranged request resuming the recent download of a client, with an If-Range validator
+// matching what was served if it sends one, is the same use as that download.
+func (st *signUseStore) use(value, client string, ranged bool, ifRange string) (int, error) {
+	now := time.Now().Unix()
+	expire, _ := signExpire(value)
+	if expire == 0 {
+		expire = now + int64(signUseTTL.Seconds())
+	}
+	if rdb != nil {
+		var n int
+		err := redisUpdate(redisKey("sign", value), func(u *signUse, found bool) (time.Time, bool) {
+			if !found {
+				u.Expire = expire
+			}
+			n = u.use(client, ranged, ifRange, now)
+			return time.Unix(u.Expire, 0), true
+		})
+		return n, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	u, ok := st.Signs[value]
+	if !ok {
+		u = &signUse{Expire: expire}
+		st.Signs[value] = u
+	}
+	st.dirty = true
+	return u.use(client, ranged, ifRange, now), nil
+}
+
+func (u *signUse) use(client string, ranged bool, ifRange string, now int64) int {
+	if c, ok := u.Clients[client]; ok && ranged && now-c.Seen <= int64(signResumeWindow.Seconds()) &&
+		(ifRange == "" || c.Validator == "" || ifRange == c.Validator) {
+		c.Seen = now
+		return c.Use
+	}
+	u.Uses++
+	if u.Clients == nil {
+		u.Clients = map[string]*signClient{}
+	}
+	if len(u.Clients) < maxSignClients || u.Clients[client] != nil {
+		u.Clients[client] = &signClient{Use: u.Uses, Seen: now}
+	}
+	return u.Uses
+}
+
+// served remembers the validator of the response a client got for the sign value.
+func (st *signUseStore) served(value, client string, header http.Header) {
+	validator := header.Get("ETag")
+	if validator == "" {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		return
+	}
+	if rdb != nil {
+		err := redisUpdate(redisKey("sign", value), func(u *signUse, found bool) (time.Time, bool) {
+			return time.Unix(u.Expire, 0), found && u.served(client, validator)
+		})
+		if err != nil {
+			logf(levelWarn, "failed to save the validator of a sign in redis: %s", err.Error())
+		}
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if u, ok := st.Signs[value]; ok && u.served(client, validator) {
+		st.dirty = true
+	}
+}
+
+// served sets the validator of client and reports whether it changed.
+func (u *signUse) served(client, validator string) bool {
+	if c, ok := u.Clients[client]; ok && c.Validator != validator {
+		c.Validator = validator
+		return true
+	}
+	return false
+}
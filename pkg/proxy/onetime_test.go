@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useOnce runs one use of value by each of clients at the same time and returns the uses counted.
+func useOnce(t *testing.T, st *signUseStore, value string, clients []string, ranged bool) []int {
+	t.Helper()
+	uses := make([]int, len(clients))
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			n, err := st.use(value, client, ranged, "")
+			if err != nil {
+				t.Error(err)
+			}
+			uses[i] = n
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return uses
+}
+
+func TestSignUsesConcurrent(t *testing.T) {
+	st := &signUseStore{Signs: map[string]*signUse{}}
+	clients := make([]string, 50)
+	for i := range clients {
+		clients[i] = fmt.Sprintf("ip:192.0.2.%d", i)
+	}
+	uses := useOnce(t, st, "sign:0", clients, false)
+	first := uses[0]
+	slices.Sort(uses)
+	for i, n := range uses {
+		if n != i+1 {
+			t.Fatalf("the uses counted are %v, expected every one of 1 to %d once", uses, len(clients))
+		}
+	}
+
+	// the resumes of a download are the use it was counted as
+	resumes := useOnce(t, st, "sign:0", slices.Repeat(clients[:1], 20), true)
+	for _, n := range resumes {
+		if n != first {
+			t.Fatalf("resumes were counted as the uses %v, expected %d", resumes, first)
+		}
+	}
+	if got := st.Signs["sign:0"].Uses; got != len(clients) {
+		t.Errorf("counted %d uses after the resumes, expected %d", got, len(clients))
+	}
+}
+
+func TestAuthorizeSignMaxUses(t *testing.T) {
+	old := signUses
+	t.Cleanup(func() { signUses = old })
+	signUses = &signUseStore{Signs: map[string]*signUse{}}
+	setFlags(t, map[string]string{"sign-max-uses": "3", "disable-sign": "false"})
+	req := &downloadRequest{Path: "/file.bin", Sign: currentSigner().Sign("/file.bin", time.Now().Add(time.Hour).Unix())}
+
+	var allowed, denied atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/file.bin", nil)
+			r.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+			w := httptest.NewRecorder()
+			if authorize(w, r, req) {
+				allowed.Add(1)
+				return
+			}
+			if w.Code != http.StatusForbidden {
+				t.Errorf("denied with %d, expected 403", w.Code)
+			}
+			denied.Add(1)
+		}()
+	}
+	wg.Wait()
+	if allowed.Load() != 3 || denied.Load() != 17 {
+		t.Errorf("allowed %d and denied %d downloads of 20 with -sign-max-uses 3", allowed.Load(), denied.Load())
+	}
+}
@@ -0,0 +1,800 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	port              int
+	https             bool
+	help              bool
+	showVersion       bool
+	disableSign       bool
+	certFile, keyFile string
+	address, token    string
+)
+
+// Version is reported by -version, telemetry and state exports, set by the command at build time.
+var Version = "dev"
+
+// CommandLine holds the flags of the proxy, which each file registers for what it configures.
+// It is separate from flag.CommandLine so embedding the proxy can't clash with the flags of
+// the service around it.
+var CommandLine = flag.NewFlagSet("openlist-proxy", flag.ContinueOnError)
+
+func init() {
+	CommandLine.IntVar(&port, "port", 5243, "the proxy port.")
+	CommandLine.BoolVar(&https, "https", false, "use https protocol.")
+	CommandLine.BoolVar(&help, "help", false, "show help")
+	CommandLine.BoolVar(&showVersion, "version", false, "show version and exit")
+	CommandLine.BoolVar(&disableSign, "disable-sign", false, "disable signature verification")
+	CommandLine.StringVar(&certFile, "cert", "server.crt", "cert file")
+	CommandLine.StringVar(&keyFile, "key", "server.key", "key file")
+	CommandLine.StringVar(&address, "address", "", "openlist address, a comma separated list fails over to the next backend when one is unreachable")
+	CommandLine.StringVar(&token, "token", "", "openlist token")
+}
+
+type Json map[string]interface{}
+
+type Result struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+func errorResponse(w http.ResponseWriter, code int, msg string) {
+	errorResponseWithStatus(w, errorStatus(code), code, msg)
+}
+
+// errorResponseWithStatus writes the JSON error body with an explicit HTTP status,
+// or the html error page of the code to browsers.
+func errorResponseWithStatus(w http.ResponseWriter, status, code int, msg string) {
+	errorResponseWithBody(w, status, code, msg, Result{Code: code, Msg: msg})
+}
+
+// errorResponseWithBody is errorResponseWithStatus with a JSON body telling more than the
+// Result, which is only sent to clients that get JSON errors.
+func errorResponseWithBody(w http.ResponseWriter, status, code int, msg string, body any) {
+	hookErrorResponse(w, code, msg)
+	if writeS3Error(w, code, msg) {
+		return
+	}
+	if code >= 400 && code <= 599 && writeErrorPage(w, code, msg) {
+		return
+	}
+	w.Header().Set("content-type", "text/json")
+	res, _ := json.Marshal(body)
+	w.WriteHeader(status)
+	_, _ = w.Write(res)
+}
+
+// apiErrorResponse reports err from an OpenList API call, keeping the code of API errors.
+func apiErrorResponse(w http.ResponseWriter, err error) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		errorResponse(w, apiErr.Code, apiErr.Message)
+		return
+	}
+	errorResponse(w, 500, err.Error())
+}
+
+// proxyHandle serves the proxy listener, dispatching reserved paths before proxying downloads.
+func proxyHandle(w http.ResponseWriter, r *http.Request) {
+	if !hookRequest(w, r) {
+		return
+	}
+	if code, ok := strings.CutPrefix(r.URL.Path, shortLinkPrefix); ok {
+		serveShortLink(w, r, code)
+		return
+	}
+	if action, ok := strings.CutPrefix(r.URL.Path, oidcPrefix); ok && oidcEnabled() {
+		serveOIDC(w, r, action)
+		return
+	}
+	if r.URL.Path == preparePath {
+		servePrepare(w, r)
+		return
+	}
+	if r.URL.Path == signAPIPath && r.Method == http.MethodPost && signAPIToken != "" {
+		serveSignAPI(w, r)
+		return
+	}
+	if p, ok := davPath(r.URL.Path); ok {
+		serveWebDAV(w, r, p)
+		return
+	}
+	if r.Method == http.MethodPut && uploadEnabled {
+		serveUpload(w, r)
+		return
+	}
+	if serveLanding(w, r) {
+		return
+	}
+	if !methodAllowed(w, r) {
+		return
+	}
+	downHandle(w, r)
+}
+
+// authorize checks the credentials of a download: a jwt or basic auth Authorization header,
+// or the sign query. It writes the error response and returns false when access is denied.
+func authorize(w http.ResponseWriter, r *http.Request, req *downloadRequest) bool {
+	filePath := req.Path
+	if oidcEnabled() {
+		// the session is for the proxy, not the origin
+		defer stripCookie(r, oidcSessionCookie)
+	}
+	if k := getRequestInfo(r).apiKey; k != nil {
+		if !k.allows(filePath) {
+			errorResponse(w, 403, "api key does not grant access to this path")
+			return false
+		}
+		return true
+	}
+	if raw, ok := bearerToken(r); ok && jwtEnabled() {
+		claims, code, err := verifyJWT(raw, filePath)
+		if err != nil {
+			auditEvent(r, "auth_failure", code, "jwt: "+err.Error())
+			autobanSignFailure(r)
+			errorResponse(w, code, err.Error())
+			return false
+		}
+		getRequestInfo(r).bandwidthClass, _ = claims[jwtClassClaim].(string)
+		// the token is for the proxy, not the origin
+		r.Header.Del("Authorization")
+		return true
+	}
+	if jwtRequired {
+		errorResponse(w, 401, "bearer token required")
+		return false
+	}
+	if user, pass, ok := r.BasicAuth(); ok && basicAuthEnabled() {
+		if !validBasicAuth(user, pass) {
+			auditEvent(r, "auth_failure", http.StatusUnauthorized, "basic auth of "+user)
+			autobanSignFailure(r)
+			basicAuthChallenge(w)
+			return false
+		}
+		r.Header.Del("Authorization")
+		return true
+	}
+	if oidcEnabled() && req.Sign == "" {
+		if _, ok := oidcUser(r); ok {
+			return true
+		}
+		oidcLogin(w, r)
+		return false
+	}
+	if basicAuthEnabled() && (disableSign || req.Sign == "") {
+		basicAuthChallenge(w)
+		return false
+	}
+	if disableSign {
+		return true
+	}
+	// If signature verification is not disabled, perform signature verification
+	sign := req.Sign
+	if code, err := verifySign(filePath, sign); err != nil {
+		auditEvent(r, "sign_failure", code, err.Error())
+		autobanSignFailure(r)
+		errorResponse(w, code, err.Error())
+		return false
+	}
+	if signMaxUses == 0 {
+		return true
+	}
+	uses, err := signUses.use(sign, clientIdentity(r), req.Ranges != nil, r.Header.Get("If-Range"))
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusServiceUnavailable, 503, "failed to count the use of the sign: "+err.Error())
+		return false
+	}
+	if uses > signMaxUses {
+		auditEvent(r, "sign_failure", 403, "sign already used")
+		errorResponse(w, 403, "sign already used")
+		return false
+	}
+	return true
+}
+
+func downHandle(w http.ResponseWriter, r *http.Request) {
+	req, err := parseDownloadRequest(r.URL.Path, r.URL.RawQuery, r.Header.Get("Range"))
+	if err != nil {
+		errorResponse(w, 400, err.Error())
+		return
+	}
+	if req.Ranges == nil {
+		// forwarding a malformed range would leave its meaning to the origin
+		r.Header.Del("Range")
+	}
+	req.Path = tenantPath(r, req.Path)
+	if !authorize(w, r, req) {
+		return
+	}
+	if req.Preview && r.Method == http.MethodGet {
+		servePreview(w, r, req)
+		return
+	}
+	serveDownload(w, r, req)
+}
+
+// serveDownload answers an authorized download from the content cache, its peers or the origin.
+func serveDownload(w http.ResponseWriter, r *http.Request, req *downloadRequest) {
+	filePath := req.Path
+	w = limitTransfer(w)
+	if !fileTypeAllowed(w, filePath, "", false) {
+		return
+	}
+	if serveCached(w, r, req) || serveSegments(w, r, req) {
+		return
+	}
+	if servePeer(w, r, req) {
+		return
+	}
+
+	var link *Link
+	var err error
+	if d, name, ok := directDriverFor(filePath); ok {
+		if link = d.serve(w, r, name); link == nil {
+			return
+		}
+	} else {
+		link, err = fetchLink(r.Context(), filePath)
+		if r.Context().Err() != nil {
+			// the client left, nobody waits for the answer
+			return
+		}
+		mirrorLink(filePath, link, err)
+		if deleted := tombstones.observe(filePath, err); !deleted.IsZero() {
+			serveTombstone(w, r, filePath, deleted)
+			return
+		}
+	}
+	if err != nil {
+		if serveSpecialObject(w, r, filePath) {
+			return
+		}
+		apiErrorResponse(w, err)
+		return
+	}
+	link.Url, err = normalizeLinkURL(link.Url, link.backend)
+	if err != nil {
+		errorResponse(w, 500, err.Error())
+		return
+	}
+	if link, err = hookLinkResolved(r, filePath, link); err != nil {
+		hookError(w, err)
+		return
+	}
+	backendServed.inc(link.backend)
+	if redirectMode && len(link.Header) == 0 && !rewritesRequestHeaders(filePath, link.Url) {
+		// clients follow a single url, the one of the mirror known to be fastest
+		l := *link
+		l.Url = orderMirrors(link.mirrors())[0]
+		if !fileTypeAllowed(w, filePath, "", true) {
+			return
+		}
+		serveRedirect(w, r, &l)
+		return
+	}
+	if cn := clientCN(r); cn != "" {
+		logf(levelInfo, "proxy: %s (client %s)", link.Url, cn)
+	} else {
+		logf(levelInfo, "proxy: %s", link.Url)
+	}
+	// the origin is left as soon as the client is
+	req2, _ := http.NewRequestWithContext(r.Context(), r.Method, link.Url, nil)
+	forwardClientHeaders(req2, r)
+	maps.Copy(req2.Header, link.Header)
+	req2.Header.Set(requestIDHeader, getRequestInfo(r).id)
+	rewriteRequestHeaders(filePath, req2)
+	firstRange(req, req2)
+	hashes := lookupHashes(r, filePath)
+	relink := func() (*Link, error) {
+		linkCache.purge(filePath)
+		l, err := fetchLink(r.Context(), filePath)
+		if err != nil {
+			return nil, err
+		}
+		l.Url, err = normalizeLinkURL(l.Url, l.backend)
+		return l, err
+	}
+	res2, mirrors, err := fetchLinkURL(r, req2, link)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		if serveSpecialObject(w, r, filePath) {
+			return
+		}
+		errorResponse(w, 500, err.Error())
+		return
+	}
+	req2, link, res2, mirrors = retryExpiredLink(r, req2, filePath, link, res2, mirrors, relink)
+	defer func() {
+		_ = res2.Body.Close()
+	}()
+	if signMaxUses > 0 && req.Sign != "" && res2.StatusCode/100 == 2 {
+		signUses.served(req.Sign, clientIdentity(r), res2.Header)
+	}
+	if res2.StatusCode == http.StatusNotFound || res2.StatusCode == http.StatusGone {
+		// the origin forgot the file, a cached link of it is stale
+		linkCache.purge(filePath)
+		contentCache.purge(filePath)
+	}
+	if res2.StatusCode >= 400 && serveSpecialObject(w, r, filePath) {
+		return
+	}
+	observeRanges(req2, res2)
+	if !checkRange(w, r, filePath, res2) {
+		return
+	}
+	if !limitFileSize(w, r, res2) {
+		return
+	}
+	if res2.StatusCode/100 == 2 && !fileTypeAllowed(w, filePath, res2.Header.Get("Content-Type"), true) {
+		return
+	}
+	synthesizeRange(r, req, res2)
+	multiRange(r, req, res2)
+	advertiseRanges(res2)
+	res2.Header.Del("Access-Control-Allow-Origin")
+	res2.Header.Del("set-cookie")
+	res2.Header.Del("Alt-Svc")
+	rewriteResponseHeaders(filePath, res2)
+	applyPolicyResponse(r, res2)
+	if err := hookResponse(r, res2); err != nil {
+		hookError(w, err)
+		return
+	}
+	maps.Copy(w.Header(), res2.Header)
+	setCORSHeaders(w, r)
+	w.WriteHeader(res2.StatusCode)
+	accelerate(res2)
+	resumable(res2, mirrors, relink)
+	res2.Body = watchStall(res2.Body)
+	verifyIntegrity(w, res2, filePath, hashes)
+	teeCache(res2, filePath)
+	teeSegments(res2, filePath)
+	copyBody(w, r, res2)
+}
+
+// accessRules wraps next in the handlers deciding which clients may download, innermost last.
+func accessRules(next http.Handler) http.Handler {
+	handler := next
+	if policyFile != "" {
+		handler = policyHandler(handler)
+	}
+	if uaEnabled() {
+		handler = userAgentHandler(handler)
+	}
+	if refererEnabled() {
+		handler = refererHandler(handler)
+	}
+	if geoIPDB != "" {
+		handler = geoIPHandler(handler)
+	}
+	handler = apiKeyHandler(handler)
+	// preflights carry no credentials, they are answered before any of them are required
+	handler = preflightHandler(handler)
+	if aclEnabled() {
+		handler = aclHandler(handler)
+	}
+	return banHandler(handler)
+}
+
+// downloadLimits wraps next in the compression, quotas, limits and access rules that apply to
+// every download, whichever listener it comes from.
+func downloadLimits(next http.Handler) http.Handler {
+	handler := next
+	if compress {
+		handler = compressHandler(handler)
+	}
+	handler = quotaHandler(handler)
+	if maxConns > 0 || maxConnsPerIP > 0 {
+		handler = concurrencyHandler(handler)
+	}
+	if rateLimit > 0 {
+		handler = rateLimitHandler(handler)
+	}
+	if maxBodySize > 0 {
+		handler = requestLimitsHandler(handler)
+	}
+	return accessRules(handler)
+}
+
+// configure applies the config files and everything the commands need as well.
+func configure() error {
+	if err := loadConfigFiles(); err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := loadPlugins(); err != nil {
+		return err
+	}
+	if err := applyLowMemoryProfile(); err != nil {
+		return err
+	}
+	if err := setupTransport(); err != nil {
+		return err
+	}
+	setupBackends()
+	if err := setupDualListeners(); err != nil {
+		return err
+	}
+	if err := loadTokenFile(); err != nil {
+		return fmt.Errorf("failed to read token: %w", err)
+	}
+	if vaultEnabled() {
+		if err := setupVault(); err != nil {
+			return fmt.Errorf("failed to read secrets from vault: %w", err)
+		}
+	}
+	resetSigner()
+	return nil
+}
+
+// setup validates the flags and loads what serving needs, starting the servers of its own
+// the flags enable, such as -metrics-address and -admin-address.
+func setup() error {
+	// first, so that the warnings of the others reach syslog and journald too
+	if err := setupLogSinks(); err != nil {
+		return err
+	}
+	if err := validateMetrics(); err != nil {
+		return err
+	}
+	if err := validateDefaultScheme(); err != nil {
+		return err
+	}
+	if err := validateDirListing(); err != nil {
+		return err
+	}
+	if err := setupErrorPages(); err != nil {
+		return err
+	}
+	if err := setupLanding(); err != nil {
+		return err
+	}
+	if err := validateBasePath(); err != nil {
+		return err
+	}
+	if err := setupS3(); err != nil {
+		return err
+	}
+	if err := setupSFTP(); err != nil {
+		return err
+	}
+	if err := validateWebDAV(); err != nil {
+		return err
+	}
+	if err := validateMinRate(); err != nil {
+		return err
+	}
+	if err := setupRequestLimits(); err != nil {
+		return err
+	}
+	if err := setupMaintenance(); err != nil {
+		return err
+	}
+	if err := validateReferer(); err != nil {
+		return err
+	}
+	if basicAuthEnabled() {
+		if err := setupBasicAuth(); err != nil {
+			return fmt.Errorf("failed to load basic auth users: %w", err)
+		}
+	}
+	if oidcEnabled() {
+		if err := setupOIDC(); err != nil {
+			return err
+		}
+	}
+	if err := setupJWT(); err != nil {
+		return err
+	}
+	if err := setupUserAgentRules(); err != nil {
+		return err
+	}
+	if err := setupFileTypeRules(); err != nil {
+		return err
+	}
+	setupForwardHeaders()
+	setupResources()
+	setupMemoryLimit()
+	setupBandwidth()
+	if err := setupBandwidthClasses(); err != nil {
+		return err
+	}
+	setupSplice()
+	if metricsAddress != "" {
+		startMetricsServer()
+	}
+
+	if err := setupRedis(); err != nil {
+		return err
+	}
+	if err := setupSharedLimits(); err != nil {
+		return err
+	}
+	if _, err := stateStore(); err != nil {
+		return fmt.Errorf("failed to open the state store: %w", err)
+	}
+	if err := loadShortLinks(); err != nil {
+		return fmt.Errorf("failed to load short links: %w", err)
+	}
+	if signMaxUses > 0 {
+		if err := loadSignUses(); err != nil {
+			return fmt.Errorf("failed to load sign uses: %w", err)
+		}
+	}
+	if err := setupSecurityHeaders(); err != nil {
+		return err
+	}
+	if err := setupCORS(); err != nil {
+		return err
+	}
+	if err := setupTrustedProxies(); err != nil {
+		return fmt.Errorf("invalid -trusted-proxy: %w", err)
+	}
+	if err := loadBans(); err != nil {
+		return fmt.Errorf("failed to load bans: %w", err)
+	}
+	if err := setupAutoban(); err != nil {
+		return err
+	}
+	if aclEnabled() {
+		if err := setupACL(); err != nil {
+			return fmt.Errorf("failed to load cidr lists: %w", err)
+		}
+	}
+	if geoIPDB != "" {
+		if err := setupGeoIP(); err != nil {
+			return fmt.Errorf("failed to load geoip database: %w", err)
+		}
+	}
+	if err := setupAccessLog(); err != nil {
+		return fmt.Errorf("failed to open the access log: %w", err)
+	}
+	if err := setupAudit(); err != nil {
+		return fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	if err := setupContentCache(); err != nil {
+		return fmt.Errorf("failed to open the content cache: %w", err)
+	}
+	if err := setupSegmentCache(); err != nil {
+		return fmt.Errorf("failed to open the segment cache: %w", err)
+	}
+	if err := setupPeerCache(); err != nil {
+		return err
+	}
+	if err := setupTombstones(); err != nil {
+		return fmt.Errorf("failed to load tombstones: %w", err)
+	}
+	if err := setupSLOs(); err != nil {
+		return err
+	}
+	if err := setupACME(); err != nil {
+		return err
+	}
+	if err := setupTenants(); err != nil {
+		return fmt.Errorf("failed to load tenants: %w", err)
+	}
+	if err := setupHeaderRules(); err != nil {
+		return fmt.Errorf("failed to load header rules: %w", err)
+	}
+	if err := setupRoutes(); err != nil {
+		return fmt.Errorf("failed to load routes: %w", err)
+	}
+	if err := setupPolicies(); err != nil {
+		return fmt.Errorf("failed to load policies: %w", err)
+	}
+	if err := setupWASMPlugins(); err != nil {
+		return err
+	}
+	startHealthChecks()
+	if err := setupProgress(); err != nil {
+		return err
+	}
+	startProgress()
+	if err := setupDirectDrivers(); err != nil {
+		return err
+	}
+	if err := setupAPIKeys(); err != nil {
+		return fmt.Errorf("failed to load api keys: %w", err)
+	}
+	if err := loadQuotas(); err != nil {
+		return fmt.Errorf("failed to load quotas: %w", err)
+	}
+	if err := setupErrorReporting(); err != nil {
+		return err
+	}
+	if err := setupEvents(); err != nil {
+		return err
+	}
+	if err := setupWebhooks(); err != nil {
+		return err
+	}
+	if err := setupTraffic(); err != nil {
+		return err
+	}
+	if err := setupStatsDB(); err != nil {
+		return fmt.Errorf("failed to open the stats database: %w", err)
+	}
+	if telemetryURL != "" {
+		if err := startTelemetry(); err != nil {
+			return fmt.Errorf("failed to start telemetry: %w", err)
+		}
+	}
+	if adminAddress != "" {
+		if err := startAdminServer(); err != nil {
+			return err
+		}
+	}
+	if s3Address != "" {
+		startS3Server()
+	}
+	if sftpAddress != "" {
+		if err := startSFTPServer(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newHandler wraps proxyHandle in the middlewares the flags enable.
+func newHandler() http.Handler {
+	handler := downloadLimits(http.HandlerFunc(proxyHandle))
+	if peerCacheEnabled() {
+		handler = peerCacheHandler(handler)
+	}
+	handler = maintenanceHandler(handler)
+	if clientCA != "" {
+		handler = clientCertHandler(handler)
+	}
+	handler = metricsHandler(handler)
+	if securityHeadersEnabled() {
+		handler = securityHeadersHandler(handler)
+	}
+	handler = recoverHandler(handler)
+	if accessLog != nil || len(logSinks) > 0 {
+		handler = accessLogHandler(handler)
+	}
+	handler = errorPagesHandler(handler)
+	if writeIdleTimeout > 0 || minRate > 0 {
+		handler = writeDeadlineHandler(handler)
+	}
+	handler = requestInfoHandler(handler)
+	if basePath != "" {
+		handler = basePathHandler(handler)
+	}
+	return handler
+}
+
+// Main runs the openlist-proxy command with the arguments of the process.
+func Main() {
+	if err := CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		os.Exit(2)
+	}
+	// answered before configure reads the token file or logs in to vault, which may fail
+	if help {
+		CommandLine.Usage()
+		return
+	}
+
+	if showVersion {
+		fmt.Println("Version:", Version)
+		return
+	}
+	startService()
+
+	if err := configure(); err != nil {
+		exitStartup("%s", err.Error())
+	}
+
+	if CommandLine.NArg() > 0 {
+		runCommand(CommandLine.Args())
+		return
+	}
+
+	if checkConfigOnly {
+		if err := runCheckConfig(); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	fmt.Printf("OpenList-Proxy - %s\n", Version)
+	if err := setup(); err != nil {
+		exitStartup("%s", err.Error())
+	}
+	if checkVersion {
+		detectBackendVersion()
+	}
+	handleReloadSignal()
+
+	addrs := listenAddresses()
+	srv := http.Server{
+		Addr:    addrs[0],
+		Handler: newHandler(),
+	}
+	configureHTTP2(&srv)
+	configureTimeouts(&srv)
+	configureLimits(&srv)
+	if clientCA != "" {
+		cfg, err := clientCATLSConfig()
+		if err != nil {
+			exitStartup("failed to load client ca: %s", err.Error())
+		}
+		srv.TLSConfig = cfg
+	}
+
+	if vaultTLSSecret != "" {
+		if srv.TLSConfig == nil {
+			srv.TLSConfig = &tls.Config{}
+		}
+		srv.TLSConfig.GetCertificate = vaultCertificate
+		certFile, keyFile = "", ""
+	}
+	if len(acmeDomains) > 0 {
+		if srv.TLSConfig == nil {
+			srv.TLSConfig = &tls.Config{}
+		}
+		acmeTLSConfig(srv.TLSConfig)
+		certFile, keyFile = "", ""
+	}
+	if https && certFile != "" {
+		if srv.TLSConfig == nil {
+			srv.TLSConfig = &tls.Config{}
+		}
+		if err := setupListenerCert(); err != nil {
+			exitStartup("failed to load the certificate: %s", err.Error())
+		}
+		srv.TLSConfig.GetCertificate = listenerCertificate
+		certFile, keyFile = "", ""
+	}
+	if tenantsFile != "" && https {
+		if srv.TLSConfig == nil {
+			srv.TLSConfig = &tls.Config{}
+		}
+		tenantTLSConfig(srv.TLSConfig)
+	}
+	if https {
+		if err := applyTLSPolicy(srv.TLSConfig); err != nil {
+			exitStartup("%s", err.Error())
+		}
+	}
+
+	if http3Enabled {
+		h3, err := startHTTP3(srv.TLSConfig, srv.Handler)
+		if err != nil {
+			exitStartup("failed to start http/3: %s", err.Error())
+		}
+		srv.Handler = altSvcHandler(h3, srv.Handler)
+	}
+	if dualListeners() {
+		srv.Handler = plainHandler(srv.Handler)
+	}
+
+	startACMEHTTP()
+	handleStop(&srv)
+	if err := serveListeners(&srv, addrs); err != nil {
+		exitStartup("failed to start: %s", err.Error())
+	}
+}
+
+// exitStartup reports why the proxy can't serve on stderr and exits with status 1, so that
+// supervisors like systemd, docker or the windows service manager see the failure.
+func exitStartup(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The parsers in this file are pure functions of strings taken from the request, so they
+// can be fuzzed in isolation. They never panic and report malformed input as *requestError.
+
+// requestError is a malformed part of a download request.
+type requestError struct {
+	Field  string
+	Reason string
+}
+
+func (e *requestError) Error() string {
+	return "invalid " + e.Field + ": " + e.Reason
+}
+
+// maxRanges bounds the ranges of a Range header, more are treated as abuse.
+const maxRanges = 64
+
+// downloadRequest is the parsed form of a download request.
+type downloadRequest struct {
+	Path string
+	// Sign is the sign query value, empty when the request has none.
+	Sign string
+	// Ranges are the requested byte ranges, nil without a valid Range header.
+	Ranges []byteRange
+	// Preview is set by ?preview=1, showing text files in the browser.
+	Preview bool
+}
+
+// byteRange is one range of a Range header. Start < 0 is a suffix range of the last
+// End bytes, End < 0 an open range from Start to the end.
+type byteRange struct {
+	Start, End int64
+}
+
+// parseDownloadRequest parses the decoded path, raw query and Range header of a download.
+// A malformed Range header is not an error, it is ignored as RFC 9110 asks.
+func parseDownloadRequest(p, rawQuery, rangeHeader string) (*downloadRequest, error) {
+	filePath, err := normalizePath(p)
+	if err != nil {
+		return nil, err
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, &requestError{Field: "query", Reason: "malformed encoding"}
+	}
+	req := &downloadRequest{Path: filePath}
+	if signs := query["sign"]; len(signs) > 1 {
+		return nil, &requestError{Field: "sign", Reason: "given more than once"}
+	} else if len(signs) == 1 {
+		req.Sign = signs[0]
+	}
+	if rangeHeader != "" {
+		req.Ranges, _ = parseRange(rangeHeader)
+	}
+	req.Preview = query.Get("preview") == "1" || query.Get("preview") == "true"
+	return req, nil
+}
+
+// normalizePath validates a decoded request path. Paths must be absolute and must not
+// contain control characters or dot segments, which are rejected rather than cleaned
+// since the sign covers the exact path.
+func normalizePath(p string) (string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", &requestError{Field: "path", Reason: "not absolute"}
+	}
+	for i := 0; i < len(p); i++ {
+		if c := p[i]; c < 0x20 || c == 0x7f {
+			return "", &requestError{Field: "path", Reason: "contains control characters"}
+		}
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "." || seg == ".." {
+			return "", &requestError{Field: "path", Reason: "contains dot segments"}
+		}
+	}
+	return p, nil
+}
+
+// signExpire extracts the expire timestamp of a sign ("<hmac>:<expire>").
+func signExpire(value string) (int64, bool) {
+	i := strings.LastIndex(value, ":")
+	if i < 0 || i == len(value)-1 {
+		return 0, false
+	}
+	expire, err := strconv.ParseInt(value[i+1:], 10, 64)
+	return expire, err == nil && expire >= 0
+}
+
+// parseRange parses a Range header of the bytes unit.
+func parseRange(header string) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, &requestError{Field: "range", Reason: "unsupported unit"}
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) > maxRanges {
+		return nil, &requestError{Field: "range", Reason: "too many ranges"}
+	}
+	ranges := make([]byteRange, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			// empty list elements are allowed by the list syntax
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, &requestError{Field: "range", Reason: "missing -"}
+		}
+		var r byteRange
+		var err error
+		switch {
+		case first == "":
+			r.Start = -1
+			r.End, err = parseRangeInt(last)
+			if err == nil && r.End == 0 {
+				return nil, &requestError{Field: "range", Reason: "empty suffix range"}
+			}
+		default:
+			r.Start, err = parseRangeInt(first)
+			r.End = -1
+			if err == nil && last != "" {
+				r.End, err = parseRangeInt(last)
+				if err == nil && r.End < r.Start {
+					return nil, &requestError{Field: "range", Reason: "end before start"}
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, &requestError{Field: "range", Reason: "no ranges"}
+	}
+	return ranges, nil
+}
+
+// parseRangeInt parses a range position, digits only unlike strconv.ParseInt.
+func parseRangeInt(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, &requestError{Field: "range", Reason: "invalid position"}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, &requestError{Field: "range", Reason: "position out of range"}
+	}
+	return n, nil
+}
+
+// resolve returns the offset and length of r within an object of size bytes,
+// ok is false when the range cannot be satisfied.
+func (r byteRange) resolve(size int64) (offset, length int64, ok bool) {
+	if r.Start < 0 {
+		n := min(r.End, size)
+		return size - n, n, n > 0
+	}
+	if r.Start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if r.End >= 0 {
+		end = min(r.End, end)
+	}
+	return r.Start, end - r.Start + 1, true
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func FuzzParseDownloadRequest(f *testing.F) {
+	for _, seed := range []struct{ path, query, rng string }{
+		{"/file.bin", "", ""},
+		{"/dir/file.bin", "sign=abc:0", "bytes=0-99"},
+		{"/dir/file.bin", "sign=abc:0&sign=def:0", ""},
+		{"/dir/../etc/passwd", "", ""},
+		{"relative", "", ""},
+		{"/a\x00b", "", ""},
+		{"/file", "preview=1&sign=%zz", "bytes=-500"},
+		{"/file", "preview=true", "bytes=5-,0-0,,10-20"},
+		{"/file", "", "items=0-1"},
+		{"/file", "", "bytes=99999999999999999999-"},
+	} {
+		f.Add(seed.path, seed.query, seed.rng)
+	}
+	f.Fuzz(func(t *testing.T, p, rawQuery, rangeHeader string) {
+		req, err := parseDownloadRequest(p, rawQuery, rangeHeader)
+		if err != nil {
+			var reqErr *requestError
+			if !errors.As(err, &reqErr) {
+				t.Fatalf("error %v is no *requestError", err)
+			}
+			if req != nil {
+				t.Fatalf("returned %+v with the error %v", req, err)
+			}
+			return
+		}
+		if req == nil {
+			t.Fatal("returned neither a request nor an error")
+		}
+		if !strings.HasPrefix(req.Path, "/") {
+			t.Fatalf("path %q is not absolute", req.Path)
+		}
+		checkRanges(t, req.Ranges)
+	})
+}
+
+func FuzzParseRange(f *testing.F) {
+	for _, seed := range []struct {
+		header string
+		size   int64
+	}{
+		{"bytes=0-0", 1},
+		{"bytes=0-", 0},
+		{"bytes=-1", 10},
+		{"bytes=-100", 10},
+		{"bytes=5-2", 10},
+		{"bytes=10-", 10},
+		{"bytes=0-9223372036854775807", 1 << 40},
+		{"bytes=1-2, 4-5 ,,", 100},
+		{"bytes= -", 100},
+		{"bytes=" + strings.Repeat("0-0,", maxRanges+1), 100},
+		{"bits=0-1", 100},
+	} {
+		f.Add(seed.header, seed.size)
+	}
+	f.Fuzz(func(t *testing.T, header string, size int64) {
+		ranges, err := parseRange(header)
+		if err != nil {
+			var reqErr *requestError
+			if !errors.As(err, &reqErr) {
+				t.Fatalf("error %v is no *requestError", err)
+			}
+			if ranges != nil {
+				t.Fatalf("returned %v with the error %v", ranges, err)
+			}
+			return
+		}
+		if len(ranges) == 0 || len(ranges) > maxRanges {
+			t.Fatalf("returned %d ranges", len(ranges))
+		}
+		checkRanges(t, ranges)
+		if size < 0 {
+			// sizes are never negative, unlike the negation of math.MinInt64 its complement isn't either
+			size = ^size
+		}
+		for _, r := range ranges {
+			offset, length, ok := r.resolve(size)
+			if !ok {
+				continue
+			}
+			if offset < 0 || length <= 0 || offset+length > size {
+				t.Fatalf("range %+v of %d bytes resolved to %d+%d", r, size, offset, length)
+			}
+		}
+	})
+}
+
+// checkRanges fails unless every range is a suffix, an open range or a range ending after it starts.
+func checkRanges(t *testing.T, ranges []byteRange) {
+	t.Helper()
+	for _, r := range ranges {
+		switch {
+		case r.Start < 0:
+			if r.Start != -1 || r.End <= 0 {
+				t.Fatalf("invalid suffix range %+v", r)
+			}
+		case r.End >= 0 && r.End < r.Start:
+			t.Fatalf("range %+v ends before it starts", r)
+		case r.End < -1:
+			t.Fatalf("invalid open range %+v", r)
+		}
+	}
+}
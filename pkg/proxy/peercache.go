@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// peerCachePath is where peers fetch the files of the content cache partition of an instance.
+const peerCachePath = "/__cache"
+
+// peerHeader names the peer a request comes from, such requests are never forwarded again.
+const peerHeader = "X-OpenList-Proxy-Peer"
+
+// ringReplicas is the number of points of every peer on the hash ring.
+const ringReplicas = 128
+
+// peerRetryAfter is how long a peer that failed is skipped, going to the origin instead.
+const peerRetryAfter = 10 * time.Second
+
+var (
+	cachePeers     stringList
+	cacheSelf      string
+	cachePeerToken string
+)
+
+func init() {
+	CommandLine.Var(&cachePeers, "cache-peer", "base `url` of an instance sharing its -cache-dir with the others, repeatable and including this one; "+
+		"the paths are partitioned among them by consistent hashing and fetched from the peer owning them")
+	CommandLine.StringVar(&cacheSelf, "cache-self", "", "the -cache-peer url of this instance")
+	CommandLine.StringVar(&cachePeerToken, "cache-peer-token", "", "bearer token the peers authenticate to each other with, required by -cache-peer")
+}
+
+// hashRing maps keys to peers by consistent hashing, so adding or removing a peer only moves
+// the keys of that peer.
+type hashRing struct {
+	points []uint64
+	peers  []string
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newHashRing(peers []string) *hashRing {
+	type point struct {
+		hash uint64
+		peer string
+	}
+	points := make([]point, 0, len(peers)*ringReplicas)
+	for _, p := range peers {
+		for i := range ringReplicas {
+			points = append(points, point{ringHash(p + "#" + strconv.Itoa(i)), p})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	h := &hashRing{}
+	for _, p := range points {
+		h.points = append(h.points, p.hash)
+		h.peers = append(h.peers, p.peer)
+	}
+	return h
+}
+
+// owner returns the peer key belongs to.
+func (h *hashRing) owner(key string) string {
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= ringHash(key) })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.peers[i]
+}
+
+var peerCache = struct {
+	ring   *hashRing
+	client *http.Client
+	sync.Mutex
+	// failed is when requests to a peer last failed
+	failed map[string]time.Time
+}{failed: map[string]time.Time{}}
+
+func peerCacheEnabled() bool {
+	return len(cachePeers) > 0
+}
+
+func setupPeerCache() error {
+	if !peerCacheEnabled() {
+		return nil
+	}
+	if cacheDir == "" {
+		return errors.New("-cache-peer needs -cache-dir")
+	}
+	if cachePeerToken == "" {
+		return errors.New("-cache-peer needs -cache-peer-token")
+	}
+	peers := make([]string, 0, len(cachePeers))
+	for _, p := range cachePeers {
+		u, err := url.Parse(p)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return errors.New("invalid -cache-peer " + p)
+		}
+		peers = append(peers, strings.TrimSuffix(p, "/"))
+	}
+	cacheSelf = strings.TrimSuffix(cacheSelf, "/")
+	if !slices.Contains(peers, cacheSelf) {
+		return errors.New("-cache-self must be one of the -cache-peer urls")
+	}
+	peerCache.ring = newHashRing(peers)
+	peerCache.client = &http.Client{
+		Transport: newUpstreamTransport(nil, upstreamMaxIdlePerHost, upstreamMaxConnsPerHost),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return nil
+}
+
+// ownsPath reports whether filePath is cached by this instance.
+func ownsPath(filePath string) bool {
+	return !peerCacheEnabled() || peerCache.ring.owner(filePath) == cacheSelf
+}
+
+func peerAvailable(peer string) bool {
+	peerCache.Lock()
+	defer peerCache.Unlock()
+	return time.Since(peerCache.failed[peer]) >= peerRetryAfter
+}
+
+func peerFailed(peer string, err string) {
+	peerCache.Lock()
+	peerCache.failed[peer] = time.Now()
+	peerCache.Unlock()
+	contentCacheTotal.inc("peer_failed")
+	logf(levelWarn, "cache peer %s failed, going to the origin: %s", peer, err)
+}
+
+// servePeer answers a download of a path another peer owns from that peer and reports
+// whether it did. Failing peers leave the download to the origin.
+func servePeer(w http.ResponseWriter, r *http.Request, req *downloadRequest) bool {
+	if !peerCacheEnabled() || r.Method != http.MethodGet && r.Method != http.MethodHead || getRequestInfo(r).fromPeer {
+		return false
+	}
+	peer := peerCache.ring.owner(req.Path)
+	if peer == cacheSelf || !peerAvailable(peer) {
+		return false
+	}
+	preq, err := http.NewRequestWithContext(r.Context(), r.Method, peer+peerCachePath+escapePath(req.Path), nil)
+	if err != nil {
+		return false
+	}
+	for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "User-Agent"} {
+		if v := r.Header.Get(h); v != "" {
+			preq.Header.Set(h, v)
+		}
+	}
+	preq.Header.Set("Authorization", "Bearer "+cachePeerToken)
+	preq.Header.Set(peerHeader, cacheSelf)
+	preq.Header.Set(requestIDHeader, getRequestInfo(r).id)
+	res, err := peerCache.client.Do(preq)
+	if err != nil {
+		if r.Context().Err() == nil {
+			peerFailed(peer, err.Error())
+		}
+		return false
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode >= 500 {
+		peerFailed(peer, res.Status)
+		return false
+	}
+	if signMaxUses > 0 && req.Sign != "" && res.StatusCode/100 == 2 {
+		signUses.served(req.Sign, clientIdentity(r), res.Header)
+	}
+	contentCacheTotal.inc("peer")
+	logf(levelInfo, "cache peer: %s %s", peer, req.Path)
+	maps.Copy(w.Header(), res.Header)
+	setCORSHeaders(w, r)
+	w.WriteHeader(res.StatusCode)
+	copyBody(w, r, res)
+	return true
+}
+
+// peerCacheHandler answers the peers asking for the paths of this instance, from its cache or
+// the origin, apart from the limits and access rules for clients.
+func peerCacheHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filePath, ok := strings.CutPrefix(r.URL.Path, peerCachePath+"/")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validBearer(r, cachePeerToken) || r.Header.Get(peerHeader) == "" {
+			errorResponseWithStatus(w, http.StatusUnauthorized, 401, "invalid cache peer token")
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			errorResponseWithStatus(w, http.StatusMethodNotAllowed, 405, "method not allowed")
+			return
+		}
+		req, err := parseDownloadRequest("/"+filePath, "", r.Header.Get("Range"))
+		if err != nil {
+			errorResponse(w, 400, err.Error())
+			return
+		}
+		if req.Ranges == nil {
+			r.Header.Del("Range")
+		}
+		// the peer authorized the client, the credentials are for the proxy, not the origin
+		r.Header.Del("Authorization")
+		r.Header.Del(peerHeader)
+		getRequestInfo(r).fromPeer = true
+		serveDownload(w, r, req)
+	})
+}
@@ -0,0 +1,11 @@
+//go:build cgo && (linux || darwin || freebsd)
+
+package proxy
+
+import "plugin"
+
+// openPlugin loads a go plugin, running its init functions which register its hooks.
+func openPlugin(file string) error {
+	_, err := plugin.Open(file)
+	return err
+}
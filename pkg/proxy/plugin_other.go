@@ -0,0 +1,12 @@
+//go:build !cgo || !(linux || darwin || freebsd)
+
+package proxy
+
+import (
+	"errors"
+	"runtime"
+)
+
+func openPlugin(string) error {
+	return errors.New("go plugins are not supported by this build for " + runtime.GOOS + ", it needs cgo on linux, darwin or freebsd")
+}
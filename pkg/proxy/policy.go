@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"gopkg.in/yaml.v3"
+)
+
+var policyFile string
+
+func init() {
+	CommandLine.StringVar(&policyFile, "policy-file", "", "yaml file of policies (when, action, status, message, location, request, response), expressions on the path, ip, headers "+
+		"and query allowing, denying, redirecting or editing the headers of requests, reloaded on change or SIGHUP")
+}
+
+// policy is a rule of -policy-file. The policies are evaluated in file order; the first
+// matching allow, deny or redirect decides, matching headers policies apply on the way.
+type policy struct {
+	// When is an expr expression over policyEnv, an empty one matches every request.
+	When string `yaml:"when"`
+	// Action is allow, deny, redirect or headers. allow only ends the evaluation, signs and
+	// credentials are still checked.
+	Action  string `yaml:"action"`
+	Status  int    `yaml:"status"`
+	Message string `yaml:"message"`
+	// Location is an expression of the url a redirect goes to, such as "https://mirror.example.com" + path.
+	Location string      `yaml:"location"`
+	Request  headerEdits `yaml:"request"`
+	Response headerEdits `yaml:"response"`
+
+	when, location *vm.Program
+}
+
+// policyEnv is what policy expressions see of a request. Header and query names are lower case.
+type policyEnv struct {
+	Path      string            `expr:"path"`
+	Method    string            `expr:"method"`
+	Host      string            `expr:"host"`
+	IP        string            `expr:"ip"`
+	UserAgent string            `expr:"user_agent"`
+	Header    map[string]string `expr:"header"`
+	Query     map[string]string `expr:"query"`
+	// APIKey is the name of the api key of the request, empty without one.
+	APIKey string `expr:"api_key"`
+}
+
+// policyFunctions are available to expressions besides the expr builtins.
+var policyFunctions = []expr.Option{
+	expr.Function("in_cidr", func(params ...any) (any, error) {
+		addr, err := netip.ParseAddr(params[0].(string))
+		if err != nil {
+			return false, nil
+		}
+		prefix, err := parsePrefix(params[1].(string))
+		if err != nil {
+			return nil, err
+		}
+		return prefix.Contains(addr.Unmap()), nil
+	}, new(func(string, string) bool)),
+}
+
+var policies atomic.Pointer[[]*policy]
+
+func loadPolicies() error {
+	var list []*policy
+	if policyFile != "" {
+		b, err := os.ReadFile(policyFile)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(b, &list); err != nil {
+			return fmt.Errorf("%s: %w", policyFile, err)
+		}
+		for i, p := range list {
+			if err := p.setup(); err != nil {
+				return fmt.Errorf("%s: policy %d: %w", policyFile, i+1, err)
+			}
+		}
+	}
+	policies.Store(&list)
+	return nil
+}
+
+func (p *policy) setup() error {
+	var err error
+	if p.When != "" {
+		if p.when, err = expr.Compile(p.When, append(policyFunctions, expr.Env(policyEnv{}), expr.AsBool())...); err != nil {
+			return fmt.Errorf("invalid when: %w", err)
+		}
+	}
+	switch p.Action {
+	case "allow", "headers":
+	case "deny":
+		if p.Status == 0 {
+			p.Status = http.StatusForbidden
+		}
+		if p.Status < 400 || p.Status > 599 {
+			return fmt.Errorf("invalid status %d of a deny, expected 4xx or 5xx", p.Status)
+		}
+	case "redirect":
+		if p.Status == 0 {
+			p.Status = http.StatusFound
+		}
+		if p.Status/100 != 3 {
+			return fmt.Errorf("invalid status %d of a redirect, expected 3xx", p.Status)
+		}
+		if p.Location == "" {
+			return errors.New("redirect needs a location")
+		}
+		if p.location, err = expr.Compile(p.Location, append(policyFunctions, expr.Env(policyEnv{}), expr.AsKind(reflect.String))...); err != nil {
+			return fmt.Errorf("invalid location: %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid action %q, expected allow, deny, redirect or headers", p.Action)
+	}
+	if err := p.Request.setup(); err != nil {
+		return err
+	}
+	return p.Response.setup()
+}
+
+func reloadPolicies() {
+	if err := loadPolicies(); err != nil {
+		noticef(levelError, "failed to reload policies, keeping the previous ones: %s", err.Error())
+		return
+	}
+	fmt.Println("reloaded policies")
+}
+
+func setupPolicies() error {
+	if err := loadPolicies(); err != nil {
+		return err
+	}
+	if policyFile != "" {
+		onReload(reloadPolicies)
+		watchFile(policyFile, reloadPolicies)
+	}
+	return nil
+}
+
+func newPolicyEnv(r *http.Request) policyEnv {
+	env := policyEnv{
+		Path:      r.URL.Path,
+		Method:    r.Method,
+		Host:      r.Host,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Header:    make(map[string]string, len(r.Header)),
+		Query:     map[string]string{},
+	}
+	for name, values := range r.Header {
+		env.Header[strings.ToLower(name)] = values[0]
+	}
+	for name, values := range r.URL.Query() {
+		env.Query[strings.ToLower(name)] = values[0]
+	}
+	if k := getRequestInfo(r).apiKey; k != nil {
+		env.APIKey = k.Name
+	}
+	return env
+}
+
+// policyHandler applies the policies of -policy-file. Response edits wait in the request
+// info for the origin response, whose headers they would not survive otherwise.
+func policyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := *policies.Load()
+		if len(list) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		env := newPolicyEnv(r)
+		info := getRequestInfo(r)
+		for _, p := range list {
+			if p.when != nil {
+				matched, err := expr.Run(p.when, env)
+				if err != nil {
+					logf(levelWarn, "policy %q failed: %s", p.When, err.Error())
+					continue
+				}
+				if !matched.(bool) {
+					continue
+				}
+			}
+			p.Request.apply(r.Header)
+			info.policyHeaders = append(info.policyHeaders, p.Request.names()...)
+			if !p.Response.empty() {
+				info.responseEdits = append(info.responseEdits, &p.Response)
+			}
+			switch p.Action {
+			case "allow":
+				next.ServeHTTP(w, r)
+				return
+			case "deny":
+				msg := p.Message
+				if msg == "" {
+					msg = "denied by policy"
+				}
+				errorResponseWithStatus(w, p.Status, p.Status, msg)
+				return
+			case "redirect":
+				location, err := expr.Run(p.location, env)
+				if err != nil {
+					errorResponse(w, 500, "policy location failed: "+err.Error())
+					return
+				}
+				for _, e := range info.responseEdits {
+					e.apply(w.Header())
+				}
+				http.Redirect(w, r, location.(string), p.Status)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// applyPolicyResponse applies the response edits of the policies matching r to an origin response.
+func applyPolicyResponse(r *http.Request, res *http.Response) {
+	for _, e := range getRequestInfo(r).responseEdits {
+		e.apply(res.Header)
+	}
+}
@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	adminMux.Handle("POST /api/cache/prefetch", adminAuth(adminPrefetch))
+	adminMux.Handle("GET /api/cache/prefetch", adminAuth(adminListPrefetches))
+	adminMux.Handle("GET /api/cache/prefetch/{id}", adminAuth(adminGetPrefetch))
+	adminMux.Handle("DELETE /api/cache/prefetch/{id}", adminAuth(adminCancelPrefetch))
+}
+
+const (
+	// prefetchWorkers is how many files of a prefetch are fetched at once.
+	prefetchWorkers = 2
+	// maxPrefetchPaths bounds the files of a prefetch, directories included.
+	maxPrefetchPaths = 100000
+	// maxPrefetchErrors bounds the failures a prefetch reports in detail.
+	maxPrefetchErrors = 20
+	// maxPrefetchJobs bounds the prefetches remembered, the oldest finished ones are forgotten.
+	maxPrefetchJobs = 20
+)
+
+type prefetchReq struct {
+	Paths []string `json:"paths"`
+	// Dir adds the files of a directory, and of its subdirectories with Recursive.
+	Dir       string `json:"dir"`
+	Recursive bool   `json:"recursive"`
+}
+
+type prefetchError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// prefetchJob fills the content cache with files in the background.
+type prefetchJob struct {
+	mu sync.Mutex
+	ID string `json:"id"`
+	// State is listing, running, done or canceled.
+	State string `json:"state"`
+	Total int    `json:"total"`
+	// Fetched and Cached count the files stored by the job and the ones that already were.
+	Fetched  int             `json:"fetched"`
+	Cached   int             `json:"cached"`
+	Failed   int             `json:"failed"`
+	Bytes    int64           `json:"bytes"`
+	Current  []string        `json:"current,omitempty"`
+	Errors   []prefetchError `json:"errors,omitempty"`
+	Created  time.Time       `json:"created"`
+	Finished time.Time       `json:"finished,omitzero"`
+
+	cancel context.CancelFunc
+}
+
+var prefetchJobs = struct {
+	sync.Mutex
+	m map[string]*prefetchJob
+}{m: map[string]*prefetchJob{}}
+
+// snapshot returns a copy of j safe to encode.
+func (j *prefetchJob) snapshot() *prefetchJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &prefetchJob{
+		ID: j.ID, State: j.State, Total: j.Total, Fetched: j.Fetched, Cached: j.Cached, Failed: j.Failed, Bytes: j.Bytes,
+		Current: append([]string(nil), j.Current...), Errors: append([]prefetchError(nil), j.Errors...),
+		Created: j.Created, Finished: j.Finished,
+	}
+}
+
+func (j *prefetchJob) update(f func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f()
+}
+
+func adminPrefetch(w http.ResponseWriter, r *http.Request) {
+	if cacheDir == "" {
+		errorResponseWithStatus(w, http.StatusBadRequest, 400, "prefetching needs -cache-dir")
+		return
+	}
+	var req prefetchReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Paths) == 0 && req.Dir == "" || req.Dir != "" && !strings.HasPrefix(req.Dir, "/") {
+		errorResponseWithStatus(w, http.StatusBadRequest, 400, "invalid prefetch request")
+		return
+	}
+	for _, p := range req.Paths {
+		if !strings.HasPrefix(p, "/") {
+			errorResponseWithStatus(w, http.StatusBadRequest, 400, "invalid prefetch path "+p)
+			return
+		}
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &prefetchJob{ID: hex.EncodeToString(b), State: "listing", Total: len(req.Paths), Created: time.Now(), cancel: cancel}
+	prefetchJobs.Lock()
+	if len(prefetchJobs.m) >= maxPrefetchJobs {
+		forgetPrefetchJob()
+	}
+	prefetchJobs.m[job.ID] = job
+	prefetchJobs.Unlock()
+	go job.run(ctx, req)
+	w.WriteHeader(http.StatusAccepted)
+	jsonResponse(w, job.snapshot())
+}
+
+// forgetPrefetchJob drops the oldest finished job, prefetchJobs must be locked.
+func forgetPrefetchJob() {
+	var oldest *prefetchJob
+	for _, j := range prefetchJobs.m {
+		s := j.snapshot()
+		if !s.Finished.IsZero() && (oldest == nil || s.Finished.Before(oldest.Finished)) {
+			oldest = s
+		}
+	}
+	if oldest != nil {
+		delete(prefetchJobs.m, oldest.ID)
+	}
+}
+
+func (j *prefetchJob) run(ctx context.Context, req prefetchReq) {
+	defer j.cancel()
+	paths := req.Paths
+	if req.Dir != "" {
+		files, err := listFiles(ctx, req.Dir, req.Recursive, maxPrefetchPaths-len(paths))
+		if err != nil {
+			j.update(func() {
+				j.State, j.Finished = "done", time.Now()
+				j.Failed++
+				j.Errors = append(j.Errors, prefetchError{Path: req.Dir, Error: err.Error()})
+			})
+			return
+		}
+		paths = append(paths, files...)
+	}
+	j.update(func() {
+		j.State, j.Total = "running", len(paths)
+	})
+	next := make(chan string)
+	var wg sync.WaitGroup
+	for range prefetchWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range next {
+				j.fetch(ctx, p)
+			}
+		}()
+	}
+feed:
+	for _, p := range paths {
+		select {
+		case next <- p:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	j.update(func() {
+		j.State, j.Finished = "done", time.Now()
+		if ctx.Err() != nil {
+			j.State = "canceled"
+		}
+	})
+}
+
+// fetch stores filePath in the content cache, through the peer owning it with -cache-peer.
+func (j *prefetchJob) fetch(ctx context.Context, filePath string) {
+	if ownsPath(filePath) && contentCache.lookup(filePath) != nil {
+		j.update(func() { j.Cached++ })
+		return
+	}
+	j.update(func() { j.Current = append(j.Current, filePath) })
+	err := prefetchPath(ctx, filePath, func(n int64) {
+		j.update(func() { j.Bytes += n })
+	})
+	j.update(func() {
+		if i := slices.Index(j.Current, filePath); i >= 0 {
+			j.Current = append(j.Current[:i], j.Current[i+1:]...)
+		}
+		switch {
+		case ctx.Err() != nil:
+		case err != nil:
+			j.Failed++
+			if len(j.Errors) < maxPrefetchErrors {
+				j.Errors = append(j.Errors, prefetchError{Path: filePath, Error: err.Error()})
+			}
+		default:
+			j.Fetched++
+		}
+	})
+}
+
+// prefetchWriter discards a prefetched body, counting it, and keeps the start of error bodies.
+type prefetchWriter struct {
+	header http.Header
+	status int
+	body   []byte
+	count  func(int64)
+}
+
+func (w *prefetchWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *prefetchWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *prefetchWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.status >= 300 && len(w.body) < 512 {
+		w.body = append(w.body, p[:min(len(p), 512-len(w.body))]...)
+	} else {
+		w.count(int64(len(p)))
+	}
+	return len(p), nil
+}
+
+// prefetchPath downloads filePath as a client of the proxy would, so it is cached on the way.
+func prefetchPath(ctx context.Context, filePath string, count func(int64)) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://prefetch"+escapePath(filePath), nil)
+	if err != nil {
+		return err
+	}
+	r.RemoteAddr = "127.0.0.1:0"
+	r = r.WithContext(context.WithValue(ctx, requestInfoKey{}, &requestInfo{id: requestID(r)}))
+	w := &prefetchWriter{header: http.Header{}, count: count}
+	serveDownload(w, r, &downloadRequest{Path: filePath})
+	if w.status >= 300 {
+		return fmt.Errorf("%d %s", w.status, strings.TrimSpace(string(w.body)))
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if ownsPath(filePath) && contentCache.lookup(filePath) == nil {
+		return errors.New("not cacheable, it is compressed by the origin, larger than -cache-size or its size is unknown")
+	}
+	return nil
+}
+
+// listFiles returns the files of dir, and of its subdirectories if recursive, up to limit.
+func listFiles(ctx context.Context, dir string, recursive bool, limit int) ([]string, error) {
+	var files []string
+	dirs := []string{dir}
+	for len(dirs) > 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		d := dirs[0]
+		dirs = dirs[1:]
+		list, err := postAPI[fsListResp]("/api/fs/list", d, Json{
+			"page":     1,
+			"per_page": 0,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", d, err)
+		}
+		for _, o := range list.Content {
+			p := path.Join(d, o.Name)
+			if o.IsDir {
+				if recursive {
+					dirs = append(dirs, p)
+				}
+				continue
+			}
+			if len(files) >= limit {
+				return nil, fmt.Errorf("more than %d files to prefetch", maxPrefetchPaths)
+			}
+			files = append(files, p)
+		}
+	}
+	return files, nil
+}
+
+func adminListPrefetches(w http.ResponseWriter, _ *http.Request) {
+	prefetchJobs.Lock()
+	list := make([]*prefetchJob, 0, len(prefetchJobs.m))
+	for _, j := range prefetchJobs.m {
+		list = append(list, j.snapshot())
+	}
+	prefetchJobs.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	jsonResponse(w, list)
+}
+
+func lookupPrefetch(w http.ResponseWriter, r *http.Request) *prefetchJob {
+	prefetchJobs.Lock()
+	job := prefetchJobs.m[r.PathValue("id")]
+	prefetchJobs.Unlock()
+	if job == nil {
+		errorResponseWithStatus(w, http.StatusNotFound, 404, "no such prefetch")
+	}
+	return job
+}
+
+func adminGetPrefetch(w http.ResponseWriter, r *http.Request) {
+	if job := lookupPrefetch(w, r); job != nil {
+		jsonResponse(w, job.snapshot())
+	}
+}
+
+// adminCancelPrefetch stops a prefetch, the files being fetched are abandoned.
+func adminCancelPrefetch(w http.ResponseWriter, r *http.Request) {
+	if job := lookupPrefetch(w, r); job != nil {
+		job.cancel()
+		jsonResponse(w, job.snapshot())
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// preparePath is where clients ask the proxy to resolve a link ahead of the download.
+const preparePath = "/__prepare"
+
+// maxPrepareWait bounds how long a prepare request waits for the resolution.
+const maxPrepareWait = 60 * time.Second
+
+var prepareTTL time.Duration
+
+func init() {
+	CommandLine.DurationVar(&prepareTTL, "prepare-ttl", 5*time.Minute, "how long links resolved through "+preparePath+" are kept for the following download, at least -link-cache-ttl")
+}
+
+type prepareJob struct {
+	done     chan struct{}
+	err      error
+	finished time.Time
+}
+
+var prepareJobs = struct {
+	sync.Mutex
+	m map[string]*prepareJob
+}{m: map[string]*prepareJob{}}
+
+// prepare starts resolving filePath in the background, or returns the job already doing so.
+func prepare(filePath string) *prepareJob {
+	prepareJobs.Lock()
+	defer prepareJobs.Unlock()
+	now := time.Now()
+	for p, job := range prepareJobs.m {
+		if !job.finished.IsZero() && now.Sub(job.finished) > prepareTTL {
+			delete(prepareJobs.m, p)
+		}
+	}
+	if job, ok := prepareJobs.m[filePath]; ok {
+		return job
+	}
+	job := &prepareJob{done: make(chan struct{})}
+	prepareJobs.m[filePath] = job
+	go func() {
+		_, err := linkCache.resolve(context.Background(), filePath, max(prepareTTL, linkCacheTTL))
+		prepareJobs.Lock()
+		job.err, job.finished = err, time.Now()
+		if err != nil {
+			// a later prepare tries again
+			delete(prepareJobs.m, filePath)
+		}
+		prepareJobs.Unlock()
+		close(job.done)
+	}()
+	return job
+}
+
+type prepareResp struct {
+	Path  string `json:"path"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// servePrepare handles /__prepare?path=...&sign=...[&wait=seconds]: it starts warming up the
+// link of path and waits up to wait seconds (default 20) for it, clients poll until the
+// state is ready or error.
+func servePrepare(w http.ResponseWriter, r *http.Request) {
+	req, err := parseDownloadRequest(r.URL.Query().Get("path"), r.URL.RawQuery, "")
+	if err != nil {
+		errorResponse(w, 400, err.Error())
+		return
+	}
+	req.Path = tenantPath(r, req.Path)
+	if !authorize(w, r, req) {
+		return
+	}
+	wait := 20 * time.Second
+	if v := r.URL.Query().Get("wait"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errorResponse(w, 400, "invalid wait")
+			return
+		}
+		wait = min(time.Duration(n)*time.Second, maxPrepareWait)
+	}
+	job := prepare(req.Path)
+	resp := prepareResp{Path: req.Path, State: "pending"}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-job.done:
+		resp.State = "ready"
+		if job.err != nil {
+			resp.State, resp.Error = "error", job.err.Error()
+		}
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+	setCORSHeaders(w, r)
+	w.Header().Set("Cache-Control", "no-store")
+	jsonResponse(w, resp)
+}
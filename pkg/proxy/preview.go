@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bytes"
+	"html"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+var previewMaxSize byteSize = 1 << 20
+
+func init() {
+	CommandLine.Var(&previewMaxSize, "preview-max-size", "max `size` of the text files ?preview=1 shows in the browser, larger ones are downloaded as usual")
+}
+
+var previewsTotal = newCounterVec("openlist_proxy_previews_total", "Downloads asked for with ?preview=1, by how they were answered: text, markdown or download.", "result")
+
+// previewExtensions are the extensions of text files besides the text/* types.
+var previewExtensions = map[string]bool{
+	".txt": true, ".log": true, ".md": true, ".markdown": true, ".csv": true, ".tsv": true, ".json": true, ".xml": true,
+	".yaml": true, ".yml": true, ".toml": true, ".ini": true, ".conf": true, ".cfg": true, ".env": true, ".properties": true,
+	".go": true, ".py": true, ".js": true, ".mjs": true, ".ts": true, ".tsx": true, ".jsx": true, ".c": true, ".h": true,
+	".cc": true, ".cpp": true, ".hpp": true, ".java": true, ".kt": true, ".rs": true, ".rb": true, ".php": true, ".sh": true,
+	".bat": true, ".ps1": true, ".sql": true, ".css": true, ".html": true, ".htm": true, ".vue": true, ".lua": true,
+	".srt": true, ".ass": true, ".vtt": true, ".diff": true, ".patch": true,
+}
+
+// previewable reports whether a file of contentType at filePath is text to preview.
+func previewable(filePath, contentType string) bool {
+	if previewExtensions[strings.ToLower(path.Ext(filePath))] {
+		return true
+	}
+	t, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(t, "text/") || t == "application/json" || t == "application/xml" || t == "application/javascript"
+}
+
+func isMarkdown(filePath string) bool {
+	ext := strings.ToLower(path.Ext(filePath))
+	return ext == ".md" || ext == ".markdown"
+}
+
+// previewWriter holds back the body of a text file small enough to preview and passes any
+// other response on as it is.
+type previewWriter struct {
+	http.ResponseWriter
+	filePath string
+	// buffering is set once the header is of a file to preview, passing once it is not
+	buffering, passing bool
+	status             int
+	buf                bytes.Buffer
+}
+
+func (pw *previewWriter) WriteHeader(status int) {
+	if pw.buffering || pw.passing {
+		return
+	}
+	h := pw.Header()
+	size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = -1
+	}
+	if status == http.StatusOK && h.Get("Content-Encoding") == "" && size <= int64(previewMaxSize) && previewable(pw.filePath, h.Get("Content-Type")) {
+		pw.buffering, pw.status = true, status
+		return
+	}
+	pw.passing = true
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *previewWriter) Write(p []byte) (int, error) {
+	pw.WriteHeader(http.StatusOK)
+	if pw.passing {
+		return pw.ResponseWriter.Write(p)
+	}
+	if pw.buf.Len()+len(p) > int(previewMaxSize) {
+		// larger than it said, it is downloaded after all
+		pw.download()
+		return pw.ResponseWriter.Write(p)
+	}
+	return pw.buf.Write(p)
+}
+
+func (pw *previewWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// download sends the held back file unchanged.
+func (pw *previewWriter) download() {
+	previewsTotal.inc("download")
+	pw.buffering, pw.passing = false, true
+	pw.ResponseWriter.WriteHeader(pw.status)
+	_, _ = pw.ResponseWriter.Write(pw.buf.Bytes())
+	pw.buf.Reset()
+}
+
+// finish answers the held back file as utf-8 text, or as html rendered from markdown.
+func (pw *previewWriter) finish() {
+	if !pw.buffering {
+		if !pw.passing {
+			previewsTotal.inc("download")
+		}
+		return
+	}
+	content := pw.buf.Bytes()
+	hasBOM := bytes.HasPrefix(content, []byte{0xff, 0xfe}) || bytes.HasPrefix(content, []byte{0xfe, 0xff})
+	if !hasBOM && bytes.IndexByte(content, 0) >= 0 {
+		// binary content behind a text extension
+		pw.download()
+		return
+	}
+	h := pw.Header()
+	if !utf8.Valid(content) {
+		contentType := h.Get("Content-Type")
+		if _, params, _ := mime.ParseMediaType(contentType); strings.EqualFold(strings.ReplaceAll(params["charset"], "-", ""), "utf8") {
+			// a utf-8 the content is not is a guess of the origin, the content is sniffed instead
+			contentType = ""
+		}
+		enc, _, _ := charset.DetermineEncoding(content, contentType)
+		if decoded, err := enc.NewDecoder().Bytes(content); err == nil {
+			content = decoded
+		}
+	}
+	content = bytes.TrimPrefix(content, []byte("\ufeff"))
+	for _, k := range []string{"Content-Range", "Accept-Ranges", "ETag", "Last-Modified", "Content-Disposition"} {
+		h.Del(k)
+	}
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Disposition", "inline")
+	if isMarkdown(pw.filePath) {
+		previewsTotal.inc("markdown")
+		content = []byte("<!doctype html>\n<html><head><meta charset=\"utf-8\"><title>" + html.EscapeString(path.Base(pw.filePath)) +
+			"</title><style>" + previewStyle + "</style></head><body>\n" + renderMarkdown(string(content)) + "</body></html>\n")
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		h.Set("Content-Security-Policy", "default-src 'none'; img-src 'self' https: data:; style-src 'unsafe-inline'")
+	} else {
+		previewsTotal.inc("text")
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	h.Set("Content-Length", strconv.Itoa(len(content)))
+	pw.ResponseWriter.WriteHeader(pw.status)
+	_, _ = pw.ResponseWriter.Write(content)
+}
+
+const previewStyle = "body{max-width:50em;margin:2em auto;padding:0 1em;font:16px/1.6 sans-serif;color:#222}" +
+	"pre{background:#f4f4f4;padding:1em;overflow:auto}code{background:#f4f4f4;padding:0 .2em}pre code{padding:0}" +
+	"blockquote{margin:0;padding-left:1em;border-left:3px solid #ccc;color:#555}img{max-width:100%}"
+
+// servePreview answers a ?preview=1 download: small text files are shown in the browser
+// instead of being downloaded, the others are served as usual.
+func servePreview(w http.ResponseWriter, r *http.Request, req *downloadRequest) {
+	// the whole file is previewed
+	r.Header.Del("Range")
+	r.Header.Del("If-Range")
+	preq := *req
+	preq.Ranges = nil
+	pw := &previewWriter{ResponseWriter: w, filePath: req.Path}
+	serveDownload(pw, r, &preq)
+	pw.finish()
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	progressInterval     time.Duration
+	upstreamStallTimeout time.Duration
+)
+
+func init() {
+	CommandLine.DurationVar(&progressInterval, "progress-interval", 10*time.Second, "how often the rate of the running transfers is measured for the admin api and metrics and logged at debug level")
+	CommandLine.DurationVar(&upstreamStallTimeout, "upstream-stall-timeout", time.Minute, "abort transfers whose origin sent no bytes for this long, resuming them where -upstream-resumes allows, 0 waits forever")
+}
+
+var (
+	transferRate    = newGaugeVec("openlist_proxy_transfer_rate_bytes", "Bytes per second the running transfers send together, over the last -progress-interval.")
+	stalledTransfer = newCounterVec("openlist_proxy_upstream_stalls_total", "Origin bodies aborted after sending nothing for -upstream-stall-timeout.")
+)
+
+func setupProgress() error {
+	if progressInterval < time.Second {
+		return fmt.Errorf("invalid -progress-interval %s, expected at least 1s", progressInterval)
+	}
+	if upstreamStallTimeout < 0 {
+		return fmt.Errorf("invalid -upstream-stall-timeout %s", upstreamStallTimeout)
+	}
+	return nil
+}
+
+func startProgress() {
+	go func() {
+		for range time.Tick(progressInterval) {
+			measureTransfers(progressInterval)
+		}
+	}()
+}
+
+// measureTransfers updates the rates of the running transfers from the bytes they sent in
+// the last interval.
+func measureTransfers(interval time.Duration) {
+	transfers.Lock()
+	list := make([]*activeTransfer, 0, len(transfers.m))
+	for _, t := range transfers.m {
+		list = append(list, t)
+	}
+	transfers.Unlock()
+	var total int64
+	for _, t := range list {
+		sent := t.sent.Load()
+		elapsed := min(interval, time.Since(t.Started))
+		rate := int64(float64(sent-t.measured.Swap(sent)) / max(elapsed.Seconds(), 1))
+		t.rate.Store(rate)
+		total += rate
+		if !t.Upload {
+			logf(levelDebug, "transfer %s of %s from %s to %s: %d bytes at %d bytes/s", t.ID, t.Path, t.Upstream, t.Client, sent, rate)
+		}
+	}
+	transferRate.set(float64(total))
+}
+
+var errUpstreamStalled = errors.New("origin stalled")
+
+// watchStall aborts reads of an origin body once it sent nothing for -upstream-stall-timeout.
+// Resumable bodies watch each of the bodies they read instead, so a stall is resumed.
+func watchStall(body io.ReadCloser) io.ReadCloser {
+	switch body.(type) {
+	case *spliceBody, *resumableBody, *stallBody:
+		// spliced bodies are not read here, the others watch their own
+		return body
+	}
+	if upstreamStallTimeout <= 0 {
+		return body
+	}
+	b := &stallBody{ReadCloser: body}
+	b.timer = time.AfterFunc(upstreamStallTimeout, b.stall)
+	b.timer.Stop()
+	return b
+}
+
+type stallBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	mu      sync.Mutex
+	stalled bool
+}
+
+func (b *stallBody) stall() {
+	b.mu.Lock()
+	b.stalled = true
+	b.mu.Unlock()
+	stalledTransfer.inc()
+	_ = b.ReadCloser.Close()
+}
+
+func (b *stallBody) Read(p []byte) (int, error) {
+	b.timer.Reset(upstreamStallTimeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && err != io.EOF {
+		b.mu.Lock()
+		if b.stalled {
+			err = fmt.Errorf("%w: no bytes for %s", errUpstreamStalled, upstreamStallTimeout)
+		}
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+func (b *stallBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Config configures a proxy embedded in another service.
+type Config struct {
+	// Address and Token of the OpenList backend, as -address and -token.
+	Address, Token string
+	// Args are further flags of the command line, such as -sign-key or -redirect.
+	Args []string
+	// HTTPClient fetches file contents from origins, replacing the client of the -upstream-*
+	// flags. -splice is off with it, since splicing would bypass it.
+	HTTPClient *http.Client
+	// APIClient calls the OpenList api, replacing the client of the -api-* flags.
+	APIClient *http.Client
+}
+
+// New returns the download handler of the proxy, with the middlewares the flags enable.
+// The configuration is process wide, as for the command, so a process runs one proxy, and
+// servers such as -admin-address are started as the command would.
+func New(cfg Config) (http.Handler, error) {
+	if err := CommandLine.Parse(cfg.Args); err != nil {
+		return nil, err
+	}
+	if CommandLine.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", CommandLine.Args())
+	}
+	if cfg.Address != "" {
+		address = cfg.Address
+	}
+	if cfg.Token != "" {
+		token = cfg.Token
+	}
+	if err := configure(); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPClient != nil {
+		HttpClient = cfg.HTTPClient
+		spliceEnabled = false
+	}
+	if cfg.APIClient != nil {
+		apiClient = cfg.APIClient
+	}
+	if err := setup(); err != nil {
+		return nil, err
+	}
+	return newHandler(), nil
+}
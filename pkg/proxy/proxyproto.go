@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyProtocol bool
+
+func init() {
+	CommandLine.BoolVar(&proxyProtocol, "proxy-protocol", false, "read a PROXY protocol v1 or v2 header, as sent by haproxy in tcp mode, from connections of -trusted-proxy peers "+
+		"and unix sockets, and take the client address from it")
+}
+
+// proxyHeaderTimeout bounds how long a trusted peer may take to send the PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener reads the PROXY header of connections accepted from trusted peers.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	trusted := true
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		trusted = trustedPeer(tcp.IP.String())
+	}
+	return &proxyProtoConn{Conn: conn, trusted: trusted}, nil
+}
+
+// proxyProtoConn parses the header on first use, in the goroutine serving the connection
+// rather than in the accept loop.
+type proxyProtoConn struct {
+	net.Conn
+	trusted bool
+	once    sync.Once
+	r       *bufio.Reader
+	remote  net.Addr
+	err     error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		c.remote = c.Conn.RemoteAddr()
+		if !c.trusted {
+			return
+		}
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		addr, err := readProxyHeader(c.r)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = fmt.Errorf("proxy protocol from %s: %w", c.remote, err)
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxyHeader consumes a v1 or v2 header, it returns a nil address for health checks
+// of the load balancer, which carry none.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if sig, err := r.Peek(6); err != nil || string(sig) != "PROXY " {
+		return nil, errors.New("missing header")
+	}
+	// a v1 header is at most 107 bytes including the crlf
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) < 2 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errors.New("malformed v1 header")
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, errors.New("malformed v1 source address")
+	}
+	p, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.New("malformed v1 source port")
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(p))), nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errors.New("unsupported v2 version")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0xf == 0 {
+		// LOCAL
+		return nil, nil
+	}
+	var ip netip.Addr
+	var port uint16
+	switch hdr[13] {
+	case 0x11: // tcp over ipv4
+		if len(body) < 12 {
+			return nil, errors.New("short v2 address")
+		}
+		ip, port = netip.AddrFrom4([4]byte(body[:4])), binary.BigEndian.Uint16(body[8:])
+	case 0x21: // tcp over ipv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 address")
+		}
+		ip, port = netip.AddrFrom16([16]byte(body[:16])).Unmap(), binary.BigEndian.Uint16(body[32:])
+	default:
+		// unix or udp sources identify no client
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
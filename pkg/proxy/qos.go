@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	bandwidthClassList stringList
+	jwtClassClaim      string
+)
+
+// defaultBandwidthClass is the class of the requests whose key or token names none.
+const defaultBandwidthClass = "default"
+
+func init() {
+	CommandLine.Var(&bandwidthClassList, "bandwidth-class", "service level given as `name=size`, the size per second a single transfer of the api keys and jwts of the class may send, "+
+		"e.g. free=5M or premium=unlimited, in place of -max-conn-bandwidth; the class "+defaultBandwidthClass+" applies to requests naming none, repeatable")
+	CommandLine.StringVar(&jwtClassClaim, "jwt-class-claim", "class", "claim naming the -bandwidth-class of a jwt")
+}
+
+var bandwidthClassTransfers = newCounterVec("openlist_proxy_bandwidth_class_transfers_total", "Proxied transfers, by -bandwidth-class.", "class")
+
+// bandwidthClasses are the bytes per second of the -bandwidth-class classes by name, 0 unlimited.
+var bandwidthClasses = map[string]int64{}
+
+func setupBandwidthClasses() error {
+	classes := map[string]int64{}
+	for _, v := range bandwidthClassList {
+		name, size, ok := strings.Cut(v, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("invalid -bandwidth-class %q, expected name=size", v)
+		}
+		if _, dup := classes[name]; dup {
+			return fmt.Errorf("-bandwidth-class %s given more than once", name)
+		}
+		size = strings.TrimSuffix(strings.TrimSpace(size), "/s")
+		if strings.EqualFold(size, "unlimited") {
+			classes[name] = 0
+			continue
+		}
+		n, err := parseSize(size)
+		if err != nil {
+			return fmt.Errorf("invalid -bandwidth-class %s: %w", name, err)
+		}
+		classes[name] = n
+	}
+	bandwidthClasses = classes
+	return nil
+}
+
+// validBandwidthClass reports whether an api key may name class, empty being the default.
+func validBandwidthClass(class string) error {
+	if _, ok := bandwidthClasses[class]; ok || class == "" {
+		return nil
+	}
+	return fmt.Errorf("unknown bandwidth class %q, expected one of -bandwidth-class", class)
+}
+
+// transferBandwidth returns the class a transfer of r is sent in, empty without classes, and
+// the bytes per second it may send, 0 unlimited. Jwts naming a class not defined get the
+// default one.
+func transferBandwidth(r *http.Request) (string, int64) {
+	if class := getRequestInfo(r).bandwidthClass; class != "" {
+		if n, ok := bandwidthClasses[class]; ok {
+			return class, n
+		}
+	}
+	if n, ok := bandwidthClasses[defaultBandwidthClass]; ok {
+		return defaultBandwidthClass, n
+	}
+	return "", int64(maxConnBandwidth)
+}
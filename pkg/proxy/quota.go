@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	quota       byteSize
+	quotaPeriod time.Duration
+)
+
+func init() {
+	CommandLine.Var(&quota, "quota", "max traffic `size` per client identity and quota period, e.g. 50G, 0 is unlimited")
+	CommandLine.DurationVar(&quotaPeriod, "quota-period", 24*time.Hour, "quota period, counters reset at multiples of it since the unix epoch (UTC midnight for 24h)")
+
+	registerState("quotas", func() any { return &quotaStore{} })
+	adminMux.Handle("GET /api/quotas", adminAuth(adminListQuotas))
+	adminMux.Handle("DELETE /api/quotas/{identity}", adminAuth(adminResetQuota))
+}
+
+// quotaSaveInterval is how often quota counters are persisted.
+const quotaSaveInterval = 30 * time.Second
+
+var errQuotaExceeded = errors.New("traffic quota exhausted")
+
+type quotaStore struct {
+	mu sync.Mutex
+	// Start is the unix time the current period started.
+	Start int64            `json:"start"`
+	Used  map[string]int64 `json:"used"`
+	// Aborted is the part of Used sent by transfers the client abandoned.
+	Aborted map[string]int64 `json:"aborted"`
+	dirty   bool
+	// shared and sharedAborted are the totals of all instances last read from redis with
+	// -limits-backend redis, Used and Aborted then only count what was not added there yet.
+	shared        map[string]int64
+	sharedAborted map[string]int64
+}
+
+var quotas = &quotaStore{Used: map[string]int64{}}
+
+func loadQuotas() error {
+	quotas.mu.Lock()
+	defer quotas.mu.Unlock()
+	if sharedLimits() {
+		quotas.Aborted = map[string]int64{}
+		quotas.roll()
+		go func() {
+			for range time.Tick(quotaSyncInterval) {
+				quotas.sync()
+			}
+		}()
+		return nil
+	}
+	if err := loadState("quotas", quotas); err != nil {
+		return err
+	}
+	if quotas.Used == nil {
+		quotas.Used = map[string]int64{}
+	}
+	if quotas.Aborted == nil {
+		quotas.Aborted = map[string]int64{}
+	}
+	quotas.roll()
+	go func() {
+		for range time.Tick(quotaSaveInterval) {
+			quotas.save()
+		}
+	}()
+	return nil
+}
+
+// roll resets the counters when the current period is over, mu must be held.
+func (q *quotaStore) roll() {
+	start := time.Now().Truncate(quotaPeriod).Unix()
+	if q.Start != start {
+		q.Start = start
+		q.Used = map[string]int64{}
+		q.Aborted = map[string]int64{}
+		q.shared, q.sharedAborted = map[string]int64{}, map[string]int64{}
+		q.dirty = true
+	}
+}
+
+func (q *quotaStore) save() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.dirty {
+		return
+	}
+	if err := saveState("quotas", q); err != nil {
+		noticef(levelError, "failed to save quotas: %s", err.Error())
+		return
+	}
+	q.dirty = false
+}
+
+// used returns the bytes accounted to id in the current period, and how many of them were aborted.
+func (q *quotaStore) used(id string) (int64, int64) {
+	if sharedLimits() {
+		q.readShared(id)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll()
+	return q.shared[id] + q.Used[id], q.sharedAborted[id] + q.Aborted[id]
+}
+
+// addAborted marks n bytes already accounted to id as sent by an aborted transfer.
+func (q *quotaStore) addAborted(id string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll()
+	q.Aborted[id] += n
+	q.dirty = true
+}
+
+// add accounts n bytes to id and reports whether id is still within limit.
+func (q *quotaStore) add(id string, n, limit int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll()
+	q.Used[id] += n
+	q.dirty = true
+	return q.shared[id]+q.Used[id] <= limit
+}
+
+func (q *quotaStore) resetAt() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return time.Unix(q.Start, 0).Add(quotaPeriod)
+}
+
+type quotaResult struct {
+	Result
+	Identity string    `json:"identity"`
+	Used     int64     `json:"used"`
+	Aborted  int64     `json:"aborted"`
+	Limit    int64     `json:"limit"`
+	ResetAt  time.Time `json:"reset_at"`
+}
+
+func quotaExceededResponse(w http.ResponseWriter, id string, used, aborted, limit int64) {
+	msg := errQuotaExceeded.Error()
+	errorResponseWithBody(w, errorStatus(http.StatusForbidden), http.StatusForbidden, msg, quotaResult{
+		Result:   Result{Code: http.StatusForbidden, Msg: msg},
+		Identity: id,
+		Used:     used,
+		Aborted:  aborted,
+		Limit:    limit,
+		ResetAt:  quotas.resetAt(),
+	})
+}
+
+// quotaWriter accounts response bytes to an identity, failing once the quota is exhausted.
+type quotaWriter struct {
+	http.ResponseWriter
+	id      string
+	limit   int64
+	written int64
+	// exceeded is set once a write exhausted the quota
+	exceeded bool
+}
+
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	n, err := qw.ResponseWriter.Write(p)
+	qw.written += int64(n)
+	if !quotas.add(qw.id, int64(n), qw.limit) && err == nil {
+		err = errQuotaExceeded
+		qw.exceeded = true
+	}
+	return n, err
+}
+
+func (qw *quotaWriter) Unwrap() http.ResponseWriter {
+	return qw.ResponseWriter
+}
+
+func quotaHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := clientIdentity(r)
+		limit := int64(quota)
+		if k := getRequestInfo(r).apiKey; k != nil && k.Quota > 0 {
+			limit = k.Quota
+		}
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if used, aborted := quotas.used(id); used >= limit {
+			auditEvent(r, "quota_exhausted", http.StatusForbidden, "")
+			quotaExceededResponse(w, id, used, aborted, limit)
+			return
+		}
+		qw := &quotaWriter{ResponseWriter: w, id: id, limit: limit}
+		next.ServeHTTP(qw, r)
+		if qw.exceeded {
+			auditEvent(r, "quota_exhausted", 0, "during the transfer")
+		}
+		if getRequestInfo(r).outcome == "aborted" {
+			quotas.addAborted(id, qw.written)
+		}
+	})
+}
+
+type quotaUsage struct {
+	Identity string `json:"identity"`
+	Used     int64  `json:"used"`
+	Aborted  int64  `json:"aborted"`
+}
+
+type quotaList struct {
+	Limit   int64        `json:"limit"`
+	ResetAt time.Time    `json:"reset_at"`
+	Usage   []quotaUsage `json:"usage"`
+}
+
+func adminListQuotas(w http.ResponseWriter, _ *http.Request) {
+	quotas.mu.Lock()
+	quotas.roll()
+	list := quotaList{Limit: int64(quota), ResetAt: time.Unix(quotas.Start, 0).Add(quotaPeriod), Usage: []quotaUsage{}}
+	used, aborted := quotas.Used, quotas.Aborted
+	quotas.mu.Unlock()
+	if sharedLimits() {
+		var err error
+		if used, aborted, err = quotas.listShared(); err != nil {
+			errorResponse(w, 500, "failed to read the quotas from redis: "+err.Error())
+			return
+		}
+	}
+	quotas.mu.Lock()
+	for id, n := range used {
+		list.Usage = append(list.Usage, quotaUsage{Identity: id, Used: n, Aborted: aborted[id]})
+	}
+	quotas.mu.Unlock()
+	sort.Slice(list.Usage, func(i, j int) bool { return list.Usage[i].Used > list.Usage[j].Used })
+	jsonResponse(w, list)
+}
+
+// adminResetQuota forgets the traffic of an identity in the current period.
+func adminResetQuota(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("identity")
+	if sharedLimits() {
+		ok, err := quotas.resetShared(id)
+		if err != nil {
+			errorResponse(w, 500, "failed to reset the quota in redis: "+err.Error())
+			return
+		}
+		if !ok {
+			errorResponseWithStatus(w, http.StatusNotFound, 404, "no traffic recorded for "+id)
+			return
+		}
+		jsonResponse(w, Result{Code: 200, Msg: "reset"})
+		return
+	}
+	quotas.mu.Lock()
+	_, ok := quotas.Used[id]
+	delete(quotas.Used, id)
+	delete(quotas.Aborted, id)
+	quotas.dirty = true
+	quotas.mu.Unlock()
+	if !ok {
+		errorResponseWithStatus(w, http.StatusNotFound, 404, "no traffic recorded for "+id)
+		return
+	}
+	jsonResponse(w, Result{Code: 200, Msg: "reset"})
+}
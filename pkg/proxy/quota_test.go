@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuotaExceededResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		accept string
+		legacy string
+		status int
+		check  func(t *testing.T, w *httptest.ResponseRecorder)
+	}{
+		{"json", "", "false", http.StatusForbidden, func(t *testing.T, w *httptest.ResponseRecorder) {
+			var res quotaResult
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatalf("answered %q: %v", w.Body, err)
+			}
+			if res.Code != http.StatusForbidden || res.Identity != "ip:192.0.2.1" || res.Used != 120 || res.Limit != 100 || res.ResetAt.IsZero() {
+				t.Errorf("answered %+v", res)
+			}
+		}},
+		{"legacy status", "", "true", http.StatusOK, func(t *testing.T, w *httptest.ResponseRecorder) {
+			var res quotaResult
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Code != http.StatusForbidden {
+				t.Errorf("answered %q, expected the code 403: %v", w.Body, err)
+			}
+		}},
+		{"html", "text/html", "false", http.StatusForbidden, func(t *testing.T, w *httptest.ResponseRecorder) {
+			if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), errQuotaExceeded.Error()) {
+				t.Errorf("answered %q, expected the error page", w.Body)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlags(t, map[string]string{"legacy-error-status": tc.legacy})
+			r := httptest.NewRequest(http.MethodGet, "/file.bin", nil)
+			r.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+			errorPagesHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				quotaExceededResponse(w, "ip:192.0.2.1", 120, 20, 100)
+			})).ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("answered %d, expected %d", w.Code, tc.status)
+			}
+			tc.check(t, w)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var originRangeErrors = newCounterVec("openlist_proxy_origin_range_errors_total", "Origin answers to range requests not matching the range, by what was done: trimmed, unsatisfiable or rejected.", "action")
+
+// checkRange validates the answer of the origin to a single range request before it is
+// relayed: a 206 must carry a Content-Range covering the start of the range, which is cut
+// down to the range when the origin sent more, and ranges beyond the end of the file get a
+// 416 with Content-Range: bytes */size, looked up in openlist for the 416s of origins leaving
+// it out. It writes a 502 and returns false for answers that would corrupt the file of the client.
+func checkRange(w http.ResponseWriter, r *http.Request, filePath string, res *http.Response) bool {
+	if res.Request == nil || res.Request.Method != http.MethodGet || res.Header.Get("Content-Encoding") != "" {
+		return true
+	}
+	ranges, err := parseRange(res.Request.Header.Get("Range"))
+	if err != nil || len(ranges) != 1 {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		start, end, ok := parseContentRange(res.Header.Get("Content-Range"))
+		if !ok || res.ContentLength >= 0 && res.ContentLength != end-start {
+			return rejectRange(w, r, res, fmt.Sprintf("origin answered the range with Content-Range %q and %d bytes", res.Header.Get("Content-Range"), res.ContentLength))
+		}
+		_, _, size, known := parseContentRangeSize(res.Header.Get("Content-Range"))
+		if !known {
+			if strings.HasSuffix(res.Header.Get("Content-Range"), "/*") {
+				// the length of the file is not known to the origin either
+				return true
+			}
+			return rejectRange(w, r, res, fmt.Sprintf("origin answered the range with Content-Range %q beyond the end of the file", res.Header.Get("Content-Range")))
+		}
+		offset, length, ok := ranges[0].resolve(size)
+		if !ok {
+			unsatisfiableRange(res, size)
+			return true
+		}
+		if offset < start || offset >= end {
+			return rejectRange(w, r, res, fmt.Sprintf("origin answered the range %s with bytes %d-%d", rangeSpec(ranges[0]), start, end-1))
+		}
+		if offset == start && offset+length >= end {
+			// a shorter range than asked for is fine, the client asks for the rest
+			return true
+		}
+		originRangeErrors.inc("trimmed")
+		length = min(offset+length, end) - offset
+		res.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		res.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+		res.ContentLength = length
+		res.Body = &rangeWindow{body: res.Body, skip: offset - start, left: length, size: size}
+	case http.StatusOK:
+		if res.ContentLength < 0 || res.Request.Header.Get("If-Range") != "" {
+			// a whole file answering a changed If-Range is right
+			return true
+		}
+		if _, _, ok := ranges[0].resolve(res.ContentLength); !ok {
+			unsatisfiableRange(res, res.ContentLength)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		if validUnsatisfiedRange(res.Header.Get("Content-Range")) {
+			return true
+		}
+		res.Header.Del("Content-Range")
+		if o, err := statObject(filePath); err == nil && !o.IsDir {
+			res.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", o.Size))
+		}
+	}
+	return true
+}
+
+// validUnsatisfiedRange reports whether v is the "bytes */size" of a 416.
+func validUnsatisfiedRange(v string) bool {
+	size, ok := strings.CutPrefix(v, "bytes */")
+	_, err := parseRangeInt(size)
+	return ok && err == nil
+}
+
+// unsatisfiableRange turns res into the 416 of a range beyond the size of the file.
+func unsatisfiableRange(res *http.Response, size int64) {
+	originRangeErrors.inc("unsatisfiable")
+	_ = res.Body.Close()
+	res.StatusCode, res.Status = http.StatusRequestedRangeNotSatisfiable, "416 Requested Range Not Satisfiable"
+	res.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	res.Header.Set("Content-Length", "0")
+	res.ContentLength = 0
+	res.Body = http.NoBody
+}
+
+func rejectRange(w http.ResponseWriter, r *http.Request, res *http.Response, reason string) bool {
+	originRangeErrors.inc("rejected")
+	logf(levelWarn, "%s for %s from %s", reason, r.URL.Path, res.Request.URL.Host)
+	errorResponse(w, http.StatusBadGateway, reason)
+	return false
+}
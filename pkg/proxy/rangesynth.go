@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var synthesizeRanges string
+
+func init() {
+	CommandLine.StringVar(&synthesizeRanges, "synthesize-ranges", "", "comma separated origin hosts known to ignore Range, whose full responses are cut down to the requested range so seeking works, "+
+		"* does so for any origin answering a range request with the whole file")
+}
+
+var synthesizedRanges = newCounterVec("openlist_proxy_synthesized_ranges_total", "Range requests answered by cutting the range out of a full origin response.")
+
+// synthesizesRanges reports whether ranges of files on host are cut out of full responses.
+func synthesizesRanges(host string) bool {
+	for _, h := range strings.Split(synthesizeRanges, ",") {
+		if h = strings.TrimSpace(h); h == "*" || strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// synthesizeRange turns the full 200 response res to a single range request into the 206 or 416
+// the client asked for, streaming the whole file from the origin but only passing on the range.
+func synthesizeRange(r *http.Request, req *downloadRequest, res *http.Response) {
+	if synthesizeRanges == "" || len(req.Ranges) != 1 || r.Method != http.MethodGet ||
+		res.StatusCode != http.StatusOK || res.ContentLength < 0 || !synthesizesRanges(res.Request.URL.Host) {
+		return
+	}
+	if v := r.Header.Get("If-Range"); v != "" && v != ifRangeValidator(res.Header) {
+		// the file changed since the client got its first part, it gets the whole new one
+		return
+	}
+	size := res.ContentLength
+	offset, length, ok := req.Ranges[0].resolve(size)
+	synthesizedRanges.inc()
+	if !ok {
+		_ = res.Body.Close()
+		res.StatusCode, res.Status = http.StatusRequestedRangeNotSatisfiable, "416 Requested Range Not Satisfiable"
+		res.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		res.Header.Set("Content-Length", "0")
+		res.ContentLength = 0
+		res.Body = http.NoBody
+		return
+	}
+	res.StatusCode, res.Status = http.StatusPartialContent, "206 Partial Content"
+	res.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+	res.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	res.Header.Set("Accept-Ranges", "bytes")
+	res.ContentLength = length
+	res.Body = &rangeWindow{body: res.Body, skip: offset, left: length, size: size}
+}
+
+// rangeWindow reads the left bytes of body after discarding the first skip.
+type rangeWindow struct {
+	body       io.ReadCloser
+	skip, left int64
+	// size is the length of the whole file in body.
+	size int64
+}
+
+func (w *rangeWindow) Read(p []byte) (int, error) {
+	if w.skip > 0 {
+		n, err := io.CopyN(io.Discard, w.body, w.skip)
+		w.skip -= n
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	if w.left <= 0 {
+		return 0, io.EOF
+	}
+	n, err := w.body.Read(p[:min(int64(len(p)), w.left)])
+	w.left -= int64(n)
+	if err == io.EOF && w.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (w *rangeWindow) Close() error {
+	return w.body.Close()
+}
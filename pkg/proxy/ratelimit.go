@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	rateLimit float64
+	rateBurst int
+)
+
+func init() {
+	CommandLine.Float64Var(&rateLimit, "rate-limit", 0, "max requests per second per client ip, 0 disables rate limiting")
+	CommandLine.IntVar(&rateBurst, "rate-burst", 10, "max burst of requests per client ip")
+}
+
+// limiterIdle is how long an unused per-ip limiter is kept before it is dropped.
+const limiterIdle = 5 * time.Minute
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type ipLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*ipLimiter
+	limit    rate.Limit
+	burst    int
+}
+
+func newIPLimiters(limit rate.Limit, burst int) *ipLimiters {
+	l := &ipLimiters{limiters: map[string]*ipLimiter{}, limit: limit, burst: burst}
+	go l.cleanup()
+	return l
+}
+
+func (l *ipLimiters) get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	il, ok := l.limiters[ip]
+	if !ok {
+		il = &ipLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = il
+	}
+	il.lastSeen = time.Now()
+	return il.limiter
+}
+
+func (l *ipLimiters) cleanup() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for ip, il := range l.limiters {
+			if time.Since(il.lastSeen) > limiterIdle {
+				delete(l.limiters, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// allow reports whether a request is allowed now, and otherwise how long to wait before retrying.
+func allow(limiter *rate.Limiter) (bool, time.Duration) {
+	res := limiter.Reserve()
+	if !res.OK() {
+		return false, time.Second
+	}
+	if delay := res.Delay(); delay > 0 {
+		res.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+func rateLimitHandler(next http.Handler) http.Handler {
+	limiters := newIPLimiters(rate.Limit(rateLimit), rateBurst)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ok, retryAfter := allowShared("ip:"+ip, rateLimit, rateBurst, limiters.get(ip)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			errorResponseWithStatus(w, http.StatusTooManyRequests, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// statusRecorder records the status code and body size written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	// headerAt is when the response header was written, zero if it never was.
+	headerAt time.Time
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	if rec.headerAt.IsZero() {
+		rec.headerAt = time.Now()
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.headerAt.IsZero() {
+		rec.headerAt = time.Now()
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	n, err := readFrom(rec.ResponseWriter, src)
+	rec.bytes += n
+	return n, err
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
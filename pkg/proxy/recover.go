@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+var panicsTotal = newCounterVec("openlist_proxy_panics_total", "Requests whose handler panicked.")
+
+// recoverHandler turns a panic in a handler into a logged stack and a 500, instead of a
+// connection dropped without a trace. It must run inside requestInfoHandler for the id.
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := newStatusRecorder(w)
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// a deliberate abort of the response
+				panic(v)
+			}
+			panicsTotal.inc()
+			stack := debug.Stack()
+			logf(levelError, "panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, getRequestInfo(r).id, v, stack)
+			reportError(r, "panic", 500, fmt.Sprint(v), string(stack))
+			if rec.headerAt.IsZero() {
+				errorResponseWithStatus(rec, http.StatusInternalServerError, 500, "internal error, request id "+getRequestInfo(r).id)
+				return
+			}
+			// the status is out, only cutting the body short tells the client
+			panic(http.ErrAbortHandler)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var redirectMode bool
+
+func init() {
+	CommandLine.BoolVar(&redirectMode, "redirect", false, "redirect clients to the origin url with a 302 instead of proxying, links that need request headers, from the backend or header rules, are still proxied")
+}
+
+// serveRedirect sends the client to the origin url of link. When the backend reported how
+// long the url is valid, Expires and Cache-Control keep clients from reusing it longer.
+func serveRedirect(w http.ResponseWriter, r *http.Request, link *Link) {
+	setCORSHeaders(w, r)
+	if expires := link.expires(); !expires.IsZero() {
+		w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(max(int(time.Until(expires).Seconds()), 0)))
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	http.Redirect(w, r, link.Url, http.StatusFound)
+}
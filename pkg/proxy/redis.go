@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisURL    string
+	redisPrefix string
+)
+
+func init() {
+	CommandLine.StringVar(&redisURL, "redis-url", "", "`url` of a redis the instances of a cluster share the link and negative caches, sign uses and bans in, "+
+		"e.g. redis://:password@host:6379/0 or rediss:// for tls, empty keeps them per instance")
+	CommandLine.StringVar(&redisPrefix, "redis-prefix", "openlist-proxy:", "prefix of the redis keys, so clusters can share a redis")
+}
+
+// redisTimeout bounds every redis operation, requests must not hang on an unreachable redis.
+const redisTimeout = 2 * time.Second
+
+// redisUpdateRetries bounds how often redisUpdate retries when other instances change the key.
+const redisUpdateRetries = 10
+
+// rdb is the shared redis, nil without -redis-url.
+var rdb *redis.Client
+
+func setupRedis() error {
+	if redisURL == "" {
+		return nil
+	}
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return fmt.Errorf("invalid -redis-url: %w", err)
+	}
+	opt.DialTimeout, opt.ReadTimeout, opt.WriteTimeout = redisTimeout, redisTimeout, redisTimeout
+	// failures are reported where they matter, not by every dial of the pool
+	redis.SetLogger(redisLogger{})
+	client := redis.NewClient(opt)
+	ctx, cancel := redisContext()
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	rdb = client
+	return nil
+}
+
+type redisLogger struct{}
+
+func (redisLogger) Printf(context.Context, string, ...any) {}
+
+func redisContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), redisTimeout)
+}
+
+// redisKey returns the key of name under -redis-prefix.
+func redisKey(name ...string) string {
+	return redisPrefix + strings.Join(name, ":")
+}
+
+// redisGlobEscape escapes the glob characters of s for SCAN MATCH.
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]^\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// redisUpdate applies f to the json value of key with a transaction, so concurrent updates of
+// several instances are not lost, and retries when another instance changed it meanwhile. f
+// returns when the updated value expires and whether it changed at all; it may run more than
+// once and must only depend on the value it is given.
+func redisUpdate[T any](key string, f func(v *T, found bool) (expire time.Time, changed bool)) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+	for range redisUpdateRetries {
+		err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+			var v T
+			b, err := tx.Get(ctx, key).Bytes()
+			found := err == nil
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+			if found {
+				if err := json.Unmarshal(b, &v); err != nil {
+					return fmt.Errorf("invalid %s: %w", key, err)
+				}
+			}
+			expire, changed := f(&v, found)
+			if !changed {
+				return nil
+			}
+			b, _ = json.Marshal(v)
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.SetArgs(ctx, key, b, redis.SetArgs{ExpireAt: expire})
+				return nil
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return fmt.Errorf("%s kept changing while updating it", key)
+}
+
+func closeRedis() {
+	if rdb != nil {
+		_ = rdb.Close()
+	}
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+var limitsBackend string
+
+func init() {
+	CommandLine.StringVar(&limitsBackend, "limits-backend", "local", "where -rate-limit, the rate limits of api keys and quotas are counted: local per instance, "+
+		"or redis to enforce them across the instances sharing -redis-url, counting locally while redis is unavailable")
+}
+
+// quotaSyncInterval is how often the traffic counted by an instance is added to the quotas in redis.
+const quotaSyncInterval = time.Second
+
+// redisFallbackLog bounds how often falling back to local limits is logged.
+const redisFallbackLog = time.Minute
+
+// redisRetryAfter is how long limits are counted locally after redis failed, rather than
+// making every request wait for it to time out.
+const redisRetryAfter = 5 * time.Second
+
+func sharedLimits() bool {
+	return limitsBackend == "redis"
+}
+
+func setupSharedLimits() error {
+	switch limitsBackend {
+	case "local":
+		return nil
+	case "redis":
+		if rdb == nil {
+			return errors.New("-limits-backend redis needs -redis-url")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid -limits-backend %q, want local or redis", limitsBackend)
+}
+
+var redisFallback = struct {
+	sync.Mutex
+	failed time.Time
+	logged time.Time
+}{}
+
+// redisLimits reports whether limits are counted in redis right now.
+func redisLimits() bool {
+	if !sharedLimits() {
+		return false
+	}
+	redisFallback.Lock()
+	defer redisFallback.Unlock()
+	return time.Since(redisFallback.failed) >= redisRetryAfter
+}
+
+// logRedisFallback notes that limits are counted locally because of err, logging it at most
+// once per redisFallbackLog.
+func logRedisFallback(err error) {
+	redisFallback.Lock()
+	defer redisFallback.Unlock()
+	redisFallback.failed = time.Now()
+	if time.Since(redisFallback.logged) >= redisFallbackLog {
+		redisFallback.logged = time.Now()
+		logf(levelWarn, "redis is unavailable, limiting per instance: %s", err.Error())
+	}
+}
+
+// gcraScript is a generic cell rate limiter: the key holds the theoretical arrival time of the
+// next request in milliseconds of the redis clock, so all instances share one bucket. It
+// returns 0 when the request is allowed, otherwise how many milliseconds to wait.
+var gcraScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local tat = tonumber(redis.call('GET', KEYS[1]) or 0)
+if tat < now then
+	tat = now
+end
+local wait = tat + interval - now - interval * burst
+if wait > 0 then
+	return math.ceil(wait)
+end
+redis.call('SET', KEYS[1], tat + interval, 'PX', math.ceil(tat + interval - now))
+return 0
+`)
+
+// allowShared is allow for a limit of limit requests per second with burst shared across
+// the instances under name, using local while redis cannot be reached.
+func allowShared(name string, limit float64, burst int, local *rate.Limiter) (bool, time.Duration) {
+	if !redisLimits() {
+		return allow(local)
+	}
+	ctx, cancel := redisContext()
+	defer cancel()
+	interval := 1000 / limit
+	wait, err := gcraScript.Run(ctx, rdb, []string{redisKey("rate", name)}, strconv.FormatFloat(interval, 'f', -1, 64), max(burst, 1)).Int64()
+	if err != nil {
+		logRedisFallback(err)
+		return allow(local)
+	}
+	if wait > 0 {
+		return false, time.Duration(wait) * time.Millisecond
+	}
+	return true, 0
+}
+
+// quotaKey is the redis hash of the counters of the period starting at start, used or aborted.
+func quotaKey(start int64, counter string) string {
+	return redisKey("quota", strconv.FormatInt(start, 10), counter)
+}
+
+// sync adds the traffic counted since the last sync to redis and reads back the totals of all
+// instances. Counts redis did not take are kept for the next sync.
+func (q *quotaStore) sync() {
+	if !redisLimits() {
+		return
+	}
+	q.mu.Lock()
+	q.roll()
+	start, used, aborted := q.Start, q.Used, q.Aborted
+	q.Used, q.Aborted = map[string]int64{}, map[string]int64{}
+	q.mu.Unlock()
+	if len(used) == 0 && len(aborted) == 0 {
+		return
+	}
+	ctx, cancel := redisContext()
+	defer cancel()
+	usedCmds, abortedCmds := map[string]*redis.IntCmd{}, map[string]*redis.IntCmd{}
+	expire := time.Unix(start, 0).Add(2 * quotaPeriod)
+	_, err := rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for id, n := range used {
+			usedCmds[id] = p.HIncrBy(ctx, quotaKey(start, "used"), id, n)
+		}
+		for id, n := range aborted {
+			abortedCmds[id] = p.HIncrBy(ctx, quotaKey(start, "aborted"), id, n)
+		}
+		p.ExpireAt(ctx, quotaKey(start, "used"), expire)
+		p.ExpireAt(ctx, quotaKey(start, "aborted"), expire)
+		return nil
+	})
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.Start != start {
+		// the period ended meanwhile, its counts no longer matter
+		return
+	}
+	if err != nil {
+		logRedisFallback(err)
+		for id, n := range used {
+			q.Used[id] += n
+		}
+		for id, n := range aborted {
+			q.Aborted[id] += n
+		}
+		return
+	}
+	for id, cmd := range usedCmds {
+		q.shared[id] = cmd.Val()
+	}
+	for id, cmd := range abortedCmds {
+		q.sharedAborted[id] = cmd.Val()
+	}
+}
+
+// readShared refreshes the totals of id from redis, keeping the last known ones when it fails.
+func (q *quotaStore) readShared(id string) {
+	if !redisLimits() {
+		return
+	}
+	q.mu.Lock()
+	q.roll()
+	start := q.Start
+	q.mu.Unlock()
+	ctx, cancel := redisContext()
+	defer cancel()
+	var used, aborted *redis.StringCmd
+	_, err := rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		used = p.HGet(ctx, quotaKey(start, "used"), id)
+		aborted = p.HGet(ctx, quotaKey(start, "aborted"), id)
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		logRedisFallback(err)
+		return
+	}
+	u, _ := used.Int64()
+	a, _ := aborted.Int64()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.Start == start {
+		q.shared[id], q.sharedAborted[id] = u, a
+	}
+}
+
+// listShared returns the totals of all identities of the current period from redis.
+func (q *quotaStore) listShared() (map[string]int64, map[string]int64, error) {
+	q.sync()
+	q.mu.Lock()
+	start := q.Start
+	q.mu.Unlock()
+	ctx, cancel := redisContext()
+	defer cancel()
+	used, err := rdb.HGetAll(ctx, quotaKey(start, "used")).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	aborted, err := rdb.HGetAll(ctx, quotaKey(start, "aborted")).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	u, a := map[string]int64{}, map[string]int64{}
+	for id, v := range used {
+		u[id], _ = strconv.ParseInt(v, 10, 64)
+	}
+	for id, v := range aborted {
+		a[id], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return u, a, nil
+}
+
+// resetShared forgets the traffic of id in redis and reports whether there was any.
+func (q *quotaStore) resetShared(id string) (bool, error) {
+	q.mu.Lock()
+	start := q.Start
+	delete(q.Used, id)
+	delete(q.Aborted, id)
+	delete(q.shared, id)
+	delete(q.sharedAborted, id)
+	q.mu.Unlock()
+	ctx, cancel := redisContext()
+	defer cancel()
+	n, err := rdb.HDel(ctx, quotaKey(start, "used"), id).Result()
+	if err == nil {
+		err = rdb.HDel(ctx, quotaKey(start, "aborted"), id).Err()
+	}
+	return n > 0, err
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	refererAllow       stringList
+	refererDeny        stringList
+	refererEmpty       string
+	hotlinkPlaceholder string
+)
+
+func init() {
+	CommandLine.Var(&refererAllow, "referer-allow", "only allow requests whose referer host matches this pattern, e.g. *.example.com, repeatable")
+	CommandLine.Var(&refererDeny, "referer-deny", "reject requests whose referer host matches this pattern, repeatable")
+	CommandLine.StringVar(&refererEmpty, "referer-empty", "allow", "how to treat requests without a referer: allow or deny")
+	CommandLine.StringVar(&hotlinkPlaceholder, "hotlink-placeholder", "", "`file` served instead of the 403 error to rejected hotlinks, e.g. an image")
+}
+
+func refererEnabled() bool {
+	return len(refererAllow) > 0 || len(refererDeny) > 0 || refererEmpty == "deny"
+}
+
+func validateReferer() error {
+	if refererEmpty != "allow" && refererEmpty != "deny" {
+		return fmt.Errorf("invalid -referer-empty %q", refererEmpty)
+	}
+	for _, p := range append(append([]string{}, refererAllow...), refererDeny...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid referer pattern %q", p)
+		}
+	}
+	return nil
+}
+
+func matchHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refererAllowed reports whether the referer of r passes the hotlink rules.
+// Referers from the proxy's own host are always allowed.
+func refererAllowed(r *http.Request) bool {
+	ref := r.Header.Get("Referer")
+	if ref == "" {
+		return refererEmpty == "allow"
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if matchHost(refererDeny, host) {
+		return false
+	}
+	return len(refererAllow) == 0 || matchHost(refererAllow, host)
+}
+
+func refererHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !refererAllowed(r) {
+			if hotlinkPlaceholder != "" {
+				w.Header().Set("Cache-Control", "no-store")
+				http.ServeFile(w, r, hotlinkPlaceholder)
+				return
+			}
+			errorResponseWithStatus(w, http.StatusForbidden, http.StatusForbidden, "hotlinking is not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fileWatchInterval is how often watched files are checked for changes.
+const fileWatchInterval = 5 * time.Second
+
+var (
+	reloadMu    sync.Mutex
+	reloadFuncs []func()
+)
+
+// onReload registers f to run on SIGHUP.
+func onReload(f func()) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadFuncs = append(reloadFuncs, f)
+}
+
+func handleReloadSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			auditEvent(nil, "reload", 0, "SIGHUP")
+			reloadMu.Lock()
+			funcs := append([]func(){}, reloadFuncs...)
+			reloadMu.Unlock()
+			for _, f := range funcs {
+				f()
+			}
+		}
+	}()
+}
+
+// watchFile calls f whenever the modification time or size of path changes.
+func watchFile(path string, f func()) {
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	mtime, size := stat()
+	go func() {
+		for range time.Tick(fileWatchInterval) {
+			m, s := stat()
+			if !m.Equal(mtime) || s != size {
+				mtime, size = m, s
+				auditEvent(nil, "reload", 0, path+" changed")
+				f()
+			}
+		}
+	}()
+}
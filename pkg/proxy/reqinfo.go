@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+var requestIDHeader string
+
+func init() {
+	CommandLine.StringVar(&requestIDHeader, "request-id-header", "X-Request-Id", "header the request id is taken from when a client or reverse proxy sets it, "+
+		"and returned in and sent to origins with")
+}
+
+// requestInfo carries per-request facts between the handler and the middlewares around it.
+type requestInfo struct {
+	// outcome of the body transfer: completed, aborted (client went away) or upstream_error,
+	// empty when no body was proxied.
+	outcome string
+	// apiKey is the api key the request authenticated with, nil without one.
+	apiKey *apiKey
+	// bandwidthClass is the -bandwidth-class of the api key or jwt, empty when they name none.
+	bandwidthClass string
+	// id correlates the logs, origin request and response of the request.
+	id string
+	// responseEdits of the matching -policy-file policies apply to the origin response.
+	responseEdits []*headerEdits
+	// policyHeaders are the request headers these policies set or added, forwarded to the
+	// origin whatever -forward-headers allows.
+	policyHeaders []string
+	// errorReported is set once an error of the request was reported, for one report per request.
+	errorReported bool
+	// fromPeer is set on the requests of -cache-peer instances.
+	fromPeer bool
+}
+
+type requestInfoKey struct{}
+
+func requestInfoHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{id: requestID(r)}
+		w.Header().Set(requestIDHeader, info.id)
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// getRequestInfo returns the info of r, a throwaway one outside requestInfoHandler.
+func getRequestInfo(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// requestID returns the id the request came with if it is sane, a new one otherwise.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 && validRequestID(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
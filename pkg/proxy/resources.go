@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cgroupLimits are the container limits found in /sys/fs/cgroup, zero when unlimited or unknown.
+type cgroupLimits struct {
+	CPUs   float64 `json:"cpus,omitempty"`
+	Memory int64   `json:"memory,omitempty"`
+}
+
+var detectedLimits cgroupLimits
+
+var startTime = time.Now()
+
+func init() {
+	adminMux.Handle("GET /api/status", adminAuth(adminStatus))
+}
+
+// readCgroupFile returns the trimmed content of a cgroup file, empty if it cannot be read.
+func readCgroupFile(name string) string {
+	b, err := os.ReadFile("/sys/fs/cgroup/" + name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// detectCgroupLimits reads the cpu and memory limits of cgroup v2, falling back to v1.
+func detectCgroupLimits() cgroupLimits {
+	var l cgroupLimits
+	if quota, period, ok := strings.Cut(readCgroupFile("cpu.max"), " "); ok && quota != "max" {
+		q, _ := strconv.ParseFloat(quota, 64)
+		p, _ := strconv.ParseFloat(period, 64)
+		if q > 0 && p > 0 {
+			l.CPUs = q / p
+		}
+	} else if q, _ := strconv.ParseFloat(readCgroupFile("cpu/cpu.cfs_quota_us"), 64); q > 0 {
+		if p, _ := strconv.ParseFloat(readCgroupFile("cpu/cpu.cfs_period_us"), 64); p > 0 {
+			l.CPUs = q / p
+		}
+	}
+	if v := readCgroupFile("memory.max"); v != "" && v != "max" {
+		l.Memory, _ = strconv.ParseInt(v, 10, 64)
+	} else if v, _ := strconv.ParseInt(readCgroupFile("memory/memory.limit_in_bytes"), 10, 64); v > 0 && v < 1<<62 {
+		// v1 reports a huge number when unlimited
+		l.Memory = v
+	}
+	return l
+}
+
+// lowMemoryThreshold is the container memory below which transfers use small copy buffers.
+const lowMemoryThreshold = 512 << 20
+
+// setupResources sizes the runtime to the container: GOMAXPROCS to the cpu quota and,
+// unless -memory-limit or GOMEMLIMIT is set, a soft memory limit below the cgroup limit.
+func setupResources() {
+	detectedLimits = detectCgroupLimits()
+	if detectedLimits.CPUs > 0 && os.Getenv("GOMAXPROCS") == "" {
+		procs := max(int(math.Ceil(detectedLimits.CPUs)), 1)
+		if procs < runtime.GOMAXPROCS(0) {
+			runtime.GOMAXPROCS(procs)
+			fmt.Printf("cgroup cpu limit %.2f, GOMAXPROCS set to %d\n", detectedLimits.CPUs, procs)
+		}
+	}
+	if detectedLimits.Memory > 0 {
+		if configSource["memory-limit"] == "" && os.Getenv("GOMEMLIMIT") == "" {
+			// leave headroom for memory the go runtime does not manage
+			memoryLimit = byteSize(detectedLimits.Memory / 10 * 9)
+			configSource["memory-limit"] = "cgroup"
+		}
+		if detectedLimits.Memory < lowMemoryThreshold {
+			copyBufferSize = min(copyBufferSize, 8<<10)
+		}
+	}
+}
+
+type statusResp struct {
+	Version        string       `json:"version"`
+	BackendVersion string       `json:"backend_version,omitempty"`
+	Uptime         int64        `json:"uptime"`
+	GOMAXPROCS     int          `json:"gomaxprocs"`
+	NumCPU         int          `json:"num_cpu"`
+	Cgroup         cgroupLimits `json:"cgroup"`
+	MemoryLimit    int64        `json:"memory_limit"`
+	HeapInUse      uint64       `json:"heap_in_use"`
+	Goroutines     int          `json:"goroutines"`
+}
+
+func adminStatus(w http.ResponseWriter, _ *http.Request) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	jsonResponse(w, statusResp{
+		Version:        Version,
+		BackendVersion: backendVersion,
+		Uptime:         int64(time.Since(startTime).Seconds()),
+		GOMAXPROCS:     runtime.GOMAXPROCS(0),
+		NumCPU:         runtime.NumCPU(),
+		Cgroup:         detectedLimits,
+		MemoryLimit:    debug.SetMemoryLimit(-1),
+		HeapInUse:      ms.HeapInuse,
+		Goroutines:     runtime.NumGoroutine(),
+	})
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var upstreamResumes int
+
+func init() {
+	CommandLine.IntVar(&upstreamResumes, "upstream-resumes", 3, "how often a broken origin transfer is resumed with a range request, 0 passes the failure to the client")
+}
+
+var upstreamResumesTotal = newCounterVec("openlist_proxy_upstream_resumes_total", "Broken origin transfers resumed mid-stream, by result.", "result")
+
+// resumableBody continues a body whose origin connection broke by requesting the rest
+// of the range again, guarded by If-Range so a changed file is never spliced in.
+type resumableBody struct {
+	mu     sync.Mutex
+	body   io.ReadCloser
+	closed bool
+
+	req *http.Request
+	// offset of the next byte to read and end of the expected range, both absolute.
+	offset, end int64
+	validator   string
+	attempts    int
+	// mirrors are the other urls of the file, resumed from in turn before the current url
+	mirrors []string
+	// relink resolves a fresh link when the current url stopped working.
+	relink func() (*Link, error)
+}
+
+// resumable wraps res.Body in a resumableBody if the transfer can be resumed.
+func resumable(res *http.Response, mirrors []string, relink func() (*Link, error)) {
+	if upstreamResumes <= 0 || res.Request == nil || res.Request.Method != http.MethodGet {
+		return
+	}
+	switch res.Body.(type) {
+	case *spliceBody, *parallelBody, *rangeWindow:
+		// parallel chunks retry on their own, synthesized ranges come from origins ignoring ranges
+		return
+	}
+	validator := ifRangeValidator(res.Header)
+	if validator == "" {
+		return
+	}
+	start, end, ok := bodyRange(res)
+	if !ok {
+		return
+	}
+	res.Body = &resumableBody{body: watchStall(res.Body), req: res.Request, offset: start, end: end, validator: validator, mirrors: mirrors, relink: relink}
+}
+
+// ifRangeValidator returns the strong validator of a response usable in If-Range, empty if it has none.
+func ifRangeValidator(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// bodyRange returns the absolute start and end (exclusive) of the bytes in the body of res,
+// if the origin would serve them again as ranges.
+func bodyRange(res *http.Response) (int64, int64, bool) {
+	switch res.StatusCode {
+	case http.StatusOK:
+		if res.ContentLength < 0 || res.Header.Get("Accept-Ranges") != "bytes" {
+			return 0, 0, false
+		}
+		return 0, res.ContentLength, true
+	case http.StatusPartialContent:
+		return parseContentRange(res.Header.Get("Content-Range"))
+	}
+	return 0, 0, false
+}
+
+// parseContentRange returns the absolute start and end (exclusive) of a "bytes a-b/n" header.
+func parseContentRange(v string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	spec, _, _ = strings.Cut(spec, "/")
+	a, b, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err1 := strconv.ParseInt(a, 10, 64)
+	last, err2 := strconv.ParseInt(b, 10, 64)
+	if err1 != nil || err2 != nil || last < start {
+		return 0, 0, false
+	}
+	return start, last + 1, true
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		body, closed := b.body, b.closed
+		b.mu.Unlock()
+		n, err := body.Read(p)
+		b.offset += int64(n)
+		if err == nil || err == io.EOF && b.offset >= b.end {
+			return n, err
+		}
+		if closed || b.attempts >= upstreamResumes {
+			return n, err
+		}
+		if rerr := b.resume(); rerr != nil {
+			upstreamResumesTotal.inc("failed")
+			logf(levelWarn, "failed to resume %s at byte %d: %s", b.req.URL.Redacted(), b.offset, rerr.Error())
+			return n, err
+		}
+		upstreamResumesTotal.inc("resumed")
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the broken body with the rest of the range, from the next mirror if there
+// are several urls and from a fresh link if the url expired.
+func (b *resumableBody) resume() error {
+	b.attempts++
+	b.mu.Lock()
+	_ = b.body.Close()
+	b.mu.Unlock()
+	var res *http.Response
+	err := errors.New("no mirror")
+	if len(b.mirrors) > 0 {
+		// the broken one is tried again last
+		next := b.mirrors[0]
+		b.mirrors = append(b.mirrors[1:], b.req.URL.String())
+		var req *http.Request
+		if req, err = b.moved(next, nil); err == nil {
+			if res, err = b.fetchRest(req); err == nil {
+				b.req = req
+			}
+		}
+	}
+	if err != nil {
+		res, err = b.fetchRest(b.req)
+	}
+	if err != nil && b.relink != nil {
+		link, lerr := b.relink()
+		if lerr != nil {
+			return errors.Join(err, lerr)
+		}
+		req, lerr := b.moved(link.Url, link.Header)
+		if lerr != nil {
+			return lerr
+		}
+		b.req = req
+		res, err = b.fetchRest(req)
+	}
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		_ = res.Body.Close()
+		return errors.New("transfer closed")
+	}
+	b.body = watchStall(res.Body)
+	return nil
+}
+
+// moved returns the request of the transfer going to raw instead, with header added.
+func (b *resumableBody) moved(raw string, header http.Header) (*http.Request, error) {
+	req := b.req.Clone(b.req.Context())
+	u, err := req.URL.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	req.URL, req.Host = u, u.Host
+	maps.Copy(req.Header, header)
+	return req, nil
+}
+
+func (b *resumableBody) fetchRest(orig *http.Request) (*http.Response, error) {
+	req := orig.Clone(orig.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", b.offset, b.end-1))
+	req.Header.Set("If-Range", b.validator)
+	res, err := HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if start, _, ok := parseContentRange(res.Header.Get("Content-Range")); res.StatusCode != http.StatusPartialContent || !ok || start != b.offset {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("origin answered the resume with %s", res.Status)
+	}
+	return res, nil
+}
+
+func (b *resumableBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return b.body.Close()
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+var (
+	linkRetries       int
+	linkRetryBackoff  time.Duration
+	linkRetryDeadline time.Duration
+	linkTimeout       time.Duration
+)
+
+func init() {
+	CommandLine.IntVar(&linkRetries, "link-retries", 2, "how often a link resolution failing with a network error is retried on the same backend")
+	CommandLine.DurationVar(&linkRetryBackoff, "link-retry-backoff", 200*time.Millisecond, "initial backoff between link resolution retries, doubled after each retry and jittered")
+	CommandLine.DurationVar(&linkRetryDeadline, "link-retry-deadline", 5*time.Second, "total time after which a link resolution is not retried anymore")
+	CommandLine.DurationVar(&linkTimeout, "link-timeout", 10*time.Second, "timeout of a single link resolution call to openlist, within -api-timeout")
+}
+
+var linkRetriesTotal = newCounterVec("openlist_proxy_link_retries_total", "Link resolutions retried after a transient error.")
+
+// withRetry calls f until it succeeds, returns an api error or the retries are used up.
+// Backoffs grow exponentially with full jitter and never pass -link-retry-deadline.
+func withRetry[T any](f func() (T, error)) (T, error) {
+	deadline := time.Now().Add(linkRetryDeadline)
+	backoff := linkRetryBackoff
+	for attempt := 0; ; attempt++ {
+		v, err := f()
+		var apiErr *apiError
+		if err == nil || errors.As(err, &apiErr) || attempt >= linkRetries {
+			return v, err
+		}
+		sleep := time.Duration(rand.Int64N(int64(backoff) + 1))
+		if time.Now().Add(sleep).After(deadline) {
+			return v, err
+		}
+		linkRetriesTotal.inc()
+		time.Sleep(sleep)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logRetention is how a log file is rotated and how long its rotated segments are kept.
+type logRetention struct {
+	maxSize  byteSize
+	maxAge   time.Duration
+	maxTotal byteSize
+	compress bool
+}
+
+// retentionFlags registers the retention options of the log configured by the flag name.
+func retentionFlags(name string, r *logRetention) {
+	r.maxSize, r.maxTotal = 100<<20, 1<<30
+	CommandLine.Var(&r.maxSize, name+"-max-size", "`size` after which -"+name+" is rotated")
+	CommandLine.DurationVar(&r.maxAge, name+"-max-age", 30*24*time.Hour, "how long rotated segments of -"+name+" are kept, 0 keeps them regardless of age")
+	CommandLine.Var(&r.maxTotal, name+"-max-total", "`size` the rotated segments of -"+name+" are kept under by deleting the oldest, 0 does not limit it")
+	CommandLine.BoolVar(&r.compress, name+"-compress", true, "gzip rotated segments of -"+name)
+}
+
+// rotatingFile is an append-only log file rotated by size, whose old segments are compressed
+// and deleted by the retention policy.
+type rotatingFile struct {
+	mu        sync.Mutex
+	path      string
+	retention logRetention
+	f         *os.File
+	size      int64
+}
+
+func openRotatingFile(path string, retention logRetention) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, retention: retention}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	go func() {
+		rf.prune()
+		// segments also age out while nothing is logged
+		for range time.Tick(time.Hour) {
+			rf.prune()
+		}
+	}()
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.retention.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > int64(rf.retention.maxSize) {
+		if err := rf.rotate(); err != nil {
+			noticef(levelError, "failed to rotate %s: %s", rf.path, err.Error())
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside as path.<time> and starts a new one, mu must be held.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	segment := rf.path + "." + time.Now().Format("20060102T150405.000")
+	if err := os.Rename(rf.path, segment); err != nil {
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	go func() {
+		if rf.retention.compress {
+			if err := compressFile(segment); err != nil {
+				noticef(levelError, "failed to compress %s: %s", segment, err.Error())
+			}
+		}
+		rf.prune()
+	}()
+	return nil
+}
+
+// compressFile replaces name by name.gz.
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// prune deletes rotated segments older than maxAge and the oldest ones beyond maxTotal.
+func (rf *rotatingFile) prune() {
+	matches, _ := filepath.Glob(rf.path + ".[0-9]*")
+	type segment struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var segments []segment
+	for _, m := range matches {
+		if strings.HasSuffix(m, ".gz") && slices.Contains(matches, strings.TrimSuffix(m, ".gz")) {
+			// being compressed, its source is counted
+			continue
+		}
+		info, err := os.Stat(m)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		segments = append(segments, segment{m, info.Size(), info.ModTime()})
+	}
+	// newest first, so the total is kept by dropping from the end
+	sort.Slice(segments, func(i, j int) bool { return segments[i].modTime.After(segments[j].modTime) })
+	var total int64
+	for _, s := range segments {
+		total += s.size
+		expired := rf.retention.maxAge > 0 && time.Since(s.modTime) > rf.retention.maxAge
+		if expired || rf.retention.maxTotal > 0 && total > int64(rf.retention.maxTotal) {
+			_ = os.Remove(s.name)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+var routesFile string
+
+func init() {
+	CommandLine.StringVar(&routesFile, "routes-file", "", "yaml file of routes (prefix, address, token, strip_prefix) sending paths below a prefix to another openlist, reloaded on change or SIGHUP")
+}
+
+// route sends the paths below Prefix to a different openlist deployment than -address.
+type route struct {
+	Prefix string `yaml:"prefix"`
+	// Address may be a comma separated list failed over between like -address.
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+	// StripPrefix removes Prefix from paths before asking the backend.
+	StripPrefix bool `yaml:"strip_prefix"`
+
+	backends []*backendHealth
+}
+
+// routes are sorted by descending prefix length so the most specific one matches.
+var routes atomic.Pointer[[]*route]
+
+func loadRoutes() error {
+	var rs []*route
+	if routesFile != "" {
+		b, err := os.ReadFile(routesFile)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(b, &rs); err != nil {
+			return fmt.Errorf("%s: %w", routesFile, err)
+		}
+		for _, rt := range rs {
+			rt.Prefix = strings.TrimSuffix(rt.Prefix, "/")
+			if !strings.HasPrefix(rt.Prefix, "/") {
+				return fmt.Errorf("%s: route prefix %q must be a path below /", routesFile, rt.Prefix)
+			}
+			if rt.backends = parseBackends(rt.Address); len(rt.backends) == 0 {
+				return fmt.Errorf("%s: route %s needs an address", routesFile, rt.Prefix)
+			}
+		}
+		sort.Slice(rs, func(i, j int) bool { return len(rs[i].Prefix) > len(rs[j].Prefix) })
+	}
+	routes.Store(&rs)
+	return nil
+}
+
+func reloadRoutes() {
+	if err := loadRoutes(); err != nil {
+		noticef(levelError, "failed to reload routes, keeping the previous ones: %s", err.Error())
+		return
+	}
+	fmt.Println("reloaded routes")
+}
+
+func setupRoutes() error {
+	if err := loadRoutes(); err != nil {
+		return err
+	}
+	if routesFile != "" {
+		onReload(reloadRoutes)
+		watchFile(routesFile, reloadRoutes)
+	}
+	return nil
+}
+
+// routeFor returns the route of filePath and the path to ask its backend for.
+func routeFor(filePath string) (*route, string, bool) {
+	rs := routes.Load()
+	if rs == nil {
+		return nil, filePath, false
+	}
+	for _, rt := range *rs {
+		if !pathWithin(filePath, rt.Prefix) {
+			continue
+		}
+		if rt.StripPrefix {
+			if p := strings.TrimPrefix(filePath, rt.Prefix); p != "" {
+				return rt, p, true
+			}
+			return rt, "/", true
+		}
+		return rt, filePath, true
+	}
+	return nil, filePath, false
+}
+
+// routedAPI calls f with the backend serving filePath and the path to send it.
+func routedAPI[T any](filePath string, f func(b backend, p string) (T, error)) (T, error) {
+	if rt, p, ok := routeFor(filePath); ok {
+		return failover(rt.backends, rt.Token, func(b backend) (T, error) {
+			return f(b, p)
+		})
+	}
+	return withFailover(func(b backend) (T, error) {
+		return f(b, filePath)
+	})
+}
+
+// backendURL returns the url of filePath in the web ui of the openlist serving it.
+func backendURL(filePath string) string {
+	base := address
+	rt, p, ok := routeFor(filePath)
+	if ok {
+		base = rt.backends[0].address
+		if up := healthyBackends(rt.backends); len(up) > 0 {
+			base = up[0].address
+		}
+	}
+	return strings.TrimSuffix(base, "/") + escapePath(p)
+}
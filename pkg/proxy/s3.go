@@ -0,0 +1,546 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	s3Address string
+	s3Keys    stringList
+	s3Buckets stringList
+)
+
+func init() {
+	CommandLine.StringVar(&s3Address, "s3-address", "", "address such as 127.0.0.1:9000 serving a read-only s3 api of -s3-bucket, empty disables it")
+	CommandLine.Var(&s3Keys, "s3-key", "`access:secret` key pair signing s3 requests with sigv4, repeatable")
+	CommandLine.Var(&s3Buckets, "s3-bucket", "`name=/path` bucket of the s3 api serving an openlist directory, repeatable")
+}
+
+// s3MaxSkew is how far the date of a signed request may be off, as on aws.
+const s3MaxSkew = 15 * time.Minute
+
+var (
+	s3Secrets     map[string]string
+	s3BucketRoots map[string]string
+)
+
+func setupS3() error {
+	if s3Address == "" {
+		return nil
+	}
+	s3Secrets, s3BucketRoots = map[string]string{}, map[string]string{}
+	for _, k := range s3Keys {
+		access, secret, ok := strings.Cut(k, ":")
+		if !ok || access == "" || secret == "" {
+			return fmt.Errorf("invalid -s3-key %q, expected access:secret", k)
+		}
+		s3Secrets[access] = secret
+	}
+	for _, b := range s3Buckets {
+		name, root, ok := strings.Cut(b, "=")
+		p, err := normalizePath(root)
+		if !ok || name == "" || strings.Contains(name, "/") || err != nil {
+			return fmt.Errorf("invalid -s3-bucket %q, expected name=/path", b)
+		}
+		s3BucketRoots[name] = p
+	}
+	if len(s3Secrets) == 0 || len(s3BucketRoots) == 0 {
+		return errors.New("-s3-address needs -s3-key and -s3-bucket")
+	}
+	return nil
+}
+
+// s3Downloads serves the objects of GetObject with the limits and rules of every download.
+var s3Downloads http.Handler
+
+func startS3Server() {
+	fmt.Printf("serve s3: %s\n", s3Address)
+	s3Downloads = downloadLimits(http.HandlerFunc(downHandle))
+	handler := requestInfoHandler(recoverHandler(http.HandlerFunc(serveS3)))
+	ln, err := handoffListen("s3 "+s3Address, s3Address, false)
+	if err != nil {
+		noticef(levelError, "failed to serve s3: %s", err.Error())
+		return
+	}
+	go func() {
+		if err := http.Serve(ln, handler); err != nil && !closedListener(err) {
+			noticef(levelError, "failed to serve s3: %s", err.Error())
+		}
+	}()
+}
+
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+func s3ErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write([]byte(xml.Header))
+		_ = xml.NewEncoder(w).Encode(s3Error{Code: code, Message: msg, Resource: r.URL.Path, RequestID: getRequestInfo(r).id})
+	}
+}
+
+// s3Writer has the errors of the download handlers answered as s3 errors.
+type s3Writer struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func (sw *s3Writer) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// ReadFrom keeps the zero-copy path of -splice open through the wrapper.
+func (sw *s3Writer) ReadFrom(src io.Reader) (int64, error) {
+	return readFrom(sw.ResponseWriter, src)
+}
+
+// writeS3Error answers the error of code as an s3 error when w is an s3Writer.
+func writeS3Error(w http.ResponseWriter, code int, msg string) bool {
+	sw, ok := unwrapWriter[*s3Writer](w)
+	if !ok {
+		return false
+	}
+	status := code
+	if status < 400 || status > 599 {
+		status = http.StatusInternalServerError
+	}
+	s3Code := "InternalError"
+	switch status {
+	case http.StatusBadRequest:
+		s3Code = "InvalidRequest"
+	case http.StatusUnauthorized, http.StatusForbidden:
+		s3Code = "AccessDenied"
+	case http.StatusNotFound:
+		s3Code = "NoSuchKey"
+	case http.StatusMethodNotAllowed:
+		s3Code = "MethodNotAllowed"
+	case http.StatusPreconditionFailed:
+		s3Code = "PreconditionFailed"
+	case http.StatusRequestEntityTooLarge:
+		s3Code = "EntityTooLarge"
+	case http.StatusRequestedRangeNotSatisfiable:
+		s3Code = "InvalidRange"
+	case http.StatusTooManyRequests:
+		s3Code = "SlowDown"
+	case http.StatusServiceUnavailable:
+		s3Code = "ServiceUnavailable"
+	default:
+		if status < 500 {
+			s3Code = "InvalidRequest"
+		}
+	}
+	s3ErrorResponse(w, sw.r, status, s3Code, msg)
+	return true
+}
+
+func s3XMLResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+// serveS3 answers ListBuckets, GetBucketLocation, ListObjects v1 and v2, HeadObject and
+// GetObject of path-style requests.
+func serveS3(w http.ResponseWriter, r *http.Request) {
+	access, err := verifySigV4(r)
+	if err != nil {
+		code := "SignatureDoesNotMatch"
+		if errors.Is(err, errS3Unsigned) {
+			code = "AccessDenied"
+		}
+		s3ErrorResponse(w, r, http.StatusForbidden, code, err.Error())
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		s3ErrorResponse(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "the s3 api is read-only")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		listBuckets(w)
+		return
+	}
+	root, ok := s3BucketRoots[bucket]
+	if !ok {
+		s3ErrorResponse(w, r, http.StatusNotFound, "NoSuchBucket", "no such bucket")
+		return
+	}
+	// downloads and listings are granted by the key like an api key limited to the bucket
+	getRequestInfo(r).apiKey = &apiKey{Name: "s3:" + access, Paths: []string{root}}
+	switch {
+	case key == "" && r.URL.Query().Has("location"):
+		s3XMLResponse(w, struct {
+			XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+		}{})
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "":
+		listObjects(w, r, bucket, root)
+	default:
+		getObject(w, r, root, key)
+	}
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+func listBuckets(w http.ResponseWriter) {
+	names := make([]string, 0, len(s3BucketRoots))
+	for name := range s3BucketRoots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := struct {
+		XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+		Owner   struct{}   `xml:"Owner"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{}
+	for _, name := range names {
+		res.Buckets = append(res.Buckets, s3Bucket{Name: name, CreationDate: time.Unix(0, 0).UTC().Format(s3TimeFormat)})
+	}
+	s3XMLResponse(w, res)
+}
+
+// s3TimeFormat is the timestamp format of s3 xml bodies.
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// s3ETag derives a stable etag from the metadata, openlist doesn't know content hashes.
+func s3ETag(filePath string, obj *fsObject) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", filePath, obj.Size, obj.Modified.UnixNano())))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func getObject(w http.ResponseWriter, r *http.Request, root, key string) {
+	filePath, err := normalizePath(path.Join(root, key))
+	if err != nil || strings.HasSuffix(key, "/") {
+		s3ErrorResponse(w, r, http.StatusNotFound, "NoSuchKey", "no such key")
+		return
+	}
+	obj, err := statObject(filePath)
+	if err != nil || obj.IsDir {
+		if err == nil || notFound(err) {
+			s3ErrorResponse(w, r, http.StatusNotFound, "NoSuchKey", "no such key")
+			return
+		}
+		s3ErrorResponse(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	etag := s3ETag(filePath, obj)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", obj.Modified.UTC().Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+		w.Header().Set("Content-Type", s3ContentType(obj.Name))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	r.URL.Path, r.URL.RawPath, r.URL.RawQuery = filePath, "", ""
+	r.Header.Del("Authorization")
+	s3Downloads.ServeHTTP(&s3Writer{ResponseWriter: w, r: r}, r)
+}
+
+func s3ContentType(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListResult struct {
+	XMLName        xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name           string     `xml:"Name"`
+	Prefix         string     `xml:"Prefix"`
+	Delimiter      string     `xml:"Delimiter,omitempty"`
+	MaxKeys        int        `xml:"MaxKeys"`
+	EncodingType   string     `xml:"EncodingType,omitempty"`
+	IsTruncated    bool       `xml:"IsTruncated"`
+	Marker         *string    `xml:"Marker"`
+	NextMarker     string     `xml:"NextMarker,omitempty"`
+	KeyCount       *int       `xml:"KeyCount"`
+	StartAfter     string     `xml:"StartAfter,omitempty"`
+	Continuation   string     `xml:"ContinuationToken,omitempty"`
+	NextContinue   string     `xml:"NextContinuationToken,omitempty"`
+	Contents       []s3Object `xml:"Contents"`
+	CommonPrefixes []s3Prefix `xml:"CommonPrefixes"`
+}
+
+var errS3Unsigned = errors.New("requests must be signed with sigv4")
+
+// errListFull stops a listing walk once a page is complete.
+var errListFull = errors.New("list full")
+
+// s3Lister walks a bucket in key order, collecting one page of a listing.
+type s3Lister struct {
+	root, prefix, delimiter, after string
+	max                            int
+	res                            *s3ListResult
+	last                           string
+}
+
+func listObjects(w http.ResponseWriter, r *http.Request, bucket, root string) {
+	q := r.URL.Query()
+	l := &s3Lister{root: root, prefix: q.Get("prefix"), delimiter: q.Get("delimiter"), max: 1000}
+	if l.delimiter != "" && l.delimiter != "/" {
+		s3ErrorResponse(w, r, http.StatusNotImplemented, "NotImplemented", "only / is supported as delimiter")
+		return
+	}
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3ErrorResponse(w, r, http.StatusBadRequest, "InvalidArgument", "invalid max-keys")
+			return
+		}
+		l.max = min(n, 1000)
+	}
+	res := &s3ListResult{Name: bucket, Prefix: l.prefix, Delimiter: l.delimiter, MaxKeys: l.max, EncodingType: q.Get("encoding-type")}
+	v2 := q.Get("list-type") == "2"
+	if v2 {
+		res.StartAfter, res.Continuation = q.Get("start-after"), q.Get("continuation-token")
+		l.after = max(res.StartAfter, res.Continuation)
+	} else {
+		marker := q.Get("marker")
+		res.Marker, l.after = &marker, marker
+	}
+	l.res = res
+	dir, _ := path.Split(l.prefix)
+	err := l.walk(dir)
+	if err != nil && !errors.Is(err, errListFull) {
+		if notFound(err) {
+			err = nil
+		} else {
+			s3ErrorResponse(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+	}
+	if res.IsTruncated {
+		if v2 {
+			res.NextContinue = l.last
+		} else {
+			res.NextMarker = l.last
+		}
+	}
+	if v2 {
+		n := len(res.Contents) + len(res.CommonPrefixes)
+		res.KeyCount = &n
+	}
+	if res.EncodingType == "url" {
+		for i := range res.Contents {
+			res.Contents[i].Key = s3EncodeKey(res.Contents[i].Key)
+		}
+		for i := range res.CommonPrefixes {
+			res.CommonPrefixes[i].Prefix = s3EncodeKey(res.CommonPrefixes[i].Prefix)
+		}
+		res.Prefix = s3EncodeKey(res.Prefix)
+	}
+	s3XMLResponse(w, res)
+}
+
+// add puts a key into the page, reporting errListFull once a further key shows the page is truncated.
+func (l *s3Lister) add(key string, obj *s3Object) error {
+	if len(l.res.Contents)+len(l.res.CommonPrefixes) >= l.max {
+		l.res.IsTruncated = true
+		return errListFull
+	}
+	if obj != nil {
+		l.res.Contents = append(l.res.Contents, *obj)
+	} else {
+		l.res.CommonPrefixes = append(l.res.CommonPrefixes, s3Prefix{Prefix: key})
+	}
+	l.last = key
+	return nil
+}
+
+// walk lists the bucket directory dir, a key prefix ending in / or empty for the root.
+func (l *s3Lister) walk(dir string) error {
+	dirPath := path.Join(l.root, dir)
+	list, err := postAPI[fsListResp]("/api/fs/list", dirPath, Json{
+		"page":     1,
+		"per_page": 0,
+	})
+	if err != nil {
+		return err
+	}
+	entries := list.Content
+	// a directory sorts as its key with the slash, as s3 orders keys
+	sortKey := func(o fsObject) string {
+		if o.IsDir {
+			return o.Name + "/"
+		}
+		return o.Name
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortKey(entries[i]) < sortKey(entries[j]) })
+	for i := range entries {
+		o := &entries[i]
+		key := dir + sortKey(*o)
+		if !o.IsDir {
+			if !strings.HasPrefix(key, l.prefix) || key <= l.after {
+				continue
+			}
+			if err := l.add(key, &s3Object{
+				Key:          key,
+				LastModified: o.Modified.UTC().Format(s3TimeFormat),
+				ETag:         s3ETag(path.Join(dirPath, o.Name), o),
+				Size:         o.Size,
+				StorageClass: "STANDARD",
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(key, l.prefix) && !strings.HasPrefix(l.prefix, key) {
+			continue
+		}
+		if l.delimiter == "/" && strings.HasPrefix(key, l.prefix) {
+			if key <= l.after {
+				continue
+			}
+			if err := l.add(key, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		// every key below sorts before after
+		if key < l.after && !strings.HasPrefix(l.after, key) {
+			continue
+		}
+		if err := l.walk(key); err != nil && !notFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3EncodeKey url-encodes a key for encoding-type=url.
+func s3EncodeKey(key string) string {
+	return strings.ReplaceAll(url.QueryEscape(key), "+", "%20")
+}
+
+// verifySigV4 checks the sigv4 signature of r, given in the Authorization header or as a
+// presigned url, and returns the access key.
+func verifySigV4(r *http.Request) (string, error) {
+	q := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	presigned := q.Get("X-Amz-Algorithm") != ""
+	if presigned {
+		if q.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+			return "", errors.New("unsupported signature algorithm")
+		}
+		credential, signedHeaders, signature = q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Signature")
+		amzDate, payloadHash = q.Get("X-Amz-Date"), "UNSIGNED-PAYLOAD"
+	} else {
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+		if !ok {
+			return "", errS3Unsigned
+		}
+		for _, part := range strings.Split(auth, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch k {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				signedHeaders = v
+			case "Signature":
+				signature = v
+			}
+		}
+		amzDate, payloadHash = r.Header.Get("X-Amz-Date"), r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = "UNSIGNED-PAYLOAD"
+		}
+	}
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[4] != "aws4_request" {
+		return "", errors.New("malformed credential")
+	}
+	access := scope[0]
+	secret, ok := s3Secrets[access]
+	if !ok {
+		return "", errors.New("unknown access key")
+	}
+	t, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, scope[1]) {
+		return "", errors.New("malformed date")
+	}
+	if presigned {
+		expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || time.Now().After(t.Add(time.Duration(expires)*time.Second)) {
+			return "", errors.New("request has expired")
+		}
+	} else if d := time.Since(t); d > s3MaxSkew || d < -s3MaxSkew {
+		return "", errors.New("request time too skewed")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	query := url.Values{}
+	for k, vs := range q {
+		if k != "X-Amz-Signature" {
+			query[k] = vs
+		}
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		awsEscape(r.URL.Path, false),
+		awsEncodeQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + strings.Join(scope[1:], "/") + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + secret)
+	for _, s := range scope[1:] {
+		key = hmacSHA256(key, s)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) != 1 {
+		return "", errors.New("the request signature does not match")
+	}
+	return access, nil
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setupS3Downloads builds the download handlers of getObject from the flags as startS3Server does.
+func setupS3Downloads(t *testing.T) {
+	old := s3Downloads
+	t.Cleanup(func() { s3Downloads = old })
+	s3Downloads = downloadLimits(http.HandlerFunc(downHandle))
+}
+
+// s3Get serves GET /bucket/key of a bucket at / through getObject, as serveS3 would once the
+// request is verified.
+func s3Get(key string) *httptest.ResponseRecorder {
+	handler := requestInfoHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		getRequestInfo(r).apiKey = &apiKey{Name: "s3:test", Paths: []string{"/"}}
+		getObject(w, r, "/", key)
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/bucket/"+key, nil))
+	return w
+}
+
+func checkS3Error(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("answered %d, expected %d", w.Code, status)
+	}
+	var e s3Error
+	if err := xml.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("answered %q: %v", w.Body, err)
+	}
+	if e.Code != code {
+		t.Errorf("answered the s3 error %s, expected %s", e.Code, code)
+	}
+}
+
+func TestS3GetObject(t *testing.T) {
+	newOpenlistStub(t)
+	setupS3Downloads(t)
+	w := s3Get("file.bin")
+	if w.Code != http.StatusOK || w.Body.String() != stubFile {
+		t.Fatalf("answered %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("ETag"); !strings.HasPrefix(got, `"`) {
+		t.Errorf("ETag is %q", got)
+	}
+}
+
+func TestS3GetObjectRateLimit(t *testing.T) {
+	newOpenlistStub(t)
+	setFlags(t, map[string]string{"rate-limit": "0.001", "rate-burst": "1"})
+	setupS3Downloads(t)
+	if w := s3Get("file.bin"); w.Code != http.StatusOK {
+		t.Fatalf("the first request answered %d", w.Code)
+	}
+	w := s3Get("file.bin")
+	checkS3Error(t, w, http.StatusTooManyRequests, "SlowDown")
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After")
+	}
+}
+
+func TestS3GetObjectDeniedClient(t *testing.T) {
+	newOpenlistStub(t)
+	old := acl.Load()
+	t.Cleanup(func() { acl.Store(old) })
+	setFlags(t, map[string]string{"deny-cidr": "192.0.2.0/24"})
+	if err := loadACL(); err != nil {
+		t.Fatal(err)
+	}
+	setupS3Downloads(t)
+	checkS3Error(t, s3Get("file.bin"), http.StatusForbidden, "AccessDenied")
+}
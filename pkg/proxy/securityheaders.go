@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	hstsMaxAge            time.Duration
+	hstsIncludeSubdomains bool
+	hstsPreload           bool
+	noSniff               bool
+	referrerPolicy        string
+	contentSecurityPolicy string
+	responseHeaders       stringList
+)
+
+func init() {
+	CommandLine.DurationVar(&hstsMaxAge, "hsts", 0, "max age of the Strict-Transport-Security header sent over https, e.g. 8760h, 0 sends none")
+	CommandLine.BoolVar(&hstsIncludeSubdomains, "hsts-include-subdomains", false, "extend -hsts to all subdomains")
+	CommandLine.BoolVar(&hstsPreload, "hsts-preload", false, "mark -hsts as eligible for the browser preload lists")
+	CommandLine.BoolVar(&noSniff, "nosniff", false, "send X-Content-Type-Options: nosniff so browsers keep to the content type of files")
+	CommandLine.StringVar(&referrerPolicy, "referrer-policy", "", "Referrer-Policy sent with every response, e.g. no-referrer")
+	CommandLine.StringVar(&contentSecurityPolicy, "content-security-policy", "", "Content-Security-Policy sent with every response, e.g. default-src 'none'; sandbox")
+	CommandLine.Var(&responseHeaders, "response-header", "`Name: value` header added to every response, repeatable")
+}
+
+type headerValue struct {
+	name, value string
+}
+
+var securityHeaders []headerValue
+
+func setupSecurityHeaders() error {
+	securityHeaders = nil
+	if noSniff {
+		securityHeaders = append(securityHeaders, headerValue{"X-Content-Type-Options", "nosniff"})
+	}
+	if referrerPolicy != "" {
+		securityHeaders = append(securityHeaders, headerValue{"Referrer-Policy", referrerPolicy})
+	}
+	if contentSecurityPolicy != "" {
+		securityHeaders = append(securityHeaders, headerValue{"Content-Security-Policy", contentSecurityPolicy})
+	}
+	for _, h := range responseHeaders {
+		name, value, ok := strings.Cut(h, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return fmt.Errorf("invalid -response-header %q, expected Name: value", h)
+		}
+		securityHeaders = append(securityHeaders, headerValue{http.CanonicalHeaderKey(name), strings.TrimSpace(value)})
+	}
+	return nil
+}
+
+func securityHeadersEnabled() bool {
+	return hstsMaxAge > 0 || len(securityHeaders) > 0
+}
+
+func hstsValue() string {
+	v := "max-age=" + strconv.Itoa(int(hstsMaxAge.Seconds()))
+	if hstsIncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if hstsPreload {
+		v += "; preload"
+	}
+	return v
+}
+
+// securityHeadersHandler sets the configured headers on every response, over the ones
+// copied from origins.
+func securityHeadersHandler(next http.Handler) http.Handler {
+	hsts := hstsValue()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headerHookWriter{ResponseWriter: w, hook: func(h http.Header) {
+			if hstsMaxAge > 0 && r.TLS != nil {
+				h.Set("Strict-Transport-Security", hsts)
+			}
+			for _, sh := range securityHeaders {
+				h.Set(sh.name, sh.value)
+			}
+		}}, r)
+	})
+}
+
+// headerHookWriter calls hook with the response header right before it is written.
+type headerHookWriter struct {
+	http.ResponseWriter
+	hook func(http.Header)
+	done bool
+}
+
+func (hw *headerHookWriter) before() {
+	if !hw.done {
+		hw.done = true
+		hw.hook(hw.Header())
+	}
+}
+
+func (hw *headerHookWriter) WriteHeader(code int) {
+	// informational responses precede the final header
+	if code >= 200 {
+		hw.before()
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headerHookWriter) Write(p []byte) (int, error) {
+	hw.before()
+	return hw.ResponseWriter.Write(p)
+}
+
+func (hw *headerHookWriter) ReadFrom(src io.Reader) (int64, error) {
+	hw.before()
+	return readFrom(hw.ResponseWriter, src)
+}
+
+func (hw *headerHookWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,626 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	cacheSegmentSize  byteSize
+	cacheSegmentTotal byteSize = 10 << 30
+)
+
+func init() {
+	CommandLine.Var(&cacheSegmentSize, "cache-segment-size", "`size` of the segments range requests cache files in below -cache-dir, e.g. 8M, so the parts of large files seeked to most are served from disk, 0 caches whole files only")
+	CommandLine.Var(&cacheSegmentTotal, "cache-segment-total", "`size` the cached segments are kept under by evicting the least recently used ones, apart from -cache-size")
+}
+
+var (
+	segmentCacheTotal = newCounterVec("openlist_proxy_segment_cache_total", "Segments served from the segment cache (hit), runs of them fetched from the origin (miss), stored and evicted, by result.", "result")
+	segmentCacheBytes = newGaugeVec("openlist_proxy_segment_cache_bytes", "Bytes of the segments in the segment cache.")
+)
+
+// segmentedFile is a file of which segments are cached, stored as cacheDir/segments/<key>/<index>
+// with its metadata in cacheDir/segments/<key>/meta.json.
+type segmentedFile struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	SegmentSize  int64     `json:"segment_size"`
+	Validator    string    `json:"validator"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	Stored       time.Time `json:"stored"`
+
+	// segments are the cached segments by index, with when they were last used
+	segments map[int64]time.Time
+}
+
+// segmentLength is the length of the segment index, the last one being shorter.
+func (f *segmentedFile) segmentLength(index int64) int64 {
+	return min(f.SegmentSize, f.Size-index*f.SegmentSize)
+}
+
+type segmentID struct {
+	key   string
+	index int64
+}
+
+type segmentCacheStore struct {
+	mu    sync.Mutex
+	files map[string]*segmentedFile
+	// filling are the segments being written, so concurrent transfers write a segment once.
+	filling map[segmentID]bool
+	bytes   int64
+}
+
+var segmentCache = &segmentCacheStore{
+	files:   map[string]*segmentedFile{},
+	filling: map[segmentID]bool{},
+}
+
+func segmentsEnabled() bool {
+	return cacheDir != "" && cacheSegmentSize > 0
+}
+
+func segmentDir(key string) string {
+	return filepath.Join(cacheDir, "segments", key)
+}
+
+func segmentFile(key string, index int64) string {
+	return filepath.Join(segmentDir(key), strconv.FormatInt(index, 10))
+}
+
+func validateSegmentCache() error {
+	if cacheSegmentSize < 0 {
+		return errors.New("-cache-segment-size must not be negative")
+	}
+	if cacheSegmentSize > 0 && cacheSegmentTotal <= 0 {
+		return errors.New("-cache-segment-total must be positive")
+	}
+	return nil
+}
+
+// setupSegmentCache indexes the segments a previous run left in -cache-dir, dropping those
+// of another -cache-segment-size.
+func setupSegmentCache() error {
+	if err := validateSegmentCache(); err != nil {
+		return err
+	}
+	if !segmentsEnabled() {
+		return nil
+	}
+	root := filepath.Join(cacheDir, "segments")
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	c := segmentCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		key := e.Name()
+		f := &segmentedFile{}
+		b, err := os.ReadFile(filepath.Join(segmentDir(key), "meta.json"))
+		if err == nil {
+			err = json.Unmarshal(b, f)
+		}
+		if err != nil || cacheKey(f.Path) != key || f.SegmentSize != int64(cacheSegmentSize) {
+			_ = os.RemoveAll(segmentDir(key))
+			continue
+		}
+		f.segments = map[int64]time.Time{}
+		names, _ := os.ReadDir(segmentDir(key))
+		for _, n := range names {
+			if n.Name() == "meta.json" {
+				continue
+			}
+			index, err := strconv.ParseInt(n.Name(), 10, 64)
+			info, ierr := n.Info()
+			if err != nil || ierr != nil || index < 0 || index*f.SegmentSize >= f.Size || info.Size() != f.segmentLength(index) {
+				// left filling by the previous run, or not a segment
+				_ = os.Remove(filepath.Join(segmentDir(key), n.Name()))
+				continue
+			}
+			f.segments[index] = info.ModTime()
+			c.bytes += info.Size()
+		}
+		c.files[key] = f
+	}
+	c.evict()
+	return nil
+}
+
+// lookup returns the segmented file of filePath, nil if there is none or it expired.
+func (c *segmentCacheStore) lookup(filePath string) *segmentedFile {
+	key := cacheKey(filePath)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.files[key]
+	if f != nil && cacheTTL > 0 && time.Since(f.Stored) >= cacheTTL {
+		c.remove(key)
+		return nil
+	}
+	return f
+}
+
+// begin returns the segmented file of filePath for the origin answer with header h, in place
+// of the one cached for another version of the file.
+func (c *segmentCacheStore) begin(filePath string, size int64, h http.Header) *segmentedFile {
+	key := cacheKey(filePath)
+	validator := ifRangeValidator(h)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f := c.files[key]; f != nil {
+		if f.Size == size && f.Validator == validator && (cacheTTL == 0 || time.Since(f.Stored) < cacheTTL) {
+			return f
+		}
+		c.remove(key)
+	}
+	f := &segmentedFile{
+		Path:         filePath,
+		Size:         size,
+		SegmentSize:  int64(cacheSegmentSize),
+		Validator:    validator,
+		ETag:         h.Get("ETag"),
+		LastModified: h.Get("Last-Modified"),
+		ContentType:  h.Get("Content-Type"),
+		Stored:       time.Now(),
+		segments:     map[int64]time.Time{},
+	}
+	b, _ := json.Marshal(f)
+	err := os.MkdirAll(segmentDir(key), 0o700)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(segmentDir(key), "meta.json.tmp"), b, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(filepath.Join(segmentDir(key), "meta.json.tmp"), filepath.Join(segmentDir(key), "meta.json"))
+	}
+	if err != nil {
+		logf(levelError, "failed to cache segments of %s: %s", filePath, err.Error())
+		_ = os.RemoveAll(segmentDir(key))
+		return nil
+	}
+	c.files[key] = f
+	return f
+}
+
+// has reports whether the segment index of f is cached.
+func (c *segmentCacheStore) has(f *segmentedFile, key string, index int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := f.segments[index]
+	return ok && c.files[key] == f
+}
+
+// use reports whether the segment index of f is cached, marking it used.
+func (c *segmentCacheStore) use(f *segmentedFile, key string, index int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := f.segments[index]; !ok || c.files[key] != f {
+		return false
+	}
+	f.segments[index] = time.Now()
+	return true
+}
+
+// claim reserves the segment index of f for a transfer to write, false if it is cached or
+// being written already.
+func (c *segmentCacheStore) claim(f *segmentedFile, key string, index int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := segmentID{key, index}
+	if _, ok := f.segments[index]; ok || c.files[key] != f || c.filling[id] {
+		return false
+	}
+	c.filling[id] = true
+	return true
+}
+
+func (c *segmentCacheStore) release(key string, index int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.filling, segmentID{key, index})
+}
+
+// store moves the complete segment written to part into the cache.
+func (c *segmentCacheStore) store(f *segmentedFile, key string, index int64, part string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.filling, segmentID{key, index})
+	if c.files[key] != f {
+		// another version of the file replaced it meanwhile
+		_ = os.Remove(part)
+		return
+	}
+	if err := os.Rename(part, segmentFile(key, index)); err != nil {
+		logf(levelError, "failed to cache a segment of %s: %s", f.Path, err.Error())
+		_ = os.Remove(part)
+		return
+	}
+	f.segments[index] = time.Now()
+	c.bytes += f.segmentLength(index)
+	segmentCacheTotal.inc("stored")
+	c.evict()
+}
+
+// remove deletes the segments of key and forgets it, mu must be held.
+func (c *segmentCacheStore) remove(key string) {
+	if f, ok := c.files[key]; ok {
+		for index := range f.segments {
+			c.bytes -= f.segmentLength(index)
+		}
+		delete(c.files, key)
+	}
+	_ = os.RemoveAll(segmentDir(key))
+	segmentCacheBytes.set(float64(c.bytes))
+}
+
+// evict removes the least recently used segments until the cache is under -cache-segment-total,
+// and the files left without any, mu must be held.
+func (c *segmentCacheStore) evict() {
+	if c.bytes > int64(cacheSegmentTotal) {
+		type used struct {
+			id   segmentID
+			used time.Time
+		}
+		var all []used
+		for key, f := range c.files {
+			for index, t := range f.segments {
+				all = append(all, used{segmentID{key, index}, t})
+			}
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i].used.Before(all[j].used) })
+		for _, u := range all {
+			if c.bytes <= int64(cacheSegmentTotal) {
+				break
+			}
+			f := c.files[u.id.key]
+			delete(f.segments, u.id.index)
+			c.bytes -= f.segmentLength(u.id.index)
+			_ = os.Remove(segmentFile(u.id.key, u.id.index))
+			segmentCacheTotal.inc("evicted")
+			if len(f.segments) == 0 {
+				c.remove(u.id.key)
+			}
+		}
+	}
+	segmentCacheBytes.set(float64(c.bytes))
+}
+
+// forget removes the segments of f, unless another version of the file replaced it.
+func (c *segmentCacheStore) forget(f *segmentedFile) {
+	key := cacheKey(f.Path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.files[key] == f {
+		c.remove(key)
+	}
+}
+
+// purge removes the segments of prefix and the paths below it and returns how many files they were of.
+func (c *segmentCacheStore) purge(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, f := range c.files {
+		if pathWithin(f.Path, prefix) {
+			c.remove(key)
+			n++
+		}
+	}
+	return n
+}
+
+// segmentFill writes the complete segments of a stream of the bytes of a file from offset on
+// to the cache.
+type segmentFill struct {
+	file   *segmentedFile
+	key    string
+	offset int64
+	part   *os.File
+	index  int64
+}
+
+func (s *segmentFill) write(p []byte) {
+	for len(p) > 0 && s.offset < s.file.Size {
+		index := s.offset / s.file.SegmentSize
+		start := index * s.file.SegmentSize
+		end := start + s.file.segmentLength(index)
+		n := min(int64(len(p)), end-s.offset)
+		if s.part == nil && s.offset == start && segmentCache.claim(s.file, s.key, index) {
+			part, err := os.OpenFile(segmentFile(s.key, index)+".part", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+			if err != nil {
+				logf(levelError, "failed to cache a segment of %s: %s", s.file.Path, err.Error())
+				segmentCache.release(s.key, index)
+			} else {
+				s.part, s.index = part, index
+			}
+		}
+		if s.part != nil {
+			if _, err := s.part.Write(p[:n]); err != nil {
+				logf(levelError, "failed to cache a segment of %s: %s", s.file.Path, err.Error())
+				s.abandon()
+			}
+		}
+		s.offset += n
+		p = p[n:]
+		if s.part != nil && s.offset == end {
+			part := s.part
+			s.part = nil
+			if err := part.Close(); err != nil {
+				_ = os.Remove(part.Name())
+				segmentCache.release(s.key, s.index)
+				continue
+			}
+			segmentCache.store(s.file, s.key, s.index, part.Name())
+		}
+	}
+}
+
+// abandon drops the segment being written.
+func (s *segmentFill) abandon() {
+	if s.part == nil {
+		return
+	}
+	_ = s.part.Close()
+	_ = os.Remove(s.part.Name())
+	segmentCache.release(s.key, s.index)
+	s.part = nil
+}
+
+// segmentTee writes the segments a body covers completely to the cache while it is read.
+type segmentTee struct {
+	body io.ReadCloser
+	// mu guards fill against a Close from another goroutine, e.g. a killed transfer.
+	mu   sync.Mutex
+	fill *segmentFill
+}
+
+func (t *segmentTee) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n > 0 && t.fill != nil {
+		t.fill.write(p[:n])
+	}
+	return n, err
+}
+
+func (t *segmentTee) Close() error {
+	t.mu.Lock()
+	if t.fill != nil {
+		t.fill.abandon()
+		t.fill = nil
+	}
+	t.mu.Unlock()
+	return t.body.Close()
+}
+
+// teeSegments makes the body of a range answer of the origin fill the segments of filePath
+// it covers, once the origin names the size and a validator of the file.
+func teeSegments(res *http.Response, filePath string) {
+	if !segmentsEnabled() || res.StatusCode != http.StatusPartialContent || res.Request == nil || res.Request.Method != http.MethodGet || res.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	if !ownsPath(filePath) {
+		return
+	}
+	start, _, size, known := parseContentRangeSize(res.Header.Get("Content-Range"))
+	if !known || ifRangeValidator(res.Header) == "" {
+		return
+	}
+	f := segmentCache.begin(filePath, size, res.Header)
+	if f == nil {
+		return
+	}
+	res.Body = &segmentTee{body: res.Body, fill: &segmentFill{file: f, key: cacheKey(filePath), offset: start}}
+}
+
+// serveSegments answers a single range request for a file with cached segments and reports
+// whether it did. The segments missing from the range are fetched from the origin, from the
+// start of the first of them so it is cached too.
+func serveSegments(w http.ResponseWriter, r *http.Request, req *downloadRequest) bool {
+	if !segmentsEnabled() || r.Method != http.MethodGet || len(req.Ranges) != 1 || !ownsPath(req.Path) {
+		return false
+	}
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if r.Header.Get(name) != "" {
+			return false
+		}
+	}
+	if _, _, ok := directDriverFor(req.Path); ok {
+		return false
+	}
+	f := segmentCache.lookup(req.Path)
+	if f == nil || r.Header.Get("If-Range") != "" && r.Header.Get("If-Range") != f.Validator {
+		return false
+	}
+	offset, length, ok := req.Ranges[0].resolve(f.Size)
+	if !ok {
+		// the origin answers the 416
+		return false
+	}
+	if !fileSizeAllowed(w, r, f.Size) || !fileTypeAllowed(w, req.Path, f.ContentType, true) {
+		return true
+	}
+	body := &segmentBody{r: r, file: f, key: cacheKey(req.Path), offset: offset, end: offset + length}
+	if err := body.next(); err != nil {
+		// the origin answers, with the new version of the file
+		logf(levelWarn, "failed to serve the segments of %s: %s", req.Path, err.Error())
+		return false
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+	h := w.Header()
+	if f.ContentType != "" {
+		h.Set("Content-Type", f.ContentType)
+	}
+	if f.ETag != "" {
+		h.Set("ETag", f.ETag)
+	}
+	if f.LastModified != "" {
+		h.Set("Last-Modified", f.LastModified)
+	}
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, f.Size))
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	if signMaxUses > 0 && req.Sign != "" {
+		signUses.served(req.Sign, clientIdentity(r), h)
+	}
+	logf(levelInfo, "cache segments: %s", req.Path)
+	setCORSHeaders(w, r)
+	w.WriteHeader(http.StatusPartialContent)
+	copyBody(w, r, &http.Response{
+		StatusCode:    http.StatusPartialContent,
+		Header:        h,
+		ContentLength: length,
+		Body:          body,
+		Request:       &http.Request{Method: http.MethodGet, URL: &url.URL{Host: "cache"}},
+	})
+	return true
+}
+
+// segmentBody reads a range of a segmented file from the cached segments and the origin.
+type segmentBody struct {
+	r           *http.Request
+	file        *segmentedFile
+	key         string
+	offset, end int64
+
+	// cached is the segment being read, with left bytes of the range in it
+	cached *os.File
+	left   int64
+	// origin is the body of the origin answer being read, up to originEnd
+	origin    io.ReadCloser
+	originEnd int64
+}
+
+func (b *segmentBody) Read(p []byte) (int, error) {
+	if b.offset >= b.end {
+		return 0, io.EOF
+	}
+	if b.cached == nil && b.origin == nil {
+		if err := b.next(); err != nil {
+			return 0, err
+		}
+	}
+	if b.cached != nil {
+		n, err := b.cached.Read(p[:min(int64(len(p)), b.left)])
+		b.offset += int64(n)
+		if b.left -= int64(n); b.left == 0 {
+			_ = b.cached.Close()
+			b.cached, err = nil, nil
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	n, err := b.origin.Read(p[:min(int64(len(p)), b.originEnd-b.offset)])
+	if b.offset += int64(n); b.offset == b.originEnd {
+		_ = b.origin.Close()
+		b.origin, err = nil, nil
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *segmentBody) Close() error {
+	if b.cached != nil {
+		_ = b.cached.Close()
+		b.cached = nil
+	}
+	if b.origin != nil {
+		_ = b.origin.Close()
+		b.origin = nil
+	}
+	return nil
+}
+
+// next opens the cached segment holding offset, or fetches the missing segments from there
+// up to the next cached one from the origin.
+func (b *segmentBody) next() error {
+	f := b.file
+	index := b.offset / f.SegmentSize
+	start := index * f.SegmentSize
+	if segmentCache.use(f, b.key, index) {
+		file, err := os.Open(segmentFile(b.key, index))
+		if err == nil {
+			if _, err = file.Seek(b.offset-start, io.SeekStart); err == nil {
+				segmentCacheTotal.inc("hit")
+				b.cached, b.left = file, min(b.end, start+f.segmentLength(index))-b.offset
+				return nil
+			}
+			_ = file.Close()
+		}
+		// evicted meanwhile
+	}
+	last := index + 1
+	for last*f.SegmentSize < b.end && !segmentCache.has(f, b.key, last) {
+		last++
+	}
+	body, end, err := fetchSegments(b.r, f, start, min(b.end, last*f.SegmentSize))
+	if err != nil {
+		return err
+	}
+	segmentCacheTotal.inc("miss")
+	tee := &segmentTee{body: body, fill: &segmentFill{file: f, key: b.key, offset: start}}
+	if _, err := io.CopyN(io.Discard, tee, b.offset-start); err != nil {
+		_ = tee.Close()
+		return err
+	}
+	b.origin, b.originEnd = tee, end
+	return nil
+}
+
+// fetchSegments asks the origin for the bytes from start to end of f and returns the body and
+// where it ends, the segments of another version of the file being dropped.
+func fetchSegments(r *http.Request, f *segmentedFile, start, end int64) (io.ReadCloser, int64, error) {
+	link, err := fetchLink(r.Context(), f.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if link.Url, err = normalizeLinkURL(link.Url, link.backend); err != nil {
+		return nil, 0, err
+	}
+	if link, err = hookLinkResolved(r, f.Path, link); err != nil {
+		return nil, 0, err
+	}
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, link.Url, nil)
+	forwardClientHeaders(req, r)
+	maps.Copy(req.Header, link.Header)
+	req.Header.Set(requestIDHeader, getRequestInfo(r).id)
+	rewriteRequestHeaders(f.Path, req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	req.Header.Set("If-Range", f.Validator)
+	req.Header.Set("Accept-Encoding", "identity")
+	res, err := HttpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	from, to, ok := parseContentRange(res.Header.Get("Content-Range"))
+	if res.StatusCode != http.StatusPartialContent || !ok || from != start || to > end || to <= start || res.Header.Get("Content-Encoding") != "" {
+		_ = res.Body.Close()
+		if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+			segmentCache.forget(f)
+		}
+		return nil, 0, fmt.Errorf("origin answered the segments with %s", res.Status)
+	}
+	return watchStall(res.Body), to, nil
+}
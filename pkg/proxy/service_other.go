@@ -0,0 +1,6 @@
+//go:build !windows
+
+package proxy
+
+// startService does nothing, only windows has a service control manager to hand over to.
+func startService() {}
@@ -0,0 +1,186 @@
+//go:build windows
+
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const defaultServiceName = "openlist-proxy"
+
+func init() {
+	commands["service"] = command{
+		usage: "service [-name openlist-proxy] install|uninstall|start|stop manages the windows service, install registers it to run with the options given before the command",
+		run:   runService,
+	}
+}
+
+// startService hands the process to the service control manager when it runs as a service.
+// Main calls it once the options are parsed, importing the package must not redirect the
+// output of the process.
+func startService() {
+	if isService, err := svc.IsWindowsService(); err == nil && isService {
+		runAsService()
+	}
+}
+
+// runAsService hands the process to the service control manager. Output goes to the event
+// log and relative paths resolve next to the executable instead of the system directory.
+func runAsService() {
+	if exe, err := os.Executable(); err == nil {
+		_ = os.Chdir(filepath.Dir(exe))
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	os.Stdout, os.Stderr = w, w
+	go func() {
+		if err := svc.Run(defaultServiceName, &windowsService{logs: r}); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+}
+
+type windowsService struct {
+	logs io.Reader
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	elog, err := eventlog.Open(args[0])
+	if err != nil {
+		go func() {
+			_, _ = io.Copy(io.Discard, s.logs)
+		}()
+	} else {
+		go forwardEventLog(s.logs, elog)
+	}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for c := range requests {
+		switch c.Cmd {
+		case svc.Interrogate:
+			status <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32((shutdownTimeout + 5*time.Second).Milliseconds())}
+			requestStop()
+			<-shutdownDone
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// forwardEventLog writes every line of the output to the event log, failures as errors.
+func forwardEventLog(r io.Reader, elog *eventlog.Log) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "failed") {
+			_ = elog.Error(1, line)
+		} else {
+			_ = elog.Info(1, line)
+		}
+	}
+}
+
+func runService(args []string) error {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	name := fs.String("name", defaultServiceName, "name of the windows service")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("missing command: install, uninstall, start or stop")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = m.Disconnect()
+	}()
+	if fs.Arg(0) == "install" {
+		return installService(m, *name)
+	}
+	s, err := m.OpenService(*name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", *name, err)
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	switch fs.Arg(0) {
+	case "uninstall":
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		return eventlog.Remove(*name)
+	case "start":
+		return s.Start()
+	case "stop":
+		st, err := s.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		deadline := time.Now().Add(shutdownTimeout + 10*time.Second)
+		for st.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return errors.New("timed out waiting for the service to stop")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if st, err = s.Query(); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+}
+
+// installService registers the service to run this executable with the global options of
+// the command line, minus the service command itself.
+func installService(m *mgr.Mgr, name string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if s, err := m.OpenService(name); err == nil {
+		_ = s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+	options := os.Args[1 : len(os.Args)-CommandLine.NArg()]
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "OpenList-Proxy",
+		Description: "Download proxy for OpenList",
+		StartType:   mgr.StartAutomatic,
+	}, options...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		_ = s.Delete()
+		return err
+	}
+	// restart after crashes, but not after a clean stop
+	return s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+	}, uint32((24 * time.Hour).Seconds()))
+}
@@ -0,0 +1,492 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	sftpAddress        string
+	sftpHostKey        string
+	sftpAuthorizedKeys string
+	sftpRoot           string
+)
+
+func init() {
+	CommandLine.StringVar(&sftpAddress, "sftp-address", "", "address such as :2022 serving a read-only sftp view of openlist, logging in with -basic-auth users "+
+		"or -sftp-authorized-keys, empty disables it")
+	CommandLine.StringVar(&sftpHostKey, "sftp-host-key", "", "ssh host key `file` of the sftp server, generated into -data-dir when empty")
+	CommandLine.StringVar(&sftpAuthorizedKeys, "sftp-authorized-keys", "", "authorized_keys `file` of public keys that may log in to the sftp server")
+	CommandLine.StringVar(&sftpRoot, "sftp-root", "/", "openlist directory shown as / of the sftp server")
+}
+
+// sftpReadWindow is how far behind the furthest read the bytes of a file are kept, since
+// clients read ahead with several requests in flight that arrive out of order.
+const sftpReadWindow = 8 << 20
+
+// sftpSkipLimit is how far ahead of the origin stream a read may start before the stream
+// is reopened at its offset rather than read up to it.
+const sftpSkipLimit = 1 << 20
+
+var sftpConfig *ssh.ServerConfig
+
+func setupSFTP() error {
+	if sftpAddress == "" {
+		return nil
+	}
+	root, err := normalizePath(sftpRoot)
+	if err != nil {
+		return fmt.Errorf("invalid -sftp-root %q: %w", sftpRoot, err)
+	}
+	sftpRoot = root
+	cfg := &ssh.ServerConfig{}
+	if basicAuthEnabled() {
+		cfg.PasswordCallback = func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if !validBasicAuth(c.User(), string(pass)) {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		}
+	}
+	if sftpAuthorizedKeys != "" {
+		keys, err := loadAuthorizedKeys(sftpAuthorizedKeys)
+		if err != nil {
+			return err
+		}
+		cfg.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !keys[string(key.Marshal())] {
+				return nil, errors.New("unknown public key")
+			}
+			return nil, nil
+		}
+	}
+	if cfg.PasswordCallback == nil && cfg.PublicKeyCallback == nil {
+		return errors.New("-sftp-address needs -basic-auth, -basic-auth-file or -sftp-authorized-keys")
+	}
+	signer, err := loadHostKey()
+	if err != nil {
+		return err
+	}
+	cfg.AddHostKey(signer)
+	sftpConfig = cfg
+	return nil
+}
+
+func loadAuthorizedKeys(file string) (map[string]bool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for len(bytes.TrimSpace(b)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("authorized keys %s: %w", file, err)
+		}
+		keys[string(key.Marshal())] = true
+		b = rest
+	}
+	return keys, nil
+}
+
+// loadHostKey reads -sftp-host-key, or the key generated into -data-dir on the first start
+// so clients see the same host key after restarts.
+func loadHostKey() (ssh.Signer, error) {
+	file := sftpHostKey
+	if file == "" && dataDir != "" {
+		file = filepath.Join(dataDir, "sftp_host_key")
+	}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err == nil {
+			return ssh.ParsePrivateKey(b)
+		}
+		if sftpHostKey != "" || !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		block, err := ssh.MarshalPrivateKey(key, "openlist-proxy sftp")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dataDir, 0o700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			return nil, err
+		}
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+func startSFTPServer() error {
+	ln, err := handoffListen("sftp "+sftpAddress, sftpAddress, false)
+	if err != nil {
+		return fmt.Errorf("failed to serve sftp: %w", err)
+	}
+	fmt.Printf("serve sftp: %s\n", sftpAddress)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if closedListener(err) {
+				return
+			}
+			if err != nil {
+				noticef(levelError, "failed to serve sftp: %s", err.Error())
+				return
+			}
+			go serveSSH(conn)
+		}
+	}()
+	return nil
+}
+
+func serveSSH(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	// a client that never finishes the handshake must not hold the connection forever
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	sc, chans, reqs, err := ssh.NewServerConn(conn, sftpConfig)
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	logf(levelInfo, "sftp login: %s from %s", sc.User(), sc.RemoteAddr())
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSFTPSession(&sftpFS{user: sc.User(), remote: sc.RemoteAddr().String()}, ch, reqs)
+	}
+}
+
+// serveSFTPSession runs the sftp subsystem, the only thing a session may request.
+func serveSFTPSession(fs *sftpFS, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer func() {
+		_ = ch.Close()
+	}()
+	for req := range reqs {
+		if req.Type != "subsystem" || len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		_ = req.Reply(true, nil)
+		go ssh.DiscardRequests(reqs)
+		server := sftp.NewRequestServer(ch, sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs})
+		if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			logf(levelWarn, "sftp session of %s: %s", fs.user, err.Error())
+		}
+		_ = server.Close()
+		return
+	}
+}
+
+// sftpFS is the read-only view of -sftp-root for a logged in user.
+type sftpFS struct {
+	user, remote string
+}
+
+func (fs *sftpFS) openlistPath(p string) string {
+	return path.Join(sftpRoot, path.Clean("/"+p))
+}
+
+func (fs *sftpFS) Filewrite(*sftp.Request) (io.WriterAt, error) {
+	return nil, sftp.ErrSSHFxPermissionDenied
+}
+
+func (fs *sftpFS) Filecmd(*sftp.Request) error {
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+func (fs *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	filePath := fs.openlistPath(r.Filepath)
+	switch r.Method {
+	case "List":
+		list, err := postAPI[fsListResp]("/api/fs/list", filePath, Json{
+			"page":     1,
+			"per_page": 0,
+		})
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		infos := make(sftpListing, len(list.Content))
+		for i := range list.Content {
+			infos[i] = &sftpFileInfo{list.Content[i]}
+		}
+		return infos, nil
+	case "Stat":
+		obj, err := statObject(filePath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		if filePath == sftpRoot {
+			obj.Name = "/"
+		}
+		return sftpListing{&sftpFileInfo{*obj}}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	filePath := fs.openlistPath(r.Filepath)
+	obj, err := statObject(filePath)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	if obj.IsDir {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	return &sftpFile{fs: fs, path: filePath, size: obj.Size}, nil
+}
+
+// sftpError maps openlist errors to the sftp status codes clients understand.
+func sftpError(err error) error {
+	var apiErr *apiError
+	switch {
+	case notFound(err):
+		return os.ErrNotExist
+	case errors.As(err, &apiErr) && (apiErr.Code == 401 || apiErr.Code == 403):
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return err
+}
+
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(infos []os.FileInfo, off int64) (int, error) {
+	if off >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[off:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type sftpFileInfo struct {
+	obj fsObject
+}
+
+func (fi *sftpFileInfo) Name() string       { return fi.obj.Name }
+func (fi *sftpFileInfo) Size() int64        { return fi.obj.Size }
+func (fi *sftpFileInfo) ModTime() time.Time { return fi.obj.Modified }
+func (fi *sftpFileInfo) IsDir() bool        { return fi.obj.IsDir }
+func (fi *sftpFileInfo) Sys() any           { return nil }
+
+func (fi *sftpFileInfo) Mode() os.FileMode {
+	if fi.obj.IsDir {
+		return os.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// sftpFile streams a file from its origin as downloads do, reading ahead sequentially
+// and keeping the last sftpReadWindow bytes for reads arriving out of order.
+type sftpFile struct {
+	fs   *sftpFS
+	path string
+	size int64
+
+	mu   sync.Mutex
+	body io.ReadCloser
+	// buf holds the bytes from bufStart up to pos, where the body continues
+	buf      []byte
+	bufStart int64
+	pos      int64
+	err      error
+}
+
+func (f *sftpFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if f.body == nil || off < f.bufStart || off > f.pos+sftpSkipLimit {
+		if err := f.open(off); err != nil {
+			return 0, err
+		}
+	}
+	end := min(off+int64(len(p)), f.size)
+	for f.pos < end && f.err == nil {
+		chunk := make([]byte, min(end-f.pos, 256<<10))
+		n, err := io.ReadFull(f.body, chunk)
+		f.buf = append(f.buf, chunk[:n]...)
+		f.pos += int64(n)
+		if err != nil {
+			f.err = err
+		}
+	}
+	n := copy(p, f.buf[off-f.bufStart:])
+	if drop := int64(len(f.buf)) - sftpReadWindow; drop > 0 {
+		f.buf = f.buf[drop:]
+		f.bufStart += drop
+	}
+	if n < len(p) {
+		if f.err != nil && !errors.Is(f.err, io.EOF) && !errors.Is(f.err, io.ErrUnexpectedEOF) {
+			return n, f.err
+		}
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// open starts streaming the file at off.
+func (f *sftpFile) open(off int64) error {
+	if f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+	body, err := f.fs.download(f.path, off)
+	if err != nil {
+		return err
+	}
+	f.body, f.buf, f.bufStart, f.pos, f.err = body, nil, off, off, nil
+	return nil
+}
+
+func (f *sftpFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+	return nil
+}
+
+// download fetches filePath from off through downHandle like a download, so links,
+// header rules, caches and direct drivers apply to sftp reads as well.
+func (fs *sftpFS) download(filePath string, off int64) (io.ReadCloser, error) {
+	info := &requestInfo{id: requestID(&http.Request{Header: http.Header{}})}
+	// the login grants access to the files below -sftp-root like an api key
+	info.apiKey = &apiKey{Name: "sftp:" + fs.user, Paths: []string{sftpRoot}}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), requestInfoKey{}, info))
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	r.URL.Path = filePath
+	r.RemoteAddr = fs.remote
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	pr, pw := io.Pipe()
+	rw := &pipeResponseWriter{header: http.Header{}, pw: pw, ready: make(chan struct{})}
+	go func() {
+		downHandle(rw, r)
+		rw.WriteHeader(http.StatusOK)
+		_ = pw.Close()
+	}()
+	<-rw.ready
+	body := &cancelReader{ReadCloser: pr, cancel: cancel}
+	switch {
+	case rw.status == http.StatusPartialContent:
+		return body, nil
+	case rw.status == http.StatusOK:
+		// the origin ignored the range
+		if _, err := io.CopyN(io.Discard, body, off); err != nil {
+			_ = body.Close()
+			return nil, err
+		}
+		return body, nil
+	case rw.status/100 == 3 && rw.header.Get("Location") != "":
+		_ = body.Close()
+		return followRedirect(rw.header.Get("Location"), off)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(body, 4096))
+	_ = body.Close()
+	switch rw.status {
+	case http.StatusNotFound, http.StatusGone:
+		return nil, os.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	return nil, fmt.Errorf("download of %s failed with status %d: %s", filePath, rw.status, strings.TrimSpace(string(msg)))
+}
+
+// followRedirect fetches the origin a download was redirected to under -redirect.
+func followRedirect(location string, off int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	res, err := HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return res.Body, nil
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, res.Body, off); err != nil {
+			_ = res.Body.Close()
+			return nil, err
+		}
+		return res.Body, nil
+	}
+	_ = res.Body.Close()
+	return nil, fmt.Errorf("origin answered %s", res.Status)
+}
+
+// pipeResponseWriter hands the response of an internal request to a reader.
+type pipeResponseWriter struct {
+	header http.Header
+	pw     *io.PipeWriter
+	status int
+	ready  chan struct{}
+	once   sync.Once
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	w.once.Do(func() {
+		w.status = status
+		close(w.ready)
+	})
+}
+
+func (w *pipeResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(p)
+}
+
+// cancelReader ends the internal request when its body is closed.
+type cancelReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cr *cancelReader) Close() error {
+	cr.cancel()
+	return cr.ReadCloser.Close()
+}
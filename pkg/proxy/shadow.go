@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+)
+
+var (
+	shadowAddress string
+	shadowToken   string
+	shadowSample  float64
+)
+
+func init() {
+	CommandLine.StringVar(&shadowAddress, "shadow-address", "", "secondary openlist address link resolutions are mirrored to for comparison, e.g. to validate a migration")
+	CommandLine.StringVar(&shadowToken, "shadow-token", "", "token of the shadow openlist")
+	CommandLine.Float64Var(&shadowSample, "shadow-sample", 1, "fraction of link resolutions mirrored to the shadow openlist, 0 to 1")
+}
+
+// maxShadowInFlight bounds concurrent shadow requests, samples beyond it are dropped.
+const maxShadowInFlight = 16
+
+var (
+	shadowSlots   = make(semaphore, maxShadowInFlight)
+	shadowResults = newCounterVec("openlist_proxy_shadow_results_total", "Outcomes of comparing mirrored link resolutions with the shadow openlist.", "result")
+)
+
+// mirrorLink compares the primary resolution of filePath with the shadow openlist in the background.
+func mirrorLink(filePath string, primary *Link, primaryErr error) {
+	if shadowAddress == "" || rand.Float64() >= shadowSample {
+		return
+	}
+	select {
+	case shadowSlots <- struct{}{}:
+	default:
+		shadowResults.inc("dropped")
+		return
+	}
+	var primaryURL string
+	if primary != nil {
+		primaryURL = primary.Url
+	}
+	go func() {
+		defer shadowSlots.release()
+		var shadowURL string
+		shadow, err := fetchBackendLink(backend{address: shadowAddress, token: shadowToken}, filePath)
+		if shadow != nil {
+			shadowURL = shadow.Url
+		}
+		result, detail := compareLinks(primaryURL, primaryErr, shadowURL, err)
+		shadowResults.inc(result)
+		if result != "match" {
+			logf(levelInfo, "shadow %s for %s: %s", result, filePath, detail)
+		}
+	}()
+}
+
+func compareLinks(primary string, primaryErr error, shadow string, shadowErr error) (string, string) {
+	switch {
+	case primaryErr != nil && shadowErr != nil:
+		var pe, se *apiError
+		if errors.As(primaryErr, &pe) && errors.As(shadowErr, &se) && pe.Code != se.Code {
+			return "mismatch", fmt.Sprintf("primary error %q, shadow error %q", primaryErr, shadowErr)
+		}
+		return "match", ""
+	case primaryErr != nil:
+		return "mismatch", fmt.Sprintf("primary error %q, shadow resolved %s", primaryErr, linkIdentity(shadow))
+	case shadowErr != nil:
+		return "shadow_error", shadowErr.Error()
+	}
+	if p, s := linkIdentity(primary), linkIdentity(shadow); p != s {
+		return "mismatch", fmt.Sprintf("primary %s, shadow %s", p, s)
+	}
+	return "match", ""
+}
+
+// linkIdentity strips the query of a link url, which usually holds per-request signatures.
+func linkIdentity(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return u.String()
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shortLinkPrefix is the path under which short links are served on the proxy listener.
+const shortLinkPrefix = "/__s/"
+
+const shortLinkAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+type shortLink struct {
+	Path    string    `json:"path"`
+	Target  string    `json:"target"`
+	Expire  int64     `json:"expire"`
+	Created time.Time `json:"created"`
+}
+
+func (l shortLink) expired() bool {
+	return l.Expire > 0 && time.Now().Unix() > l.Expire
+}
+
+type shortLinkStore struct {
+	mu    sync.Mutex
+	Links map[string]shortLink `json:"links"`
+}
+
+var shortLinks = &shortLinkStore{Links: map[string]shortLink{}}
+
+func init() {
+	registerState("shortlinks", func() any { return &shortLinkStore{} })
+}
+
+func loadShortLinks() error {
+	shortLinks.mu.Lock()
+	defer shortLinks.mu.Unlock()
+	if err := loadState("shortlinks", shortLinks); err != nil {
+		return err
+	}
+	if shortLinks.Links == nil {
+		shortLinks.Links = map[string]shortLink{}
+	}
+	return nil
+}
+
+// create stores a short link to target, a signed proxy path, and returns its code.
+func (st *shortLinkStore) create(path, target string, expire int64) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for i := range b {
+			b[i] = shortLinkAlphabet[int(b[i])%len(shortLinkAlphabet)]
+		}
+		code := string(b)
+		if _, ok := st.Links[code]; ok {
+			continue
+		}
+		st.Links[code] = shortLink{Path: path, Target: target, Expire: expire, Created: time.Now()}
+		return code, saveState("shortlinks", st)
+	}
+}
+
+func (st *shortLinkStore) get(code string) (shortLink, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	l, ok := st.Links[code]
+	if ok && l.expired() {
+		delete(st.Links, code)
+		if err := saveState("shortlinks", st); err != nil {
+			noticef(levelError, "failed to save short links: %s", err.Error())
+		}
+		return shortLink{}, false
+	}
+	return l, ok
+}
+
+// removePath deletes the short links of path and returns how many there were.
+func (st *shortLinkStore) removePath(path string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	n := 0
+	for code, l := range st.Links {
+		if l.Path == path {
+			delete(st.Links, code)
+			n++
+		}
+	}
+	if n > 0 {
+		if err := saveState("shortlinks", st); err != nil {
+			noticef(levelError, "failed to save short links: %s", err.Error())
+		}
+	}
+	return n
+}
+
+func serveShortLink(w http.ResponseWriter, r *http.Request, code string) {
+	l, ok := shortLinks.get(code)
+	if !ok {
+		errorResponse(w, 404, "short link not found")
+		return
+	}
+	target := l.Target
+	if strings.HasPrefix(target, "/") {
+		target = basePath + target
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+var shutdownTimeout time.Duration
+
+func init() {
+	CommandLine.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long running transfers may finish when stopped by systemd or the windows service manager before they are cut")
+}
+
+var (
+	stopRequests = make(chan struct{}, 1)
+	shutdownDone = make(chan struct{})
+)
+
+// requestStop asks the server to stop gracefully, the service manager integrations call it.
+func requestStop() {
+	select {
+	case stopRequests <- struct{}{}:
+	default:
+	}
+}
+
+// handleStop shuts srv down once a stop is requested, letting running transfers finish, and
+// closes shutdownDone when they did.
+func handleStop(srv *http.Server) {
+	stopOnSignal()
+	upgradeOnSignal()
+	go func() {
+		<-stopRequests
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			noticef(levelError, "failed to finish running transfers: %s", err.Error())
+		}
+		closeStatsDB()
+		closeEvents()
+		flushErrorReports()
+		closeRedis()
+		close(shutdownDone)
+	}()
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// signAPIPath is where POST requests on the proxy listener generate signed urls.
+const signAPIPath = "/api/sign"
+
+var signAPIToken string
+
+func init() {
+	CommandLine.StringVar(&signAPIToken, "sign-api-token", "", "bearer token enabling POST "+signAPIPath+" on the proxy listener to generate signed urls, empty disables it")
+}
+
+type signReq struct {
+	Path string `json:"path"`
+	// Expires is the validity in seconds, 0 never expires.
+	Expires int64 `json:"expires"`
+	// Upload asks for a sign accepted by PUT uploads instead of downloads.
+	Upload bool `json:"upload"`
+}
+
+type signResp struct {
+	URL    string `json:"url"`
+	Sign   string `json:"sign"`
+	Expire int64  `json:"expire"`
+}
+
+// serveSignAPI lets backends without the OpenList sign package generate proxy links.
+func serveSignAPI(w http.ResponseWriter, r *http.Request) {
+	if !validBearer(r, signAPIToken) {
+		errorResponseWithStatus(w, http.StatusUnauthorized, 401, "invalid sign api token")
+		return
+	}
+	var req signReq
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil ||
+		!strings.HasPrefix(req.Path, "/") || req.Expires < 0 {
+		errorResponse(w, 400, "invalid sign request")
+		return
+	}
+	if signMaxAge > 0 && (req.Expires == 0 || time.Duration(req.Expires)*time.Second > signMaxAge) {
+		errorResponse(w, 400, errSignTooLong.Error())
+		return
+	}
+	var expire int64
+	if req.Expires > 0 {
+		expire = time.Now().Unix() + req.Expires
+	}
+	data := req.Path
+	if req.Upload {
+		data = uploadSignPrefix + req.Path
+	}
+	value := currentSigner().Sign(data, expire)
+	jsonResponse(w, signResp{
+		URL:    requestBaseURL(r) + escapePath(req.Path) + "?sign=" + url.QueryEscape(value),
+		Sign:   value,
+		Expire: expire,
+	})
+}
+
+// requestBaseURL returns -public-url, or the scheme and host the request was made to.
+func requestBaseURL(r *http.Request) string {
+	if publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + basePath
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenListTeam/OpenList/v4/pkg/sign"
+)
+
+var (
+	signMaxAge time.Duration
+	signKey    string
+)
+
+func init() {
+	CommandLine.StringVar(&signKey, "sign-key", "", "secret used to sign and verify links instead of -token, keeping the openlist api token private; links signed by openlist itself then no longer verify")
+	CommandLine.DurationVar(&signMaxAge, "sign-max-age", 0, "reject signs that never expire or expire further than this in the future, 0 accepts any expiry")
+}
+
+// signingKey returns the HMAC key for signs.
+func signingKey() string {
+	if signKey != "" {
+		return signKey
+	}
+	return apiToken()
+}
+
+var signer atomic.Pointer[sign.Sign]
+
+// currentSigner returns the signer for the current signing key.
+func currentSigner() sign.Sign {
+	return *signer.Load()
+}
+
+func resetSigner() {
+	sg := sign.NewHMACSign([]byte(signingKey()))
+	signer.Store(&sg)
+}
+
+var errSignTooLong = errors.New("sign validity exceeds the allowed maximum")
+
+// verifySign checks the sign of filePath and returns the error code to report on failure:
+// 403 for expired signs or ones valid for longer than -sign-max-age, 401 otherwise.
+func verifySign(filePath, value string) (int, error) {
+	if err := currentSigner().Verify(filePath, value); err != nil {
+		if errors.Is(err, sign.ErrSignExpired) {
+			return 403, err
+		}
+		return 401, err
+	}
+	if signMaxAge > 0 {
+		expire, _ := signExpire(value)
+		if expire == 0 || time.Unix(expire, 0).After(time.Now().Add(signMaxAge)) {
+			return 403, errSignTooLong
+		}
+	}
+	return 0, nil
+}
+
+// escapePath escapes every segment of filePath for use in a url.
+func escapePath(filePath string) string {
+	segments := strings.Split(filePath, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// signedPath returns the escaped proxy path for filePath with a sign query valid until expire
+// (a unix timestamp, 0 never expires).
+func signedPath(filePath string, expire int64) string {
+	return escapePath(filePath) + "?sign=" + url.QueryEscape(currentSigner().Sign(filePath, expire))
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	sloSpecs   stringList
+	sloWebhook string
+)
+
+func init() {
+	CommandLine.Var(&sloSpecs, "slo", "service level objective as first-byte:`threshold:target`, e.g. first-byte:2s:99 for 99% of downloads "+
+		"starting within 2s, or availability:target, e.g. availability:99.9, repeatable")
+	CommandLine.StringVar(&sloWebhook, "slo-webhook", "", "`url` a json notification is posted to when an slo starts or stops burning its error budget too fast")
+}
+
+var (
+	sloEvents   = newCounterVec("openlist_proxy_slo_events_total", "Requests counted by each slo, by result good or bad.", "slo", "result")
+	sloBurnRate = newGaugeVec("openlist_proxy_slo_burn_rate", "Rate each slo consumes its error budget at over a window, 1 uses it up exactly in time.", "slo", "window")
+	sloAlerting = newGaugeVec("openlist_proxy_slo_alert", "Current alert of each slo: 0 none, 1 ticket (slow burn), 2 page (fast burn).", "slo")
+)
+
+// sloBuckets hold one minute each, covering the longest burn rate window.
+const sloBuckets = 6 * 60
+
+type sloBucket struct {
+	minute     int64
+	total, bad int64
+}
+
+// slo is an objective on the share of good downloads.
+type slo struct {
+	name string
+	// threshold is the first-byte latency a good download stays within, 0 for availability.
+	threshold time.Duration
+	// target is the share of good downloads, e.g. 0.99.
+	target float64
+
+	mu      sync.Mutex
+	buckets [sloBuckets]sloBucket
+	alert   int
+}
+
+var slos []*slo
+
+func parseSLO(spec string) (*slo, error) {
+	parts := strings.Split(spec, ":")
+	s := &slo{name: spec}
+	var target string
+	switch {
+	case parts[0] == "first-byte" && len(parts) == 3:
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid -slo threshold %q", parts[1])
+		}
+		s.threshold, target = d, parts[2]
+	case parts[0] == "availability" && len(parts) == 2:
+		target = parts[1]
+	default:
+		return nil, fmt.Errorf("invalid -slo %q, expected first-byte:threshold:target or availability:target", spec)
+	}
+	t, err := strconv.ParseFloat(strings.TrimSuffix(target, "%"), 64)
+	if err != nil || t <= 0 || t >= 100 {
+		return nil, fmt.Errorf("invalid -slo target %q, expected a percentage below 100", target)
+	}
+	s.target = t / 100
+	return s, nil
+}
+
+func setupSLOs() error {
+	slos = nil
+	for _, spec := range sloSpecs {
+		s, err := parseSLO(spec)
+		if err != nil {
+			return err
+		}
+		slos = append(slos, s)
+	}
+	if len(slos) > 0 {
+		go func() {
+			for range time.Tick(time.Minute) {
+				for _, s := range slos {
+					s.evaluate(time.Now())
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// observeSLOs counts a finished request towards every slo. Reserved paths such as
+// the long-polling /__prepare are not downloads and never count.
+func observeSLOs(r *http.Request, rec *statusRecorder, start time.Time) {
+	if len(slos) == 0 || strings.HasPrefix(r.URL.Path, "/__") || r.Method == http.MethodOptions {
+		return
+	}
+	for _, s := range slos {
+		bad := rec.status >= 500 || getRequestInfo(r).outcome == "upstream_error"
+		if s.threshold > 0 {
+			bad = rec.headerAt.IsZero() || rec.headerAt.Sub(start) > s.threshold
+		}
+		s.record(bad, time.Now())
+	}
+}
+
+func (s *slo) record(bad bool, now time.Time) {
+	m := now.Unix() / 60
+	s.mu.Lock()
+	b := &s.buckets[m%sloBuckets]
+	if b.minute != m {
+		*b = sloBucket{minute: m}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+	s.mu.Unlock()
+	if bad {
+		sloEvents.inc(s.name, "bad")
+	} else {
+		sloEvents.inc(s.name, "good")
+	}
+}
+
+// burnRate returns the error rate over the last window relative to the error budget.
+func (s *slo) burnRate(window time.Duration, now time.Time) float64 {
+	m := now.Unix() / 60
+	from := m - int64(window/time.Minute)
+	var total, bad int64
+	s.mu.Lock()
+	for _, b := range s.buckets {
+		if b.minute > from && b.minute <= m {
+			total += b.total
+			bad += b.bad
+		}
+	}
+	s.mu.Unlock()
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - s.target)
+}
+
+// burnWindows are the multiwindow pairs of the alerting scheme of the google sre workbook:
+// a long window to see significant budget spent and a short one to notice recovery quickly.
+var burnWindows = []struct {
+	long, short time.Duration
+	rate        float64
+	alert       int
+}{
+	{time.Hour, 5 * time.Minute, 14.4, 2},
+	{6 * time.Hour, 30 * time.Minute, 6, 1},
+}
+
+var alertNames = []string{"none", "ticket", "page"}
+
+func (s *slo) evaluate(now time.Time) {
+	rates := map[string]float64{}
+	alert := 0
+	for _, w := range burnWindows {
+		long, short := s.burnRate(w.long, now), s.burnRate(w.short, now)
+		rates[formatWindow(w.long)], rates[formatWindow(w.short)] = long, short
+		if long > w.rate && short > w.rate {
+			alert = max(alert, w.alert)
+		}
+	}
+	for window, rate := range rates {
+		sloBurnRate.set(rate, s.name, window)
+	}
+	sloAlerting.set(float64(alert), s.name)
+	s.mu.Lock()
+	changed := alert != s.alert
+	s.alert = alert
+	s.mu.Unlock()
+	if changed {
+		notifySLO(s, alert, rates)
+	}
+}
+
+func formatWindow(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	}
+	return strconv.Itoa(int(d/time.Minute)) + "m"
+}
+
+type sloNotification struct {
+	SLO       string             `json:"slo"`
+	Alert     string             `json:"alert"`
+	BurnRates map[string]float64 `json:"burn_rates"`
+	Time      time.Time          `json:"time"`
+}
+
+func notifySLO(s *slo, alert int, rates map[string]float64) {
+	fmt.Printf("slo %s: alert %s, burn rate %.1f over 1h, %.1f over 6h\n", s.name, alertNames[alert], rates["1h"], rates["6h"])
+	if sloWebhook == "" {
+		return
+	}
+	b, _ := json.Marshal(sloNotification{SLO: s.name, Alert: alertNames[alert], BurnRates: rates, Time: time.Now()})
+	res, err := apiClient.Post(sloWebhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		noticef(levelError, "failed to notify -slo-webhook: %s", err.Error())
+		return
+	}
+	_ = res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		noticef(levelError, "failed to notify -slo-webhook: %s", res.Status)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+var dirListing string
+
+func init() {
+	CommandLine.StringVar(&dirListing, "dir-listing", "openlist", "response for directory paths: openlist (redirect to the openlist web ui), json (list the directory) or error")
+}
+
+func validateDirListing() error {
+	switch dirListing {
+	case "openlist", "json", "error":
+		return nil
+	}
+	return fmt.Errorf("invalid -dir-listing %q", dirListing)
+}
+
+// statObject returns the metadata of filePath via the OpenList /api/fs/get API.
+func statObject(filePath string) (*fsObject, error) {
+	return postAPI[fsObject]("/api/fs/get", filePath, Json{})
+}
+
+// serveSpecialObject answers requests for directories and empty files, whose links
+// can't be resolved or fetched like regular files. It reports whether it responded.
+func serveSpecialObject(w http.ResponseWriter, r *http.Request, filePath string) bool {
+	obj, err := statObject(filePath)
+	if err != nil {
+		return false
+	}
+	switch {
+	case obj.IsDir:
+		serveDirectory(w, r, filePath)
+		return true
+	case obj.Size == 0:
+		setCORSHeaders(w, r)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+	return false
+}
+
+func serveDirectory(w http.ResponseWriter, r *http.Request, dirPath string) {
+	switch dirListing {
+	case "openlist":
+		http.Redirect(w, r, backendURL(dirPath), http.StatusFound)
+	case "json":
+		list, err := postAPI[fsListResp]("/api/fs/list", dirPath, Json{
+			"page":     1,
+			"per_page": 0,
+		})
+		if err != nil {
+			apiErrorResponse(w, err)
+			return
+		}
+		setCORSHeaders(w, r)
+		jsonResponse(w, list)
+	default:
+		errorResponse(w, 400, "path is a directory")
+	}
+}
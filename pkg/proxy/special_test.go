@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// openlistStub emulates the api of an openlist holding a directory /dir, an empty file
+// /empty.txt whose link can't be resolved, as some drivers refuse to link empty files, and
+// /file.bin linked to the stub itself.
+type openlistStub struct {
+	*httptest.Server
+	// originFetches counts the requests for file contents.
+	originFetches atomic.Int32
+}
+
+// stubFile is the content of /file.bin of the openlist stub.
+var stubFile = strings.Repeat("0123456789abcdef", 64<<10)
+
+func newOpenlistStub(t *testing.T) *openlistStub {
+	t.Helper()
+	s := &openlistStub{}
+	objects := map[string]fsObject{
+		"/dir":       {Name: "dir", IsDir: true, Modified: mockEpoch},
+		"/empty.txt": {Name: "empty.txt", Modified: mockEpoch},
+		"/file.bin":  {Name: "file.bin", Size: int64(len(stubFile)), Modified: mockEpoch},
+	}
+	mux := http.NewServeMux()
+	answer := func(w http.ResponseWriter, r *http.Request, data func(p string) (any, bool)) {
+		var body struct {
+			Path string `json:"path"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		resp := apiResponse[any]{Code: 500, Message: "object not found"}
+		if d, ok := data(body.Path); ok {
+			resp = apiResponse[any]{Code: 200, Message: "success", Data: d}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+	mux.HandleFunc("POST /api/fs/get", func(w http.ResponseWriter, r *http.Request) {
+		answer(w, r, func(p string) (any, bool) {
+			o, ok := objects[p]
+			return o, ok
+		})
+	})
+	mux.HandleFunc("POST /api/fs/list", func(w http.ResponseWriter, r *http.Request) {
+		answer(w, r, func(p string) (any, bool) {
+			if p != "/dir" {
+				return nil, false
+			}
+			return fsListResp{Content: []fsObject{{Name: "a.txt", Size: 3, Modified: mockEpoch}}, Total: 1}, true
+		})
+	})
+	mux.HandleFunc("POST /api/fs/link", func(w http.ResponseWriter, r *http.Request) {
+		answer(w, r, func(p string) (any, bool) {
+			if p != "/file.bin" {
+				return nil, false
+			}
+			return Json{"url": s.URL + "/d" + p, "header": Json{}}, true
+		})
+	})
+	mux.HandleFunc("/d/", func(w http.ResponseWriter, r *http.Request) {
+		s.originFetches.Add(1)
+		if r.URL.Path != "/d/file.bin" {
+			http.Error(w, "unexpected origin fetch", http.StatusTeapot)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", mockEpoch, strings.NewReader(stubFile))
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	oldAddress, oldBackends, oldListing := address, backends, dirListing
+	t.Cleanup(func() {
+		address, backends, dirListing = oldAddress, oldBackends, oldListing
+		linkCache.purge("/")
+	})
+	address = s.URL
+	setupBackends()
+	return s
+}
+
+func TestServeSpecialObjectDirListing(t *testing.T) {
+	s := newOpenlistStub(t)
+	for _, tc := range []struct {
+		mode   string
+		status int
+		check  func(t *testing.T, w *httptest.ResponseRecorder)
+	}{
+		{"openlist", http.StatusFound, func(t *testing.T, w *httptest.ResponseRecorder) {
+			if got := w.Header().Get("Location"); got != s.URL+"/dir" {
+				t.Errorf("redirected to %q, expected the openlist page %s/dir", got, s.URL)
+			}
+		}},
+		{"json", http.StatusOK, func(t *testing.T, w *httptest.ResponseRecorder) {
+			var list fsListResp
+			if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+				t.Fatalf("listing %q: %v", w.Body, err)
+			}
+			if list.Total != 1 || len(list.Content) != 1 || list.Content[0].Name != "a.txt" {
+				t.Errorf("listed %+v, expected a.txt", list)
+			}
+		}},
+		{"error", http.StatusBadRequest, func(t *testing.T, w *httptest.ResponseRecorder) {
+			if !strings.Contains(w.Body.String(), "path is a directory") {
+				t.Errorf("answered %q, expected the directory error", w.Body)
+			}
+		}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			dirListing = tc.mode
+			w := httptest.NewRecorder()
+			if !serveSpecialObject(w, httptest.NewRequest(http.MethodGet, "/dir", nil), "/dir") {
+				t.Fatal("the directory was not answered")
+			}
+			if w.Code != tc.status {
+				t.Fatalf("answered %d, expected %d", w.Code, tc.status)
+			}
+			tc.check(t, w)
+		})
+	}
+}
+
+func TestServeSpecialObjectUnknownPath(t *testing.T) {
+	newOpenlistStub(t)
+	w := httptest.NewRecorder()
+	if serveSpecialObject(w, httptest.NewRequest(http.MethodGet, "/missing.bin", nil), "/missing.bin") {
+		t.Fatalf("answered a file openlist doesn't know with %d", w.Code)
+	}
+}
+
+func TestServeDownloadEmptyFile(t *testing.T) {
+	s := newOpenlistStub(t)
+	r := httptest.NewRequest(http.MethodGet, "/empty.txt", nil)
+	w := httptest.NewRecorder()
+	serveDownload(w, r, &downloadRequest{Path: "/empty.txt"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("answered %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Length"); got != "0" {
+		t.Errorf("Content-Length is %q, expected 0", got)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("sent %d bytes", w.Body.Len())
+	}
+	if n := s.originFetches.Load(); n != 0 {
+		t.Errorf("fetched the origin %d times", n)
+	}
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+var spliceEnabled bool
+
+func init() {
+	CommandLine.BoolVar(&spliceEnabled, "splice", false, "fetch plain http origins over a dedicated connection so bodies can be spliced to the client socket in the kernel (linux only), skipped whenever compression, quotas, bandwidth limits or tls are in play")
+}
+
+func setupSplice() {
+	if spliceEnabled && runtime.GOOS != "linux" {
+		noticef(levelWarn, "warning: -splice has no effect on %s", runtime.GOOS)
+	}
+}
+
+// spliceable reports whether req can be fetched over a dedicated connection for r.
+func spliceable(r *http.Request, req *http.Request) bool {
+	if !spliceEnabled || r.TLS != nil || r.ProtoMajor != 1 || req.Method != http.MethodGet || req.URL.Scheme != "http" {
+		return false
+	}
+	if originProxy != nil {
+		if proxyURL, err := originProxy(req); err != nil || proxyURL != nil {
+			return false
+		}
+	}
+	// the writers of these wrap the response writer, so the body would be copied anyway
+	if compress && negotiateEncoding(r.Header.Get("Accept-Encoding")) != "" && r.Header.Get("Range") == "" {
+		return false
+	}
+	if k := getRequestInfo(r).apiKey; quota > 0 || k != nil && k.Quota > 0 {
+		return false
+	}
+	if _, perTransfer := transferBandwidth(r); globalBandwidth != nil || perTransfer > 0 {
+		return false
+	}
+	return true
+}
+
+// fetchOrigin performs the origin request, over a dedicated connection when its body can be spliced.
+func fetchOrigin(r *http.Request, req *http.Request) (*http.Response, error) {
+	if !spliceable(r, req) {
+		return HttpClient.Do(req)
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	dial := overrideHosts(&net.Dialer{Timeout: upstreamDialTimeout, Resolver: upstreamResolver})
+	conn, err := dial(req.Context(), "tcp", net.JoinHostPort(req.URL.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	// the origin is left as soon as the client is, as by the pooled client
+	stop := context.AfterFunc(req.Context(), func() {
+		_ = conn.Close()
+	})
+	fail := func(err error) (*http.Response, error) {
+		stop()
+		_ = conn.Close()
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	if upstreamHeaderTimeout > 0 {
+		// bounds the wait for the header like -upstream-header-timeout does for the pooled client
+		_ = conn.SetDeadline(time.Now().Add(upstreamHeaderTimeout))
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return fail(err)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return fail(err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if res.ContentLength < 0 || len(res.TransferEncoding) > 0 || res.Uncompressed {
+		res.Body = &connBody{ReadCloser: res.Body, conn: conn, stop: stop}
+		return res, nil
+	}
+	res.Body = &spliceBody{br: br, conn: conn, remaining: res.ContentLength, stop: stop}
+	return res, nil
+}
+
+// connBody closes the dedicated connection along with a body that cannot be spliced.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+	stop func() bool
+}
+
+func (b *connBody) Close() error {
+	b.stop()
+	_ = b.ReadCloser.Close()
+	return b.conn.Close()
+}
+
+// spliceBody is a fixed-length body read straight from the origin connection.
+// Its WriteTo hands the connection to the destination's ReadFrom, which lets
+// net.TCPConn splice between the sockets.
+type spliceBody struct {
+	br        *bufio.Reader
+	conn      net.Conn
+	remaining int64
+	stop      func() bool
+}
+
+func (b *spliceBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), b.remaining)]
+	n, err := b.br.Read(p)
+	b.remaining -= int64(n)
+	if err == io.EOF && b.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *spliceBody) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	// drain what the header parsing already buffered, so the rest is on the socket only
+	if buffered := min(int64(b.br.Buffered()), b.remaining); buffered > 0 {
+		n, err := io.CopyN(w, b.br, buffered)
+		written += n
+		b.remaining -= n
+		if err != nil {
+			return written, err
+		}
+	}
+	lr := &io.LimitedReader{R: b.conn, N: b.remaining}
+	n, err := io.Copy(w, lr)
+	written += n
+	b.remaining = lr.N
+	if err == nil && b.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
+}
+
+// originAlive reports whether the origin connection still works after a failed copy, so the
+// failure was on the side of the client. It waits a moment for a byte or the end of the
+// connection, which a transfer given up on doesn't miss.
+func (b *spliceBody) originAlive() bool {
+	_ = b.conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	var p [1]byte
+	_, err := b.conn.Read(p[:])
+	var netErr net.Error
+	return err == nil || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (b *spliceBody) Close() error {
+	b.stop()
+	return b.conn.Close()
+}
+
+// readFrom hands src to w's ReadFrom when w has one, keeping zero-copy paths open
+// through response writer wrappers.
+func readFrom(w io.Writer, src io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{w}, src)
+}
+
+// writerOnly hides any ReadFrom of the wrapped writer, avoiding recursion in io.Copy.
+type writerOnly struct {
+	io.Writer
+}
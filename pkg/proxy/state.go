@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"encoding/json"
+)
+
+var dataDir string
+
+func init() {
+	CommandLine.StringVar(&dataDir, "data-dir", "data", "directory for proxy-local state such as short links, empty keeps state in memory only")
+}
+
+// loadState reads the persisted state section name into v.
+// A section never saved or an empty -data-dir leaves v untouched.
+func loadState(name string, v any) error {
+	store, err := stateStore()
+	if err != nil {
+		return err
+	}
+	b, err := store.get(name)
+	if err != nil || b == nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// saveState atomically persists v as the state section name.
+func saveState(name string, v any) error {
+	store, err := stateStore()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.put(name, b)
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+)
+
+var stateStoreKind string
+
+func init() {
+	CommandLine.StringVar(&stateStoreKind, "state-store", "file", "where the state sections such as quotas, sign uses, bans and short links are kept: "+
+		"file (a json file each in -data-dir), bolt (one embedded database, -data-dir/state.db) or redis (shared by the instances using -redis-url)")
+}
+
+// stateBackend persists the state sections, each a json document.
+type stateBackend interface {
+	// get returns the section name, nil if it was never saved.
+	get(name string) ([]byte, error)
+	put(name string, b []byte) error
+}
+
+var (
+	stateMu sync.Mutex
+	// stateDB is the backend of -state-store once opened.
+	stateDB stateBackend
+)
+
+func validateStateStore() error {
+	switch stateStoreKind {
+	case "file", "bolt":
+		return nil
+	case "redis":
+		if redisURL == "" {
+			return errors.New("-state-store redis needs -redis-url")
+		}
+		if !sharedLimits() {
+			// every instance would save its own quota counters over the others
+			return errors.New("-state-store redis needs -limits-backend redis")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid -state-store %q, expected file, bolt or redis", stateStoreKind)
+}
+
+// stateStore returns the backend of -state-store, opening it on first use so the commands
+// reading the state need no setup.
+func stateStore() (stateBackend, error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if stateDB != nil {
+		return stateDB, nil
+	}
+	if err := validateStateStore(); err != nil {
+		return nil, err
+	}
+	switch {
+	case stateStoreKind == "redis":
+		if rdb == nil {
+			if err := setupRedis(); err != nil {
+				return nil, err
+			}
+		}
+		stateDB = redisState{}
+	case stateStoreKind == "bolt" && dataDir != "":
+		s := &boltState{file: filepath.Join(dataDir, "state.db")}
+		if err := s.open(); err != nil {
+			return nil, err
+		}
+		stateDB = s
+	default:
+		stateDB = fileState{}
+	}
+	return stateDB, nil
+}
+
+// fileState keeps every section in a json file of -data-dir, nothing without one.
+type fileState struct{}
+
+func (fileState) get(name string) ([]byte, error) {
+	if dataDir == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(filepath.Join(dataDir, name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (fileState) put(name string, b []byte) error {
+	if dataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dataDir, 0o700); err != nil {
+		return err
+	}
+	file := filepath.Join(dataDir, name+".json")
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+var stateBucket = []byte("state")
+
+// boltState keeps the sections in one bolt database, written in a transaction each. Sections
+// not in it yet are read from the json files of the file store, so switching keeps the state.
+type boltState struct {
+	file string
+	mu   sync.Mutex
+	// db is nil once released for the process an upgrade starts.
+	db *bolt.DB
+}
+
+func (s *boltState) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.file), 0o700); err != nil {
+		return err
+	}
+	db, err := bolt.Open(s.file, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolterrors.ErrTimeout) {
+		return fmt.Errorf("%s is open in another process", s.file)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.file, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(stateBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return fmt.Errorf("%s: %w", s.file, err)
+	}
+	s.mu.Lock()
+	s.db = db
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *boltState) get(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil, errors.New(s.file + " is released")
+	}
+	var b []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(stateBucket).Get([]byte(name)); v != nil {
+			b = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err == nil && b == nil {
+		return fileState{}.get(name)
+	}
+	return b, err
+}
+
+func (s *boltState) put(name string, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		// the process an upgrade started owns the state now
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put([]byte(name), b)
+	})
+}
+
+func (s *boltState) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		_ = s.db.Close()
+		s.db = nil
+	}
+}
+
+// releaseStateStore closes a bolt -state-store, so the process an upgrade starts can open it.
+func releaseStateStore() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if s, ok := stateDB.(*boltState); ok {
+		s.release()
+	}
+}
+
+// reopenStateStore opens a bolt -state-store again after an upgrade failed.
+func reopenStateStore() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if s, ok := stateDB.(*boltState); ok {
+		if err := s.open(); err != nil {
+			logf(levelError, "failed to reopen the state store: %s", err.Error())
+		}
+	}
+}
+
+// redisState keeps the sections in redis, shared by the instances: the last one saving a
+// section wins.
+type redisState struct{}
+
+func (redisState) get(name string) ([]byte, error) {
+	ctx, cancel := redisContext()
+	defer cancel()
+	b, err := rdb.Get(ctx, redisKey("state", name)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (redisState) put(name string, b []byte) error {
+	ctx, cancel := redisContext()
+	defer cancel()
+	return rdb.Set(ctx, redisKey("state", name), b, 0).Err()
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	adminMux.Handle("GET /api/stats", adminAuth(adminStats))
+}
+
+// statsResp sums up the metrics since the start, for operators without prometheus.
+type statsResp struct {
+	Uptime          int64              `json:"uptime"`
+	Requests        float64            `json:"requests"`
+	ClientErrors    float64            `json:"client_errors"`
+	ServerErrors    float64            `json:"server_errors"`
+	ResponseBytes   float64            `json:"response_bytes"`
+	ActiveRequests  float64            `json:"active_requests"`
+	ActiveTransfers int                `json:"active_transfers"`
+	Transfers       map[string]float64 `json:"transfers"`
+	// LinkCache and ContentCache count the results of the caches, by result.
+	LinkCache    map[string]float64 `json:"link_cache"`
+	ContentCache map[string]float64 `json:"content_cache"`
+	Maintenance  bool               `json:"maintenance"`
+}
+
+// totalWhere sums the series of the family whose label at index matches.
+func (s *series) totalWhere(index int, match func(string) bool) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sum float64
+	for key, v := range s.values {
+		if labels := strings.Split(key, "\xff"); index < len(labels) && match(labels[index]) {
+			sum += v
+		}
+	}
+	return sum
+}
+
+func adminStats(w http.ResponseWriter, _ *http.Request) {
+	transfers.Lock()
+	active := len(transfers.m)
+	transfers.Unlock()
+	resp := statsResp{
+		Uptime:          int64(time.Since(startTime).Seconds()),
+		Requests:        requestsTotal.total(),
+		ClientErrors:    requestsTotal.totalWhere(0, func(code string) bool { return strings.HasPrefix(code, "4") }),
+		ServerErrors:    requestsTotal.totalWhere(0, func(code string) bool { return strings.HasPrefix(code, "5") }),
+		ResponseBytes:   bytesSent.total(),
+		ActiveRequests:  activeReqs.total(),
+		ActiveTransfers: active,
+		Transfers:       map[string]float64{},
+		LinkCache:       map[string]float64{},
+		ContentCache:    map[string]float64{},
+		Maintenance:     currentMaintenance().Enabled,
+	}
+	for _, outcome := range []string{"completed", "aborted", "upstream_error"} {
+		resp.Transfers[outcome] = transfersTotal.value(outcome)
+	}
+	for _, result := range []string{"hit", "miss"} {
+		resp.LinkCache[result] = linkCacheTotal.value(result)
+	}
+	for _, result := range []string{"hit", "stored", "abandoned", "evicted"} {
+		resp.ContentCache[result] = contentCacheTotal.value(result)
+	}
+	jsonResponse(w, resp)
+}
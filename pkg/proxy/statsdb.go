@@ -0,0 +1,385 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+)
+
+var (
+	statsDBFile    string
+	statsRetention time.Duration
+)
+
+func init() {
+	CommandLine.StringVar(&statsDBFile, "stats-db", "", "bolt database `file` keeping the requests, errors, bytes, unique ips and top paths of every day across restarts, "+
+		"empty keeps no history")
+	CommandLine.DurationVar(&statsRetention, "stats-retention", 400*24*time.Hour, "how long -stats-db keeps days, 0 keeps them forever")
+	adminMux.Handle("GET /api/stats/days", adminAuth(adminStatsDays))
+}
+
+// statsSaveInterval is how often the counts of the current day are written to -stats-db.
+const statsSaveInterval = 30 * time.Second
+
+var (
+	statsDaysBucket = []byte("days")
+	statsIPsBucket  = []byte("ips")
+)
+
+// dayStats are the counts of one day, local time, as stored in the days bucket.
+type dayStats struct {
+	Day       string      `json:"day"`
+	Requests  int64       `json:"requests"`
+	Errors    int64       `json:"errors"`
+	Bytes     int64       `json:"bytes"`
+	UniqueIPs int64       `json:"unique_ips"`
+	TopPaths  []pathCount `json:"top_paths,omitempty"`
+}
+
+// statsDB accumulates the current day in memory and saves it periodically. The client ips
+// of a day are kept hashed in a bucket of their own under the ips bucket, so unique ips
+// can be counted over any range of days.
+type statsDB struct {
+	db *bolt.DB
+
+	mu     sync.Mutex
+	day    dayStats
+	ips    map[[8]byte]bool
+	newIPs [][8]byte
+	paths  *topPathCounter
+	dirty  bool
+}
+
+var dailyStats *statsDB
+
+func setupStatsDB() error {
+	if statsDBFile == "" {
+		return nil
+	}
+	db, err := bolt.Open(statsDBFile, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("%s: %w", statsDBFile, err)
+	}
+	s := &statsDB{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(statsDaysBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(statsIPsBucket)
+		return err
+	})
+	if err == nil {
+		err = s.load(dayKey(time.Now()))
+	}
+	if err != nil {
+		_ = db.Close()
+		return fmt.Errorf("%s: %w", statsDBFile, err)
+	}
+	dailyStats = s
+	go func() {
+		for range time.Tick(statsSaveInterval) {
+			s.mu.Lock()
+			if s.db != nil {
+				s.roll(time.Now())
+			}
+			s.mu.Unlock()
+			s.save()
+			s.prune()
+		}
+	}()
+	return nil
+}
+
+func dayKey(t time.Time) string {
+	return t.Format(time.DateOnly)
+}
+
+// load makes day the current day, continuing its counts of before a restart.
+func (s *statsDB) load(day string) error {
+	s.reset(day)
+	return s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(statsDaysBucket).Get([]byte(day)); b != nil {
+			if err := json.Unmarshal(b, &s.day); err != nil {
+				return err
+			}
+		}
+		for _, p := range s.day.TopPaths {
+			s.paths.paths[p.Path] = &p
+		}
+		if ips := tx.Bucket(statsIPsBucket).Bucket([]byte(day)); ips != nil {
+			return ips.ForEach(func(k, _ []byte) error {
+				s.ips[[8]byte(k)] = true
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// roll saves the current day and starts the one of now once it changed, mu must be held.
+func (s *statsDB) roll(now time.Time) {
+	day := dayKey(now)
+	if s.day.Day == day {
+		return
+	}
+	if err := s.write(); err != nil {
+		logf(levelError, "failed to save the stats of %s: %s", s.day.Day, err.Error())
+	}
+	s.reset(day)
+}
+
+// reset starts day with no counts.
+func (s *statsDB) reset(day string) {
+	s.day = dayStats{Day: day}
+	s.ips = map[[8]byte]bool{}
+	s.newIPs = nil
+	s.paths = newTopPathCounter()
+	s.dirty = false
+}
+
+func (s *statsDB) add(r *http.Request, status int, bytes int64) {
+	ip := hashIP(clientIP(r))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return
+	}
+	s.roll(time.Now())
+	s.day.Requests++
+	s.day.Bytes += bytes
+	if status >= 500 {
+		s.day.Errors++
+	}
+	if !s.ips[ip] {
+		s.ips[ip] = true
+		s.newIPs = append(s.newIPs, ip)
+	}
+	s.paths.add(r.URL.Path, status, bytes)
+	s.dirty = true
+}
+
+// hashIP is what the ips bucket keeps of an ip, enough to tell ips apart.
+func hashIP(ip string) [8]byte {
+	sum := sha256.Sum256([]byte(ip))
+	return [8]byte(sum[:8])
+}
+
+func (s *statsDB) save() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty || s.db == nil {
+		return
+	}
+	if err := s.write(); err != nil {
+		logf(levelError, "failed to save stats: %s", err.Error())
+		return
+	}
+	s.dirty = false
+}
+
+// write stores the current day and its new ips, mu must be held.
+func (s *statsDB) write() error {
+	s.day.UniqueIPs = int64(len(s.ips))
+	s.day.TopPaths = s.paths.top(topPathsSize, "requests")
+	b, _ := json.Marshal(s.day)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(statsDaysBucket).Put([]byte(s.day.Day), b); err != nil {
+			return err
+		}
+		ips, err := tx.Bucket(statsIPsBucket).CreateBucketIfNotExists([]byte(s.day.Day))
+		if err != nil {
+			return err
+		}
+		for _, ip := range s.newIPs {
+			if err := ips.Put(ip[:], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		s.newIPs = nil
+	}
+	return err
+}
+
+// handle returns the database, nil once released.
+func (s *statsDB) handle() *bolt.DB {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db
+}
+
+// prune drops the days older than -stats-retention.
+func (s *statsDB) prune() {
+	if statsRetention <= 0 {
+		return
+	}
+	db := s.handle()
+	if db == nil {
+		return
+	}
+	oldest := []byte(dayKey(time.Now().Add(-statsRetention)))
+	err := db.Update(func(tx *bolt.Tx) error {
+		days, ips := tx.Bucket(statsDaysBucket), tx.Bucket(statsIPsBucket)
+		var old [][]byte
+		c := days.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(oldest); k, _ = c.Next() {
+			old = append(old, k)
+		}
+		for _, k := range old {
+			if err := days.Delete(k); err != nil {
+				return err
+			}
+			if err := ips.DeleteBucket(k); err != nil && !errors.Is(err, bolterrors.ErrBucketNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logf(levelError, "failed to prune stats: %s", err.Error())
+	}
+}
+
+// statsDaysResp are the days of a range and their sum, whose unique ips are the ones of the
+// whole range and whose top paths merge the top paths of the days.
+type statsDaysResp struct {
+	Days  []dayStats `json:"days"`
+	Total dayStats   `json:"total"`
+}
+
+// days returns the stored days from from to to, both included.
+func (s *statsDB) days(from, to string) (statsDaysResp, error) {
+	s.save()
+	resp := statsDaysResp{Days: []dayStats{}, Total: dayStats{Day: from + "/" + to}}
+	paths := map[string]*pathCount{}
+	db := s.handle()
+	if db == nil {
+		return resp, errors.New("-stats-db was handed over to an upgrade")
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(statsDaysBucket).Cursor()
+		for k, v := c.Seek([]byte(from)); k != nil && string(k) <= to; k, v = c.Next() {
+			var d dayStats
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			resp.Total.Requests += d.Requests
+			resp.Total.Errors += d.Errors
+			resp.Total.Bytes += d.Bytes
+			for _, p := range d.TopPaths {
+				e, ok := paths[p.Path]
+				if !ok {
+					e = &pathCount{Path: p.Path}
+					paths[p.Path] = e
+				}
+				e.Requests += p.Requests
+				e.Errors += p.Errors
+				e.Bytes += p.Bytes
+			}
+			d.TopPaths = d.TopPaths[:min(len(d.TopPaths), 10)]
+			resp.Days = append(resp.Days, d)
+		}
+		seen := map[string]bool{}
+		c = tx.Bucket(statsIPsBucket).Cursor()
+		for k, _ := c.Seek([]byte(from)); k != nil && string(k) <= to; k, _ = c.Next() {
+			if ips := tx.Bucket(statsIPsBucket).Bucket(k); ips != nil {
+				_ = ips.ForEach(func(ip, _ []byte) error {
+					seen[string(ip)] = true
+					return nil
+				})
+			}
+		}
+		resp.Total.UniqueIPs = int64(len(seen))
+		return nil
+	})
+	for _, p := range paths {
+		resp.Total.TopPaths = append(resp.Total.TopPaths, *p)
+	}
+	sort.Slice(resp.Total.TopPaths, func(i, j int) bool { return resp.Total.TopPaths[i].Requests > resp.Total.TopPaths[j].Requests })
+	resp.Total.TopPaths = resp.Total.TopPaths[:min(len(resp.Total.TopPaths), 10)]
+	return resp, err
+}
+
+// adminStatsDays answers the days from the from query parameter to to, both dates
+// (2006-01-02) and defaulting to the last 30 days.
+func adminStatsDays(w http.ResponseWriter, r *http.Request) {
+	if dailyStats == nil {
+		errorResponseWithStatus(w, http.StatusNotFound, 404, "no -stats-db")
+		return
+	}
+	now := time.Now()
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" {
+		from = dayKey(now.AddDate(0, 0, -29))
+	}
+	if to == "" {
+		to = dayKey(now)
+	}
+	for _, d := range []string{from, to} {
+		if _, err := time.Parse(time.DateOnly, d); err != nil {
+			errorResponseWithStatus(w, http.StatusBadRequest, 400, "invalid date "+d+", expected 2006-01-02")
+			return
+		}
+	}
+	resp, err := dailyStats.days(from, to)
+	if err != nil {
+		errorResponse(w, 500, err.Error())
+		return
+	}
+	jsonResponse(w, resp)
+}
+
+// closeStatsDB saves the current day when stopping.
+func closeStatsDB() {
+	releaseStatsDB()
+}
+
+// releaseStatsDB saves the current day and closes -stats-db, so the process an upgrade starts
+// can open it. Requests are no longer counted in this one.
+func releaseStatsDB() {
+	if s := dailyStats; s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.db == nil {
+			return
+		}
+		if s.dirty {
+			if err := s.write(); err != nil {
+				logf(levelError, "failed to save stats: %s", err.Error())
+			}
+		}
+		_ = s.db.Close()
+		s.db = nil
+	}
+}
+
+// reopenStatsDB opens -stats-db again after an upgrade failed.
+func reopenStatsDB() {
+	if s := dailyStats; s != nil {
+		db, err := bolt.Open(statsDBFile, 0o600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			logf(levelError, "failed to reopen %s: %s", statsDBFile, err.Error())
+			return
+		}
+		s.mu.Lock()
+		s.db = db
+		s.mu.Unlock()
+	}
+}
+
+// recordDailyStats counts a request in -stats-db.
+func recordDailyStats(r *http.Request, status int, bytes int64) {
+	if dailyStats != nil {
+		dailyStats.add(r, status, bytes)
+	}
+}
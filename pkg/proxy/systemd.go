@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+// systemdListeners returns the sockets inherited from systemd, or nil when the process
+// was not socket activated.
+func systemdListeners() ([]net.Listener, []string, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// they describe this process only
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+	var lns []net.Listener
+	var addrs []string
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		name := fmt.Sprintf("fd %d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, l := range lns {
+				_ = l.Close()
+			}
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		registerHandoff("systemd "+name, ln, nil)
+		lns = append(lns, ln)
+		addrs = append(addrs, "systemd "+name+" "+ln.Addr().String())
+	}
+	return lns, addrs, nil
+}
+
+// sdNotify sends state to the service manager, it does nothing outside of a notify unit.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if strings.HasPrefix(socket, "@") {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		noticef(levelError, "failed to notify systemd: %s", err.Error())
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		noticef(levelError, "failed to notify systemd: %s", err.Error())
+	}
+}
+
+// startWatchdog pings the systemd watchdog at half its interval while the process is alive.
+func startWatchdog() {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
+
+// stopOnSignal stops the server on SIGTERM when run by systemd, so a restart of a socket
+// activated unit loses no request: new connections wait in the inherited socket.
+func stopOnSignal() {
+	if os.Getenv("NOTIFY_SOCKET") == "" && os.Getenv("INVOCATION_ID") == "" {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-ch
+		sdNotify("STOPPING=1")
+		requestStop()
+	}()
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+)
+
+var (
+	telemetryURL      string
+	telemetryInterval time.Duration
+)
+
+func init() {
+	CommandLine.StringVar(&telemetryURL, "telemetry-url", "", "opt in to sending anonymous usage reports to this `url`, see `telemetry preview` for their content, empty sends nothing")
+	CommandLine.DurationVar(&telemetryInterval, "telemetry-interval", 24*time.Hour, "how often a usage report is sent with -telemetry-url")
+	registerState("telemetry", func() any { return &telemetryState{} })
+	commands["telemetry"] = command{
+		usage: "telemetry preview prints the usage report -telemetry-url would send with the current options",
+		run:   telemetryCommand,
+	}
+}
+
+// telemetryState holds the random id that tells reports of one installation apart.
+type telemetryState struct {
+	ID string `json:"id"`
+}
+
+// telemetryReport is everything a usage report contains. Option values, paths,
+// addresses and names are never included, only which options are in use.
+type telemetryReport struct {
+	ID       string             `json:"id"`
+	Version  string             `json:"version"`
+	Go       string             `json:"go"`
+	OS       string             `json:"os"`
+	Arch     string             `json:"arch"`
+	CPUs     int                `json:"cpus"`
+	Uptime   int64              `json:"uptime_seconds"`
+	Features []string           `json:"features"`
+	Counters map[string]float64 `json:"counters"`
+}
+
+func newTelemetryReport(id string) telemetryReport {
+	var features []string
+	for name, source := range configSource {
+		if source != "" && name != "telemetry-url" && name != "telemetry-interval" {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return telemetryReport{
+		ID:       id,
+		Version:  Version,
+		Go:       runtime.Version(),
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		CPUs:     runtime.GOMAXPROCS(0),
+		Uptime:   int64(time.Since(startTime).Seconds()),
+		Features: features,
+		Counters: map[string]float64{
+			"requests":            requestsTotal.total(),
+			"response_bytes":      bytesSent.total(),
+			"transfers_completed": transfersTotal.value("completed"),
+			"transfers_aborted":   transfersTotal.value("aborted"),
+			"transfers_failed":    transfersTotal.value("upstream_error"),
+			"transfer_bytes":      transferBytes.total(),
+		},
+	}
+}
+
+func telemetryCommand(args []string) error {
+	if len(args) == 0 || args[0] != "preview" {
+		return errors.New("usage: telemetry preview")
+	}
+	var st telemetryState
+	if err := loadState("telemetry", &st); err != nil {
+		return err
+	}
+	if st.ID == "" {
+		st.ID = "generated on the first report"
+	}
+	b, err := json.MarshalIndent(newTelemetryReport(st.ID), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	if telemetryURL == "" {
+		fmt.Println("telemetry is disabled, nothing is sent unless -telemetry-url is set")
+	} else {
+		fmt.Printf("the running proxy sends this with its own counters to %s every %s\n", telemetryURL, telemetryInterval)
+	}
+	return nil
+}
+
+// startTelemetry periodically sends usage reports to -telemetry-url.
+func startTelemetry() error {
+	var st telemetryState
+	if err := loadState("telemetry", &st); err != nil {
+		return err
+	}
+	if st.ID == "" {
+		st.ID = randomToken()
+		if err := saveState("telemetry", &st); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("sending anonymous usage reports to %s, run `telemetry preview` to see them\n", telemetryURL)
+	go func() {
+		for range time.Tick(telemetryInterval) {
+			if err := sendTelemetry(newTelemetryReport(st.ID)); err != nil {
+				noticef(levelError, "failed to send usage report: %s", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+func sendTelemetry(report telemetryReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	res, err := apiClient.Post(telemetryURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded %s", telemetryURL, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/acme"
+	"gopkg.in/yaml.v3"
+)
+
+var tenantsFile string
+
+func init() {
+	CommandLine.StringVar(&tenantsFile, "tenants-file", "", "yaml file of tenants (name, hosts, root, cert, key, acme) sharing the proxy, chosen by sni or Host, reloaded on change or SIGHUP")
+}
+
+// tenant is a site served on the shared listener, selected by the tls server name or Host header.
+type tenant struct {
+	Name string `yaml:"name"`
+	// Hosts are exact host names or *.domain wildcards matching a single label.
+	Hosts []string `yaml:"hosts"`
+	// Root is prepended to request paths, so a tenant only reaches its part of the openlist namespace.
+	Root string `yaml:"root"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ACME issues the certificate of the hosts through -acme-directory instead of Cert and Key.
+	ACME bool `yaml:"acme"`
+
+	cert *tls.Certificate
+}
+
+type tenantSet struct {
+	exact     map[string]*tenant
+	wildcards map[string]*tenant
+}
+
+var tenants atomic.Pointer[tenantSet]
+
+func loadTenants() error {
+	set := &tenantSet{exact: map[string]*tenant{}, wildcards: map[string]*tenant{}}
+	if tenantsFile != "" {
+		b, err := os.ReadFile(tenantsFile)
+		if err != nil {
+			return err
+		}
+		var ts []*tenant
+		if err := yaml.Unmarshal(b, &ts); err != nil {
+			return fmt.Errorf("%s: %w", tenantsFile, err)
+		}
+		for _, t := range ts {
+			if err := t.setup(set); err != nil {
+				return fmt.Errorf("%s: tenant %s: %w", tenantsFile, t.Name, err)
+			}
+		}
+	}
+	tenants.Store(set)
+	return nil
+}
+
+func (t *tenant) setup(set *tenantSet) error {
+	if len(t.Hosts) == 0 {
+		return errors.New("needs hosts")
+	}
+	if t.Root = strings.TrimSuffix(t.Root, "/"); t.Root != "" {
+		if _, err := normalizePath(t.Root); err != nil {
+			return fmt.Errorf("invalid root %q", t.Root)
+		}
+	}
+	switch {
+	case t.ACME && t.Cert != "":
+		return errors.New("acme and cert are exclusive")
+	case t.ACME && !https:
+		return errors.New("acme needs -https")
+	case t.Cert != "":
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return err
+		}
+		t.cert = &cert
+	}
+	for _, h := range t.Hosts {
+		h = strings.ToLower(h)
+		m := set.exact
+		if domain, ok := strings.CutPrefix(h, "*."); ok {
+			if t.ACME {
+				// wildcard certificates need dns challenges, which autocert can't answer
+				return fmt.Errorf("acme can't issue the wildcard %s, use cert and key", h)
+			}
+			m, h = set.wildcards, domain
+		}
+		if _, ok := m[h]; ok {
+			return fmt.Errorf("host %s is already served by another tenant", h)
+		}
+		m[h] = t
+	}
+	return nil
+}
+
+func reloadTenants() {
+	if err := loadTenants(); err != nil {
+		noticef(levelError, "failed to reload tenants, keeping the previous ones: %s", err.Error())
+		return
+	}
+	fmt.Println("reloaded tenants")
+}
+
+func setupTenants() error {
+	if err := loadTenants(); err != nil {
+		return err
+	}
+	if tenantsFile == "" {
+		return nil
+	}
+	onReload(reloadTenants)
+	watchFile(tenantsFile, reloadTenants)
+	return nil
+}
+
+// tenantFor returns the tenant serving host, preferring exact names over wildcards.
+func tenantFor(host string) *tenant {
+	set := tenants.Load()
+	if set == nil || host == "" {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if t, ok := set.exact[host]; ok {
+		return t
+	}
+	if _, domain, ok := strings.Cut(host, "."); ok {
+		return set.wildcards[domain]
+	}
+	return nil
+}
+
+// requestTenant returns the tenant of r, by the tls server name before the Host header.
+func requestTenant(r *http.Request) *tenant {
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		return tenantFor(r.TLS.ServerName)
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return tenantFor(host)
+}
+
+// tenantPath maps the request path p into the namespace of the tenant serving r.
+func tenantPath(r *http.Request, p string) string {
+	if t := requestTenant(r); t != nil && t.Root != "" {
+		return t.Root + p
+	}
+	return p
+}
+
+// tenantTLSConfig selects certificates during the handshake, before any http is parsed.
+// It falls back to -cert and -key, -vault-tls-secret or -acme-domain for unknown names.
+func tenantTLSConfig(cfg *tls.Config) {
+	cfg.GetCertificate = tenantCertificate
+	cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+}
+
+func tenantCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if t := tenantFor(hello.ServerName); t != nil {
+		if t.ACME {
+			return acmeManager.GetCertificate(hello)
+		}
+		if t.cert != nil {
+			return t.cert, nil
+		}
+	}
+	if vaultTLSSecret != "" {
+		return vaultCert.Load(), nil
+	}
+	if cert := listenerCert.Load(); cert != nil || acmeManager == nil {
+		return cert, nil
+	}
+	return acmeManager.GetCertificate(hello)
+}
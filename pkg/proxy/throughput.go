@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"cmp"
+	"math"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+var throughputHalfLife time.Duration
+
+func init() {
+	CommandLine.DurationVar(&throughputHalfLife, "throughput-half-life", 10*time.Minute, "age after which an upstream host's measured throughput counts half when choosing between sources")
+}
+
+var upstreamThroughput = newGaugeVec("openlist_proxy_upstream_throughput_bytes", "Smoothed throughput in bytes per second achieved from each upstream host.", "host")
+
+// minThroughputSample is the smallest transfer that yields a meaningful throughput sample.
+const minThroughputSample = 256 << 10
+
+type hostSample struct {
+	rate    float64 // bytes per second, exponentially weighted
+	updated time.Time
+}
+
+// throughputStats keeps a decaying throughput estimate per upstream host.
+type throughputStats struct {
+	mu    sync.Mutex
+	hosts map[string]*hostSample
+}
+
+var throughputs = &throughputStats{hosts: map[string]*hostSample{}}
+
+// decay returns how much an estimate last updated at t still counts.
+func decay(t, now time.Time) float64 {
+	return math.Pow(0.5, float64(now.Sub(t))/float64(throughputHalfLife))
+}
+
+// record adds a transfer of n bytes from host that took d.
+func (ts *throughputStats) record(host string, n int64, d time.Duration) {
+	if n < minThroughputSample || d <= 0 {
+		return
+	}
+	sample := float64(n) / d.Seconds()
+	now := time.Now()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	h, ok := ts.hosts[host]
+	if !ok {
+		h = &hostSample{rate: sample}
+		ts.hosts[host] = h
+	} else {
+		// older estimates weigh less, a single sample never replaces a fresh one outright
+		w := min(decay(h.updated, now), 0.8)
+		h.rate = h.rate*w + sample*(1-w)
+	}
+	h.updated = now
+	upstreamThroughput.set(h.rate, host)
+}
+
+// estimate returns the expected throughput of host. Estimates fade towards the average of
+// all hosts as they age, so a host that was slow once gets tried again eventually.
+// Unknown hosts get the average too.
+func (ts *throughputStats) estimate(host string, now time.Time) float64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var avg float64
+	for _, h := range ts.hosts {
+		avg += h.rate / float64(len(ts.hosts))
+	}
+	h, ok := ts.hosts[host]
+	if !ok {
+		return avg
+	}
+	w := decay(h.updated, now)
+	return h.rate*w + avg*(1-w)
+}
+
+// preferFaster orders candidate urls by the expected throughput of their hosts,
+// keeping the given order between hosts that are equally fast or unknown.
+func preferFaster(urls []string) []string {
+	now := time.Now()
+	scores := make(map[string]float64, len(urls))
+	for _, u := range urls {
+		scores[u] = throughputs.estimate(urlHost(u), now)
+	}
+	sorted := slices.Clone(urls)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		return cmp.Compare(scores[b], scores[a])
+	})
+	return sorted
+}
+
+func urlHost(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
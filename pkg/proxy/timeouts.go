@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	idleTimeout       time.Duration
+	writeTimeout      time.Duration
+	writeIdleTimeout  time.Duration
+	minRate           byteSize
+	minRateWindow     time.Duration
+)
+
+func init() {
+	CommandLine.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "how long clients may take to send the request header")
+	CommandLine.DurationVar(&readTimeout, "read-timeout", 0, "how long clients may take to send the whole request including its body, 0 does not limit it")
+	CommandLine.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "how long keep-alive connections wait for the next request")
+	CommandLine.DurationVar(&writeTimeout, "write-timeout", 0, "deadline of whole responses, cutting downloads taking longer, 0 does not limit it, prefer -write-idle-timeout")
+	CommandLine.DurationVar(&writeIdleTimeout, "write-idle-timeout", 2*time.Minute, "cut responses the client accepts no data of for this long, the deadline moves on with every write, 0 disables it")
+	CommandLine.Var(&minRate, "min-rate", "cut responses the client reads slower than this `size` per second over -min-rate-window, e.g. 10K, 0 disables it")
+	CommandLine.DurationVar(&minRateWindow, "min-rate-window", time.Minute, "time over which -min-rate is measured, waiting on the origin or -max-bandwidth not included")
+}
+
+// configureTimeouts bounds how long connections may be held by clients doing nothing.
+func configureTimeouts(srv *http.Server) {
+	srv.ReadHeaderTimeout = readHeaderTimeout
+	srv.ReadTimeout = readTimeout
+	srv.IdleTimeout = idleTimeout
+	srv.WriteTimeout = writeTimeout
+}
+
+func validateMinRate() error {
+	if minRate > 0 && minRateWindow < time.Second {
+		return fmt.Errorf("invalid -min-rate-window %s, expected at least 1s", minRateWindow)
+	}
+	return nil
+}
+
+// writeIdleChunk is how much a single ReadFrom may send under one deadline.
+const writeIdleChunk = 4 << 20
+
+var slowClientsTotal = newCounterVec("openlist_proxy_slow_clients_total", "Responses cut because the client read slower than -min-rate.")
+
+// writeDeadlineHandler sets a write deadline before every write, so a download is only cut
+// when the client stops accepting data for -write-idle-timeout, or reads slower than
+// -min-rate, however long it runs.
+func writeDeadlineHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		dw := &deadlineWriter{ResponseWriter: w, rc: rc, r: r}
+		next.ServeHTTP(dw, r)
+		if dw.set {
+			// the connection is reused for the next request, which must not inherit it
+			_ = rc.SetWriteDeadline(time.Time{})
+		}
+	})
+}
+
+// deadlineWriter measures the client rate by the time spent blocked in writes, so neither
+// a slow origin nor -max-bandwidth count against the client.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc          *http.ResponseController
+	r           *http.Request
+	set         bool
+	unsupported bool
+
+	// windowBytes were sent in windowBlocked time of writes since the window began
+	windowBytes   int64
+	windowBlocked time.Duration
+	cut           bool
+}
+
+// windowSize is how much the client has to read within -min-rate-window.
+func windowSize() int64 {
+	return int64(minRate) * int64(minRateWindow/time.Second)
+}
+
+// begin sets the deadline of the write that follows.
+func (dw *deadlineWriter) begin() time.Time {
+	now := time.Now()
+	if dw.unsupported {
+		return now
+	}
+	var deadline time.Time
+	if writeIdleTimeout > 0 {
+		deadline = now.Add(writeIdleTimeout)
+	}
+	if minRate > 0 {
+		if dw.windowBytes >= windowSize() {
+			dw.windowBytes, dw.windowBlocked = 0, 0
+		}
+		if end := now.Add(minRateWindow - dw.windowBlocked); deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+		}
+	}
+	if err := dw.rc.SetWriteDeadline(deadline); errors.Is(err, http.ErrNotSupported) {
+		dw.unsupported = true
+		return now
+	}
+	dw.set = true
+	return now
+}
+
+// end accounts a write of n bytes begun at start.
+func (dw *deadlineWriter) end(start time.Time, n int64, err error) {
+	if minRate <= 0 || dw.unsupported {
+		return
+	}
+	dw.windowBytes += n
+	dw.windowBlocked += time.Since(start)
+	if err != nil && !dw.cut && errors.Is(err, os.ErrDeadlineExceeded) && dw.windowBlocked >= minRateWindow {
+		dw.cut = true
+		slowClientsTotal.inc()
+		logf(levelInfo, "cut slow client %s of %s (request %s): %d bytes in %s", clientIP(dw.r), dw.r.URL.Path, getRequestInfo(dw.r).id,
+			dw.windowBytes, dw.windowBlocked.Round(time.Second))
+	}
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	start := dw.begin()
+	n, err := dw.ResponseWriter.Write(p)
+	dw.end(start, int64(n), err)
+	return n, err
+}
+
+// chunkSize is how much a single ReadFrom may send under one deadline, no more than the
+// rest of the -min-rate window.
+func (dw *deadlineWriter) chunkSize() int64 {
+	if minRate > 0 {
+		if rest := windowSize() - dw.windowBytes; rest > 0 {
+			return min(rest, writeIdleChunk)
+		}
+		return min(windowSize(), writeIdleChunk)
+	}
+	return writeIdleChunk
+}
+
+// ReadFrom sends src in chunks with a deadline each. A LimitedReader is split rather than
+// wrapped, since splicing only sees through one of them.
+func (dw *deadlineWriter) ReadFrom(src io.Reader) (int64, error) {
+	var written int64
+	for {
+		size := dw.chunkSize()
+		chunk := &io.LimitedReader{R: src, N: size}
+		lr, limited := src.(*io.LimitedReader)
+		if limited {
+			if lr.N <= 0 {
+				return written, nil
+			}
+			chunk = &io.LimitedReader{R: lr.R, N: min(lr.N, size)}
+		}
+		want := chunk.N
+		start := dw.begin()
+		n, err := readFrom(dw.ResponseWriter, chunk)
+		dw.end(start, n, err)
+		written += n
+		if limited {
+			lr.N -= n
+		}
+		if err != nil || n < want {
+			return written, err
+		}
+	}
+}
+
+func (dw *deadlineWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var (
+	tlsMinVersion string
+	tlsCiphers    string
+	tlsCurves     string
+)
+
+func init() {
+	CommandLine.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "oldest tls version the https listener accepts: 1.0, 1.1, 1.2 or 1.3")
+	CommandLine.StringVar(&tlsCiphers, "tls-ciphers", "", "comma separated cipher suites of tls 1.2 and older, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, empty keeps the go defaults, http/2 needs one of the AES_128_GCM_SHA256 suites, "+
+		"tls 1.3 suites are not configurable")
+	CommandLine.StringVar(&tlsCurves, "tls-curves", "", "comma separated key exchange curves in order of preference: X25519MLKEM768, X25519, P256, P384, P521, empty keeps the go defaults")
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurveIDs = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// applyTLSPolicy hardens cfg with -tls-min-version, -tls-ciphers and -tls-curves.
+func applyTLSPolicy(cfg *tls.Config) error {
+	v, ok := tlsVersions[tlsMinVersion]
+	if !ok {
+		return fmt.Errorf("invalid -tls-min-version %q", tlsMinVersion)
+	}
+	cfg.MinVersion = v
+	if tlsCiphers != "" {
+		suites := map[string]uint16{}
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		for _, s := range tls.InsecureCipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		cfg.CipherSuites = nil
+		for _, name := range strings.Split(tlsCiphers, ",") {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return fmt.Errorf("unknown cipher suite %q in -tls-ciphers", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+	if tlsCurves != "" {
+		cfg.CurvePreferences = nil
+		for _, name := range strings.Split(tlsCurves, ",") {
+			id, ok := tlsCurveIDs[strings.TrimSpace(name)]
+			if !ok {
+				return fmt.Errorf("unknown curve %q in -tls-curves", name)
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+	return nil
+}
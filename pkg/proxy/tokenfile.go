@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var tokenFile string
+
+func init() {
+	CommandLine.StringVar(&tokenFile, "token-file", "", "read the openlist token from this `file` instead of -token, re-read on change or SIGHUP")
+}
+
+var tokenMu sync.RWMutex
+
+// apiToken returns the current openlist token.
+func apiToken() string {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	return token
+}
+
+func readTokenFile() (string, error) {
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", err
+	}
+	t := strings.TrimSpace(string(b))
+	if t == "" {
+		return "", errors.New(tokenFile + " is empty")
+	}
+	return t, nil
+}
+
+// loadTokenFile sets the token from -token-file and keeps following the file.
+func loadTokenFile() error {
+	if tokenFile == "" {
+		return nil
+	}
+	if token != "" {
+		return errors.New("-token and -token-file are exclusive")
+	}
+	t, err := readTokenFile()
+	if err != nil {
+		return err
+	}
+	token = t
+	onReload(reloadTokenFile)
+	watchFile(tokenFile, reloadTokenFile)
+	return nil
+}
+
+func reloadTokenFile() {
+	t, err := readTokenFile()
+	if err != nil {
+		noticef(levelError, "failed to reload the openlist token, keeping the previous one: %s", err.Error())
+		return
+	}
+	if updateToken(t) {
+		fmt.Println("reloaded openlist token")
+	}
+}
+
+// updateToken replaces the openlist token at runtime and reports whether it changed.
+func updateToken(t string) bool {
+	tokenMu.Lock()
+	changed := t != token
+	token = t
+	tokenMu.Unlock()
+	if changed && signKey == "" {
+		// signs follow the token openlist signs with
+		resetSigner()
+	}
+	return changed
+}
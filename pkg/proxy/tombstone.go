@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	tombstoneTTL  time.Duration
+	tombstonePage string
+)
+
+func init() {
+	CommandLine.DurationVar(&tombstoneTTL, "tombstone-ttl", 0, "how long files openlist reports deleted after they were served answer 410 Gone, 0 disables tombstones")
+	CommandLine.StringVar(&tombstonePage, "tombstone-page", "", "html/template `file` served for tombstones with .Path and .Deleted, a built-in page by default")
+	registerState("tombstones", func() any { return &tombstoneStore{} })
+}
+
+var defaultTombstonePage = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>410 Gone</title></head>
+<body>
+<h1>Gone</h1>
+<p>{{.Path}} was deleted on {{.Deleted.Format "2006-01-02"}} and is no longer available.</p>
+</body>
+</html>
+`
+
+// maxSeenPaths bounds the paths remembered as served, it starts over when full.
+const maxSeenPaths = 65536
+
+type tombstoneStore struct {
+	mu sync.Mutex
+	// Deleted maps removed paths to when their removal was noticed.
+	Deleted map[string]time.Time `json:"deleted"`
+	// seen holds paths recently resolved, only their disappearance creates a tombstone.
+	seen map[string]struct{}
+	page *template.Template
+}
+
+var tombstones = &tombstoneStore{Deleted: map[string]time.Time{}, seen: map[string]struct{}{}}
+
+func setupTombstones() error {
+	if tombstoneTTL <= 0 {
+		return nil
+	}
+	src := defaultTombstonePage
+	if tombstonePage != "" {
+		b, err := os.ReadFile(tombstonePage)
+		if err != nil {
+			return err
+		}
+		src = string(b)
+	}
+	page, err := template.New("tombstone").Parse(src)
+	if err != nil {
+		return fmt.Errorf("-tombstone-page: %w", err)
+	}
+	tombstones.mu.Lock()
+	defer tombstones.mu.Unlock()
+	tombstones.page = page
+	if err := loadState("tombstones", tombstones); err != nil {
+		return err
+	}
+	if tombstones.Deleted == nil {
+		tombstones.Deleted = map[string]time.Time{}
+	}
+	tombstones.prune()
+	return nil
+}
+
+// notFound reports whether err is openlist saying the path does not exist.
+func notFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && (apiErr.Code == 404 || strings.Contains(strings.ToLower(apiErr.Message), "not found"))
+}
+
+// observe records the outcome of resolving filePath and returns when it was deleted,
+// zero unless it is tombstoned. A path that was served before and now is not found
+// becomes a tombstone, and its cached links, cached file and short links are purged.
+func (st *tombstoneStore) observe(filePath string, err error) time.Time {
+	if tombstoneTTL <= 0 {
+		return time.Time{}
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err == nil {
+		if len(st.seen) >= maxSeenPaths {
+			st.seen = map[string]struct{}{}
+		}
+		st.seen[filePath] = struct{}{}
+		if _, ok := st.Deleted[filePath]; ok {
+			// the path was recreated
+			delete(st.Deleted, filePath)
+			st.save()
+		}
+		return time.Time{}
+	}
+	if !notFound(err) {
+		return time.Time{}
+	}
+	if deleted, ok := st.Deleted[filePath]; ok {
+		if time.Since(deleted) < tombstoneTTL {
+			return deleted
+		}
+		return time.Time{}
+	}
+	if _, ok := st.seen[filePath]; !ok {
+		return time.Time{}
+	}
+	delete(st.seen, filePath)
+	now := time.Now()
+	st.Deleted[filePath] = now
+	st.prune()
+	st.save()
+	n := linkCache.purge(filePath) + contentCache.purge(filePath) + shortLinks.removePath(filePath)
+	logf(levelInfo, "tombstone: %s was deleted, purged %d cached links, files and short links", filePath, n)
+	return now
+}
+
+// prune drops tombstones past -tombstone-ttl, mu must be held.
+func (st *tombstoneStore) prune() {
+	for p, deleted := range st.Deleted {
+		if time.Since(deleted) >= tombstoneTTL {
+			delete(st.Deleted, p)
+		}
+	}
+}
+
+// save persists the tombstones, mu must be held.
+func (st *tombstoneStore) save() {
+	if err := saveState("tombstones", st); err != nil {
+		noticef(levelError, "failed to save tombstones: %s", err.Error())
+	}
+}
+
+func serveTombstone(w http.ResponseWriter, r *http.Request, filePath string, deleted time.Time) {
+	setCORSHeaders(w, r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusGone)
+	_ = tombstones.page.Execute(w, struct {
+		Path    string
+		Deleted time.Time
+	}{filePath, deleted})
+}
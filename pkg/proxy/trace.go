@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func init() {
+	adminMux.Handle("GET /api/trace", adminAuth(adminTrace))
+}
+
+// traceStep is what one step of the download pipeline made of a traced request.
+type traceStep struct {
+	Step string `json:"step"`
+	// Result is ok, denied, skipped or error.
+	Result string      `json:"result"`
+	Detail string      `json:"detail,omitempty"`
+	URL    string      `json:"url,omitempty"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+type traceResp struct {
+	Path  string      `json:"path"`
+	Steps []traceStep `json:"steps"`
+}
+
+// traceHeaders are the origin response headers a trace reports.
+var traceHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Content-Encoding",
+	"Content-Disposition", "ETag", "Last-Modified", "Cache-Control", "Expires", "Location"}
+
+// adminTrace follows the download of ?url= through the rules, the signature check, the link
+// of openlist and the origin as a client at ?client= sending ?host= and ?range= would, and
+// reports each step. The origin is asked for the first byte or the range and its body left
+// unread, nothing is served from or stored in the content cache and sign uses aren't counted.
+func adminTrace(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	u, err := url.Parse(q.Get("url"))
+	if err != nil || !strings.HasPrefix(u.Path, "/") {
+		errorResponseWithStatus(w, http.StatusBadRequest, 400, "url must be a download path like /dir/file?sign=...")
+		return
+	}
+	t := ruleTest{Path: u.Path, Client: q.Get("client"), Host: q.Get("host"), Headers: map[string]string{}}
+	if t.Host == "" {
+		t.Host = u.Host
+	}
+	if v := q.Get("range"); v != "" {
+		t.Headers["Range"] = v
+	}
+	jsonResponse(w, trace(r, t, u.RawQuery))
+}
+
+func trace(r *http.Request, t ruleTest, rawQuery string) traceResp {
+	resp := traceResp{Path: t.Path}
+	step := func(s traceStep) {
+		resp.Steps = append(resp.Steps, s)
+	}
+	req, err := parseDownloadRequest(t.Path, rawQuery, t.Headers["Range"])
+	if err != nil {
+		step(traceStep{Step: "parse", Result: "error", Detail: err.Error()})
+		return resp
+	}
+	t.Path = req.Path
+	resp.Path = req.Path
+	detail := "path " + req.Path
+	if req.Ranges == nil && t.Headers["Range"] != "" {
+		detail += ", malformed range dropped"
+		delete(t.Headers, "Range")
+	}
+	step(traceStep{Step: "parse", Result: "ok", Detail: detail})
+
+	d := t.decide()
+	if !d.allow {
+		step(traceStep{Step: "rules", Result: "denied", Status: d.status, Detail: d.String()})
+		return resp
+	}
+	step(traceStep{Step: "rules", Result: "ok", Detail: d.String()})
+
+	tr := t.request()
+	filePath := tenantPath(tr, req.Path)
+	switch {
+	case disableSign:
+		step(traceStep{Step: "signature", Result: "skipped", Detail: "-disable-sign"})
+	case req.Sign == "":
+		step(traceStep{Step: "signature", Result: "skipped", Detail: "no sign query, a jwt, basic auth, api key or oidc session must authorize the download"})
+	default:
+		if code, err := verifySign(filePath, req.Sign); err != nil {
+			step(traceStep{Step: "signature", Result: "denied", Status: code, Detail: err.Error()})
+		} else {
+			step(traceStep{Step: "signature", Result: "ok", Detail: "valid for " + filePath})
+		}
+	}
+
+	if d.backend == "direct" {
+		step(traceStep{Step: "link", Result: "skipped", Detail: "served by a -direct mount without openlist"})
+		return resp
+	}
+	_, cached := linkCache.get(filePath)
+	link, err := fetchLink(r.Context(), filePath)
+	if err != nil {
+		step(traceStep{Step: "link", Result: "error", Detail: err.Error()})
+		return resp
+	}
+	detail = "from " + link.backend
+	if cached {
+		detail += ", cached"
+	}
+	if exp := link.expires(); !exp.IsZero() {
+		detail += ", expires in " + time.Until(exp).Round(time.Second).String()
+	}
+	if len(link.URLs) > 1 {
+		detail += fmt.Sprintf(", %d mirrors", len(link.URLs))
+	}
+	step(traceStep{Step: "link", Result: "ok", Detail: detail, URL: link.Url, Header: link.Header})
+
+	if link.Url, err = normalizeLinkURL(link.Url, link.backend); err != nil {
+		step(traceStep{Step: "normalize", Result: "error", Detail: err.Error()})
+		return resp
+	}
+	if link, err = hookLinkResolved(tr, filePath, link); err != nil {
+		step(traceStep{Step: "hooks", Result: "error", Detail: err.Error()})
+		return resp
+	}
+	target := orderMirrors(link.mirrors())[0]
+	if redirectMode && len(link.Header) == 0 && !rewritesRequestHeaders(filePath, link.Url) {
+		step(traceStep{Step: "mode", Result: "ok", Detail: "redirect", URL: target})
+	} else {
+		step(traceStep{Step: "mode", Result: "ok", Detail: "proxy", URL: target})
+	}
+
+	req2, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+	if err != nil {
+		step(traceStep{Step: "origin", Result: "error", Detail: err.Error()})
+		return resp
+	}
+	forwardClientHeaders(req2, tr)
+	maps.Copy(req2.Header, link.Header)
+	req2.Header.Set(requestIDHeader, requestID(tr))
+	rewriteRequestHeaders(filePath, req2)
+	firstRange(req, req2)
+	if req2.Header.Get("Range") == "" {
+		// the first byte tells about the file without sending it
+		req2.Header.Set("Range", "bytes=0-0")
+	}
+	step(traceStep{Step: "origin request", Result: "ok", Detail: "GET " + req2.URL.Redacted(), Header: req2.Header})
+	begin := time.Now()
+	res, err := HttpClient.Do(req2)
+	if err != nil {
+		step(traceStep{Step: "origin", Result: "error", Detail: err.Error()})
+		return resp
+	}
+	_ = res.Body.Close()
+	header := http.Header{}
+	for _, name := range traceHeaders {
+		if v := res.Header.Values(name); len(v) > 0 {
+			header[name] = v
+		}
+	}
+	result := "ok"
+	if res.StatusCode >= 400 {
+		result = "error"
+	}
+	step(traceStep{Step: "origin", Result: result, Status: res.StatusCode, Header: header,
+		Detail: fmt.Sprintf("%s in %s", res.Proto, time.Since(begin).Round(time.Millisecond))})
+	return resp
+}
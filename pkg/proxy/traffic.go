@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	trafficPathDepth    int
+	trafficWindow       time.Duration
+	trafficMetricLabels int
+)
+
+func init() {
+	CommandLine.IntVar(&trafficPathDepth, "traffic-path-depth", 1, "number of leading path segments traffic is accounted to")
+	CommandLine.DurationVar(&trafficWindow, "traffic-window", time.Hour, "window the top traffic consumers of the admin api are counted over")
+	CommandLine.IntVar(&trafficMetricLabels, "traffic-metric-labels", 50, "max path prefixes and clients labelling the traffic metrics, later ones are counted as other")
+	adminMux.Handle("GET /api/traffic", adminAuth(adminTraffic))
+}
+
+var (
+	trafficPrefixBytes = newCounterVec("openlist_proxy_traffic_prefix_bytes_total", "Response bytes by path prefix of -traffic-path-depth segments.", "prefix")
+	trafficClientBytes = newCounterVec("openlist_proxy_traffic_client_bytes_total", "Response bytes by client identity, api key or ip.", "client")
+)
+
+// windowBuckets is the number of buckets a windowCounter divides its window into.
+const windowBuckets = 60
+
+// windowKeys bounds the keys of a bucket of a windowCounter.
+const windowKeys = 1024
+
+// windowCounter sums values by key over a sliding window, in buckets of a fraction of it.
+// Like topPathCounter, a bucket keeps the largest keys: a new key of a full bucket takes the
+// place and the count of its smallest one.
+type windowCounter struct {
+	mu      sync.Mutex
+	size    time.Duration
+	buckets [windowBuckets]windowBucket
+}
+
+type windowBucket struct {
+	index  int64
+	counts map[string]int64
+}
+
+// keyCount is the sum of a key over a window.
+type keyCount struct {
+	Key   string `json:"key"`
+	Bytes int64  `json:"bytes"`
+}
+
+func newWindowCounter(window time.Duration) *windowCounter {
+	return &windowCounter{size: max(window/windowBuckets, time.Second)}
+}
+
+func (c *windowCounter) add(key string, n int64) {
+	index := time.Now().UnixNano() / int64(c.size)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := &c.buckets[index%windowBuckets]
+	if b.index != index || b.counts == nil {
+		*b = windowBucket{index: index, counts: map[string]int64{}}
+	}
+	if _, ok := b.counts[key]; !ok && len(b.counts) >= windowKeys {
+		least, leastCount := "", int64(-1)
+		for k, v := range b.counts {
+			if leastCount < 0 || v < leastCount {
+				least, leastCount = k, v
+			}
+		}
+		delete(b.counts, least)
+		b.counts[key] = leastCount
+	}
+	b.counts[key] += n
+}
+
+// top returns the n keys with the largest sums over the window and the sum of all keys.
+func (c *windowCounter) top(n int) ([]keyCount, int64) {
+	oldest := time.Now().UnixNano()/int64(c.size) - windowBuckets + 1
+	sums := map[string]int64{}
+	var total int64
+	c.mu.Lock()
+	for _, b := range c.buckets {
+		if b.index < oldest {
+			continue
+		}
+		for k, v := range b.counts {
+			sums[k] += v
+			total += v
+		}
+	}
+	c.mu.Unlock()
+	list := make([]keyCount, 0, len(sums))
+	for k, v := range sums {
+		list = append(list, keyCount{Key: k, Bytes: v})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Bytes > list[j].Bytes })
+	return list[:min(n, len(list))], total
+}
+
+// labelLimiter bounds the values of a metric label to the first ones seen.
+type labelLimiter struct {
+	mu     sync.Mutex
+	values map[string]bool
+}
+
+func (l *labelLimiter) value(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.values[v] {
+		if len(l.values) >= trafficMetricLabels {
+			return "other"
+		}
+		if l.values == nil {
+			l.values = map[string]bool{}
+		}
+		l.values[v] = true
+	}
+	return v
+}
+
+var (
+	trafficByPrefix = newWindowCounter(time.Hour)
+	trafficByClient = newWindowCounter(time.Hour)
+	prefixLabels    labelLimiter
+	clientLabels    labelLimiter
+)
+
+func setupTraffic() error {
+	if trafficWindow <= 0 {
+		return fmt.Errorf("invalid -traffic-window %s, expected a positive duration", trafficWindow)
+	}
+	trafficByPrefix = newWindowCounter(trafficWindow)
+	trafficByClient = newWindowCounter(trafficWindow)
+	return nil
+}
+
+// trafficPrefix is the prefix of -traffic-path-depth segments of p traffic is accounted to.
+func trafficPrefix(p string) string {
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	return "/" + strings.Join(segments[:min(trafficPathDepth, len(segments))], "/")
+}
+
+// accountTraffic accounts the response bytes of r to its path prefix and client.
+func accountTraffic(r *http.Request, bytes int64) {
+	if bytes == 0 {
+		return
+	}
+	prefix, client := trafficPrefix(r.URL.Path), clientIdentity(r)
+	trafficByPrefix.add(prefix, bytes)
+	trafficByClient.add(client, bytes)
+	trafficPrefixBytes.add(float64(bytes), prefixLabels.value(prefix))
+	trafficClientBytes.add(float64(bytes), clientLabels.value(client))
+}
+
+type trafficResp struct {
+	// Window is the length in seconds the bytes were counted over.
+	Window int64      `json:"window"`
+	By     string     `json:"by"`
+	Total  int64      `json:"total"`
+	Top    []keyCount `json:"top"`
+}
+
+func adminTraffic(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = 10
+	}
+	resp := trafficResp{Window: int64(trafficWindow.Seconds()), By: r.URL.Query().Get("by")}
+	switch resp.By {
+	case "", "prefix":
+		resp.By = "prefix"
+		resp.Top, resp.Total = trafficByPrefix.top(n)
+	case "client":
+		resp.Top, resp.Total = trafficByClient.top(n)
+	default:
+		errorResponseWithStatus(w, http.StatusBadRequest, 400, "invalid by, expected prefix or client")
+		return
+	}
+	jsonResponse(w, resp)
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	transfersTotal = newCounterVec("openlist_proxy_transfers_total", "Proxied body transfers, by outcome (completed, aborted by the client, upstream_error).", "outcome")
+	transferBytes  = newCounterVec("openlist_proxy_transfer_bytes_total", "Bytes sent to clients by proxied transfers, by outcome.", "outcome")
+)
+
+// clientWriter remembers whether writing to the client failed, to tell client aborts
+// from upstream read errors after a copy.
+type clientWriter struct {
+	w    io.Writer
+	err  error
+	sent *atomic.Int64
+}
+
+func (cw *clientWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.sent.Add(int64(n))
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// spliceFrom copies a spliced body to the client. The kernel copies between the sockets
+// without telling which of them failed, so a failure counts as the client's while the
+// origin connection still works.
+func (cw *clientWriter) spliceFrom(body *spliceBody) (int64, error) {
+	n, err := body.WriteTo(cw.w)
+	cw.sent.Add(n)
+	if err != nil && cw.err == nil && !errors.Is(err, io.ErrUnexpectedEOF) && body.originAlive() {
+		cw.err = err
+	}
+	return n, err
+}
+
+// copyBody streams the origin body to the client and records the outcome of the transfer.
+// The response header is already sent, so errors can only be logged.
+func copyBody(w http.ResponseWriter, r *http.Request, res *http.Response) {
+	t := trackTransfer(r, res)
+	defer t.untrack()
+	class, perTransfer := transferBandwidth(r)
+	if class != "" {
+		bandwidthClassTransfers.inc(class)
+	}
+	cw := &clientWriter{w: throttle(r.Context(), w, perTransfer), sent: &t.sent}
+	start := time.Now()
+	publishEvent(newDownloadEvent("start", r, res))
+	var n int64
+	var err error
+	if body, ok := res.Body.(*spliceBody); ok {
+		n, err = cw.spliceFrom(body)
+	} else {
+		buf := copyBuffers.Get().(*[]byte)
+		defer copyBuffers.Put(buf)
+		n, err = io.CopyBuffer(cw, res.Body, *buf)
+	}
+	outcome := "completed"
+	switch {
+	case cw.err != nil || r.Context().Err() != nil || t.killed.Load():
+		outcome = "aborted"
+	case err != nil:
+		outcome = "upstream_error"
+		logf(levelWarn, "failed to read from upstream for %s: %s", r.URL.Path, err.Error())
+	}
+	if outcome == "completed" && perTransfer == 0 {
+		// capped transfers measure the cap, not the upstream
+		throughputs.record(res.Request.URL.Host, n, time.Since(start))
+	}
+	getRequestInfo(r).outcome = outcome
+	event := newDownloadEvent("complete", r, res)
+	if outcome != "completed" {
+		event.Event, event.Outcome = "fail", outcome
+	}
+	event.Bytes, event.Duration = n, time.Since(start).Milliseconds()
+	publishEvent(event)
+	transfersTotal.inc(outcome)
+	transferBytes.add(float64(n), outcome)
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	upstreamMaxIdlePerHost  int
+	upstreamMaxConnsPerHost int
+	apiMaxIdlePerHost       int
+	apiMaxConnsPerHost      int
+	upstreamIdleTimeout     time.Duration
+	upstreamDialTimeout     time.Duration
+	upstreamTLSTimeout      time.Duration
+	upstreamHeaderTimeout   time.Duration
+	upstreamKeepAlive       time.Duration
+	upstreamHTTP2           bool
+	apiTimeout              time.Duration
+)
+
+func init() {
+	CommandLine.IntVar(&upstreamMaxIdlePerHost, "upstream-max-idle-per-host", 64, "idle connections kept open to each origin host for reuse")
+	CommandLine.IntVar(&upstreamMaxConnsPerHost, "upstream-max-conns-per-host", 0, "max connections to each origin host, further requests wait for one to free up, 0 is unlimited")
+	CommandLine.IntVar(&apiMaxIdlePerHost, "api-max-idle-per-host", 16, "idle connections kept open to each openlist backend and control endpoint for reuse")
+	CommandLine.IntVar(&apiMaxConnsPerHost, "api-max-conns-per-host", 0, "max connections to each openlist backend and control endpoint, further calls wait for one to free up, 0 is unlimited")
+	CommandLine.DurationVar(&upstreamIdleTimeout, "upstream-idle-timeout", 90*time.Second, "how long an idle upstream connection is kept open")
+	CommandLine.DurationVar(&upstreamDialTimeout, "upstream-dial-timeout", 10*time.Second, "timeout of connecting to an upstream host")
+	CommandLine.DurationVar(&upstreamTLSTimeout, "upstream-tls-timeout", 10*time.Second, "timeout of the tls handshake with an upstream host")
+	CommandLine.DurationVar(&upstreamHeaderTimeout, "upstream-header-timeout", 30*time.Second, "how long to wait for the response header of an origin once the request is sent, 0 waits forever")
+	CommandLine.DurationVar(&upstreamKeepAlive, "upstream-keepalive", 30*time.Second, "interval of tcp keep-alive probes on upstream connections, 0 disables them")
+	CommandLine.BoolVar(&upstreamHTTP2, "upstream-http2", true, "use http/2 with upstream hosts offering it over tls")
+	CommandLine.DurationVar(&apiTimeout, "api-timeout", 30*time.Second, "timeout of whole requests to the openlist api and other control endpoints such as vault, oidc and webhooks")
+}
+
+// HttpClient fetches file contents from origins. It has no overall timeout since transfers
+// may take hours, only the connection and response header are bounded.
+var HttpClient = &http.Client{}
+
+// apiClient calls the openlist api and other small json endpoints, on its own connection
+// pool so they never wait behind busy origin connections.
+var apiClient = &http.Client{}
+
+func newUpstreamTransport(proxy func(*http.Request) (*url.URL, error), maxIdlePerHost, maxConnsPerHost int) *http.Transport {
+	keepAlive := upstreamKeepAlive
+	if keepAlive == 0 {
+		keepAlive = -1
+	}
+	dialer := &net.Dialer{Timeout: upstreamDialTimeout, KeepAlive: keepAlive, Resolver: upstreamResolver}
+	dial := overrideHosts(dialer)
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		DialTLSContext:        insecureTLSDialer(dial),
+		ForceAttemptHTTP2:     upstreamHTTP2,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		MaxConnsPerHost:       maxConnsPerHost,
+		IdleConnTimeout:       upstreamIdleTimeout,
+		TLSHandshakeTimeout:   upstreamTLSTimeout,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       upstreamTLSConfig.Clone(),
+	}
+}
+
+// setupTransport configures the upstream clients, before anything talks to a backend.
+func setupTransport() error {
+	if err := setupUpstreamTLS(); err != nil {
+		return err
+	}
+	if err := setupDNS(); err != nil {
+		return err
+	}
+	var err error
+	if originProxy, err = proxyFunc("upstream-proxy", upstreamProxy); err != nil {
+		return err
+	}
+	api, err := proxyFunc("api-proxy", apiProxy)
+	if err != nil {
+		return err
+	}
+	if upstreamMaxIdlePerHost < 0 || upstreamMaxConnsPerHost < 0 || apiMaxIdlePerHost < 0 || apiMaxConnsPerHost < 0 {
+		return errors.New("the idle and max connections of -upstream-max-*-per-host and -api-max-*-per-host cannot be negative")
+	}
+	origin := newUpstreamTransport(originProxy, upstreamMaxIdlePerHost, upstreamMaxConnsPerHost)
+	origin.ResponseHeaderTimeout = upstreamHeaderTimeout
+	HttpClient.Transport = origin
+	apiClient.Transport = newUpstreamTransport(api, apiMaxIdlePerHost, apiMaxConnsPerHost)
+	apiClient.Timeout = apiTimeout
+	return nil
+}
@@ -0,0 +1,139 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeOnSignal starts the executable on disk again on SIGUSR2, passing it the listening
+// sockets, and stops gracefully once it serves. Connections keep being accepted throughout:
+// until the new process takes them, they wait in the sockets both share.
+func upgradeOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	go func() {
+		for range ch {
+			auditEvent(nil, "upgrade", 0, "SIGUSR2")
+			pid, err := upgrade()
+			if err != nil {
+				logf(levelError, "upgrade failed, still serving: %s", err.Error())
+				continue
+			}
+			logf(levelInfo, "upgraded to process %d, finishing the running transfers", pid)
+			signal.Stop(ch)
+			requestStop()
+			return
+		}
+	}()
+}
+
+// upgrade starts the new process and returns its pid once it serves. The sockets of the
+// admin api and the other servers are closed then, the client facing ones are left to the
+// graceful stop.
+func upgrade() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	handoff.Lock()
+	sockets := slices.Clone(handoff.sockets)
+	handoff.Unlock()
+	names := make([]string, 0, len(sockets))
+	files := make([]*os.File, 0, len(sockets)+1)
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, s := range sockets {
+		f, err := s.socket.File()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", s.name, err)
+		}
+		names = append(names, s.name)
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	files = append(files, w)
+
+	// bolt allows one process at a time
+	releaseStatsDB()
+	releaseStateStore()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = upgradeEnv(names)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		reopenStatsDB()
+		reopenStateStore()
+		return 0, err
+	}
+	_ = w.Close()
+	ready := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(r, make([]byte, len("ready\n")))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errors.New("the new process exited before serving")
+		}
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("the new process does not serve after %s", upgradeTimeout)
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		reopenStatsDB()
+		reopenStateStore()
+		return 0, err
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+	for _, s := range sockets {
+		if ln, ok := s.socket.(*net.UnixListener); ok {
+			// the socket file is the new process's now
+			ln.SetUnlinkOnClose(false)
+		}
+		if s.close != nil {
+			_ = s.close()
+		}
+	}
+	sdNotify("MAINPID=" + strconv.Itoa(cmd.Process.Pid))
+	return cmd.Process.Pid, nil
+}
+
+// upgradeEnv is the environment of the new process, which is the main process of a systemd
+// unit once it took over.
+func upgradeEnv(names []string) []string {
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		switch k {
+		case upgradeFdsEnv, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID":
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env, upgradeFdsEnv+"="+strings.Join(names, "\n"))
+}
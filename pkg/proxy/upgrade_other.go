@@ -0,0 +1,6 @@
+//go:build windows || plan9
+
+package proxy
+
+// upgradeOnSignal does nothing, upgrades pass sockets to a new process by file descriptors.
+func upgradeOnSignal() {}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+var (
+	uploadEnabled bool
+	uploadMaxSize byteSize
+)
+
+func init() {
+	CommandLine.BoolVar(&uploadEnabled, "upload", false, "accept PUT uploads with upload signs or api keys, streamed to the /api/fs/put api of the openlist serving the path")
+	CommandLine.Var(&uploadMaxSize, "upload-max-size", "max `size` of an upload, 0 is unlimited")
+}
+
+// uploadSignPrefix is signed along with the path of uploads, so download links can't overwrite
+// their file. Upload signs are issued by the sign api with "upload": true.
+const uploadSignPrefix = "upload:"
+
+// uploadHeaders are passed on from the client to /api/fs/put.
+var uploadHeaders = []string{"Content-Type", "Last-Modified", "As-Task", "Overwrite", "X-File-Md5", "X-File-Sha1", "X-File-Sha256"}
+
+// serveUpload streams a PUT body to openlist. -disable-sign does not open uploads.
+func serveUpload(w http.ResponseWriter, r *http.Request) {
+	req, err := parseDownloadRequest(r.URL.Path, r.URL.RawQuery, "")
+	if err != nil {
+		errorResponse(w, 400, err.Error())
+		return
+	}
+	filePath := tenantPath(r, req.Path)
+	if k := getRequestInfo(r).apiKey; k != nil {
+		if !k.allows(filePath) {
+			errorResponse(w, 403, "api key does not grant access to this path")
+			return
+		}
+	} else if code, err := verifySign(uploadSignPrefix+filePath, req.Sign); err != nil {
+		errorResponse(w, code, err.Error())
+		return
+	}
+	if r.ContentLength < 0 {
+		errorResponse(w, 411, "uploads need a Content-Length")
+		return
+	}
+	if uploadMaxSize > 0 && r.ContentLength > int64(uploadMaxSize) {
+		errorResponse(w, 413, "upload too large")
+		return
+	}
+	b, p, err := uploadBackend(filePath)
+	if err != nil {
+		apiErrorResponse(w, err)
+		return
+	}
+	t := trackUpload(r, b.address)
+	defer t.untrack()
+	body := &countingReader{r: r.Body, n: &t.sent}
+	put, _ := http.NewRequestWithContext(r.Context(), http.MethodPut, b.address+"/api/fs/put", body)
+	put.ContentLength = r.ContentLength
+	put.Header.Set("Authorization", b.token)
+	put.Header.Set("File-Path", url.PathEscape(p))
+	put.Header.Set(requestIDHeader, getRequestInfo(r).id)
+	for _, h := range uploadHeaders {
+		if v := r.Header.Get(h); v != "" {
+			put.Header.Set(h, v)
+		}
+	}
+	logf(levelInfo, "upload: %s (%d bytes) to %s", filePath, r.ContentLength, b.address)
+	// no overall timeout, the body may take hours to arrive
+	res, err := (&http.Client{Transport: apiClient.Transport}).Do(put)
+	if err != nil {
+		if t.killed.Load() {
+			err = errors.New("upload killed")
+		}
+		errorResponse(w, 502, err.Error())
+		return
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	var resp apiResponse[any]
+	if err := decodeAPIResponse(res, &resp); err != nil {
+		errorResponse(w, 502, err.Error())
+		return
+	}
+	if resp.Code != 200 {
+		errorResponse(w, resp.Code, resp.Message)
+		return
+	}
+	jsonResponse(w, Result{Code: 200, Msg: "success"})
+}
+
+// uploadBackend picks the backend an upload of filePath goes to and the path to give it.
+// Unlike api calls it does not fail over, the body can only be sent once.
+func uploadBackend(filePath string) (backend, string, error) {
+	hs, token, p := backends, apiToken(), filePath
+	if rt, rp, ok := routeFor(filePath); ok {
+		hs, token, p = rt.backends, rt.Token, rp
+	} else if len(backends) == 0 {
+		return defaultBackend(), filePath, nil
+	}
+	up := healthyBackends(hs)
+	if len(up) == 0 {
+		return backend{}, "", errBackendsDown
+	}
+	return backend{address: up[0].address, token: token}, p, nil
+}
+
+// countingReader adds the bytes read to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
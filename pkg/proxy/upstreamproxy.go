@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+var (
+	upstreamProxy string
+	apiProxy      string
+)
+
+func init() {
+	CommandLine.StringVar(&upstreamProxy, "upstream-proxy", "", "`url` of an http, https, socks5 or socks5h proxy fetching origin downloads, "+
+		"empty uses HTTP_PROXY, HTTPS_PROXY and NO_PROXY, direct ignores them")
+	CommandLine.StringVar(&apiProxy, "api-proxy", "", "`url` of the proxy calling the openlist api and other control endpoints, like -upstream-proxy")
+}
+
+// originProxy picks the proxy of origin requests, nil connects directly. Dedicated splice
+// connections consult it too.
+var originProxy func(*http.Request) (*url.URL, error)
+
+// proxyFunc returns the Transport.Proxy of a -upstream-proxy style setting. NO_PROXY is
+// honored by explicit proxies as well.
+func proxyFunc(name, spec string) (func(*http.Request) (*url.URL, error), error) {
+	switch spec {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return nil, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -%s %q", name, spec)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q of -%s, expected http, https, socks5 or socks5h", u.Scheme, name)
+	}
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	f := (&httpproxy.Config{HTTPProxy: spec, HTTPSProxy: spec, NoProxy: noProxy}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return f(req.URL)
+	}, nil
+}
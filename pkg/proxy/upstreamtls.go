@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	upstreamCAs   stringList
+	insecureHosts stringList
+)
+
+func init() {
+	CommandLine.Var(&upstreamCAs, "upstream-ca", "pem `file` of CAs trusted for openlist backends and origins besides the system roots, repeatable")
+	CommandLine.Var(&insecureHosts, "insecure-hosts", "upstream host `pattern` such as *.lan or 10.0.0.5 whose certificate is not verified when connecting directly, repeatable")
+}
+
+// upstreamTLSConfig is the client tls config of backends and origins, nil keeps the defaults.
+var upstreamTLSConfig *tls.Config
+
+func setupUpstreamTLS() error {
+	upstreamTLSConfig = nil
+	if len(upstreamCAs) == 0 && len(insecureHosts) == 0 {
+		return nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, f := range upstreamCAs {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return errors.New("no certificates found in " + f)
+		}
+	}
+	for _, p := range insecureHosts {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid -insecure-hosts pattern %q", p)
+		}
+	}
+	upstreamTLSConfig = &tls.Config{RootCAs: pool}
+	return nil
+}
+
+// insecureTLSDialer returns the DialTLSContext of transports connecting with dial, which
+// skips the verification of -insecure-hosts, nil when there are none. Tls over a connect
+// tunnel of -upstream-proxy is done by the transport and always verified.
+func insecureTLSDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(insecureHosts) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := upstreamTLSConfig.Clone()
+		cfg.ServerName = host
+		cfg.InsecureSkipVerify = matchHost(insecureHosts, strings.ToLower(host))
+		if upstreamHTTP2 {
+			cfg.NextProtos = []string{"h2", "http/1.1"}
+		}
+		if upstreamTLSTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, upstreamTLSTimeout)
+			defer cancel()
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+var uaAllow, uaDeny stringList
+
+func init() {
+	CommandLine.Var(&uaAllow, "ua-allow", "only allow user agents matching this case-insensitive regexp, repeatable")
+	CommandLine.Var(&uaDeny, "ua-deny", "reject user agents matching this case-insensitive regexp, repeatable, takes precedence over -ua-allow")
+}
+
+type uaRule struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+var (
+	uaAllowRules, uaDenyRules []uaRule
+
+	uaRuleMatches = newCounterVec("openlist_proxy_user_agent_rule_matches_total", "Requests matched by user agent rules, by rule and action.", "rule", "action")
+	uaRejected    = newCounterVec("openlist_proxy_user_agent_rejected_total", "Requests rejected because their user agent matched no -ua-allow rule.")
+)
+
+func compileUARules(patterns []string) ([]uaRule, error) {
+	rules := make([]uaRule, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user agent pattern %q: %w", p, err)
+		}
+		rules = append(rules, uaRule{pattern: p, re: re})
+	}
+	return rules, nil
+}
+
+func uaEnabled() bool {
+	return len(uaAllow) > 0 || len(uaDeny) > 0
+}
+
+func setupUserAgentRules() error {
+	var err error
+	if uaAllowRules, err = compileUARules(uaAllow); err != nil {
+		return err
+	}
+	uaDenyRules, err = compileUARules(uaDeny)
+	return err
+}
+
+func matchUARule(rules []uaRule, ua string) (uaRule, bool) {
+	for _, rule := range rules {
+		if rule.re.MatchString(ua) {
+			return rule, true
+		}
+	}
+	return uaRule{}, false
+}
+
+// userAgentAllowed reports whether ua passes the rules, counting the rule that decided.
+func userAgentAllowed(ua string) bool {
+	if rule, ok := matchUARule(uaDenyRules, ua); ok {
+		uaRuleMatches.inc(rule.pattern, "deny")
+		return false
+	}
+	if len(uaAllowRules) == 0 {
+		return true
+	}
+	if rule, ok := matchUARule(uaAllowRules, ua); ok {
+		uaRuleMatches.inc(rule.pattern, "allow")
+		return true
+	}
+	uaRejected.inc()
+	return false
+}
+
+func userAgentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !userAgentAllowed(r.UserAgent()) {
+			errorResponseWithStatus(w, http.StatusForbidden, http.StatusForbidden, "user agent not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	vaultAddress     string
+	vaultTokenFile   string
+	vaultRoleID      string
+	vaultTokenSecret string
+	vaultTLSSecret   string
+	vaultRefresh     time.Duration
+)
+
+func init() {
+	CommandLine.StringVar(&vaultAddress, "vault-address", os.Getenv("VAULT_ADDR"), "vault address secrets are read from, defaults to $VAULT_ADDR")
+	CommandLine.StringVar(&vaultTokenFile, "vault-token-file", "", "file with the vault token, defaults to $VAULT_TOKEN")
+	CommandLine.StringVar(&vaultRoleID, "vault-role-id", "", "log in to vault with this approle role id and the secret id in $VAULT_SECRET_ID instead of a token")
+	CommandLine.StringVar(&vaultTokenSecret, "vault-token-secret", "", "vault kv secret holding the openlist token as `path#field`, e.g. secret/data/openlist#token")
+	CommandLine.StringVar(&vaultTLSSecret, "vault-tls-secret", "", "vault kv secret `path` with pem fields cert and key served with -https instead of -cert and -key")
+	CommandLine.DurationVar(&vaultRefresh, "vault-refresh", 10*time.Minute, "how often vault secrets are re-read and the vault token renewed")
+}
+
+func vaultEnabled() bool {
+	return vaultTokenSecret != "" || vaultTLSSecret != ""
+}
+
+// vaultClient holds the vault login, the token is replaced on re-login.
+type vaultClient struct {
+	mu        sync.Mutex
+	token     string
+	renewable bool
+}
+
+var vault = &vaultClient{}
+
+// vaultCert is the tls certificate read from -vault-tls-secret.
+var vaultCert atomic.Pointer[tls.Certificate]
+
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+type vaultResponse struct {
+	Data   map[string]any `json:"data"`
+	Auth   *vaultAuth     `json:"auth"`
+	Errors []string       `json:"errors"`
+}
+
+func (vc *vaultClient) do(method, apiPath string, body any) (*vaultResponse, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, _ := http.NewRequest(method, strings.TrimSuffix(vaultAddress, "/")+"/v1/"+apiPath, reader)
+	vc.mu.Lock()
+	if vc.token != "" {
+		req.Header.Set("X-Vault-Token", vc.token)
+	}
+	vc.mu.Unlock()
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	var resp vaultResponse
+	if err := json.NewDecoder(http.MaxBytesReader(nil, res.Body, maxAPIResponseSize)).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("vault responded %s", res.Status)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault responded %s: %s", res.Status, strings.Join(resp.Errors, ", "))
+	}
+	return &resp, nil
+}
+
+// login obtains a vault token from the configured source.
+func (vc *vaultClient) login() error {
+	if vaultRoleID != "" {
+		resp, err := vc.do("POST", "auth/approle/login", Json{"role_id": vaultRoleID, "secret_id": os.Getenv("VAULT_SECRET_ID")})
+		if err != nil {
+			return err
+		}
+		if resp.Auth == nil || resp.Auth.ClientToken == "" {
+			return errors.New("vault approle login returned no token")
+		}
+		vc.mu.Lock()
+		vc.token, vc.renewable = resp.Auth.ClientToken, resp.Auth.Renewable
+		vc.mu.Unlock()
+		return nil
+	}
+	t := os.Getenv("VAULT_TOKEN")
+	if vaultTokenFile != "" {
+		b, err := os.ReadFile(vaultTokenFile)
+		if err != nil {
+			return err
+		}
+		t = strings.TrimSpace(string(b))
+	}
+	if t == "" {
+		return errors.New("no vault token, set $VAULT_TOKEN, -vault-token-file or -vault-role-id")
+	}
+	vc.mu.Lock()
+	vc.token, vc.renewable = t, true
+	vc.mu.Unlock()
+	return nil
+}
+
+// renew extends the lease of the vault token, logging in again when that fails.
+func (vc *vaultClient) renew() error {
+	vc.mu.Lock()
+	renewable := vc.renewable
+	vc.mu.Unlock()
+	if renewable {
+		if _, err := vc.do("POST", "auth/token/renew-self", Json{}); err == nil {
+			return nil
+		}
+	}
+	return vc.login()
+}
+
+// readSecret returns the fields of a kv secret, for both kv version 1 and 2 mounts.
+func (vc *vaultClient) readSecret(secretPath string) (map[string]any, error) {
+	resp, err := vc.do("GET", strings.TrimPrefix(secretPath, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	if inner, ok := resp.Data["data"].(map[string]any); ok {
+		if _, v2 := resp.Data["metadata"]; v2 {
+			return inner, nil
+		}
+	}
+	return resp.Data, nil
+}
+
+func secretField(fields map[string]any, secretPath, name string) (string, error) {
+	v, ok := fields[name].(string)
+	if !ok || v == "" {
+		return "", fmt.Errorf("vault secret %s has no field %q", secretPath, name)
+	}
+	return v, nil
+}
+
+// loadVaultSecrets reads the secrets from vault and applies them.
+func loadVaultSecrets() error {
+	if vaultTokenSecret != "" {
+		secretPath, field, ok := strings.Cut(vaultTokenSecret, "#")
+		if !ok {
+			return errors.New("-vault-token-secret must be path#field")
+		}
+		fields, err := vault.readSecret(secretPath)
+		if err != nil {
+			return err
+		}
+		t, err := secretField(fields, secretPath, field)
+		if err != nil {
+			return err
+		}
+		if updateToken(t) {
+			fmt.Println("openlist token loaded from vault")
+		}
+	}
+	if vaultTLSSecret != "" {
+		fields, err := vault.readSecret(vaultTLSSecret)
+		if err != nil {
+			return err
+		}
+		certPEM, err := secretField(fields, vaultTLSSecret, "cert")
+		if err != nil {
+			return err
+		}
+		keyPEM, err := secretField(fields, vaultTLSSecret, "key")
+		if err != nil {
+			return err
+		}
+		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			return fmt.Errorf("vault secret %s: %w", vaultTLSSecret, err)
+		}
+		vaultCert.Store(&cert)
+	}
+	return nil
+}
+
+// setupVault logs in, reads the secrets and keeps both fresh.
+func setupVault() error {
+	if vaultAddress == "" {
+		return errors.New("vault secrets need -vault-address or $VAULT_ADDR")
+	}
+	if vaultTokenSecret != "" && (token != "" || tokenFile != "") {
+		return errors.New("-vault-token-secret is exclusive with -token and -token-file")
+	}
+	if vaultTLSSecret != "" && !https {
+		return errors.New("-vault-tls-secret needs -https")
+	}
+	if err := vault.login(); err != nil {
+		return err
+	}
+	if err := loadVaultSecrets(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(vaultRefresh) {
+			if err := vault.renew(); err != nil {
+				noticef(levelError, "failed to renew vault token: %s", err.Error())
+				continue
+			}
+			if err := loadVaultSecrets(); err != nil {
+				noticef(levelError, "failed to refresh vault secrets, keeping the previous ones: %s", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+func vaultCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return vaultCert.Load(), nil
+}
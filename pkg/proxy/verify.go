@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/OpenListTeam/OpenList/v4/pkg/sign"
+)
+
+func init() {
+	commands["verify"] = command{
+		usage: "verify -url https://dl.example.com -path /test.bin checks a running deployment end-to-end",
+		run:   verifyDeployment,
+	}
+}
+
+type verifyCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+type verifier struct {
+	base     string
+	path     string
+	signer   sign.Sign
+	unsigned bool
+	client   *http.Client
+
+	size      int64
+	etag      string
+	head      []byte
+	tailHash  []byte
+	tailStart int64
+}
+
+func verifyDeployment(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	base := fs.String("url", "", "base url of the deployment, e.g. https://dl.example.com")
+	path := fs.String("path", "", "path of an existing test file, at least a few KB large")
+	key := fs.String("sign-token", signingKey(), "key used to sign requests, defaults to -sign-key or -token")
+	unsigned := fs.Bool("unsigned", false, "the deployment runs with -disable-sign")
+	timeout := fs.Duration("timeout", time.Minute, "timeout of each request")
+	_ = fs.Parse(args)
+	if *base == "" || !strings.HasPrefix(*path, "/") {
+		fs.Usage()
+		return errors.New("-url and an absolute -path are required")
+	}
+	v := &verifier{
+		base:     strings.TrimSuffix(*base, "/"),
+		path:     *path,
+		signer:   sign.NewHMACSign([]byte(*key)),
+		unsigned: *unsigned,
+		client:   &http.Client{Timeout: *timeout},
+	}
+	checks := []verifyCheck{
+		{"reject unsigned", v.checkUnsigned},
+		{"reject bad sign", v.checkBadSign},
+		{"full download", v.checkFull},
+		{"head", v.checkHead},
+		{"range", v.checkRange},
+		{"resume", v.checkResume},
+		{"cors preflight", v.checkPreflight},
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	failed := 0
+	for _, c := range checks {
+		detail, err := c.run()
+		result := "pass"
+		if errors.Is(err, errSkipped) {
+			result = "skip"
+		} else if err != nil {
+			result, detail = "FAIL", err.Error()
+			failed++
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", c.name, result, detail)
+	}
+	_ = tw.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+var errSkipped = errors.New("skipped")
+
+// url returns the test file url, signed for an hour if signed is set.
+func (v *verifier) url(signed bool) string {
+	u := v.base + escapePath(v.path)
+	if signed && !v.unsigned {
+		u += "?sign=" + url.QueryEscape(v.signer.Sign(v.path, time.Now().Add(time.Hour).Unix()))
+	}
+	return u
+}
+
+func (v *verifier) do(method, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	return v.client.Do(req)
+}
+
+// rejected reports whether res is an error response of the proxy with one of the codes.
+func rejected(res *http.Response, codes ...int) bool {
+	for _, code := range codes {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+	var result Result
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if json.Unmarshal(b, &result) != nil {
+		return false
+	}
+	for _, code := range codes {
+		if result.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *verifier) expectRejected(url string) (string, error) {
+	if v.unsigned {
+		return "signatures disabled", errSkipped
+	}
+	res, err := v.do("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if !rejected(res, http.StatusUnauthorized, http.StatusForbidden) {
+		return "", fmt.Errorf("expected a 401 error, got status %s", res.Status)
+	}
+	return "rejected", nil
+}
+
+func (v *verifier) checkUnsigned() (string, error) {
+	return v.expectRejected(v.url(false))
+}
+
+func (v *verifier) checkBadSign() (string, error) {
+	return v.expectRejected(v.url(true) + "x")
+}
+
+func (v *verifier) checkFull() (string, error) {
+	res, err := v.do("GET", v.url(true), nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("expected 200, got %s", res.Status)
+	}
+	head := &bytes.Buffer{}
+	n, err := io.Copy(&limitedBuffer{buf: head, max: 100}, res.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading body: %w", err)
+	}
+	if cl := res.ContentLength; cl >= 0 && cl != n {
+		return "", fmt.Errorf("content-length %d but received %d bytes", cl, n)
+	}
+	if n < 200 {
+		return "", fmt.Errorf("test file has %d bytes, use one with at least 200", n)
+	}
+	v.size, v.etag, v.head = n, res.Header.Get("ETag"), head.Bytes()
+
+	// fetch again to hash the second half used by the resume check
+	v.tailStart = n / 2
+	res2, err := v.do("GET", v.url(true), nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = res2.Body.Close()
+	}()
+	tail := &hashFrom{offset: v.tailStart, h: sha256.New()}
+	if _, err := io.Copy(tail, res2.Body); err != nil {
+		return "", fmt.Errorf("reading body: %w", err)
+	}
+	v.tailHash = tail.h.Sum(nil)
+	return fmt.Sprintf("%d bytes, accept-ranges %q", n, res.Header.Get("Accept-Ranges")), nil
+}
+
+func (v *verifier) checkHead() (string, error) {
+	if v.size == 0 {
+		return "full download failed", errSkipped
+	}
+	res, err := v.do("HEAD", v.url(true), nil)
+	if err != nil {
+		return "", err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("expected 200, got %s", res.Status)
+	}
+	if res.ContentLength != v.size {
+		return "", fmt.Errorf("content-length %d, expected %d", res.ContentLength, v.size)
+	}
+	return "content-length " + strconv.FormatInt(res.ContentLength, 10), nil
+}
+
+func (v *verifier) checkRange() (string, error) {
+	if v.size == 0 {
+		return "full download failed", errSkipped
+	}
+	res, err := v.do("GET", v.url(true), http.Header{"Range": {"bytes=0-99"}})
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("expected 206, got %s", res.Status)
+	}
+	want := fmt.Sprintf("bytes 0-99/%d", v.size)
+	if cr := res.Header.Get("Content-Range"); cr != want {
+		return "", fmt.Errorf("content-range %q, expected %q", cr, want)
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(b, v.head) {
+		return "", errors.New("range body differs from the full download")
+	}
+	return want, nil
+}
+
+func (v *verifier) checkResume() (string, error) {
+	if v.size == 0 {
+		return "full download failed", errSkipped
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", v.tailStart)}}
+	if v.etag != "" {
+		header.Set("If-Range", v.etag)
+	}
+	res, err := v.do("GET", v.url(true), header)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("expected 206, got %s", res.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, res.Body); err != nil {
+		return "", err
+	}
+	if !bytes.Equal(h.Sum(nil), v.tailHash) {
+		return "", errors.New("resumed body differs from the full download")
+	}
+	detail := fmt.Sprintf("from byte %d", v.tailStart)
+	if v.etag != "" {
+		detail += " with If-Range"
+	}
+	return detail, nil
+}
+
+func (v *verifier) checkPreflight() (string, error) {
+	res, err := v.do("OPTIONS", v.url(true), http.Header{
+		"Origin":                         {"https://example.com"},
+		"Access-Control-Request-Method":  {"GET"},
+		"Access-Control-Request-Headers": {"range"},
+	})
+	if err != nil {
+		return "", err
+	}
+	_ = res.Body.Close()
+	origin := res.Header.Get("Access-Control-Allow-Origin")
+	if origin != "*" && origin != "https://example.com" {
+		return "", fmt.Errorf("missing Access-Control-Allow-Origin, status %s", res.Status)
+	}
+	if !strings.Contains(strings.ToLower(res.Header.Get("Access-Control-Allow-Headers")), "range") {
+		return "", errors.New("range is not an allowed header")
+	}
+	return "allow-origin " + origin, nil
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	max int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if rest := l.max - l.buf.Len(); rest > 0 {
+		l.buf.Write(p[:min(rest, len(p))])
+	}
+	return len(p), nil
+}
+
+// hashFrom hashes the bytes written to it starting at offset.
+type hashFrom struct {
+	offset, pos int64
+	h           hash.Hash
+}
+
+func (hf *hashFrom) Write(p []byte) (int, error) {
+	n := len(p)
+	if skip := hf.offset - hf.pos; skip < int64(n) {
+		hf.h.Write(p[max(skip, 0):])
+	}
+	hf.pos += int64(n)
+	return n, nil
+}
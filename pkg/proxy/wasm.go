@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+var wasmPluginFlags stringList
+
+func init() {
+	CommandLine.Var(&wasmPluginFlags, "wasm-plugin", "`file.wasm[,memory=64M][,timeout=100ms][,instances=n]` webassembly filter inspecting requests and responses in a sandbox "+
+		"with the memory and time limits given, repeatable, see the README for its abi")
+}
+
+// A wasm plugin exports memory, alloc(size i32) i32 returning a buffer the input is written
+// to, and on_request and optionally on_response taking the (ptr, len) of json input and
+// returning the json output as ptr<<32 | len.
+
+// wasmRequest is the input of on_request.
+type wasmRequest struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Query   string              `json:"query"`
+	Host    string              `json:"host"`
+	IP      string              `json:"ip"`
+	Headers map[string][]string `json:"headers"`
+}
+
+// wasmRequestResult is the output of on_request. An empty action or continue goes on with
+// the request headers edited, deny and redirect answer it.
+type wasmRequestResult struct {
+	Action        string            `json:"action"`
+	Status        int               `json:"status"`
+	Message       string            `json:"message"`
+	Location      string            `json:"location"`
+	SetHeaders    map[string]string `json:"set_headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+}
+
+// wasmResponse is the input of on_response, about the origin response.
+type wasmResponse struct {
+	Path    string              `json:"path"`
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+}
+
+// wasmResponseResult is the output of on_response.
+type wasmResponseResult struct {
+	SetHeaders    map[string]string `json:"set_headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+}
+
+// wasmPlugin runs a compiled module in a runtime of its own, whose memory limit it is, with
+// a pool of instances since an instance runs one call at a time.
+type wasmPlugin struct {
+	name     string
+	runtime  wazero.Runtime
+	module   wazero.CompiledModule
+	timeout  time.Duration
+	response bool
+	pool     chan api.Module
+}
+
+func setupWASMPlugins() error {
+	for _, v := range wasmPluginFlags {
+		p, err := loadWASMPlugin(v)
+		if err != nil {
+			return fmt.Errorf("failed to load wasm plugin %s: %w", v, err)
+		}
+		AddHooks(p.hooks())
+	}
+	return nil
+}
+
+func loadWASMPlugin(v string) (*wasmPlugin, error) {
+	file, opts, _ := strings.Cut(v, ",")
+	memory, timeout, instances := int64(64<<20), 100*time.Millisecond, runtime.GOMAXPROCS(0)
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(opt, "=")
+		var err error
+		switch name {
+		case "memory":
+			memory, err = parseSize(value)
+		case "timeout":
+			timeout, err = time.ParseDuration(value)
+		case "instances":
+			instances, err = strconv.Atoi(value)
+			if err == nil && instances < 1 {
+				err = errors.New("expected at least 1")
+			}
+		default:
+			err = errors.New("unknown option, expected memory, timeout or instances")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", opt, err)
+		}
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	pages := max(uint32(memory>>16), 1)
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithMemoryLimitPages(pages).WithCloseOnContextDone(true))
+	// wasi without a filesystem, environment or network, for languages whose runtime needs it
+	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
+	compiled, err := rt.CompileModule(ctx, b)
+	if err != nil {
+		_ = rt.Close(ctx)
+		return nil, err
+	}
+	p := &wasmPlugin{name: filepath.Base(file), runtime: rt, module: compiled, timeout: timeout, pool: make(chan api.Module, instances)}
+	m, err := p.instantiate()
+	if err != nil {
+		_ = rt.Close(ctx)
+		return nil, err
+	}
+	for _, fn := range []string{"alloc", "on_request"} {
+		if m.ExportedFunction(fn) == nil {
+			_ = rt.Close(ctx)
+			return nil, fmt.Errorf("the module does not export %s", fn)
+		}
+	}
+	p.response = m.ExportedFunction("on_response") != nil
+	p.put(m)
+	return p, nil
+}
+
+func (p *wasmPlugin) instantiate() (api.Module, error) {
+	cfg := wazero.NewModuleConfig().WithName("").WithStderr(os.Stderr).
+		WithSysWalltime().WithSysNanotime().WithRandSource(rand.Reader).
+		// reactors built by go and tinygo initialize with _initialize instead of _start
+		WithStartFunctions("_initialize", "_start")
+	ctx, cancel := context.WithTimeout(context.Background(), max(p.timeout, time.Second))
+	defer cancel()
+	return p.runtime.InstantiateModule(ctx, p.module, cfg)
+}
+
+func (p *wasmPlugin) get() (api.Module, error) {
+	select {
+	case m := <-p.pool:
+		return m, nil
+	default:
+		return p.instantiate()
+	}
+}
+
+func (p *wasmPlugin) put(m api.Module) {
+	select {
+	case p.pool <- m:
+	default:
+		_ = m.Close(context.Background())
+	}
+}
+
+// call passes in to fn and decodes its output into out. An instance that failed, ran out
+// of memory or time is closed rather than reused.
+func (p *wasmPlugin) call(fn string, in, out any) error {
+	m, err := p.get()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	res, err := p.invoke(ctx, m, fn, in)
+	if err != nil {
+		_ = m.Close(context.Background())
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s exceeded %s", fn, p.timeout)
+		}
+		return err
+	}
+	p.put(m)
+	if len(res) == 0 {
+		return nil
+	}
+	return json.Unmarshal(res, out)
+}
+
+func (p *wasmPlugin) invoke(ctx context.Context, m api.Module, fn string, in any) ([]byte, error) {
+	b, _ := json.Marshal(in)
+	res, err := m.ExportedFunction("alloc").Call(ctx, uint64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(res[0])
+	if !m.Memory().Write(ptr, b) {
+		return nil, errors.New("alloc returned a buffer out of memory")
+	}
+	res, err = m.ExportedFunction(fn).Call(ctx, uint64(ptr), uint64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	out, ok := m.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, fmt.Errorf("%s returned a buffer out of memory", fn)
+	}
+	// the view is of the instance memory, which the next call reuses
+	return append([]byte(nil), out...), nil
+}
+
+// hooks runs the plugin on the requests and origin responses of downloads. A failing
+// plugin fails the request, since it may be what authorizes it.
+func (p *wasmPlugin) hooks() Hooks {
+	h := Hooks{
+		OnRequest: func(w http.ResponseWriter, r *http.Request) bool {
+			var res wasmRequestResult
+			err := p.call("on_request", wasmRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Host: r.Host, IP: clientIP(r), Headers: r.Header}, &res)
+			if err != nil {
+				logf(levelError, "wasm plugin %s failed: %s", p.name, err.Error())
+				errorResponse(w, 500, "wasm plugin failed")
+				return false
+			}
+			for _, name := range res.RemoveHeaders {
+				r.Header.Del(name)
+			}
+			for name, value := range res.SetHeaders {
+				r.Header.Set(name, value)
+			}
+			switch res.Action {
+			case "", "continue":
+				return true
+			case "deny":
+				status := res.Status
+				if status < 400 || status > 599 {
+					status = http.StatusForbidden
+				}
+				msg := res.Message
+				if msg == "" {
+					msg = "denied by " + p.name
+				}
+				errorResponseWithStatus(w, status, status, msg)
+				return false
+			case "redirect":
+				status := res.Status
+				if status/100 != 3 {
+					status = http.StatusFound
+				}
+				http.Redirect(w, r, res.Location, status)
+				return false
+			}
+			logf(levelError, "wasm plugin %s returned the unknown action %q", p.name, res.Action)
+			errorResponse(w, 500, "wasm plugin failed")
+			return false
+		},
+	}
+	if p.response {
+		h.OnResponse = func(r *http.Request, res *http.Response) error {
+			var out wasmResponseResult
+			if err := p.call("on_response", wasmResponse{Path: r.URL.Path, Status: res.StatusCode, Headers: res.Header}, &out); err != nil {
+				logf(levelError, "wasm plugin %s failed: %s", p.name, err.Error())
+				return &HTTPError{Code: 502, Message: "wasm plugin failed"}
+			}
+			for _, name := range out.RemoveHeaders {
+				res.Header.Del(name)
+			}
+			for name, value := range out.SetHeaders {
+				res.Header.Set(name, value)
+			}
+			return nil
+		}
+	}
+	return h
+}
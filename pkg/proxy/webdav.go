@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var webdavPrefix string
+
+func init() {
+	CommandLine.StringVar(&webdavPrefix, "webdav", "", "path `prefix` such as /dav serving a read-only webdav view of openlist for rclone, kodi and file managers, "+
+		"authenticated by basic auth, api keys or jwt, empty disables it")
+}
+
+// davMethods are the methods of the read-only webdav view.
+const davMethods = "OPTIONS, PROPFIND, GET, HEAD"
+
+func validateWebDAV() error {
+	if webdavPrefix == "" {
+		return nil
+	}
+	p := strings.TrimSuffix(webdavPrefix, "/")
+	if !strings.HasPrefix(p, "/") || path.Clean(p) != p {
+		return fmt.Errorf("invalid -webdav %q, expected a clean absolute path such as /dav", webdavPrefix)
+	}
+	webdavPrefix = p
+	return nil
+}
+
+// davPath returns the openlist path of a request to the webdav view.
+func davPath(urlPath string) (string, bool) {
+	if webdavPrefix == "" {
+		return "", false
+	}
+	if urlPath == webdavPrefix {
+		return "/", true
+	}
+	p, ok := strings.CutPrefix(urlPath, webdavPrefix+"/")
+	return "/" + p, ok
+}
+
+// serveWebDAV answers PROPFIND from the openlist listings and GET like a download.
+func serveWebDAV(w http.ResponseWriter, r *http.Request, davPath string) {
+	filePath, err := normalizePath(strings.TrimSuffix(davPath, "/"))
+	if davPath == "/" {
+		filePath, err = "/", nil
+	}
+	if err != nil {
+		errorResponse(w, 400, err.Error())
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if davChallenge(w, r) {
+			return
+		}
+		// downHandle authorizes it like any download
+		r.URL.Path, r.URL.RawPath = filePath, ""
+		downHandle(w, r)
+	case "PROPFIND":
+		if davChallenge(w, r) || !authorize(w, r, &downloadRequest{Path: tenantPath(r, filePath)}) {
+			return
+		}
+		propfind(w, r, filePath)
+	default:
+		w.Header().Set("Allow", davMethods)
+		errorResponse(w, 405, "the webdav view is read-only")
+	}
+}
+
+// davChallenge asks for basic auth before anything else, since webdav clients only send it
+// when challenged and can't sign links. It reports whether it responded.
+func davChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if basicAuthEnabled() && r.Header.Get("Authorization") == "" && getRequestInfo(r).apiKey == nil {
+		basicAuthChallenge(w)
+		return true
+	}
+	return false
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// propfind lists filePath and, at depth 1, its children. Infinite depth is refused as
+// RFC 4918 allows, it would walk whole storages.
+func propfind(w http.ResponseWriter, r *http.Request, filePath string) {
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		errorResponseWithStatus(w, http.StatusForbidden, 403, "propfind needs depth 0 or 1")
+		return
+	}
+	obj, err := statObject(tenantPath(r, filePath))
+	if err == nil && filePath == "/" {
+		obj.Name = ""
+	}
+	if err != nil {
+		if notFound(err) {
+			errorResponseWithStatus(w, http.StatusNotFound, 404, "not found")
+			return
+		}
+		apiErrorResponse(w, err)
+		return
+	}
+	ms := davMultistatus{XMLNS: "DAV:", Responses: []davResponse{davEntry(filePath, obj)}}
+	if depth == "1" && obj.IsDir {
+		list, err := postAPI[fsListResp]("/api/fs/list", tenantPath(r, filePath), Json{
+			"page":     1,
+			"per_page": 0,
+		})
+		if err != nil {
+			apiErrorResponse(w, err)
+			return
+		}
+		for i := range list.Content {
+			child := &list.Content[i]
+			ms.Responses = append(ms.Responses, davEntry(path.Join(filePath, child.Name), child))
+		}
+	}
+	b, _ := xml.Marshal(ms)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(b)
+}
+
+func davEntry(filePath string, obj *fsObject) davResponse {
+	href := basePath + webdavPrefix + escapePath(filePath)
+	prop := davProp{DisplayName: obj.Name}
+	if !obj.Modified.IsZero() {
+		prop.LastModified = obj.Modified.UTC().Format(http.TimeFormat)
+	}
+	if obj.IsDir {
+		prop.ResourceType.Collection = &struct{}{}
+		if !strings.HasSuffix(href, "/") {
+			href += "/"
+		}
+	} else {
+		size := obj.Size
+		prop.ContentLength = &size
+		prop.ContentType = mime.TypeByExtension(path.Ext(obj.Name))
+		if prop.ContentType == "" {
+			prop.ContentType = "application/octet-stream"
+		}
+	}
+	return davResponse{Href: href, Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"}}
+}
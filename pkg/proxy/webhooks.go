@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	webhookURLs    stringList
+	webhookSecret  string
+	webhookEvents  string
+	webhookMinSize byteSize
+	webhookRetries int
+)
+
+func init() {
+	CommandLine.Var(&webhookURLs, "webhook", "`url` a json event is posted to when a download starts, completes or fails, repeatable")
+	CommandLine.StringVar(&webhookSecret, "webhook-secret", "", "secret signing webhook payloads with hmac-sha256 in the X-Signature-256 header, empty sends them unsigned")
+	CommandLine.StringVar(&webhookEvents, "webhook-events", "complete,fail", "comma separated download events posted to -webhook: start, complete and fail")
+	CommandLine.Var(&webhookMinSize, "webhook-min-size", "min `size` of the downloads posted to -webhook, e.g. 100M, 0 posts all of them")
+	CommandLine.IntVar(&webhookRetries, "webhook-retries", 3, "how often a failed webhook delivery is retried, with doubling delays from a second")
+}
+
+// webhookQueueSize bounds the events waiting for delivery, more are dropped.
+const webhookQueueSize = 1024
+
+// downloadEvent is the payload of a download event.
+type downloadEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	ClientIP string    `json:"client_ip"`
+	// Client is the identity quotas are counted by, the api key or the ip.
+	Client   string `json:"client"`
+	Upstream string `json:"upstream"`
+	Status   int    `json:"status"`
+	// Size is the length of the body, -1 if the origin did not tell it.
+	Size int64 `json:"size"`
+	// Bytes and Duration, in milliseconds, are what was sent until the end of the transfer.
+	Bytes    int64 `json:"bytes,omitempty"`
+	Duration int64 `json:"duration,omitempty"`
+	// Outcome tells why a transfer failed: aborted by the client or upstream_error.
+	Outcome string `json:"outcome,omitempty"`
+}
+
+var (
+	webhookEnabled = map[string]bool{}
+	webhookQueue   chan []byte
+)
+
+func setupWebhooks() error {
+	if len(webhookURLs) == 0 {
+		return nil
+	}
+	for _, e := range strings.Split(webhookEvents, ",") {
+		switch e = strings.TrimSpace(e); e {
+		case "start", "complete", "fail":
+			webhookEnabled[e] = true
+		case "":
+		default:
+			return fmt.Errorf("invalid -webhook-events %q, expected start, complete or fail", e)
+		}
+	}
+	webhookQueue = make(chan []byte, webhookQueueSize)
+	go func() {
+		for b := range webhookQueue {
+			for _, u := range webhookURLs {
+				deliverWebhook(u, b)
+			}
+		}
+	}()
+	return nil
+}
+
+// newDownloadEvent describes the transfer of res to the client of r.
+func newDownloadEvent(event string, r *http.Request, res *http.Response) downloadEvent {
+	return downloadEvent{
+		Event:    event,
+		Time:     time.Now(),
+		Path:     r.URL.Path,
+		ClientIP: clientIP(r),
+		Client:   clientIdentity(r),
+		Upstream: res.Request.URL.Host,
+		Status:   res.StatusCode,
+		Size:     res.ContentLength,
+	}
+}
+
+// publishEvent queues e for the webhooks, if they take its kind and size.
+func publishEvent(e downloadEvent) {
+	if webhookQueue == nil || !webhookEnabled[e.Event] || max(e.Size, e.Bytes) < int64(webhookMinSize) {
+		return
+	}
+	b, _ := json.Marshal(e)
+	select {
+	case webhookQueue <- b:
+	default:
+		logf(levelWarn, "webhook queue full, dropping the %s event of %s", e.Event, e.Path)
+	}
+}
+
+// deliverWebhook posts b to u, retrying failures with doubling delays.
+func deliverWebhook(u string, b []byte) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := postWebhook(u, b)
+		if err == nil {
+			return
+		}
+		if attempt >= webhookRetries {
+			logf(levelError, "failed to deliver webhook to %s: %s", u, err.Error())
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postWebhook(u string, b []byte) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "OpenList-Proxy/"+Version)
+	if webhookSecret != "" {
+		m := hmac.New(sha256.New, []byte(webhookSecret))
+		m.Write(b)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(m.Sum(nil)))
+	}
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded %s", u, res.Status)
+	}
+	return nil
+}